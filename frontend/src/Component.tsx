@@ -4,6 +4,8 @@ import MESSAGE_CREATED from './graphql/subscriptions/messageCreated';
 import CREATE_MESSAGE from './graphql/mutations/createMessage';
 import MESSAGES from './graphql/query/messages';
 
+const ROOM_ID = 'general'
+
 type Message = {
   id: string
   message: string
@@ -16,9 +18,12 @@ type MessagesQuery = {
 }
 
 export const Component: React.FC = () => {
-  const { data } = useSubscription<MessageSubscription>(MESSAGE_CREATED);
+  const { data } = useSubscription<MessageSubscription>(MESSAGE_CREATED, {
+    variables: { roomId: ROOM_ID },
+  });
   const [createMessage] = useMutation<Message>(CREATE_MESSAGE);
   const queryResult = useQuery<MessagesQuery>(MESSAGES, {
+    variables: { roomId: ROOM_ID },
     fetchPolicy: 'cache-and-network', // Use cache first, then network
   })
   const [messages, setMessages] = useState<Message[]>([]);
@@ -64,7 +69,7 @@ export const Component: React.FC = () => {
       setMessages(m => [...m, tempMessage])
       setInputValue('') // Clear input immediately
 
-      await createMessage({ variables: { message: inputValue } })
+      await createMessage({ variables: { roomId: ROOM_ID, message: inputValue } })
     } catch (error) {
       console.error('Failed to create message:', error)
       // Remove the optimistic message on error
@@ -1,8 +1,8 @@
 import { gql } from '@apollo/client';
 
 export default gql`
-  mutation($message: String!) {
-    createMessage(message: $message) {
+  mutation($roomId: ID!, $message: String!) {
+    createMessage(roomId: $roomId, message: $message) {
       message
     }
   }
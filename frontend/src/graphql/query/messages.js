@@ -1,8 +1,8 @@
 import { gql } from '@apollo/client';
 
 export default gql`
-    query {
-      messages {
+    query($roomId: ID!) {
+      messages(roomId: $roomId) {
         id
         message
       }
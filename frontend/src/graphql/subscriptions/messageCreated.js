@@ -1,11 +1,10 @@
 import { gql } from '@apollo/client';
 
 export default gql`
-  subscription {
-    messageCreated {
+  subscription($roomId: ID!) {
+    messageCreated(roomId: $roomId) {
       id
       message
     }
   }
 `
-
@@ -0,0 +1,100 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/generated"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+)
+
+// roleRanks orders the roles, each one implies those of a lower rank
+var roleRanks = map[model.Role]int{
+	model.RoleMember:    1,
+	model.RoleModerator: 2,
+	model.RoleAdmin:     3,
+}
+
+// Directives returns the implementations of the @auth and @hasRole schema
+// directives. When authentication is disabled every caller is anonymous and
+// the directives let all requests through.
+func Directives(authEnabled bool) generated.DirectiveRoot {
+	if !authEnabled {
+		return generated.DirectiveRoot{
+			Auth: func(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+				return next(ctx)
+			},
+			HasRole: func(ctx context.Context, obj interface{}, next graphql.Resolver, role model.Role) (interface{}, error) {
+				return next(ctx)
+			},
+		}
+	}
+
+	return generated.DirectiveRoot{
+		Auth: func(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+			if auth.FromContext(ctx) == nil {
+				return nil, gqlError(fmt.Errorf("%w: %s requires authentication", auth.ErrUnauthenticated, fieldName(ctx)))
+			}
+			return next(ctx)
+		},
+		HasRole: func(ctx context.Context, obj interface{}, next graphql.Resolver, role model.Role) (interface{}, error) {
+			p := auth.FromContext(ctx)
+			if p == nil {
+				return nil, gqlError(fmt.Errorf("%w: %s requires authentication", auth.ErrUnauthenticated, fieldName(ctx)))
+			}
+			if !hasRole(p, role) {
+				return nil, gqlError(fmt.Errorf("%w: %s requires the %s role", auth.ErrForbidden, fieldName(ctx), strings.ToLower(string(role))))
+			}
+			return next(ctx)
+		},
+	}
+}
+
+// hasRole reports whether p holds role or a higher one. Roles of the token
+// are matched case-insensitively and unknown ones are ignored.
+func hasRole(p *auth.Principal, role model.Role) bool {
+	for _, r := range p.Roles {
+		if rank, ok := roleRanks[model.Role(strings.ToUpper(r))]; ok && rank >= roleRanks[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldName names the field being resolved in authorization errors
+func fieldName(ctx context.Context) string {
+	if fc := graphql.GetFieldContext(ctx); fc != nil {
+		return fc.Field.Name
+	}
+	return "this field"
+}
+
+// author returns the authenticated caller of a request as a message author,
+// nil when authentication is disabled
+func author(ctx context.Context) *model.User {
+	p := auth.FromContext(ctx)
+	if p == nil {
+		return nil
+	}
+	return &model.User{ID: p.ID, Name: p.Name}
+}
+
+// mayRevise checks that the caller may edit msg, or delete it when deleting
+// is set: authors may revise their own messages and moderators may delete any
+// message. Anyone may when authentication is disabled.
+func mayRevise(ctx context.Context, msg *model.Message, deleting bool) error {
+	p := auth.FromContext(ctx)
+	if p == nil {
+		return nil
+	}
+	if msg.Author != nil && msg.Author.ID == p.ID {
+		return nil
+	}
+	if deleting && hasRole(p, model.RoleModerator) {
+		return nil
+	}
+	return fmt.Errorf("%w: message %s was sent by another user", auth.ErrForbidden, msg.ID)
+}
@@ -0,0 +1,83 @@
+package graph
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/99designs/gqlgen/client"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/generated"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+)
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		roles []string
+		role  model.Role
+		want  bool
+	}{
+		{roles: nil, role: model.RoleMember, want: false},
+		{roles: []string{"member"}, role: model.RoleMember, want: true},
+		{roles: []string{"member"}, role: model.RoleModerator, want: false},
+		{roles: []string{"MODERATOR"}, role: model.RoleMember, want: true},
+		{roles: []string{"admin"}, role: model.RoleModerator, want: true},
+		{roles: []string{"owner", "member"}, role: model.RoleAdmin, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := hasRole(&auth.Principal{ID: "u-1", Roles: tt.roles}, tt.role); got != tt.want {
+			t.Errorf("hasRole(%v, %s) = %t, want %t", tt.roles, tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	tests := []struct {
+		name        string
+		authEnabled bool
+		principal   *auth.Principal
+		query       string
+		wantCode    string
+	}{
+		{name: "authentication disabled", query: `mutation { deleteRoom(id: "general") }`},
+		{name: "anonymous", authEnabled: true, query: `mutation { createMessage(roomId: "general", message: "hi") { id } }`, wantCode: ErrCodeUnauthenticated},
+		{name: "anonymous @auth", authEnabled: true, query: `{ room(id: "general") { id } }`, wantCode: ErrCodeUnauthenticated},
+		{name: "authenticated @auth", authEnabled: true, principal: &auth.Principal{ID: "u-1"}, query: `{ room(id: "general") { id } }`},
+		{name: "no role", authEnabled: true, principal: &auth.Principal{ID: "u-1"}, query: `mutation { createMessage(roomId: "general", message: "hi") { id } }`, wantCode: ErrCodeForbidden},
+		{name: "member", authEnabled: true, principal: &auth.Principal{ID: "u-1", Roles: []string{"member"}}, query: `mutation { createMessage(roomId: "general", message: "hi") { id } }`},
+		{name: "member deleting", authEnabled: true, principal: &auth.Principal{ID: "u-1", Roles: []string{"member"}}, query: `mutation { deleteRoom(id: "general") }`, wantCode: ErrCodeForbidden},
+		{name: "moderator deleting", authEnabled: true, principal: &auth.Principal{ID: "u-1", Roles: []string{"moderator"}}, query: `mutation { deleteRoom(id: "general") }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := newTestResolver(&mockRedisClient{hGetAllFunc: existingRoom})
+			srv := handler.New(generated.NewExecutableSchema(generated.Config{
+				Resolvers:  resolver,
+				Directives: Directives(tt.authEnabled),
+			}))
+			srv.AddTransport(transport.POST{})
+			c := client.New(srv)
+
+			var resp map[string]interface{}
+			err := c.Post(tt.query, &resp, func(bd *client.Request) {
+				if tt.principal != nil {
+					bd.HTTP = bd.HTTP.WithContext(auth.WithPrincipal(context.Background(), tt.principal))
+				}
+			})
+
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("expected an error with code %s, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package graph
+
+import (
+	"errors"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Error codes reported in the "code" extension of GraphQL errors
+const (
+	ErrCodeBadUserInput = "BAD_USER_INPUT"
+	ErrCodeRoomNotFound = "ROOM_NOT_FOUND"
+	ErrCodeRoomExists   = "ROOM_ALREADY_EXISTS"
+	ErrCodeRoomArchived = "ROOM_ARCHIVED"
+
+	ErrCodeMessageNotFound = "MESSAGE_NOT_FOUND"
+
+	ErrCodeUnauthenticated = "UNAUTHENTICATED"
+	ErrCodeForbidden       = "FORBIDDEN"
+
+	ErrCodeStreamUnavailable = "STREAM_UNAVAILABLE"
+	ErrCodeShuttingDown      = "SHUTTING_DOWN"
+	ErrCodeUnsupported       = "UNSUPPORTED"
+)
+
+// ErrShuttingDown rejects subscriptions while the server shuts down
+var ErrShuttingDown = errors.New("server is shutting down")
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{service.ErrInvalidRoomID, ErrCodeBadUserInput},
+	{service.ErrInvalidRetention, ErrCodeBadUserInput},
+	{service.ErrInvalidPagination, ErrCodeBadUserInput},
+	{service.ErrInvalidStreamID, ErrCodeBadUserInput},
+	{service.ErrInvalidMessage, ErrCodeBadUserInput},
+	{service.ErrInvalidReaction, ErrCodeBadUserInput},
+	{service.ErrRoomNotFound, ErrCodeRoomNotFound},
+	{service.ErrRoomExists, ErrCodeRoomExists},
+	{service.ErrRoomArchived, ErrCodeRoomArchived},
+	{service.ErrMessageNotFound, ErrCodeMessageNotFound},
+	{service.ErrStreamUnavailable, ErrCodeStreamUnavailable},
+	{ErrShuttingDown, ErrCodeShuttingDown},
+	{broker.ErrNoHistory, ErrCodeUnsupported},
+	{auth.ErrUnauthenticated, ErrCodeUnauthenticated},
+	{auth.ErrForbidden, ErrCodeForbidden},
+}
+
+// gqlError converts known service errors into GraphQL errors carrying an extension code,
+// leaving unknown errors untouched
+func gqlError(err error) error {
+	if errors.Is(err, nil) {
+		return nil
+	}
+
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return &gqlerror.Error{
+				Err:        err,
+				Message:    err.Error(),
+				Extensions: map[string]interface{}{"code": c.code},
+			}
+		}
+	}
+
+	return err
+}
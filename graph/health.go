@@ -0,0 +1,89 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
+)
+
+// Check statuses reported by Readiness
+const (
+	CheckOK          = "ok"
+	CheckUnavailable = "unavailable"
+)
+
+// Readiness reports whether the server can serve subscriptions
+type Readiness struct {
+	Ready         bool               `json:"-"`
+	Redis         Check              `json:"redis"`
+	StreamReader  ReaderCheck        `json:"streamReader"`
+	Subscriptions SubscriptionCounts `json:"subscriptions"`
+}
+
+// Check is the result of checking one dependency
+type Check struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latencyMs"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// ReaderCheck reports the state of the background stream reader
+type ReaderCheck struct {
+	Status    string    `json:"status"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since,omitzero"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// SubscriptionCounts counts the active messageCreated subscriptions
+type SubscriptionCounts struct {
+	Total int            `json:"total"`
+	Rooms map[string]int `json:"rooms"`
+}
+
+// Readiness pings Redis and checks that the stream reader is running. The server
+// is not ready while either is down or once it is shutting down.
+func (r *Resolver) Readiness(ctx context.Context) Readiness {
+	var report Readiness
+
+	pingCtx, cancel := context.WithTimeout(ctx, constants.ReadinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := r.RedisClient.Ping(pingCtx).Err()
+	report.Redis = Check{Status: CheckOK, Latency: float64(time.Since(start).Microseconds()) / 1000}
+	if !errors.Is(err, nil) {
+		report.Redis.Status = CheckUnavailable
+		report.Redis.Error = err.Error()
+	}
+
+	status := r.StreamStatus()
+	report.StreamReader = ReaderCheck{
+		Status:   CheckOK,
+		State:    string(status.State),
+		Since:    status.Since,
+		Attempts: status.Attempts,
+	}
+	if status.State != service.ReaderRunning {
+		report.StreamReader.Status = CheckUnavailable
+	}
+	if status.LastError != nil {
+		report.StreamReader.LastError = status.LastError.Error()
+	}
+
+	r.mutex.Lock()
+	closing := r.closing
+	report.Subscriptions.Rooms = make(map[string]int, len(r.messageChannels))
+	for roomID, channels := range r.messageChannels {
+		report.Subscriptions.Rooms[roomID] = len(channels)
+		report.Subscriptions.Total += len(channels)
+	}
+	r.mutex.Unlock()
+
+	report.Ready = !closing && report.Redis.Status == CheckOK && report.StreamReader.Status == CheckOK
+	return report
+}
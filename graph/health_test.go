@@ -0,0 +1,83 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
+)
+
+func TestResolver_Readiness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The stream reader has not been started yet
+	report := resolver.Readiness(ctx)
+	if report.Ready || report.Redis.Status != CheckOK || report.StreamReader.State != string(service.ReaderStarting) {
+		t.Errorf("expected not ready before the stream reader starts, got %+v", report)
+	}
+
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+	deadline := time.Now().Add(2 * time.Second)
+	for resolver.StreamStatus().State != service.ReaderRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the stream reader, state %s", resolver.StreamStatus().State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	subCtx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	for range 2 {
+		if _, err := (&subscriptionResolver{resolver}).MessageCreated(subCtx, "general", nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	report = resolver.Readiness(ctx)
+	if !report.Ready || report.StreamReader.Status != CheckOK {
+		t.Errorf("expected ready, got %+v", report)
+	}
+	if report.Subscriptions.Total != 2 || report.Subscriptions.Rooms["general"] != 2 {
+		t.Errorf("expected 2 subscriptions to general, got %+v", report.Subscriptions)
+	}
+
+	// Redis going away makes the server unready
+	_ = client.Close()
+	report = resolver.Readiness(ctx)
+	if report.Ready || report.Redis.Status != CheckUnavailable || report.Redis.Error == "" {
+		t.Errorf("expected Redis unavailable, got %+v", report.Redis)
+	}
+}
+
+func TestResolver_ReadinessShuttingDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 2*time.Second)
+	defer cancelShutdown()
+	if err := resolver.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	report := resolver.Readiness(ctx)
+	if report.Ready {
+		t.Errorf("expected not ready once shutting down, got %+v", report)
+	}
+	if report.StreamReader.State != string(service.ReaderStopped) {
+		t.Errorf("expected the stream reader stopped, got %s", report.StreamReader.State)
+	}
+}
@@ -0,0 +1,35 @@
+package graph
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var activeSubscriptionsDesc = prometheus.NewDesc(
+	"chat_active_subscriptions",
+	"Active message subscriptions, by room.",
+	[]string{"room"}, nil,
+)
+
+// subscriptionCollector reports the subscriptions registered in messageChannels
+// when scraped, so the gauge cannot drift from the channels actually open
+type subscriptionCollector struct {
+	r *Resolver
+}
+
+// MetricsCollector returns a Prometheus collector of the active subscriptions per room
+func (r *Resolver) MetricsCollector() prometheus.Collector {
+	return subscriptionCollector{r}
+}
+
+func (c subscriptionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeSubscriptionsDesc
+}
+
+func (c subscriptionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.r.mutex.Lock()
+	defer c.r.mutex.Unlock()
+
+	for roomID, channels := range c.r.messageChannels {
+		ch <- prometheus.MustNewConstMetric(activeSubscriptionsDesc, prometheus.GaugeValue, float64(len(channels)), roomID)
+	}
+}
@@ -0,0 +1,53 @@
+package graph
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPublishEvent_Metrics(t *testing.T) {
+	resolver := newTestResolver(&mockRedisClient{})
+	if err := resolver.addMessageChannel("general", "a", subscriber{event: constants.MessageEventCreated, messages: make(chan *model.Message, 1)}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := resolver.addMessageChannel("general", "b", subscriber{event: constants.MessageEventCreated, messages: make(chan *model.Message, 1)}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := resolver.addMessageChannel("random", "c", subscriber{event: constants.MessageEventCreated, messages: make(chan *model.Message, 1)}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	delivered := testutil.ToFloat64(metrics.MessagesDelivered)
+	dropped := testutil.ToFloat64(metrics.MessagesDropped)
+
+	// The second message finds both channels of general full
+	resolver.publishEvent(&model.MessageCreated{ID: "1-0", RoomID: "general", Message: &model.Message{ID: "1-0", RoomID: "general", Message: "first"}})
+	resolver.publishEvent(&model.MessageCreated{ID: "2-0", RoomID: "general", Message: &model.Message{ID: "2-0", RoomID: "general", Message: "second"}})
+
+	if got := testutil.ToFloat64(metrics.MessagesDelivered) - delivered; got != 2 {
+		t.Errorf("expected 2 deliveries, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.MessagesDropped) - dropped; got != 2 {
+		t.Errorf("expected 2 dropped deliveries, got %v", got)
+	}
+
+	expected := `
+# HELP chat_active_subscriptions Active message subscriptions, by room.
+# TYPE chat_active_subscriptions gauge
+chat_active_subscriptions{room="general"} 2
+chat_active_subscriptions{room="random"} 1
+`
+	if err := testutil.CollectAndCompare(resolver.MetricsCollector(), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	resolver.removeMessageChannel("random", "c")
+	if got := testutil.CollectAndCount(resolver.MetricsCollector()); got != 1 {
+		t.Errorf("expected the room without subscriptions to disappear, got %d series", got)
+	}
+}
@@ -5,67 +5,565 @@ package graph
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/metrics"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
+	"github.com/thanhpk/randstr"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Resolver struct {
 	RedisClient     datastore.RedisClient
+	broker          broker.Broker
 	messageService  *service.MessageService
-	messageChannels map[string]chan *model.Message
+	roomService     *service.RoomService
+	reader          service.StreamReader
+	supervisor      *service.StreamSupervisor
+	messageChannels map[string]map[string]subscriber // room ID -> subscription token -> subscriber
+	subscriptionErr map[string]*subscriptionError    // subscription token -> error slot, when the transport installed one
+	downTimer       *time.Timer                      // notifies subscribers once the stream reader has been down too long
+	stopReader      context.CancelFunc               // cancels the stream reader started by SubscribeRedis
+	readerDone      chan struct{}                    // closed once the stream reader has stopped
+	subscriptions   sync.WaitGroup                   // active message subscriptions
+	closing         bool                             // set by Shutdown, new subscriptions are rejected
 	mutex           sync.Mutex
 }
 
-func NewResolver(client datastore.RedisClient) *Resolver {
-	return &Resolver{
+// subscriber is the channel of a subscription, either to the messages of one
+// kind of event, to the reaction changes or, for roomEvents, to every event of
+// the room. New messages are delivered by thread: messageCreated only receives
+// the messages posted to the room itself and threadReplies the replies to its
+// parent.
+type subscriber struct {
+	event     string                   // constants.MessageEvent value delivered to messages
+	parent    string                   // parent of the created messages delivered, empty for the room itself
+	messages  chan *model.Message      // set for message subscriptions
+	reactions chan model.ReactionEvent // set for reactionChanged
+	events    chan model.RoomEvent     // set for roomEvents
+}
+
+// offer hands event to the subscriber without blocking. It reports whether the
+// subscriber receives this kind of event and, if so, whether it was sent.
+func (s subscriber) offer(event model.RoomEvent) (wanted, sent bool) {
+	if s.events != nil {
+		select {
+		case s.events <- event:
+			return true, true
+		default:
+			return true, false
+		}
+	}
+
+	if s.reactions != nil {
+		reaction, ok := event.(model.ReactionEvent)
+		if !ok {
+			return false, false
+		}
+		select {
+		case s.reactions <- reaction:
+			return true, true
+		default:
+			return true, false
+		}
+	}
+
+	kind, msg := eventMessage(event)
+	if kind != s.event {
+		return false, false
+	}
+	if kind == constants.MessageEventCreated && parentID(msg) != s.parent {
+		return false, false
+	}
+	select {
+	case s.messages <- msg:
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// close ends the subscription by closing its channel
+func (s subscriber) close() {
+	switch {
+	case s.events != nil:
+		close(s.events)
+	case s.reactions != nil:
+		close(s.reactions)
+	default:
+		close(s.messages)
+	}
+}
+
+// eventFields names the subscription field each stream event is delivered to
+var eventFields = map[string]string{
+	constants.MessageEventCreated:     "messageCreated",
+	constants.MessageEventUpdated:     "messageUpdated",
+	constants.MessageEventDeleted:     "messageDeleted",
+	constants.MessageEventReacted:     "reactionChanged",
+	constants.MessageEventUnreacted:   "reactionChanged",
+	constants.MessageEventJoined:      "roomEvents",
+	constants.MessageEventRoomDeleted: "roomEvents",
+}
+
+// eventMessage returns the constants.MessageEvent value of a room event along
+// with the message it carries, nil for reactions, joins and room deletions
+func eventMessage(event model.RoomEvent) (string, *model.Message) {
+	switch e := event.(type) {
+	case *model.MessageCreated:
+		return constants.MessageEventCreated, e.Message
+	case *model.MessageUpdated:
+		return constants.MessageEventUpdated, e.Message
+	case *model.MessageDeleted:
+		return constants.MessageEventDeleted, e.Message
+	case *model.ReactionAdded:
+		return constants.MessageEventReacted, nil
+	case *model.ReactionRemoved:
+		return constants.MessageEventUnreacted, nil
+	case *model.MemberJoined:
+		return constants.MessageEventJoined, nil
+	case *model.RoomDeleted:
+		return constants.MessageEventRoomDeleted, nil
+	}
+	return "", nil
+}
+
+// eventTrace returns the trace context of the request that wrote a room event
+func eventTrace(event model.RoomEvent) trace.SpanContext {
+	switch e := event.(type) {
+	case *model.ReactionAdded:
+		return e.Trace
+	case *model.ReactionRemoved:
+		return e.Trace
+	case *model.MemberJoined:
+		return e.Trace
+	}
+	if _, msg := eventMessage(event); msg != nil {
+		return msg.Trace
+	}
+	return trace.SpanContext{}
+}
+
+// parentID returns the ID of the message msg replies to, empty for a message
+// posted to the room itself
+func parentID(msg *model.Message) string {
+	if msg == nil || msg.ParentID == nil {
+		return ""
+	}
+	return *msg.ParentID
+}
+
+// NewResolver creates a Resolver keeping room metadata in client and messages in b;
+// retention is the retention policy of rooms that do not override it
+func NewResolver(client datastore.RedisClient, b broker.Broker, retention service.RetentionPolicy) *Resolver {
+	r := &Resolver{
 		RedisClient:     client,
-		messageService:  service.NewMessageService(client),
-		messageChannels: map[string]chan *model.Message{},
+		broker:          b,
+		messageService:  service.NewMessageService(client, b),
+		roomService:     service.NewRoomService(client, b, retention),
+		messageChannels: map[string]map[string]subscriber{},
+		subscriptionErr: map[string]*subscriptionError{},
 		mutex:           sync.Mutex{},
 	}
+	r.reader = service.NewStreamTailer(b, r.subscribedRooms)
+	return r
+}
+
+// StreamStats returns the counters of the background stream reader
+func (r *Resolver) StreamStats() service.ReaderStats {
+	r.mutex.Lock()
+	reader := r.reader
+	r.mutex.Unlock()
+
+	return reader.Stats()
+}
+
+// EnsureDefaultRoom creates the default room used by the bundled frontend if it is missing
+func (r *Resolver) EnsureDefaultRoom(ctx context.Context) error {
+	_, err := r.roomService.EnsureRoom(ctx, constants.DefaultRoomID, constants.DefaultRoomName)
+	return err
+}
+
+// StartRetentionTrimmer periodically trims room streams to their retention policies
+func (r *Resolver) StartRetentionTrimmer(ctx context.Context, interval time.Duration) {
+	slog.Info("Start retention trimmer", slog.Duration("interval", interval))
+
+	go service.NewTrimmer(r.broker, r.roomService, interval).Run(ctx)
+}
+
+// StreamStatus reports the state of the background stream reader
+func (r *Resolver) StreamStatus() service.ReaderStatus {
+	r.mutex.Lock()
+	supervisor := r.supervisor
+	r.mutex.Unlock()
+
+	if supervisor == nil {
+		return service.ReaderStatus{State: service.ReaderStarting}
+	}
+	return supervisor.Status()
+}
+
+// StreamOptions configures the background stream reader
+type StreamOptions struct {
+	// Backoff paces reconnects after Redis failures
+	Backoff service.Backoff
+	// NotifyAfter ends active subscriptions with a STREAM_UNAVAILABLE error once the
+	// reader has been down this long or has given up; zero keeps them open until it recovers
+	NotifyAfter time.Duration
+	// Group, when set, reads the room streams through a Redis consumer group instead
+	// of the broker; it requires the Redis Streams broker
+	Group *service.GroupConfig
 }
 
-func (r *Resolver) SubscribeRedis(ctx context.Context) {
-	log.Println("Start Redis Stream...")
+// SubscribeRedis starts the stream reader that fans new messages out to subscribers
+func (r *Resolver) SubscribeRedis(ctx context.Context, opts StreamOptions) {
+	slog.Info("Start Redis Stream...")
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	r.mutex.Lock()
+	if opts.Group != nil {
+		r.reader = service.NewGroupReader(r.RedisClient, r.subscribedRooms, *opts.Group)
+	}
+	supervisor := service.NewStreamSupervisor(r.RedisClient, r.reader, opts.Backoff)
+	supervisor.OnStateChange = func(status service.ReaderStatus) {
+		r.streamStateChanged(status, opts.NotifyAfter)
+	}
+	r.supervisor = supervisor
+	r.stopReader = cancel
+	r.readerDone = done
+	r.mutex.Unlock()
 
 	go func() {
-		msgChan, errChan := r.messageService.StreamMessages(ctx)
+		defer close(done)
+		supervisor.Run(ctx, r.publishEvent)
+	}()
+}
+
+// Shutdown completes every active subscription, so clients see a regular end
+// of stream instead of a dropped connection, rejects new ones with
+// ErrShuttingDown, waits for the transports to send the completions and then
+// stops the stream reader. It returns early with an error once ctx is done.
+func (r *Resolver) Shutdown(ctx context.Context) error {
+	r.mutex.Lock()
+	r.closing = true
+	active := 0
+	for _, channels := range r.messageChannels {
+		for _, sub := range channels {
+			sub.close()
+			active++
+		}
+	}
+	r.messageChannels = map[string]map[string]subscriber{}
+	r.subscriptionErr = map[string]*subscriptionError{}
+	if r.downTimer != nil {
+		r.downTimer.Stop()
+		r.downTimer = nil
+	}
+	stopReader, readerDone := r.stopReader, r.readerDone
+	r.mutex.Unlock()
+
+	slog.InfoContext(ctx, "Completing subscriptions", slog.Int("active", active))
+
+	// A subscription context ends once the transport has sent its completion
+	drained := make(chan struct{})
+	go func() {
+		r.subscriptions.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("subscriptions not drained: %w", ctx.Err())
+	}
+
+	if stopReader == nil {
+		return nil
+	}
+	stopReader()
+
+	select {
+	case <-readerDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stream reader not stopped: %w", ctx.Err())
+	}
+}
+
+// publishEvent sends an event read from the stream to the subscribers of its
+// room that receive it, in the order the reader hands events over. The delivery
+// span is linked to the span that published the message, edit, deletion or
+// reaction. A RoomDeleted event then ends every subscription of its room, on
+// whichever instance deleted it.
+func (r *Resolver) publishEvent(event model.RoomEvent) {
+	kind, msg := eventMessage(event)
+	if kind == constants.MessageEventRoomDeleted {
+		defer r.closeRoom(event.GetRoomID())
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingDestinationName(service.RoomStreamKey(event.GetRoomID())),
+			semconv.MessagingMessageID(event.GetID()),
+		),
+	}
+	if spanCtx := eventTrace(event); spanCtx.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: spanCtx}))
+	}
+	field := eventFields[kind]
+	if kind == constants.MessageEventCreated && parentID(msg) != "" {
+		field = "threadReplies"
+	}
+	ctx, span := tracing.Tracer().Start(context.Background(), "deliver "+field, opts...)
+	defer span.End()
+
+	ctx = logging.With(ctx, slog.String(logging.RoomKey, event.GetRoomID()), slog.String(logging.MessageIDKey, event.GetID()))
+	if msg != nil {
+		slog.DebugContext(ctx, "Received message", slog.String("event", kind), logging.Content(msg.Message))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delivered, dropped := 0, 0
+	for token, sub := range r.messageChannels[event.GetRoomID()] {
+		wanted, sent := sub.offer(event)
+		switch {
+		case !wanted:
+		case sent:
+			delivered++
+			metrics.MessagesDelivered.Inc()
+		default:
+			dropped++
+			metrics.MessagesDropped.Inc()
+			slog.WarnContext(ctx, "Channel full, skipping message", slog.String(logging.TokenKey, token))
+		}
+	}
+	span.SetAttributes(attribute.Int("chat.subscriptions.delivered", delivered), attribute.Int("chat.subscriptions.dropped", dropped))
+}
 
+// streamStateChanged arms the subscriber notification while the stream reader is
+// down and disarms it once the reader runs again
+func (r *Resolver) streamStateChanged(status service.ReaderStatus, notifyAfter time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch status.State {
+	case service.ReaderRunning, service.ReaderStopped:
+		if r.downTimer != nil {
+			r.downTimer.Stop()
+			r.downTimer = nil
+		}
+	case service.ReaderReconnecting:
+		if notifyAfter > 0 && r.downTimer == nil {
+			r.downTimer = time.AfterFunc(notifyAfter, func() {
+				slog.Warn("Stream reader down for too long, ending subscriptions", slog.Duration("notify_after", notifyAfter))
+				r.failSubscriptions(service.ErrStreamUnavailable)
+			})
+		}
+	case service.ReaderFailed:
+		if r.downTimer != nil {
+			r.downTimer.Stop()
+			r.downTimer = nil
+		}
+		if notifyAfter > 0 {
+			go r.failSubscriptions(service.ErrStreamUnavailable)
+		}
+	}
+}
+
+// resumeMessages replays the messages of a room stored after since into out and
+// then switches to the live channel, skipping entries that were already replayed.
+// Live messages are buffered while the replay runs; should the buffer have
+// overflowed, the gap is read from the stream before the first live message is
+// delivered, so the client sees every entry exactly once and in stream order.
+func (r *Resolver) resumeMessages(ctx context.Context, roomID, since string, live <-chan *model.Message, out chan<- *model.Message) {
+	defer close(out)
+
+	lastID := since
+
+	// replay sends stored messages after lastID and before stop (or the end of the stream)
+	replay := func(stop string) bool {
 		for {
-			select {
-			case <-ctx.Done():
-				log.Println("Redis stream context cancelled")
-				return
-			case err, ok := <-errChan:
-				if !ok {
-					log.Println("Error channel closed")
-					return
-				}
-				if !errors.Is(err, nil) {
-					log.Printf("Error streaming messages: %v", err)
-					return
+			batch, err := r.messageService.ReadMessagesAfter(ctx, roomID, lastID, stop, constants.SubscriptionReplayBatch)
+			if !errors.Is(err, nil) {
+				slog.ErrorContext(ctx, "Error replaying messages", slog.String("after", lastID), logging.Err(err))
+				return false
+			}
+
+			for _, msg := range batch {
+				select {
+				case out <- msg:
+					lastID = msg.ID
+				case <-ctx.Done():
+					return false
 				}
-			case msg, ok := <-msgChan:
-				if !ok {
-					log.Println("Message channel closed")
+			}
+
+			if len(batch) < constants.SubscriptionReplayBatch {
+				return true
+			}
+		}
+	}
+
+	if !replay("") {
+		return
+	}
+
+	caughtUp := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-live:
+			if !ok {
+				return
+			}
+
+			if service.CompareStreamIDs(msg.ID, lastID) <= 0 {
+				continue
+			}
+
+			if !caughtUp {
+				caughtUp = true
+				if !replay(msg.ID) {
 					return
 				}
-				log.Printf("Received message: %s", msg.Message)
-
-				r.mutex.Lock()
-				for _, ch := range r.messageChannels {
-					select {
-					case ch <- msg:
-					default:
-						log.Println("Channel full, skipping message")
-					}
-				}
-				r.mutex.Unlock()
+			}
+
+			select {
+			case out <- msg:
+				lastID = msg.ID
+			case <-ctx.Done():
+				return
 			}
 		}
+	}
+}
+
+// subscribe registers sub for a room and unregisters it once ctx is done. The
+// returned context carries the subscription token and room for logging.
+func (r *Resolver) subscribe(ctx context.Context, roomID string, sub subscriber) (context.Context, error) {
+	if r.StreamStatus().State == service.ReaderFailed {
+		return ctx, service.ErrStreamUnavailable
+	}
+
+	if _, err := r.roomService.GetRoom(ctx, roomID); !errors.Is(err, nil) {
+		return ctx, err
+	}
+
+	token := randstr.Hex(constants.WebSocketSubscriptionToken)
+	ctx = logging.With(ctx, slog.String(logging.TokenKey, token), slog.String(logging.RoomKey, roomID))
+	if err := r.addMessageChannel(roomID, token, sub, subscriptionErrorFrom(ctx)); !errors.Is(err, nil) {
+		return ctx, err
+	}
+
+	// Start the room at the current end of its stream now rather than when the
+	// reader next refreshes its rooms, which would lose what is published in between
+	r.mutex.Lock()
+	reader := r.reader
+	r.mutex.Unlock()
+	if err := reader.Follow(ctx, roomID); !errors.Is(err, nil) {
+		r.removeMessageChannel(roomID, token)
+		r.subscriptions.Done()
+		return ctx, err
+	}
+
+	go func() {
+		defer r.subscriptions.Done()
+		<-ctx.Done()
+		r.removeMessageChannel(roomID, token)
+		slog.DebugContext(ctx, "Subscription cleanup: deleted channel")
 	}()
+
+	return ctx, nil
+}
+
+// subscribedRooms returns the IDs of rooms that have at least one active subscriber
+func (r *Resolver) subscribedRooms() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rooms := make([]string, 0, len(r.messageChannels))
+	for roomID := range r.messageChannels {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// addMessageChannel registers a subscriber for a room, along with the slot its
+// terminal error is reported through when one is given. The caller calls
+// subscriptions.Done once the subscription has ended.
+func (r *Resolver) addMessageChannel(roomID, token string, sub subscriber, errSlot *subscriptionError) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closing {
+		return ErrShuttingDown
+	}
+	r.subscriptions.Add(1)
+
+	if r.messageChannels[roomID] == nil {
+		r.messageChannels[roomID] = map[string]subscriber{}
+	}
+	r.messageChannels[roomID][token] = sub
+	if errSlot != nil {
+		r.subscriptionErr[token] = errSlot
+	}
+	return nil
+}
+
+// removeMessageChannel unregisters a subscriber channel, dropping the room once it has no subscribers
+func (r *Resolver) removeMessageChannel(roomID, token string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.messageChannels[roomID], token)
+	delete(r.subscriptionErr, token)
+	if len(r.messageChannels[roomID]) == 0 {
+		delete(r.messageChannels, roomID)
+	}
+}
+
+// closeRoom terminates every active subscription of a room by closing its channels
+func (r *Resolver) closeRoom(roomID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for token, sub := range r.messageChannels[roomID] {
+		sub.close()
+		delete(r.subscriptionErr, token)
+	}
+	delete(r.messageChannels, roomID)
+}
+
+// failSubscriptions terminates every active subscription with err
+func (r *Resolver) failSubscriptions(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, channels := range r.messageChannels {
+		for token, sub := range channels {
+			if errSlot := r.subscriptionErr[token]; errSlot != nil {
+				errSlot.set(err)
+			}
+			sub.close()
+		}
+	}
+	r.messageChannels = map[string]map[string]subscriber{}
+	r.subscriptionErr = map[string]*subscriptionError{}
 }
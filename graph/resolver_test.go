@@ -2,16 +2,55 @@ package graph
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
 	"github.com/redis/go-redis/v9"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 type mockRedisClient struct {
-	xAddFunc  func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd
-	xReadFunc func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd
+	xAddFunc    func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd
+	xReadFunc   func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd
+	hGetAllFunc func(ctx context.Context, key string) *redis.MapStringStringCmd
+	xRangeNFunc func(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd
+}
+
+// newTestResolver creates a Resolver keeping messages in the mocked Redis streams
+func newTestResolver(mock *mockRedisClient) *Resolver {
+	return NewResolver(mock, broker.NewStreams(mock), service.RetentionPolicy{})
+}
+
+// roomHash returns the stored metadata of an existing room
+func roomHash(ctx context.Context, key string, archived bool) *redis.MapStringStringCmd {
+	cmd := redis.NewMapStringStringCmd(ctx)
+	archivedValue := "0"
+	if archived {
+		archivedValue = "1"
+	}
+	cmd.SetVal(map[string]string{
+		"id":        "general",
+		"name":      "General",
+		"archived":  archivedValue,
+		"createdAt": "2024-01-01T00:00:00Z",
+		"updatedAt": "2024-01-01T00:00:00Z",
+	})
+	return cmd
+}
+
+// existingRoom makes every room lookup succeed
+func existingRoom(ctx context.Context, key string) *redis.MapStringStringCmd {
+	return roomHash(ctx, key, false)
 }
 
 func (m *mockRedisClient) XAdd(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
@@ -28,6 +67,121 @@ func (m *mockRedisClient) XRead(ctx context.Context, args *redis.XReadArgs) *red
 	return redis.NewXStreamSliceCmd(ctx)
 }
 
+func (m *mockRedisClient) XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	if m.xRangeNFunc != nil {
+		return m.xRangeNFunc(ctx, stream, start, stop, count)
+	}
+	return redis.NewXMessageSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return redis.NewXMessageSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMaxLen(ctx context.Context, key string, maxLen int64) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMaxLenApprox(ctx context.Context, key string, maxLen, limit int64) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMinID(ctx context.Context, key string, minID string) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMinIDApprox(ctx context.Context, key string, minID string, limit int64) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	return redis.NewStatusCmd(ctx)
+}
+
+func (m *mockRedisClient) XReadGroup(ctx context.Context, args *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	return redis.NewXStreamSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XAutoClaim(ctx context.Context, args *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+	return redis.NewXAutoClaimCmd(ctx)
+}
+
+func (m *mockRedisClient) XGroupDelConsumer(ctx context.Context, stream, group, consumer string) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd {
+	return redis.NewBoolCmd(ctx)
+}
+
+func (m *mockRedisClient) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd {
+	if m.hGetAllFunc != nil {
+		return m.hGetAllFunc(ctx, key)
+	}
+	return redis.NewMapStringStringCmd(ctx)
+}
+
+func (m *mockRedisClient) HIncrBy(ctx context.Context, key, field string, incr int64) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd {
+	cmd := redis.NewSliceCmd(ctx)
+	cmd.SetVal(make([]interface{}, len(fields)))
+	return cmd
+}
+
+func (m *mockRedisClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	return redis.NewStringSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	return redis.NewStringSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx)
+	cmd.SetErr(errors.New("ERR scripts run through EvalSha"))
+	return cmd
+}
+
+// EvalSha runs the Go implementation of a script against the mock
+func (m *mockRedisClient) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	return datastore.EvalEmulated(ctx, m, sha1, keys, args)
+}
+
 func (m *mockRedisClient) Ping(ctx context.Context) *redis.StatusCmd {
 	return redis.NewStatusCmd(ctx)
 }
@@ -38,7 +192,7 @@ func (m *mockRedisClient) Close() error {
 
 func TestNewResolver(t *testing.T) {
 	mock := &mockRedisClient{}
-	resolver := NewResolver(mock)
+	resolver := newTestResolver(mock)
 
 	if resolver == nil {
 		t.Fatal("expected resolver to be created, got nil")
@@ -60,6 +214,7 @@ func TestNewResolver(t *testing.T) {
 func TestMutationResolver_CreateMessage(t *testing.T) {
 	ctx := context.Background()
 	mock := &mockRedisClient{
+		hGetAllFunc: existingRoom,
 		xAddFunc: func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
 			cmd := redis.NewStringCmd(ctx)
 			cmd.SetVal("OK")
@@ -67,10 +222,10 @@ func TestMutationResolver_CreateMessage(t *testing.T) {
 		},
 	}
 
-	resolver := NewResolver(mock)
+	resolver := newTestResolver(mock)
 	mr := &mutationResolver{resolver}
 
-	msg, err := mr.CreateMessage(ctx, "test message")
+	msg, err := mr.CreateMessage(ctx, "general", "test message", model.ContentTypePlain, nil, nil)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -85,14 +240,43 @@ func TestMutationResolver_CreateMessage(t *testing.T) {
 	}
 }
 
+func TestMutationResolver_CreateMessage_StampsAuthor(t *testing.T) {
+	var values map[string]interface{}
+	mock := &mockRedisClient{
+		hGetAllFunc: existingRoom,
+		xAddFunc: func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
+			values = args.Values.(map[string]interface{})
+			cmd := redis.NewStringCmd(ctx)
+			cmd.SetVal("1-0")
+			return cmd
+		},
+	}
+
+	resolver := newTestResolver(mock)
+	mr := &mutationResolver{resolver}
+
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{ID: "u-1", Name: "Alice"})
+	msg, err := mr.CreateMessage(ctx, "general", "test message", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if msg.Author == nil || msg.Author.ID != "u-1" || msg.Author.Name != "Alice" {
+		t.Errorf("expected the message authored by the principal, got %+v", msg.Author)
+	}
+	if values[constants.RedisAuthorField] != "u-1" || values[constants.RedisAuthorNameField] != "Alice" {
+		t.Errorf("expected the author stored in the stream entry, got %v", values)
+	}
+}
+
 func TestMutationResolver_CreateMessage_Error(t *testing.T) {
 	ctx := context.Background()
-	mock := &mockRedisClient{}
+	mock := &mockRedisClient{hGetAllFunc: existingRoom}
 
-	resolver := NewResolver(mock)
+	resolver := newTestResolver(mock)
 	mr := &mutationResolver{resolver}
 
-	_, err := mr.CreateMessage(ctx, "")
+	_, err := mr.CreateMessage(ctx, "general", "", model.ContentTypePlain, nil, nil)
 
 	if err == nil {
 		t.Fatal("expected error for empty message, got nil")
@@ -102,27 +286,23 @@ func TestMutationResolver_CreateMessage_Error(t *testing.T) {
 func TestQueryResolver_Messages(t *testing.T) {
 	ctx := context.Background()
 	mock := &mockRedisClient{
-		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
-			cmd := redis.NewXStreamSliceCmd(ctx)
-			cmd.SetVal([]redis.XStream{
+		hGetAllFunc: existingRoom,
+		xRangeNFunc: func(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+			cmd := redis.NewXMessageSliceCmd(ctx)
+			cmd.SetVal([]redis.XMessage{
 				{
-					Stream: "room",
-					Messages: []redis.XMessage{
-						{
-							ID:     "1-0",
-							Values: map[string]interface{}{"message": "test1"},
-						},
-					},
+					ID:     "1-0",
+					Values: map[string]interface{}{"message": "test1"},
 				},
 			})
 			return cmd
 		},
 	}
 
-	resolver := NewResolver(mock)
+	resolver := newTestResolver(mock)
 	qr := &queryResolver{resolver}
 
-	messages, err := qr.Messages(ctx)
+	messages, err := qr.Messages(ctx, "general")
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -141,11 +321,11 @@ func TestSubscriptionResolver_MessageCreated(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mock := &mockRedisClient{}
-	resolver := NewResolver(mock)
+	mock := &mockRedisClient{hGetAllFunc: existingRoom}
+	resolver := newTestResolver(mock)
 	sr := &subscriptionResolver{resolver}
 
-	ch, err := sr.MessageCreated(ctx)
+	ch, err := sr.MessageCreated(ctx, "general", nil)
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -157,7 +337,7 @@ func TestSubscriptionResolver_MessageCreated(t *testing.T) {
 
 	// Verify channel is registered
 	resolver.mutex.Lock()
-	channelCount := len(resolver.messageChannels)
+	channelCount := len(resolver.messageChannels["general"])
 	resolver.mutex.Unlock()
 
 	if channelCount != 1 {
@@ -181,21 +361,21 @@ func TestSubscriptionResolver_MessageDelivery(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mock := &mockRedisClient{}
-	resolver := NewResolver(mock)
+	mock := &mockRedisClient{hGetAllFunc: existingRoom}
+	resolver := newTestResolver(mock)
 	sr := &subscriptionResolver{resolver}
 
-	ch, err := sr.MessageCreated(ctx)
+	ch, err := sr.MessageCreated(ctx, "general", nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	// Simulate message delivery
-	testMsg := &model.Message{ID: "1-0", Message: "test"}
+	testMsg := &model.Message{ID: "1-0", RoomID: "general", Message: "test"}
 
 	resolver.mutex.Lock()
-	for _, msgCh := range resolver.messageChannels {
-		msgCh <- testMsg
+	for _, msgCh := range resolver.messageChannels["general"] {
+		msgCh.messages <- testMsg
 	}
 	resolver.mutex.Unlock()
 
@@ -209,3 +389,913 @@ func TestSubscriptionResolver_MessageDelivery(t *testing.T) {
 		t.Error("timeout waiting for message")
 	}
 }
+
+func TestSubscriptionResolver_MessageCreated_InvalidRoom(t *testing.T) {
+	ctx := context.Background()
+	resolver := newTestResolver(&mockRedisClient{})
+	sr := &subscriptionResolver{resolver}
+
+	if _, err := sr.MessageCreated(ctx, "", nil); err == nil {
+		t.Fatal("expected error for empty room ID, got nil")
+	}
+}
+
+func TestSubscribedRooms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := newTestResolver(&mockRedisClient{hGetAllFunc: existingRoom})
+	sr := &subscriptionResolver{resolver}
+
+	for _, roomID := range []string{"general", "general", "random"} {
+		if _, err := sr.MessageCreated(ctx, roomID, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	rooms := resolver.subscribedRooms()
+	if len(rooms) != 2 {
+		t.Fatalf("expected 2 subscribed rooms, got %d: %v", len(rooms), rooms)
+	}
+
+	resolver.mutex.Lock()
+	generalCount := len(resolver.messageChannels["general"])
+	resolver.mutex.Unlock()
+
+	if generalCount != 2 {
+		t.Errorf("expected 2 subscribers in room general, got %d", generalCount)
+	}
+}
+
+func TestMutationResolver_CreateMessage_ArchivedRoom(t *testing.T) {
+	ctx := context.Background()
+	mock := &mockRedisClient{
+		hGetAllFunc: func(ctx context.Context, key string) *redis.MapStringStringCmd {
+			return roomHash(ctx, key, true)
+		},
+		xAddFunc: func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
+			t.Error("expected archived room to reject the message before publishing")
+			return redis.NewStringCmd(ctx)
+		},
+	}
+
+	mr := &mutationResolver{newTestResolver(mock)}
+	_, err := mr.CreateMessage(ctx, "general", "test message", model.ContentTypePlain, nil, nil)
+
+	var gqlErr *gqlerror.Error
+	if !errors.As(err, &gqlErr) {
+		t.Fatalf("expected GraphQL error, got %v", err)
+	}
+
+	if gqlErr.Extensions["code"] != ErrCodeRoomArchived {
+		t.Errorf("expected code %s, got %v", ErrCodeRoomArchived, gqlErr.Extensions["code"])
+	}
+}
+
+func TestMutationResolver_DeleteRoom_ClosesSubscriptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two instances sharing a datastore, the room is deleted through the first
+	client := datastore.NewMemoryClient()
+	var resolvers []*Resolver
+	for range 2 {
+		resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+		if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+		resolvers = append(resolvers, resolver)
+	}
+	other := resolvers[1]
+	sr := &subscriptionResolver{other}
+
+	messages, err := sr.MessageCreated(ctx, "general", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events, err := sr.RoomEvents(ctx, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deleted, err := (&mutationResolver{resolvers[0]}).DeleteRoom(ctx, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !deleted {
+		t.Error("expected room to be deleted")
+	}
+
+	// roomEvents receives the deletion, then every subscription ends
+	select {
+	case event := <-events:
+		if _, ok := event.(*model.RoomDeleted); !ok || event.GetRoomID() != "general" {
+			t.Errorf("expected a RoomDeleted event, got %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the RoomDeleted event")
+	}
+	for _, closed := range []func() bool{
+		func() bool { _, ok := <-messages; return !ok },
+		func() bool { _, ok := <-events; return !ok },
+	} {
+		done := make(chan bool, 1)
+		go func() { done <- closed() }()
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Error("expected the subscription channel to be closed")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for subscription to terminate")
+		}
+	}
+
+	if rooms := other.subscribedRooms(); len(rooms) != 0 {
+		t.Errorf("expected no subscribed rooms, got %v", rooms)
+	}
+}
+
+func TestSubscriptionResolver_MessageCreated_UnknownRoom(t *testing.T) {
+	ctx := context.Background()
+	sr := &subscriptionResolver{newTestResolver(&mockRedisClient{})}
+
+	_, err := sr.MessageCreated(ctx, "missing", nil)
+
+	var gqlErr *gqlerror.Error
+	if !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeRoomNotFound {
+		t.Fatalf("expected %s error, got %v", ErrCodeRoomNotFound, err)
+	}
+}
+
+// storedMessages serves XRANGE calls with exclusive bounds from the given stream IDs
+func storedMessages(ids ...string) func(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return func(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+		result := []redis.XMessage{}
+		for _, id := range ids {
+			if start != "-" && service.CompareStreamIDs(id, strings.TrimPrefix(start, "(")) <= 0 {
+				continue
+			}
+			if stop != "+" && service.CompareStreamIDs(id, strings.TrimPrefix(stop, "(")) >= 0 {
+				continue
+			}
+			if int64(len(result)) == count {
+				break
+			}
+			result = append(result, redis.XMessage{ID: id, Values: map[string]interface{}{"message": "stored " + id}})
+		}
+
+		cmd := redis.NewXMessageSliceCmd(ctx)
+		cmd.SetVal(result)
+		return cmd
+	}
+}
+
+// waitFollowing waits until the stream tailer follows a room, so that entries
+// written from then on reach its subscribers
+func waitFollowing(t *testing.T, resolver *Resolver, roomID string) {
+	t.Helper()
+
+	resolver.mutex.Lock()
+	tailer := resolver.reader.(*service.StreamTailer)
+	resolver.mutex.Unlock()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		if _, ok := tailer.Offsets()[roomID]; ok {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timeout waiting for the stream reader to follow %s", roomID)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func receiveIDs(t *testing.T, ch <-chan *model.Message, n int) []string {
+	t.Helper()
+
+	ids := make([]string, 0, n)
+	for len(ids) < n {
+		select {
+		case msg := <-ch:
+			ids = append(ids, msg.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for messages, got %v", ids)
+		}
+	}
+	return ids
+}
+
+func TestSubscriptionResolver_MessageCreated_Since(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock := &mockRedisClient{
+		hGetAllFunc: existingRoom,
+		xRangeNFunc: storedMessages("1-0", "2-0", "3-0"),
+	}
+	resolver := newTestResolver(mock)
+	sr := &subscriptionResolver{resolver}
+
+	since := "1-0"
+	ch, err := sr.MessageCreated(ctx, "general", &since)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The replayed entries arrive live as well, and must not be delivered twice
+	resolver.mutex.Lock()
+	for _, msgCh := range resolver.messageChannels["general"] {
+		for _, id := range []string{"3-0", "4-0"} {
+			msgCh.messages <- &model.Message{ID: id, RoomID: "general", Message: "live " + id}
+		}
+	}
+	resolver.mutex.Unlock()
+
+	got := fmt.Sprint(receiveIDs(t, ch, 3))
+	if got != "[2-0 3-0 4-0]" {
+		t.Errorf("expected [2-0 3-0 4-0], got %s", got)
+	}
+}
+
+func TestSubscriptionResolver_MessageCreated_SinceFillsGap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 2-0 and 3-0 were stored before the replay, 4-0 and 5-0 while the
+	// replay ran, but only 5-0 made it into the live buffer
+	stored := []string{"2-0", "3-0"}
+	mock := &mockRedisClient{hGetAllFunc: existingRoom}
+	mock.xRangeNFunc = func(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+		cmd := storedMessages(stored...)(ctx, stream, start, stop, count)
+		stored = []string{"2-0", "3-0", "4-0", "5-0"}
+		return cmd
+	}
+
+	resolver := newTestResolver(mock)
+	sr := &subscriptionResolver{resolver}
+
+	since := "1-0"
+	ch, err := sr.MessageCreated(ctx, "general", &since)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := fmt.Sprint(receiveIDs(t, ch, 2))
+	if got != "[2-0 3-0]" {
+		t.Fatalf("expected replay [2-0 3-0], got %s", got)
+	}
+
+	resolver.mutex.Lock()
+	for _, msgCh := range resolver.messageChannels["general"] {
+		msgCh.messages <- &model.Message{ID: "5-0", RoomID: "general", Message: "live 5-0"}
+	}
+	resolver.mutex.Unlock()
+
+	got = fmt.Sprint(receiveIDs(t, ch, 2))
+	if got != "[4-0 5-0]" {
+		t.Errorf("expected gap fill [4-0 5-0], got %s", got)
+	}
+}
+
+func TestSubscriptionResolver_MessageCreated_InvalidSince(t *testing.T) {
+	sr := &subscriptionResolver{newTestResolver(&mockRedisClient{hGetAllFunc: existingRoom})}
+
+	since := "$"
+	_, err := sr.MessageCreated(context.Background(), "general", &since)
+
+	var gqlErr *gqlerror.Error
+	if !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeBadUserInput {
+		t.Fatalf("expected %s error, got %v", ErrCodeBadUserInput, err)
+	}
+}
+
+func TestSubscriptionErrors_StreamDown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := newTestResolver(&mockRedisClient{hGetAllFunc: existingRoom})
+	sr := &subscriptionResolver{resolver}
+
+	// Stand in for the executor, which resolves the subscription with the middleware's context
+	responses := SubscriptionErrors(ctx, func(ctx context.Context) graphql.ResponseHandler {
+		ch, err := sr.MessageCreated(ctx, "general", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return func(ctx context.Context) *graphql.Response {
+			if _, ok := <-ch; !ok {
+				return nil
+			}
+			return &graphql.Response{}
+		}
+	})
+
+	resolver.streamStateChanged(service.ReaderStatus{State: service.ReaderReconnecting}, 10*time.Millisecond)
+
+	done := make(chan *graphql.Response)
+	go func() { done <- responses(ctx) }()
+
+	select {
+	case resp := <-done:
+		if resp == nil || len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != ErrCodeStreamUnavailable {
+			t.Fatalf("expected a %s error response, got %+v", ErrCodeStreamUnavailable, resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the subscription to end")
+	}
+
+	if resp := responses(ctx); resp != nil {
+		t.Errorf("expected the subscription to complete after the error, got %+v", resp)
+	}
+
+	if rooms := resolver.subscribedRooms(); len(rooms) != 0 {
+		t.Errorf("expected no subscribed rooms, got %v", rooms)
+	}
+}
+
+func TestStreamStateChanged_RecoveryKeepsSubscriptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := newTestResolver(&mockRedisClient{hGetAllFunc: existingRoom})
+	sr := &subscriptionResolver{resolver}
+
+	if _, err := sr.MessageCreated(ctx, "general", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resolver.streamStateChanged(service.ReaderStatus{State: service.ReaderReconnecting}, 20*time.Millisecond)
+	resolver.streamStateChanged(service.ReaderStatus{State: service.ReaderRunning}, 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	if rooms := resolver.subscribedRooms(); len(rooms) != 1 {
+		t.Errorf("expected the subscription to survive a short outage, got rooms %v", rooms)
+	}
+}
+
+func TestResolver_MemoryBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := NewResolver(&mockRedisClient{hGetAllFunc: existingRoom}, broker.NewMemory(), service.RetentionPolicy{})
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	ch, err := (&subscriptionResolver{resolver}).MessageCreated(ctx, "general", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Wait for the reader to follow the room before publishing
+	deadline := time.After(time.Second)
+	for resolver.StreamStats().Reads == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for the stream reader")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	created, err := (&mutationResolver{resolver}).CreateMessage(ctx, "general", "hello", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.ID != created.ID || msg.Message != "hello" {
+			t.Errorf("expected the created message, got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the message")
+	}
+
+	messages, err := (&queryResolver{resolver}).Messages(ctx, "general")
+	if err != nil || len(messages) != 1 {
+		t.Errorf("expected the message in the history, got %v (%v)", messages, err)
+	}
+}
+
+// noPubSubClient lets the Pub/Sub broker publish without a Redis server
+type noPubSubClient struct{}
+
+func (noPubSubClient) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+
+func (noPubSubClient) PSubscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return nil
+}
+
+func TestResolver_PubSubBrokerRejectsHistory(t *testing.T) {
+	ctx := context.Background()
+	resolver := NewResolver(&mockRedisClient{hGetAllFunc: existingRoom}, broker.NewPubSub(noPubSubClient{}), service.RetentionPolicy{})
+
+	created, err := (&mutationResolver{resolver}).CreateMessage(ctx, "general", "hello", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	since := created.ID
+	calls := map[string]func() error{
+		"messages": func() error {
+			_, err := (&queryResolver{resolver}).Messages(ctx, "general")
+			return err
+		},
+		"updateMessage": func() error {
+			_, err := (&mutationResolver{resolver}).UpdateMessage(ctx, "general", created.ID, "edited")
+			return err
+		},
+		"messageCreated since": func() error {
+			_, err := (&subscriptionResolver{resolver}).MessageCreated(ctx, "general", &since)
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		var gqlErr *gqlerror.Error
+		if err := call(); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeUnsupported {
+			t.Errorf("%s: expected %s error, got %v", name, ErrCodeUnsupported, err)
+		}
+	}
+}
+
+func TestResolver_MemoryDatastore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{MaxLen: 2})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	mr := &mutationResolver{resolver}
+	first, err := mr.CreateMessage(ctx, "general", "first", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Resuming after the first message replays nothing, the live message
+	// arrives through the blocking XREAD of the stream reader
+	ch, err := (&subscriptionResolver{resolver}).MessageCreated(ctx, "general", &first.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second, err := mr.CreateMessage(ctx, "general", "second", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.ID != second.ID || msg.Message != "second" {
+			t.Errorf("expected the second message, got %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the message")
+	}
+
+	// The room retention keeps the 2 newest messages
+	if _, err := mr.CreateMessage(ctx, "general", "third", model.ContentTypePlain, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	messages, err := (&queryResolver{resolver}).Messages(ctx, "general")
+	if err != nil || len(messages) != 2 || messages[0].ID != second.ID {
+		t.Errorf("expected the 2 newest messages, got %v (%v)", messages, err)
+	}
+
+	// Deleting the room completes its subscriptions
+	if _, err := mr.DeleteRoom(ctx, "general"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("timeout waiting for the subscription to complete")
+		}
+	}
+}
+
+func TestResolver_UpdateAndDeleteMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	alice := auth.WithPrincipal(ctx, &auth.Principal{ID: "u-1", Name: "Alice", Roles: []string{"member"}})
+	bob := auth.WithPrincipal(ctx, &auth.Principal{ID: "u-2", Name: "Bob", Roles: []string{"member"}})
+	moderator := auth.WithPrincipal(ctx, &auth.Principal{ID: "u-3", Name: "Mod", Roles: []string{"moderator"}})
+
+	sr := &subscriptionResolver{resolver}
+	created, err := sr.MessageCreated(ctx, "general", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := sr.MessageUpdated(ctx, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deleted, err := sr.MessageDeleted(ctx, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	waitFollowing(t, resolver, "general")
+
+	mr := &mutationResolver{resolver}
+	msg, err := mr.CreateMessage(alice, "general", "helo", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := receiveIDs(t, created, 1); got[0] != msg.ID {
+		t.Fatalf("expected the created message, got %v", got)
+	}
+
+	var gqlErr *gqlerror.Error
+	if _, err := mr.UpdateMessage(bob, "general", msg.ID, "hacked"); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeForbidden {
+		t.Errorf("expected a %s error for another member, got %v", ErrCodeForbidden, err)
+	}
+	if _, err := mr.UpdateMessage(moderator, "general", msg.ID, "moderated"); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeForbidden {
+		t.Errorf("expected a %s error for a moderator edit, got %v", ErrCodeForbidden, err)
+	}
+	if _, err := mr.UpdateMessage(alice, "general", msg.ID, "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case m := <-updated:
+		if m.ID != msg.ID || m.Message != "hello" || m.EditedAt == nil || m.Author == nil || m.Author.ID != "u-1" {
+			t.Errorf("unexpected update %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the update")
+	}
+
+	if _, err := mr.DeleteMessage(bob, "general", msg.ID); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeForbidden {
+		t.Errorf("expected a %s error for another member, got %v", ErrCodeForbidden, err)
+	}
+	if _, err := mr.DeleteMessage(moderator, "general", msg.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case m := <-deleted:
+		if m.ID != msg.ID || !m.Deleted || m.Message != "" {
+			t.Errorf("unexpected deletion %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the deletion")
+	}
+
+	// Neither event reaches messageCreated subscribers
+	select {
+	case m := <-created:
+		t.Errorf("unexpected delivery to messageCreated: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	messages, err := (&queryResolver{resolver}).Messages(ctx, "general")
+	if err != nil || len(messages) != 1 || !messages[0].Deleted || messages[0].EditedAt == nil {
+		t.Errorf("expected the tombstone in the history, got %v (%v)", messages, err)
+	}
+
+	if _, err := mr.UpdateMessage(alice, "general", msg.ID, "again"); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeMessageNotFound {
+		t.Errorf("expected a %s error for a deleted message, got %v", ErrCodeMessageNotFound, err)
+	}
+}
+
+func TestSubscriptionResolver_RoomEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	events, err := (&subscriptionResolver{resolver}).RoomEvents(ctx, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFollowing(t, resolver, "general")
+
+	mr := &mutationResolver{resolver}
+	first, err := mr.CreateMessage(ctx, "general", "first", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := mr.UpdateMessage(ctx, "general", first.ID, "edited"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := mr.CreateMessage(ctx, "general", "second", model.ContentTypePlain, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := mr.DeleteMessage(ctx, "general", first.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every event arrives typed and in stream order
+	var got []string
+	lastID := ""
+	for len(got) < 4 {
+		select {
+		case event := <-events:
+			if lastID != "" && service.CompareStreamIDs(event.GetID(), lastID) <= 0 {
+				t.Errorf("event %s delivered after %s", event.GetID(), lastID)
+			}
+			lastID = event.GetID()
+
+			switch e := event.(type) {
+			case *model.MessageCreated:
+				got = append(got, "created "+e.Message.Message)
+			case *model.MessageUpdated:
+				got = append(got, "updated "+e.Message.Message)
+			case *model.MessageDeleted:
+				got = append(got, fmt.Sprintf("deleted %t", e.Message.Deleted))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for events, got %v", got)
+		}
+	}
+
+	if want := "[created first updated edited created second deleted true]"; fmt.Sprint(got) != want {
+		t.Errorf("expected %s, got %v", want, got)
+	}
+}
+
+func TestMutationResolver_JoinRoom(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	sr := &subscriptionResolver{resolver}
+	alice := auth.WithPrincipal(ctx, &auth.Principal{ID: "u-1", Name: "Alice", Roles: []string{"member"}})
+	bob := auth.WithPrincipal(ctx, &auth.Principal{ID: "u-2", Name: "Bob", Roles: []string{"member"}})
+	events, err := sr.RoomEvents(alice, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFollowing(t, resolver, "general")
+
+	// Subscribing joins nobody, and joining again announces nothing
+	if _, err := sr.MessageCreated(bob, "general", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mr := &mutationResolver{resolver}
+	for _, join := range []struct {
+		ctx  context.Context
+		want bool
+	}{{alice, true}, {alice, false}, {bob, true}} {
+		joined, err := mr.JoinRoom(join.ctx, "general")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if joined != join.want {
+			t.Errorf("expected joined %v, got %v", join.want, joined)
+		}
+	}
+	if _, err := mr.CreateMessage(bob, "general", "hi", model.ContentTypePlain, nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Anonymous callers cannot join
+	if _, err := mr.JoinRoom(ctx, "general"); !errors.Is(err, auth.ErrUnauthenticated) {
+		t.Errorf("expected ErrUnauthenticated, got %v", err)
+	}
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case event := <-events:
+			switch e := event.(type) {
+			case *model.MemberJoined:
+				got = append(got, "joined "+e.User.Name)
+			case *model.MessageCreated:
+				got = append(got, "created "+e.Message.Message)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for events, got %v", got)
+		}
+	}
+
+	if want := "[joined Alice joined Bob created hi]"; fmt.Sprint(got) != want {
+		t.Errorf("expected %s, got %v", want, got)
+	}
+}
+
+func TestSubscriptionResolver_ThreadReplies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	sr := &subscriptionResolver{resolver}
+	created, err := sr.MessageCreated(ctx, "general", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFollowing(t, resolver, "general")
+
+	mr := &mutationResolver{resolver}
+	parent, err := mr.CreateMessage(ctx, "general", "lunch?", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := receiveIDs(t, created, 1); ids[0] != parent.ID {
+		t.Errorf("expected %s on messageCreated, got %v", parent.ID, ids)
+	}
+
+	var gqlErr *gqlerror.Error
+	if _, err := sr.ThreadReplies(ctx, "general", "9-0"); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeMessageNotFound {
+		t.Errorf("expected %s subscribing to a missing thread, got %v", ErrCodeMessageNotFound, err)
+	}
+	replies, err := sr.ThreadReplies(ctx, "general", parent.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Replies reach the thread subscription only, room messages messageCreated only
+	reply, err := mr.CreateMessage(ctx, "general", "yes", model.ContentTypePlain, nil, &parent.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := receiveIDs(t, replies, 1); ids[0] != reply.ID {
+		t.Errorf("expected %s on threadReplies, got %v", reply.ID, ids)
+	}
+	other, err := mr.CreateMessage(ctx, "general", "coffee?", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := receiveIDs(t, created, 1); ids[0] != other.ID {
+		t.Errorf("expected %s on messageCreated, got %v", other.ID, ids)
+	}
+	select {
+	case msg := <-replies:
+		t.Errorf("unexpected reply %s", msg.ID)
+	default:
+	}
+
+	messages, err := (&queryResolver{resolver}).Messages(ctx, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 2 || messages[0].ReplyCount != 1 || messages[0].LastReplyAt == nil {
+		t.Fatalf("expected the parent with 1 reply and the other message, got %+v", messages)
+	}
+
+	conn, err := (&messageResolver{resolver}).Replies(ctx, messages[0], nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(conn.Edges) != 1 || conn.Edges[0].Node.ID != reply.ID || conn.Edges[0].Node.ParentID == nil {
+		t.Errorf("unexpected replies %+v", conn.Edges)
+	}
+}
+
+func TestSubscriptionResolver_ReactionChanged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	alice := auth.WithPrincipal(ctx, &auth.Principal{ID: "u-1", Name: "Alice", Roles: []string{"member"}})
+	changes, err := (&subscriptionResolver{resolver}).ReactionChanged(alice, "general")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	waitFollowing(t, resolver, "general")
+
+	mr := &mutationResolver{resolver}
+	msg, err := mr.CreateMessage(alice, "general", "ship it?", model.ContentTypePlain, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reacted, err := mr.AddReaction(alice, "general", msg.ID, "👍")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reacted.Reactions) != 1 || reacted.Reactions[0].Count != 1 || !reacted.Reactions[0].ViewerHasReacted {
+		t.Errorf("unexpected reactions %+v", reacted.Reactions)
+	}
+
+	// Only reaction changes reach the subscription, the new message does not
+	select {
+	case change := <-changes:
+		added, ok := change.(*model.ReactionAdded)
+		if !ok || added.MessageID != msg.ID || added.Emoji != "👍" || added.Count != 1 || added.User == nil || added.User.ID != "u-1" {
+			t.Errorf("unexpected change %+v", change)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the reaction")
+	}
+
+	if _, err := mr.RemoveReaction(alice, "general", msg.ID, "👍"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case change := <-changes:
+		if removed, ok := change.(*model.ReactionRemoved); !ok || removed.Count != 0 {
+			t.Errorf("unexpected change %+v", change)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the removal")
+	}
+
+	// Messages delivered without their reactions read them on demand
+	reactions, err := (&messageResolver{resolver}).Reactions(alice, msg)
+	if err != nil || len(reactions) != 0 {
+		t.Errorf("expected no reactions after the removal, got %+v (%v)", reactions, err)
+	}
+
+	var gqlErr *gqlerror.Error
+	if _, err := mr.AddReaction(alice, "general", msg.ID, ""); !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeBadUserInput {
+		t.Errorf("expected %s for an empty emoji, got %v", ErrCodeBadUserInput, err)
+	}
+}
+
+func TestResolver_Shutdown(t *testing.T) {
+	client := datastore.NewMemoryClient()
+	resolver := NewResolver(client, broker.NewStreams(client), service.RetentionPolicy{})
+	if err := resolver.EnsureDefaultRoom(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver.SubscribeRedis(context.Background(), StreamOptions{Backoff: service.DefaultBackoff()})
+
+	// Like the transport, end the subscription context once the channel is closed
+	subCtx, endSub := context.WithCancel(context.Background())
+	sr := &subscriptionResolver{resolver}
+	ch, err := sr.MessageCreated(subCtx, "general", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go func() {
+		for range ch {
+		}
+		endSub()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := resolver.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if state := resolver.StreamStatus().State; state != service.ReaderStopped {
+		t.Errorf("expected the stream reader to be stopped, got %s", state)
+	}
+
+	_, err = sr.MessageCreated(context.Background(), "general", nil)
+	var gqlErr *gqlerror.Error
+	if !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] != ErrCodeShuttingDown {
+		t.Errorf("expected a %s error for a new subscription, got %v", ErrCodeShuttingDown, err)
+	}
+}
+
+func TestResolver_ShutdownDeadline(t *testing.T) {
+	resolver := newTestResolver(&mockRedisClient{hGetAllFunc: existingRoom})
+
+	// The subscription context never ends, as with a stuck transport
+	if _, err := (&subscriptionResolver{resolver}).MessageCreated(context.Background(), "general", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := resolver.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
@@ -7,45 +7,336 @@ package graph
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/generated"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
-	"github.com/thanhpk/randstr"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/metrics"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
 )
 
+// Replies is the resolver for the replies field.
+func (r *messageResolver) Replies(ctx context.Context, obj *model.Message, first *int, after *string) (*model.MessageConnection, error) {
+	conn, err := r.messageService.ReadReplies(ctx, obj.RoomID, obj.ID, service.PageArgs{
+		First: first,
+		After: after,
+	})
+	return conn, gqlError(err)
+}
+
+// Reactions is the resolver for the reactions field.
+func (r *messageResolver) Reactions(ctx context.Context, obj *model.Message) ([]*model.Reaction, error) {
+	reactions, err := r.messageService.Reactions(ctx, obj)
+	return reactions, gqlError(err)
+}
+
 // CreateMessage is the resolver for the createMessage field.
-func (r *mutationResolver) CreateMessage(ctx context.Context, message string) (*model.Message, error) {
-	return r.messageService.PublishMessage(ctx, message)
+func (r *mutationResolver) CreateMessage(ctx context.Context, roomID string, message string, contentType model.ContentType, metadata map[string]any, parentID *string) (*model.Message, error) {
+	room, err := r.roomService.WritableRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	input := service.MessageInput{
+		Message:     message,
+		ContentType: contentType,
+		Metadata:    metadata,
+		Author:      author(ctx),
+	}
+	if parentID != nil {
+		input.ParentID = *parentID
+	}
+
+	m, err := r.messageService.PublishMessage(ctx, roomID, input, service.RetentionFromModel(room.Retention))
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	metrics.MessagesPublished.Inc()
+	return m, nil
+}
+
+// UpdateMessage is the resolver for the updateMessage field.
+func (r *mutationResolver) UpdateMessage(ctx context.Context, roomID string, id string, message string) (*model.Message, error) {
+	room, err := r.roomService.WritableRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	current, err := r.messageService.GetMessage(ctx, roomID, id)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	if err := mayRevise(ctx, current, false); !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	m, err := r.messageService.UpdateMessage(ctx, current, message, service.RetentionFromModel(room.Retention))
+	return m, gqlError(err)
+}
+
+// DeleteMessage is the resolver for the deleteMessage field.
+func (r *mutationResolver) DeleteMessage(ctx context.Context, roomID string, id string) (*model.Message, error) {
+	room, err := r.roomService.WritableRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	current, err := r.messageService.GetMessage(ctx, roomID, id)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	if err := mayRevise(ctx, current, true); !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	m, err := r.messageService.DeleteMessage(ctx, current, service.RetentionFromModel(room.Retention))
+	return m, gqlError(err)
+}
+
+// AddReaction is the resolver for the addReaction field.
+func (r *mutationResolver) AddReaction(ctx context.Context, roomID string, messageID string, emoji string) (*model.Message, error) {
+	room, err := r.roomService.WritableRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	current, err := r.messageService.GetMessage(ctx, roomID, messageID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	m, err := r.messageService.AddReaction(ctx, current, emoji, author(ctx), service.RetentionFromModel(room.Retention))
+	return m, gqlError(err)
+}
+
+// RemoveReaction is the resolver for the removeReaction field.
+func (r *mutationResolver) RemoveReaction(ctx context.Context, roomID string, messageID string, emoji string) (*model.Message, error) {
+	room, err := r.roomService.WritableRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	current, err := r.messageService.GetMessage(ctx, roomID, messageID)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	m, err := r.messageService.RemoveReaction(ctx, current, emoji, author(ctx), service.RetentionFromModel(room.Retention))
+	return m, gqlError(err)
+}
+
+// JoinRoom is the resolver for the joinRoom field.
+func (r *mutationResolver) JoinRoom(ctx context.Context, roomID string) (bool, error) {
+	user := author(ctx)
+	if user == nil {
+		return false, gqlError(fmt.Errorf("%w: %s requires authentication", auth.ErrUnauthenticated, fieldName(ctx)))
+	}
+
+	room, err := r.roomService.WritableRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return false, gqlError(err)
+	}
+
+	joined, err := r.messageService.JoinRoom(ctx, roomID, user, service.RetentionFromModel(room.Retention))
+	return joined, gqlError(err)
+}
+
+// CreateRoom is the resolver for the createRoom field.
+func (r *mutationResolver) CreateRoom(ctx context.Context, id string, name string) (*model.Room, error) {
+	room, err := r.roomService.CreateRoom(ctx, id, name)
+	return room, gqlError(err)
+}
+
+// UpdateRoom is the resolver for the updateRoom field.
+func (r *mutationResolver) UpdateRoom(ctx context.Context, id string, name string) (*model.Room, error) {
+	room, err := r.roomService.RenameRoom(ctx, id, name)
+	return room, gqlError(err)
+}
+
+// ArchiveRoom is the resolver for the archiveRoom field.
+func (r *mutationResolver) ArchiveRoom(ctx context.Context, id string) (*model.Room, error) {
+	room, err := r.roomService.ArchiveRoom(ctx, id)
+	return room, gqlError(err)
+}
+
+// SetRoomRetention is the resolver for the setRoomRetention field.
+func (r *mutationResolver) SetRoomRetention(ctx context.Context, id string, retention *model.RetentionPolicyInput) (*model.Room, error) {
+	if retention == nil {
+		room, err := r.roomService.SetRetention(ctx, id, nil)
+		return room, gqlError(err)
+	}
+
+	policy, err := service.RetentionPolicyFromInput(retention)
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	room, err := r.roomService.SetRetention(ctx, id, &policy)
+	return room, gqlError(err)
+}
+
+// DeleteRoom is the resolver for the deleteRoom field.
+func (r *mutationResolver) DeleteRoom(ctx context.Context, id string) (bool, error) {
+	if err := r.roomService.DeleteRoom(ctx, id); !errors.Is(err, nil) {
+		return false, gqlError(err)
+	}
+
+	slog.InfoContext(ctx, "Room deleted", slog.String(logging.RoomKey, id))
+
+	return true, nil
 }
 
 // Messages is the resolver for the messages field.
-func (r *queryResolver) Messages(ctx context.Context) ([]*model.Message, error) {
-	return r.messageService.ReadMessages(ctx)
+func (r *queryResolver) Messages(ctx context.Context, roomID string) ([]*model.Message, error) {
+	if _, err := r.roomService.GetRoom(ctx, roomID); !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	messages, err := r.messageService.ReadMessages(ctx, roomID)
+	return messages, gqlError(err)
+}
+
+// MessagesConnection is the resolver for the messagesConnection field.
+func (r *queryResolver) MessagesConnection(ctx context.Context, roomID string, first *int, after *string, last *int, before *string) (*model.MessageConnection, error) {
+	if _, err := r.roomService.GetRoom(ctx, roomID); !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	conn, err := r.messageService.ReadMessagesPage(ctx, roomID, service.PageArgs{
+		First:  first,
+		After:  after,
+		Last:   last,
+		Before: before,
+	})
+	return conn, gqlError(err)
+}
+
+// Room is the resolver for the room field.
+func (r *queryResolver) Room(ctx context.Context, id string) (*model.Room, error) {
+	room, err := r.roomService.GetRoom(ctx, id)
+	if errors.Is(err, service.ErrRoomNotFound) {
+		return nil, nil
+	}
+	return room, gqlError(err)
+}
+
+// Rooms is the resolver for the rooms field.
+func (r *queryResolver) Rooms(ctx context.Context, includeArchived *bool) ([]*model.Room, error) {
+	rooms, err := r.roomService.ListRooms(ctx, includeArchived != nil && *includeArchived)
+	return rooms, gqlError(err)
 }
 
 // MessageCreated is the resolver for the messageCreated field.
-func (r *subscriptionResolver) MessageCreated(ctx context.Context) (<-chan *model.Message, error) {
-	token := randstr.Hex(constants.WebSocketSubscriptionToken)
+func (r *subscriptionResolver) MessageCreated(ctx context.Context, roomID string, since *string) (<-chan *model.Message, error) {
+	if since != nil {
+		if err := service.ValidateStreamID(*since); !errors.Is(err, nil) {
+			return nil, gqlError(err)
+		}
+		if !broker.KeepsHistory(r.broker) {
+			return nil, gqlError(fmt.Errorf("%w: cannot resume since %s", broker.ErrNoHistory, *since))
+		}
+	}
+
+	size := 1
+	if since != nil {
+		// Register a larger buffer first so nothing published during the replay is missed
+		size = constants.SubscriptionReplayBuffer
+	}
+	mc := make(chan *model.Message, size)
+	ctx, err := r.subscribe(ctx, roomID, subscriber{event: constants.MessageEventCreated, messages: mc})
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	if since == nil {
+		slog.InfoContext(ctx, "Subscription: message created")
+		return mc, nil
+	}
+
+	slog.InfoContext(ctx, "Subscription: message created, resuming", slog.String("since", *since))
+
+	out := make(chan *model.Message, 1)
+	go r.resumeMessages(ctx, roomID, *since, mc, out)
+
+	return out, nil
+}
+
+// ThreadReplies is the resolver for the threadReplies field.
+func (r *subscriptionResolver) ThreadReplies(ctx context.Context, roomID string, parentID string) (<-chan *model.Message, error) {
+	if _, err := r.messageService.GetMessage(ctx, roomID, parentID); !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
 	mc := make(chan *model.Message, 1)
-	r.mutex.Lock()
-	r.messageChannels[token] = mc
-	r.mutex.Unlock()
+	ctx, err := r.subscribe(ctx, roomID, subscriber{event: constants.MessageEventCreated, parent: parentID, messages: mc})
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
 
-	go func() {
-		<-ctx.Done()
-		r.mutex.Lock()
-		delete(r.messageChannels, token)
-		r.mutex.Unlock()
-		log.Printf("Subscription cleanup: deleted channel for token %s", token)
-	}()
+	slog.InfoContext(ctx, "Subscription: thread replies", slog.String("parent", parentID))
+	return mc, nil
+}
+
+// MessageUpdated is the resolver for the messageUpdated field.
+func (r *subscriptionResolver) MessageUpdated(ctx context.Context, roomID string) (<-chan *model.Message, error) {
+	mc := make(chan *model.Message, 1)
+	ctx, err := r.subscribe(ctx, roomID, subscriber{event: constants.MessageEventUpdated, messages: mc})
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	slog.InfoContext(ctx, "Subscription: message updated")
+	return mc, nil
+}
 
-	log.Println("Subscription: message created")
+// MessageDeleted is the resolver for the messageDeleted field.
+func (r *subscriptionResolver) MessageDeleted(ctx context.Context, roomID string) (<-chan *model.Message, error) {
+	mc := make(chan *model.Message, 1)
+	ctx, err := r.subscribe(ctx, roomID, subscriber{event: constants.MessageEventDeleted, messages: mc})
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
 
+	slog.InfoContext(ctx, "Subscription: message deleted")
 	return mc, nil
 }
 
+// ReactionChanged is the resolver for the reactionChanged field.
+func (r *subscriptionResolver) ReactionChanged(ctx context.Context, roomID string) (<-chan model.ReactionEvent, error) {
+	rc := make(chan model.ReactionEvent, 1)
+	ctx, err := r.subscribe(ctx, roomID, subscriber{reactions: rc})
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	slog.InfoContext(ctx, "Subscription: reaction changed")
+	return rc, nil
+}
+
+// RoomEvents is the resolver for the roomEvents field.
+func (r *subscriptionResolver) RoomEvents(ctx context.Context, roomID string) (<-chan model.RoomEvent, error) {
+	ec := make(chan model.RoomEvent, constants.RoomEventsBuffer)
+	ctx, err := r.subscribe(ctx, roomID, subscriber{events: ec})
+	if !errors.Is(err, nil) {
+		return nil, gqlError(err)
+	}
+
+	slog.InfoContext(ctx, "Subscription: room events")
+	return ec, nil
+}
+
+// Message returns generated.MessageResolver implementation.
+func (r *Resolver) Message() generated.MessageResolver { return &messageResolver{r} }
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
@@ -55,6 +346,7 @@ func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 // Subscription returns generated.SubscriptionResolver implementation.
 func (r *Resolver) Subscription() generated.SubscriptionResolver { return &subscriptionResolver{r} }
 
+type messageResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
 type subscriptionResolver struct{ *Resolver }
@@ -0,0 +1,65 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+type subscriptionErrorKey struct{}
+
+// subscriptionError holds the error that ended a subscription
+type subscriptionError struct {
+	mutex sync.Mutex
+	err   error
+}
+
+func (s *subscriptionError) set(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+func (s *subscriptionError) get() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// subscriptionErrorFrom returns the error slot installed by SubscriptionErrors, or nil
+func subscriptionErrorFrom(ctx context.Context) *subscriptionError {
+	s, _ := ctx.Value(subscriptionErrorKey{}).(*subscriptionError)
+	return s
+}
+
+// SubscriptionErrors is an operation middleware that lets a subscription resolver
+// end its stream with an error. Subscription channels can only carry data, so the
+// resolver records the error before closing its channel and the middleware sends
+// it to the client as a final response before the subscription completes.
+func SubscriptionErrors(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	slot := &subscriptionError{}
+	responses := next(context.WithValue(ctx, subscriptionErrorKey{}, slot))
+
+	reported := false
+	return func(ctx context.Context) *graphql.Response {
+		resp := responses(ctx)
+		if resp != nil || reported {
+			return resp
+		}
+
+		reported = true
+		err := slot.get()
+		if errors.Is(err, nil) {
+			return nil
+		}
+
+		gqlErr, ok := gqlError(err).(*gqlerror.Error)
+		if !ok {
+			gqlErr = gqlerror.WrapIfUnwrapped(err)
+		}
+		return &graphql.Response{Errors: gqlerror.List{gqlErr}}
+	}
+}
@@ -0,0 +1,89 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPublishMessage_LinksDeliveryToPublisher(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	resolver := NewResolver(&mockRedisClient{hGetAllFunc: existingRoom}, broker.NewMemory(), service.RetentionPolicy{})
+	resolver.SubscribeRedis(ctx, StreamOptions{Backoff: service.DefaultBackoff()})
+
+	ch, err := (&subscriptionResolver{resolver}).MessageCreated(ctx, "general", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The stream reader picks up the room within one blocking read
+	deadline := time.Now().Add(3 * time.Second)
+	for len(resolver.subscribedRooms()) == 0 || resolver.StreamStats().Reads < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the stream reader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutationCtx, mutationSpan := otel.Tracer("test").Start(ctx, "mutation createMessage")
+	msg, err := (&mutationResolver{resolver}).CreateMessage(mutationCtx, "general", "hello", model.ContentTypePlain, nil, nil)
+	mutationSpan.End()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for the message")
+	}
+
+	var publish, deliver sdktrace.ReadOnlySpan
+	for range 100 {
+		for _, span := range recorder.Ended() {
+			switch span.Name() {
+			case "XADD room:general":
+				publish = span
+			case "deliver messageCreated":
+				deliver = span
+			}
+		}
+		if publish != nil && deliver != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if publish == nil || deliver == nil {
+		t.Fatalf("expected XADD and delivery spans, got %d spans", len(recorder.Ended()))
+	}
+
+	if publish.Parent().SpanID() != mutationSpan.SpanContext().SpanID() {
+		t.Errorf("expected XADD to be a child of the mutation span")
+	}
+	if msg.Trace.SpanID() != publish.SpanContext().SpanID() {
+		t.Errorf("expected the message to carry the XADD span context")
+	}
+	links := deliver.Links()
+	if len(links) != 1 || links[0].SpanContext.SpanID() != publish.SpanContext().SpanID() || links[0].SpanContext.TraceID() != mutationSpan.SpanContext().TraceID() {
+		t.Errorf("expected the delivery linked to the XADD span, got %+v", links)
+	}
+}
@@ -0,0 +1,221 @@
+// Package auth authenticates the callers of the GraphQL API with JSON Web
+// Tokens, signed with a shared HS256 secret or with the RS256 keys of a JWKS
+// file. The principal of a token is attached to the request context.
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrUnauthenticated is returned when a request carries no valid token
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned when the principal of a request lacks a required role
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	ID    string   // sub claim
+	Name  string   // name or preferred_username claim, the ID when missing
+	Roles []string // roles claim
+}
+
+// Options configures the tokens accepted by an Authenticator
+type Options struct {
+	Secret   string        // HS256 shared secret
+	JWKSFile string        // JSON Web Key Set holding the RS256 public keys
+	Issuer   string        // required iss claim, empty accepts any issuer
+	Audience string        // required aud claim, empty accepts any audience
+	Leeway   time.Duration // clock skew tolerated on exp, nbf and iat
+}
+
+// claims are the JWT claims read by Authenticate
+type claims struct {
+	jwt.RegisteredClaims
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Roles             []string `json:"roles"`
+}
+
+// Authenticator validates bearer tokens
+type Authenticator struct {
+	parser *jwt.Parser
+	secret []byte
+	keys   map[string]*rsa.PublicKey // by key ID
+}
+
+// New creates an Authenticator accepting HS256 tokens when opts.Secret is
+// set and RS256 tokens when opts.JWKSFile is set
+func New(opts Options) (*Authenticator, error) {
+	a := &Authenticator{}
+
+	var methods []string
+	if opts.Secret != "" {
+		a.secret = []byte(opts.Secret)
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if opts.JWKSFile != "" {
+		keys, err := loadJWKS(opts.JWKSFile)
+		if !errors.Is(err, nil) {
+			return nil, err
+		}
+		a.keys = keys
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("either a secret or a JWKS file is required")
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+	a.parser = jwt.NewParser(parserOpts...)
+
+	return a, nil
+}
+
+// Authenticate validates a token and returns its principal. The token may be
+// prefixed with "Bearer ", as in an Authorization header.
+func (a *Authenticator) Authenticate(token string) (*Principal, error) {
+	token = strings.TrimSpace(token)
+	if scheme, credentials, ok := strings.Cut(token, " "); ok {
+		if !strings.EqualFold(scheme, "Bearer") {
+			return nil, fmt.Errorf("%w: unsupported authorization scheme %q", ErrUnauthenticated, scheme)
+		}
+		token = strings.TrimSpace(credentials)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("%w: missing token", ErrUnauthenticated)
+	}
+
+	var c claims
+	if _, err := a.parser.ParseWithClaims(token, &c, a.key); !errors.Is(err, nil) {
+		return nil, fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+	if c.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+
+	p := &Principal{ID: c.Subject, Name: c.Name, Roles: c.Roles}
+	if p.Name == "" {
+		p.Name = c.PreferredUsername
+	}
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+	return p, nil
+}
+
+// key returns the key verifying a token, depending on its algorithm
+func (a *Authenticator) key(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		return a.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	// A token without key ID is accepted when there is no ambiguity
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// jwk is a JSON Web Key, only RSA keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// loadJWKS reads the RSA signing keys of a JSON Web Key Set
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to read JWKS: %w", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to parse JWKS %s: %w", path, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != jwt.SigningMethodRS256.Alg()) {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("invalid key %q in JWKS %s: %w", k.Kid, path, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no RS256 signing key", path)
+	}
+	return keys, nil
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid RSA public key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+type contextKey struct{}
+
+// WithPrincipal returns a context carrying the authenticated principal, whose
+// ID is added to the log records of the request
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	ctx = logging.With(ctx, slog.String(logging.UserKey, p.ID))
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal of a request, nil when it is anonymous
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v5"
+)
+
+const testSecret = "s3cret"
+
+// sign returns a token of claims signed with method and key, with header kid when not empty
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// validClaims returns the claims of a token valid for an hour
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":   "u-1",
+		"name":  "Alice",
+		"roles": []string{"admin"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// writeJWKS writes a JWKS holding the public key of key under kid
+func writeJWKS(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "EC", "kid": "ignored", "crv": "P-256"},
+			{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("failed to encode JWKS: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write JWKS: %v", err)
+	}
+	return path
+}
+
+func TestNew_RequiresKeys(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Error("expected an error without secret nor JWKS file")
+	}
+	if _, err := New(Options{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("expected an error for a missing JWKS file")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	a, err := New(Options{Secret: testSecret, JWKSFile: writeJWKS(t, "key-1", rsaKey), Issuer: "https://issuer.test", Audience: "chat"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims := func(modify func(jwt.MapClaims)) jwt.MapClaims {
+		c := validClaims()
+		c["iss"] = "https://issuer.test"
+		c["aud"] = "chat"
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "HS256", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(nil))},
+		{name: "bearer prefix", token: "Bearer " + sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(nil))},
+		{name: "RS256", token: sign(t, jwt.SigningMethodRS256, rsaKey, "key-1", claims(nil))},
+		{name: "RS256 without key ID", token: sign(t, jwt.SigningMethodRS256, rsaKey, "", claims(nil))},
+		{name: "empty", token: "", wantErr: true},
+		{name: "basic scheme", token: "Basic dXNlcjpwYXNz", wantErr: true},
+		{name: "wrong secret", token: sign(t, jwt.SigningMethodHS256, []byte("other"), "", claims(nil)), wantErr: true},
+		{name: "unknown key ID", token: sign(t, jwt.SigningMethodRS256, rsaKey, "key-2", claims(nil)), wantErr: true},
+		{name: "wrong RSA key", token: sign(t, jwt.SigningMethodRS256, otherKey, "key-1", claims(nil)), wantErr: true},
+		{name: "unsupported algorithm", token: sign(t, jwt.SigningMethodHS512, []byte(testSecret), "", claims(nil)), wantErr: true},
+		{name: "none algorithm", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims(nil)), wantErr: true},
+		{name: "expired", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), wantErr: true},
+		{name: "no expiry", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(func(c jwt.MapClaims) { delete(c, "exp") })), wantErr: true},
+		{name: "no subject", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(func(c jwt.MapClaims) { delete(c, "sub") })), wantErr: true},
+		{name: "wrong issuer", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.test" })), wantErr: true},
+		{name: "wrong audience", token: sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claims(func(c jwt.MapClaims) { c["aud"] = "billing" })), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Errorf("expected ErrUnauthenticated, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.ID != "u-1" || p.Name != "Alice" || len(p.Roles) != 1 || p.Roles[0] != "admin" {
+				t.Errorf("unexpected principal %+v", p)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_NameFallback(t *testing.T) {
+	a, err := New(Options{Secret: testSecret})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := validClaims()
+	delete(c, "name")
+	c["preferred_username"] = "alice"
+	if p, err := a.Authenticate(sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", c)); err != nil || p.Name != "alice" {
+		t.Errorf("expected the preferred username, got %+v (%v)", p, err)
+	}
+
+	delete(c, "preferred_username")
+	if p, err := a.Authenticate(sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", c)); err != nil || p.Name != "u-1" {
+		t.Errorf("expected the subject, got %+v (%v)", p, err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a, err := New(Options{Secret: testSecret})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token := sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", validClaims())
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+		wantUser   string
+	}{
+		{name: "valid token", header: http.Header{"Authorization": {"Bearer " + token}}, wantStatus: http.StatusOK, wantUser: "u-1"},
+		{name: "anonymous", header: http.Header{}, wantStatus: http.StatusOK},
+		{name: "invalid token", header: http.Header{"Authorization": {"Bearer nope"}}, wantStatus: http.StatusUnauthorized},
+		{name: "basic scheme", header: http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user string
+			e := echo.New()
+			e.GET("/query", func(c *echo.Context) error {
+				if p := FromContext(c.Request().Context()); p != nil {
+					user = p.ID
+				}
+				return c.NoContent(http.StatusOK)
+			}, Middleware(a))
+
+			req := httptest.NewRequest(http.MethodGet, "/query", nil)
+			req.Header = tt.header
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected a WWW-Authenticate challenge")
+			}
+			if user != tt.wantUser {
+				t.Errorf("expected user %q, got %q", tt.wantUser, user)
+			}
+		})
+	}
+}
+
+func TestInitFunc(t *testing.T) {
+	a, err := New(Options{Secret: testSecret})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	initFunc := InitFunc(a)
+	token := sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", validClaims())
+
+	ctx, _, err := initFunc(context.Background(), transport.InitPayload{"Authorization": "Bearer " + token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := FromContext(ctx); p == nil || p.ID != "u-1" {
+		t.Errorf("expected the principal of the payload, got %+v", p)
+	}
+
+	ctx, _, err = initFunc(context.Background(), transport.InitPayload{})
+	if err != nil || FromContext(ctx) != nil {
+		t.Errorf("expected an anonymous connection without token, got %+v (%v)", FromContext(ctx), err)
+	}
+	if _, _, err := initFunc(context.Background(), transport.InitPayload{"Authorization": "Bearer nope"}); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected ErrUnauthenticated for an invalid token, got %v", err)
+	}
+
+	// The upgrade request was authenticated by its header already
+	upgraded := WithPrincipal(context.Background(), &Principal{ID: "u-2"})
+	ctx, _, err = initFunc(upgraded, transport.InitPayload{})
+	if err != nil || FromContext(ctx).ID != "u-2" {
+		t.Errorf("expected the principal of the upgrade request, got %+v (%v)", FromContext(ctx), err)
+	}
+}
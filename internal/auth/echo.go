@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/labstack/echo/v5"
+)
+
+// Middleware authenticates requests with the bearer token of their
+// Authorization header. Requests without one are anonymous, the schema
+// directives deciding what they may access; WebSocket connections, whose
+// headers browsers cannot set, may authenticate later with their
+// connection_init payload, see InitFunc. An invalid token is rejected.
+func Middleware(a *Authenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			header := req.Header.Get(echo.HeaderAuthorization)
+			if header == "" {
+				return next(c)
+			}
+
+			p, err := a.Authenticate(header)
+			if !errors.Is(err, nil) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="chat", error="invalid_token"`)
+				slog.InfoContext(req.Context(), "Authentication failed", logging.Err(err))
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid bearer token")
+			}
+
+			c.SetRequest(req.WithContext(WithPrincipal(req.Context(), p)))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+)
+
+// InitFunc authenticates a WebSocket connection with the token of its
+// connection_init payload, {"Authorization": "Bearer <token>"}, unless the
+// upgrade request already carried one. A connection without token is
+// anonymous, one with an invalid token is closed before any subscription
+// starts.
+func InitFunc(a *Authenticator) transport.WebsocketInitFunc {
+	return func(ctx context.Context, payload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+		token := payload.Authorization()
+		if FromContext(ctx) != nil || token == "" {
+			return ctx, nil, nil
+		}
+
+		p, err := a.Authenticate(token)
+		if !errors.Is(err, nil) {
+			slog.InfoContext(ctx, "WebSocket authentication failed", logging.Err(err))
+			return ctx, nil, ErrUnauthenticated
+		}
+		return WithPrincipal(ctx, p), nil, nil
+	}
+}
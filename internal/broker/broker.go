@@ -0,0 +1,167 @@
+// Package broker carries room messages between publishers and subscribers.
+// Backends differ in what they keep: Redis Streams stores history, Redis Pub/Sub
+// only fans messages out, and the in-process broker keeps history in memory.
+package broker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+)
+
+// Entry is a message stored in or delivered by a broker
+type Entry struct {
+	ID     string // stream entry ID "<ms>-<seq>"
+	Values map[string]interface{}
+}
+
+// Batch holds entries of one room returned by Read
+type Batch struct {
+	RoomID  string
+	Entries []Entry
+}
+
+// Offset is the ID of the last entry of a room the reader has seen
+type Offset struct {
+	RoomID string
+	After  string
+}
+
+// Trim describes which entries a broker may drop. MaxLen and MinID may both be
+// set; Publish only applies one of them, preferring MaxLen.
+type Trim struct {
+	MaxLen int64  // keep at most this many entries, 0 for no limit
+	MinID  string // drop entries older than this ID, empty for no limit
+	Approx bool   // allow the broker to trim lazily
+}
+
+// ErrNoHistory is returned when reading the stored entries of a broker that
+// keeps none
+var ErrNoHistory = errors.New("message history is not supported by the pubsub broker")
+
+// Broker publishes, stores and delivers the messages of rooms
+type Broker interface {
+	// Publish appends an entry to a room and returns its ID
+	Publish(ctx context.Context, roomID string, values map[string]interface{}, trim Trim) (string, error)
+
+	// Append adds an entry under a given ID, which must be greater than the ID
+	// of the last entry of the room. It copies entries published to a room into
+	// another one, such as replies into the thread of their parent. Rooms
+	// appended to are not published to.
+	Append(ctx context.Context, roomID, id string, values map[string]interface{}, trim Trim) error
+
+	// Range returns up to count entries of a room between start and stop, oldest
+	// first. Bounds are entry IDs, inclusive unless prefixed with "(", or "-"
+	// and "+" for the open ends. Brokers storing nothing return ErrNoHistory.
+	Range(ctx context.Context, roomID, start, stop string, count int64) ([]Entry, error)
+
+	// RevRange is Range newest first, start being the upper bound
+	RevRange(ctx context.Context, roomID, start, stop string, count int64) ([]Entry, error)
+
+	// Read returns up to count entries per room published after the given offsets.
+	// It waits up to block for new entries (not at all when block is not
+	// positive) and returns no batches when none arrived. Redis brokers read all
+	// rooms with one command, see Slot.
+	Read(ctx context.Context, offsets []Offset, count int64, block time.Duration) ([]Batch, error)
+
+	// Trim drops old entries of a room
+	Trim(ctx context.Context, roomID string, trim Trim) error
+
+	// Delete drops all entries of a room
+	Delete(ctx context.Context, roomID string) error
+
+	// Close releases the resources held by the broker
+	Close() error
+}
+
+// KeepsHistory reports whether b stores the entries it publishes, so that
+// Range, RevRange and offsets of Read are meaningful
+func KeepsHistory(b Broker) bool {
+	_, pubsub := b.(*PubSub)
+	return !pubsub
+}
+
+var (
+	streamPrefix = constants.RedisStreamRoomPrefix // prefixes the key of every room stream
+	hashTag      bool                              // wrap the room ID in a Redis Cluster hash tag
+)
+
+// SetStreamPrefix changes the key prefix of the room streams. It must be called
+// at startup, before any broker is used.
+func SetStreamPrefix(prefix string) {
+	streamPrefix = prefix
+}
+
+// SetHashTag wraps the room ID of the stream keys in a Redis Cluster hash tag,
+// so room "general" yields "room:{general}". Every key derived from the stream
+// key of a room, its metadata, revisions and threads alike, then shares the
+// slot of the room, which lets scripts and multi-key commands span them, while
+// different rooms spread over the slots of the cluster. Readers following many
+// rooms issue one read per slot, see Slot. It must be called at startup,
+// before any broker is used.
+func SetHashTag(enabled bool) {
+	hashTag = enabled
+}
+
+// HashTags reports whether SetHashTag turned the hash tags on
+func HashTags() bool {
+	return hashTag
+}
+
+// StreamKey returns the Redis key (stream or Pub/Sub channel) of a room. With
+// hash tags, the tag is the room ID up to its first ":", so the thread
+// "general:thread:1-0" of room "general" yields "room:{general}:thread:1-0"
+// and lives in the slot of its room.
+func StreamKey(roomID string) string {
+	if !hashTag {
+		return streamPrefix + roomID
+	}
+	tag, rest, found := strings.Cut(roomID, ":")
+	if !found {
+		return streamPrefix + "{" + tag + "}"
+	}
+	return streamPrefix + "{" + tag + "}:" + rest
+}
+
+// RoomIDFromStreamKey is the inverse of StreamKey
+func RoomIDFromStreamKey(key string) string {
+	roomID := strings.TrimPrefix(key, streamPrefix)
+	if !hashTag {
+		return roomID
+	}
+	tag, rest, _ := strings.Cut(strings.TrimPrefix(roomID, "{"), "}")
+	return tag + rest
+}
+
+// Slot returns the Redis Cluster hash slot of the stream key of a room, or 0
+// for every room when hash tags are off. Commands spanning several rooms, like
+// XREAD, must only name rooms of one slot.
+func Slot(roomID string) int {
+	if !hashTag {
+		return 0
+	}
+	tag, _, _ := strings.Cut(roomID, ":")
+	return int(crc16(tag) % clusterSlots)
+}
+
+// clusterSlots is the number of hash slots of a Redis Cluster
+const clusterSlots = 16384
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum Redis Cluster hashes keys with
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,50 @@
+package broker
+
+import "testing"
+
+func TestStreamKey_HashTag(t *testing.T) {
+	defer SetStreamPrefix(streamPrefix)
+	defer SetHashTag(false)
+
+	tests := []struct {
+		prefix  string
+		hashTag bool
+		roomID  string
+		want    string
+	}{
+		{prefix: "room:", roomID: "general", want: "room:general"},
+		{prefix: "room:", hashTag: true, roomID: "general", want: "room:{general}"},
+		{prefix: "chat-", hashTag: true, roomID: "general", want: "chat-{general}"},
+		{prefix: "room:", hashTag: true, roomID: "general:thread:1-0", want: "room:{general}:thread:1-0"},
+	}
+
+	for _, tt := range tests {
+		SetStreamPrefix(tt.prefix)
+		SetHashTag(tt.hashTag)
+
+		key := StreamKey(tt.roomID)
+		if key != tt.want {
+			t.Errorf("prefix %q, hash tag %v: expected %s, got %s", tt.prefix, tt.hashTag, tt.want, key)
+		}
+		if roomID := RoomIDFromStreamKey(key); roomID != tt.roomID {
+			t.Errorf("expected room %s back from %s, got %s", tt.roomID, key, roomID)
+		}
+	}
+}
+
+func TestSlot(t *testing.T) {
+	defer SetHashTag(false)
+
+	if slot := Slot("foo"); slot != 0 {
+		t.Errorf("expected slot 0 without hash tags, got %d", slot)
+	}
+
+	SetHashTag(true)
+	// Slots as reported by CLUSTER KEYSLOT
+	tests := map[string]int{"foo": 12182, "bar": 5061, "foo:thread:1-0": 12182}
+	for roomID, want := range tests {
+		if slot := Slot(roomID); slot != want {
+			t.Errorf("room %s: expected slot %d, got %d", roomID, want, slot)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidID is returned for strings that are not stream entry IDs
+var ErrInvalidID = errors.New("invalid stream ID")
+
+// ParseID splits a stream entry ID "<ms>-<seq>" into its parts
+func ParseID(id string) (ms, seq uint64, err error) {
+	msPart, seqPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+
+	ms, err = strconv.ParseUint(msPart, 10, 64)
+	if !errors.Is(err, nil) {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+
+	seq, err = strconv.ParseUint(seqPart, 10, 64)
+	if !errors.Is(err, nil) {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+
+	return ms, seq, nil
+}
+
+// CompareIDs orders two valid stream IDs the way Redis does, returning
+// -1, 0 or +1. Invalid IDs sort before valid ones.
+func CompareIDs(a, b string) int {
+	aMs, aSeq, aErr := ParseID(a)
+	bMs, bSeq, bErr := ParseID(b)
+
+	switch {
+	case aErr != nil && bErr != nil:
+		return 0
+	case aErr != nil:
+		return -1
+	case bErr != nil:
+		return 1
+	}
+
+	if c := cmp.Compare(aMs, bMs); c != 0 {
+		return c
+	}
+	return cmp.Compare(aSeq, bSeq)
+}
+
+// idGenerator hands out increasing stream IDs the way XADD "*" does
+type idGenerator struct {
+	mutex sync.Mutex
+	ms    uint64
+	seq   uint64
+}
+
+func (g *idGenerator) next(now time.Time) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms > g.ms {
+		g.ms, g.seq = ms, 0
+	} else {
+		// Same millisecond or a clock going backwards, keep IDs increasing
+		g.seq++
+	}
+
+	return fmt.Sprintf("%d-%d", g.ms, g.seq)
+}
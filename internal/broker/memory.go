@@ -0,0 +1,28 @@
+package broker
+
+import (
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+)
+
+// Memory is a Broker keeping room history in process memory. It needs no Redis
+// and suits single instance deployments and tests; history is lost on restart.
+// It is the Streams broker over an in-memory datastore, so it stores, reads
+// and trims entries exactly like Redis Streams do.
+type Memory struct {
+	*Streams
+	client *datastore.MemoryClient
+}
+
+// NewMemory creates an in-process broker
+func NewMemory() *Memory {
+	client := datastore.NewMemoryClient()
+	return &Memory{
+		Streams: NewStreams(client),
+		client:  client,
+	}
+}
+
+// Close releases the in-memory datastore, which the broker owns
+func (m *Memory) Close() error {
+	return m.client.Close()
+}
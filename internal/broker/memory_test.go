@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// ids returns the IDs of entries
+func ids(entries []Entry) string {
+	out := make([]string, len(entries))
+	for i, entry := range entries {
+		out[i] = entry.ID
+	}
+	return fmt.Sprint(out)
+}
+
+// appendN appends n entries to a room, with the IDs 1-0 on
+func appendN(t *testing.T, b Broker, roomID string, n int) {
+	t.Helper()
+	for i := range n {
+		if err := b.Append(context.Background(), roomID, fmt.Sprintf("1-%d", i), map[string]interface{}{"message": fmt.Sprint(i)}, Trim{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestMemory_Range(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	appendN(t, m, "a", 4)
+
+	tests := []struct {
+		name        string
+		reverse     bool
+		start, stop string
+		count       int64
+		want        string
+	}{
+		{name: "all", start: "-", stop: "+", want: "[1-0 1-1 1-2 1-3]"},
+		{name: "count", start: "-", stop: "+", count: 2, want: "[1-0 1-1]"},
+		{name: "inclusive", start: "1-1", stop: "1-2", want: "[1-1 1-2]"},
+		{name: "exclusive", start: "(1-1", stop: "(1-3", want: "[1-2]"},
+		{name: "reverse", reverse: true, start: "+", stop: "-", count: 3, want: "[1-3 1-2 1-1]"},
+		{name: "reverse exclusive", reverse: true, start: "(1-3", stop: "(1-0", want: "[1-2 1-1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []Entry
+			var err error
+			if tt.reverse {
+				entries, err = m.RevRange(ctx, "a", tt.start, tt.stop, tt.count)
+			} else {
+				entries, err = m.Range(ctx, "a", tt.start, tt.stop, tt.count)
+			}
+			if !errors.Is(err, nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := ids(entries); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMemory_ReadWaitsForNewEntries(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	appendN(t, m, "a", 1)
+
+	// Entries after the offset are returned right away
+	batches, err := m.Read(ctx, []Offset{{RoomID: "a", After: "0-0"}, {RoomID: "b", After: "0-0"}}, 10, time.Second)
+	if !errors.Is(err, nil) || len(batches) != 1 || batches[0].RoomID != "a" {
+		t.Fatalf("expected one batch of room a, got %+v (%v)", batches, err)
+	}
+
+	// Nothing new times out
+	batches, err = m.Read(ctx, []Offset{{RoomID: "a", After: "1-0"}}, 10, 10*time.Millisecond)
+	if !errors.Is(err, nil) || len(batches) != 0 {
+		t.Fatalf("expected no batches, got %+v (%v)", batches, err)
+	}
+
+	// A publish wakes up a blocked reader
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		appendN(t, m, "b", 1)
+	}()
+
+	batches, err = m.Read(ctx, []Offset{{RoomID: "a", After: "1-0"}, {RoomID: "b", After: "0-0"}}, 10, time.Second)
+	if !errors.Is(err, nil) || len(batches) != 1 || batches[0].RoomID != "b" || ids(batches[0].Entries) != "[1-0]" {
+		t.Fatalf("expected the new entry of room b, got %+v (%v)", batches, err)
+	}
+}
+
+func TestMemory_Trim(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	appendN(t, m, "a", 5)
+
+	if err := m.Trim(ctx, "a", Trim{MaxLen: 3}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, _ := m.Range(ctx, "a", "-", "+", 0)
+	if got := ids(entries); got != "[1-2 1-3 1-4]" {
+		t.Errorf("expected the 3 newest entries, got %s", got)
+	}
+
+	if err := m.Trim(ctx, "a", Trim{MinID: "1-4"}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, _ = m.Range(ctx, "a", "-", "+", 0)
+	if got := ids(entries); got != "[1-4]" {
+		t.Errorf("expected entries from 1-4 on, got %s", got)
+	}
+
+	if err := m.Delete(ctx, "a"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, _ = m.Range(ctx, "a", "-", "+", 0); len(entries) != 0 {
+		t.Errorf("expected no entries after delete, got %s", ids(entries))
+	}
+}
+
+func TestMemory_Append(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	for _, id := range []string{"1-3", "2-0", "2-5"} {
+		if err := m.Append(ctx, "a", id, map[string]interface{}{}, Trim{MaxLen: 2}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	entries, _ := m.Range(ctx, "a", "-", "+", 0)
+	if got := ids(entries); got != "[2-0 2-5]" {
+		t.Errorf("expected the appended IDs trimmed to 2, got %s", got)
+	}
+
+	for _, id := range []string{"2-5", "1-9", "not-an-id"} {
+		if err := m.Append(ctx, "a", id, map[string]interface{}{}, Trim{}); err == nil {
+			t.Errorf("expected an error appending %s", id)
+		}
+	}
+}
+
+func TestMemory_PublishTrimsExactly(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+
+	for range 25 {
+		if _, err := m.Publish(ctx, "a", map[string]interface{}{}, Trim{MaxLen: 20, Approx: true}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The in-memory datastore ignores "~" and keeps the room at its limit
+	entries, _ := m.Range(ctx, "a", "-", "+", 0)
+	if len(entries) != 20 {
+		t.Errorf("expected 20 entries, got %d", len(entries))
+	}
+}
+
+func TestMemory_Close(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	if err := m.Close(); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.Publish(ctx, "a", map[string]interface{}{}, Trim{}); err == nil {
+		t.Error("expected publishing to fail once closed")
+	}
+}
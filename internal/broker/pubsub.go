@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/redis/go-redis/v9"
+)
+
+// PubSubClient is the part of the Redis client used by the Pub/Sub broker
+type PubSubClient interface {
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+	PSubscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// pubSubPayload is the JSON published on a room channel
+type pubSubPayload struct {
+	ID     string                 `json:"id"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// PubSub is a Broker fanning messages out over Redis Pub/Sub. It stores nothing:
+// Range and RevRange fail with ErrNoHistory, and Read delivers the messages
+// received since the previous Read in arrival order, ignoring offsets. Messages
+// published while no instance reads are lost. Entry IDs come from a generator
+// local to each instance, so IDs published by different instances cannot be
+// compared.
+type PubSub struct {
+	client PubSubClient
+	ids    idGenerator
+	now    func() time.Time
+
+	// subscribe starts receiving the messages of all room channels
+	subscribe func(ctx context.Context) (<-chan *redis.Message, io.Closer)
+
+	mutex    sync.Mutex
+	receiver io.Closer
+	pending  map[string][]Entry // room ID -> entries received but not read yet
+	notify   chan struct{}      // closed and replaced whenever an entry is received
+}
+
+// NewPubSub creates a Redis Pub/Sub broker
+func NewPubSub(client PubSubClient) *PubSub {
+	p := &PubSub{
+		client:  client,
+		now:     time.Now,
+		pending: map[string][]Entry{},
+		notify:  make(chan struct{}),
+	}
+	p.subscribe = func(ctx context.Context) (<-chan *redis.Message, io.Closer) {
+		sub := client.PSubscribe(ctx, StreamKey("*"))
+		return sub.Channel(), sub
+	}
+	return p
+}
+
+// Publish sends an entry to the channel of a room; trim is ignored
+func (p *PubSub) Publish(ctx context.Context, roomID string, values map[string]interface{}, trim Trim) (string, error) {
+	id := p.ids.next(p.now())
+
+	payload, err := json.Marshal(pubSubPayload{ID: id, Values: values})
+	if !errors.Is(err, nil) {
+		return "", fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	if err := p.client.Publish(ctx, StreamKey(roomID), payload).Err(); !errors.Is(err, nil) {
+		return "", fmt.Errorf("failed to publish to channel %s: %w", StreamKey(roomID), err)
+	}
+	return id, nil
+}
+
+// Append fails with ErrNoHistory, an entry copied under a given ID is only
+// useful to read back
+func (p *PubSub) Append(ctx context.Context, roomID, id string, values map[string]interface{}, trim Trim) error {
+	return ErrNoHistory
+}
+
+// Range fails with ErrNoHistory, Pub/Sub keeps no history
+func (p *PubSub) Range(ctx context.Context, roomID, start, stop string, count int64) ([]Entry, error) {
+	return nil, ErrNoHistory
+}
+
+// RevRange fails with ErrNoHistory, Pub/Sub keeps no history
+func (p *PubSub) RevRange(ctx context.Context, roomID, start, stop string, count int64) ([]Entry, error) {
+	return nil, ErrNoHistory
+}
+
+// Read returns the entries received for the given rooms since the previous
+// Read. Entries of rooms not asked for are dropped. The first Read subscribes.
+func (p *PubSub) Read(ctx context.Context, offsets []Offset, count int64, block time.Duration) ([]Batch, error) {
+	p.start()
+
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	wanted := make(map[string]struct{}, len(offsets))
+	for _, offset := range offsets {
+		wanted[offset.RoomID] = struct{}{}
+	}
+
+	for {
+		p.mutex.Lock()
+		for roomID := range p.pending {
+			if _, ok := wanted[roomID]; !ok {
+				delete(p.pending, roomID)
+			}
+		}
+
+		var batches []Batch
+		for _, offset := range offsets {
+			entries := p.pending[offset.RoomID]
+			if len(entries) == 0 {
+				continue
+			}
+			if count > 0 && int64(len(entries)) > count {
+				p.pending[offset.RoomID] = entries[count:]
+				entries = entries[:count]
+			} else {
+				delete(p.pending, offset.RoomID)
+			}
+			batches = append(batches, Batch{RoomID: offset.RoomID, Entries: entries})
+		}
+		notify := p.notify
+		p.mutex.Unlock()
+
+		if len(batches) > 0 || timeout == nil {
+			return batches, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, nil
+		case <-notify:
+		}
+	}
+}
+
+// start subscribes to the room channels unless already subscribed
+func (p *PubSub) start() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.receiver != nil {
+		return
+	}
+
+	messages, receiver := p.subscribe(context.Background())
+	p.receiver = receiver
+	go p.receive(messages)
+}
+
+// receive buffers incoming messages until they are read
+func (p *PubSub) receive(messages <-chan *redis.Message) {
+	for msg := range messages {
+		var payload pubSubPayload
+		if err := json.Unmarshal([]byte(msg.Payload), &payload); !errors.Is(err, nil) {
+			slog.Warn("Skipping invalid message", slog.String("channel", msg.Channel), logging.Err(err))
+			continue
+		}
+
+		roomID := RoomIDFromStreamKey(msg.Channel)
+
+		p.mutex.Lock()
+		entries := append(p.pending[roomID], Entry{ID: payload.ID, Values: payload.Values})
+		if len(entries) > constants.PubSubPendingLimit {
+			slog.Warn("Dropping unread messages", slog.String(logging.RoomKey, roomID), slog.Int("dropped", len(entries)-constants.PubSubPendingLimit))
+			entries = entries[len(entries)-constants.PubSubPendingLimit:]
+		}
+		p.pending[roomID] = entries
+		close(p.notify)
+		p.notify = make(chan struct{})
+		p.mutex.Unlock()
+	}
+}
+
+// Trim is a no-op, Pub/Sub keeps no history
+func (p *PubSub) Trim(ctx context.Context, roomID string, trim Trim) error {
+	return nil
+}
+
+// Delete is a no-op, Pub/Sub keeps no history
+func (p *PubSub) Delete(ctx context.Context, roomID string) error {
+	return nil
+}
+
+// Close ends the subscription
+func (p *PubSub) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.receiver == nil {
+		return nil
+	}
+	err := p.receiver.Close()
+	p.receiver = nil
+	return err
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// mockPubSubClient loops published messages back to the subscription channel
+type mockPubSubClient struct {
+	messages chan *redis.Message
+}
+
+func (m *mockPubSubClient) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	m.messages <- &redis.Message{Channel: channel, Payload: string(message.([]byte))}
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockPubSubClient) PSubscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return nil
+}
+
+func (m *mockPubSubClient) Close() error {
+	close(m.messages)
+	return nil
+}
+
+func newTestPubSub() *PubSub {
+	client := &mockPubSubClient{messages: make(chan *redis.Message, 10)}
+	p := NewPubSub(client)
+	p.subscribe = func(ctx context.Context) (<-chan *redis.Message, io.Closer) {
+		return client.messages, client
+	}
+	return p
+}
+
+func TestPubSub_DeliversPublishedMessages(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPubSub()
+	defer p.Close()
+
+	offsets := []Offset{{RoomID: "a", After: "0-0"}}
+
+	// The first read subscribes, nothing was received yet
+	if batches, err := p.Read(ctx, offsets, 10, 0); !errors.Is(err, nil) || len(batches) != 0 {
+		t.Fatalf("expected no batches, got %+v (%v)", batches, err)
+	}
+
+	id, err := p.Publish(ctx, "a", map[string]interface{}{"message": "hello"}, Trim{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := p.Publish(ctx, "b", map[string]interface{}{"message": "elsewhere"}, Trim{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batches, err := p.Read(ctx, offsets, 10, time.Second)
+	if !errors.Is(err, nil) || len(batches) != 1 || len(batches[0].Entries) != 1 {
+		t.Fatalf("expected one entry, got %+v (%v)", batches, err)
+	}
+
+	entry := batches[0].Entries[0]
+	if batches[0].RoomID != "a" || entry.ID != id || entry.Values["message"] != "hello" {
+		t.Errorf("unexpected entry %+v in room %s", entry, batches[0].RoomID)
+	}
+
+	// Entries are delivered once
+	if batches, _ := p.Read(ctx, offsets, 10, 10*time.Millisecond); len(batches) != 0 {
+		t.Errorf("expected no more batches, got %+v", batches)
+	}
+}
+
+func TestPubSub_KeepsNoHistory(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPubSub()
+	defer p.Close()
+
+	if _, err := p.Publish(ctx, "a", map[string]interface{}{"message": "hello"}, Trim{MaxLen: 1}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, err := p.Range(ctx, "a", "-", "+", 10)
+	if !errors.Is(err, ErrNoHistory) || len(entries) != 0 {
+		t.Errorf("expected ErrNoHistory, got %+v (%v)", entries, err)
+	}
+	if KeepsHistory(p) {
+		t.Error("expected the pubsub broker to keep no history")
+	}
+}
@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+// Streams is a Broker storing every room in a Redis stream
+type Streams struct {
+	redis datastore.RedisClient
+}
+
+// NewStreams creates a Redis Streams broker
+func NewStreams(redis datastore.RedisClient) *Streams {
+	return &Streams{
+		redis: redis,
+	}
+}
+
+// Publish appends an entry with XADD, trimming the stream in the same command
+func (s *Streams) Publish(ctx context.Context, roomID string, values map[string]interface{}, trim Trim) (string, error) {
+	args := xAddArgs(roomID, "*", values, trim)
+	id, err := s.redis.XAdd(ctx, args).Result()
+	if !errors.Is(err, nil) {
+		return "", fmt.Errorf("failed to add to stream %s: %w", args.Stream, err)
+	}
+	return id, nil
+}
+
+// Append adds an entry under id with XADD, trimming the stream in the same command
+func (s *Streams) Append(ctx context.Context, roomID, id string, values map[string]interface{}, trim Trim) error {
+	args := xAddArgs(roomID, id, values, trim)
+	if err := s.redis.XAdd(ctx, args).Err(); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to add to stream %s: %w", args.Stream, err)
+	}
+	return nil
+}
+
+// xAddArgs returns the XADD of an entry of a room, applying one trim limit
+func xAddArgs(roomID, id string, values map[string]interface{}, trim Trim) *redis.XAddArgs {
+	args := &redis.XAddArgs{
+		Stream: StreamKey(roomID),
+		ID:     id,
+		Values: values,
+		Approx: trim.Approx,
+	}
+	switch {
+	case trim.MaxLen > 0:
+		args.MaxLen = trim.MaxLen
+	case trim.MinID != "":
+		args.MinID = trim.MinID
+	}
+	return args
+}
+
+// Range reads entries with XRANGE
+func (s *Streams) Range(ctx context.Context, roomID, start, stop string, count int64) ([]Entry, error) {
+	messages, err := s.redis.XRangeN(ctx, StreamKey(roomID), start, stop, count).Result()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to read stream %s: %w", StreamKey(roomID), err)
+	}
+	return toEntries(messages), nil
+}
+
+// RevRange reads entries with XREVRANGE
+func (s *Streams) RevRange(ctx context.Context, roomID, start, stop string, count int64) ([]Entry, error) {
+	messages, err := s.redis.XRevRangeN(ctx, StreamKey(roomID), start, stop, count).Result()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to read stream %s: %w", StreamKey(roomID), err)
+	}
+	return toEntries(messages), nil
+}
+
+// Read waits for new entries of all rooms with a single XREAD, so with hash
+// tags on the rooms must share a slot, see Slot
+func (s *Streams) Read(ctx context.Context, offsets []Offset, count int64, block time.Duration) ([]Batch, error) {
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(offsets)*2)
+	for _, offset := range offsets {
+		keys = append(keys, StreamKey(offset.RoomID))
+	}
+	for _, offset := range offsets {
+		keys = append(keys, offset.After)
+	}
+
+	if block <= 0 {
+		block = -1 // no BLOCK argument, return immediately
+	}
+
+	streams, err := s.redis.XRead(ctx, &redis.XReadArgs{
+		Streams: keys,
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if !errors.Is(err, nil) {
+		// Block timed out without new entries
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read streams: %w", err)
+	}
+
+	batches := make([]Batch, len(streams))
+	for i, stream := range streams {
+		batches[i] = Batch{
+			RoomID:  RoomIDFromStreamKey(stream.Stream),
+			Entries: toEntries(stream.Messages),
+		}
+	}
+	return batches, nil
+}
+
+// Trim applies XTRIM by length and by minimum ID
+func (s *Streams) Trim(ctx context.Context, roomID string, trim Trim) error {
+	key := StreamKey(roomID)
+
+	if trim.MaxLen > 0 {
+		var err error
+		if trim.Approx {
+			err = s.redis.XTrimMaxLenApprox(ctx, key, trim.MaxLen, 0).Err()
+		} else {
+			err = s.redis.XTrimMaxLen(ctx, key, trim.MaxLen).Err()
+		}
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("failed to trim stream %s by length: %w", key, err)
+		}
+	}
+
+	if trim.MinID != "" {
+		var err error
+		if trim.Approx {
+			err = s.redis.XTrimMinIDApprox(ctx, key, trim.MinID, 0).Err()
+		} else {
+			err = s.redis.XTrimMinID(ctx, key, trim.MinID).Err()
+		}
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("failed to trim stream %s by age: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the stream of a room
+func (s *Streams) Delete(ctx context.Context, roomID string) error {
+	if err := s.redis.Del(ctx, StreamKey(roomID)).Err(); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to delete stream %s: %w", StreamKey(roomID), err)
+	}
+	return nil
+}
+
+// Close is a no-op, the Redis client is owned by the caller
+func (s *Streams) Close() error {
+	return nil
+}
+
+func toEntries(messages []redis.XMessage) []Entry {
+	entries := make([]Entry, len(messages))
+	for i, msg := range messages {
+		entries[i] = Entry{ID: msg.ID, Values: msg.Values}
+	}
+	return entries
+}
@@ -0,0 +1,324 @@
+// Package config loads the runtime configuration of the server from defaults,
+// an optional YAML or TOML file, environment variables and command-line flags.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values when the configuration is printed
+const redacted = "[redacted]"
+
+// Config is the runtime configuration of the server
+type Config struct {
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Datastore string          `yaml:"datastore" toml:"datastore"`
+	Redis     RedisConfig     `yaml:"redis" toml:"redis"`
+	Broker    string          `yaml:"broker" toml:"broker"`
+	Streams   StreamsConfig   `yaml:"streams" toml:"streams"`
+	Retention RetentionConfig `yaml:"retention" toml:"retention"`
+	Reader    ReaderConfig    `yaml:"reader" toml:"reader"`
+	WebSocket WebSocketConfig `yaml:"websocket" toml:"websocket"`
+	Cache     CacheConfig     `yaml:"cache" toml:"cache"`
+	Auth      AuthConfig      `yaml:"auth" toml:"auth"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+}
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	Addr            string        `yaml:"addr" toml:"addr"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout" toml:"shutdown-timeout"`
+}
+
+// RedisConfig configures the Redis connection
+type RedisConfig struct {
+	Mode         string              `yaml:"mode" toml:"mode"` // single, sentinel or cluster
+	URL          string              `yaml:"url" toml:"url"`   // secret when it holds a password
+	Sentinel     RedisSentinelConfig `yaml:"sentinel" toml:"sentinel"`
+	Cluster      RedisClusterConfig  `yaml:"cluster" toml:"cluster"`
+	Username     string              `yaml:"username" toml:"username"`
+	Password     string              `yaml:"password" toml:"password"` // secret
+	DB           int                 `yaml:"db" toml:"db"`
+	TLS          RedisTLSConfig      `yaml:"tls" toml:"tls"`
+	DialTimeout  time.Duration       `yaml:"dial-timeout" toml:"dial-timeout"`
+	ReadTimeout  time.Duration       `yaml:"read-timeout" toml:"read-timeout"`
+	WriteTimeout time.Duration       `yaml:"write-timeout" toml:"write-timeout"`
+	PoolSize     int                 `yaml:"pool-size" toml:"pool-size"`
+	MinIdleConns int                 `yaml:"min-idle-conns" toml:"min-idle-conns"`
+}
+
+// RedisSentinelConfig locates the primary through Redis Sentinel
+type RedisSentinelConfig struct {
+	MasterName string   `yaml:"master-name" toml:"master-name"`
+	Addrs      []string `yaml:"addrs" toml:"addrs"`
+	Username   string   `yaml:"username" toml:"username"`
+	Password   string   `yaml:"password" toml:"password"` // secret
+}
+
+// RedisClusterConfig lists the seed nodes of a Redis Cluster
+type RedisClusterConfig struct {
+	Addrs []string `yaml:"addrs" toml:"addrs"`
+}
+
+// RedisTLSConfig configures TLS for the Redis connection
+type RedisTLSConfig struct {
+	Enabled            bool   `yaml:"enabled" toml:"enabled"`
+	CAFile             string `yaml:"ca-file" toml:"ca-file"`
+	CertFile           string `yaml:"cert-file" toml:"cert-file"`
+	KeyFile            string `yaml:"key-file" toml:"key-file"`
+	ServerName         string `yaml:"server-name" toml:"server-name"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify" toml:"insecure-skip-verify"`
+}
+
+// StreamsConfig configures the naming of the room streams
+type StreamsConfig struct {
+	Prefix  string `yaml:"prefix" toml:"prefix"`
+	HashTag bool   `yaml:"hash-tag" toml:"hash-tag"` // always on with a Redis Cluster
+}
+
+// RetentionConfig is the default retention of room streams
+type RetentionConfig struct {
+	MaxLen       int64         `yaml:"max-len" toml:"max-len"`
+	Approx       bool          `yaml:"approx" toml:"approx"`
+	MaxAge       time.Duration `yaml:"max-age" toml:"max-age"`
+	TrimInterval time.Duration `yaml:"trim-interval" toml:"trim-interval"`
+}
+
+// ReaderConfig configures the background stream reader
+type ReaderConfig struct {
+	BackoffInitial    time.Duration `yaml:"backoff-initial" toml:"backoff-initial"`
+	BackoffMax        time.Duration `yaml:"backoff-max" toml:"backoff-max"`
+	BackoffMultiplier float64       `yaml:"backoff-multiplier" toml:"backoff-multiplier"`
+	BackoffJitter     float64       `yaml:"backoff-jitter" toml:"backoff-jitter"`
+	MaxAttempts       int           `yaml:"max-attempts" toml:"max-attempts"`
+	NotifyAfter       time.Duration `yaml:"notify-after" toml:"notify-after"`
+	Group             string        `yaml:"group" toml:"group"`
+	ClaimIdle         time.Duration `yaml:"claim-idle" toml:"claim-idle"`
+	ClaimInterval     time.Duration `yaml:"claim-interval" toml:"claim-interval"`
+}
+
+// WebSocketConfig configures the subscription transport
+type WebSocketConfig struct {
+	ReadBufferSize  int           `yaml:"read-buffer-size" toml:"read-buffer-size"`
+	WriteBufferSize int           `yaml:"write-buffer-size" toml:"write-buffer-size"`
+	KeepAlivePing   time.Duration `yaml:"keep-alive-ping" toml:"keep-alive-ping"`
+}
+
+// CacheConfig sizes the GraphQL caches
+type CacheConfig struct {
+	QuerySize int `yaml:"query-size" toml:"query-size"`
+	APQSize   int `yaml:"apq-size" toml:"apq-size"`
+}
+
+// AuthConfig configures the JWT authentication of the API, which is enabled
+// by setting a secret or a JWKS file
+type AuthConfig struct {
+	Secret   string        `yaml:"secret" toml:"secret"`       // HS256 shared secret, secret
+	JWKSFile string        `yaml:"jwks-file" toml:"jwks-file"` // RS256 public keys
+	Issuer   string        `yaml:"issuer" toml:"issuer"`
+	Audience string        `yaml:"audience" toml:"audience"`
+	Leeway   time.Duration `yaml:"leeway" toml:"leeway"`
+}
+
+// Enabled reports whether requests must be authenticated
+func (c AuthConfig) Enabled() bool {
+	return c.Secret != "" || c.JWKSFile != ""
+}
+
+// LogConfig configures the structured logger
+type LogConfig struct {
+	Level   string `yaml:"level" toml:"level"`     // debug, info, warn or error
+	Format  string `yaml:"format" toml:"format"`   // text or json
+	Content bool   `yaml:"content" toml:"content"` // log message bodies
+}
+
+// TracingConfig configures the export of OpenTelemetry traces
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"` // none, stdout or otlp
+	Protocol    string  `yaml:"protocol" toml:"protocol"` // OTLP transport: grpc or http
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"` // OTLP collector host:port, empty uses OTEL_EXPORTER_OTLP_ENDPOINT
+	Insecure    bool    `yaml:"insecure" toml:"insecure"`
+	ServiceName string  `yaml:"service-name" toml:"service-name"`
+	SampleRatio float64 `yaml:"sample-ratio" toml:"sample-ratio"`
+}
+
+// Default returns the configuration used when nothing overrides it
+func Default() *Config {
+	return &Config{
+		Server:    ServerConfig{Addr: constants.ServerPort, ShutdownTimeout: constants.ShutdownTimeout},
+		Datastore: constants.Datastore,
+		Redis:     RedisConfig{Mode: constants.RedisMode, URL: constants.RedisURL},
+		Broker:    constants.MessageBroker,
+		Streams:   StreamsConfig{Prefix: constants.RedisStreamRoomPrefix},
+		Retention: RetentionConfig{
+			MaxLen:       constants.RedisStreamMaxLen,
+			Approx:       constants.RedisStreamMaxLenApprox,
+			MaxAge:       constants.RedisStreamMaxAge,
+			TrimInterval: constants.RetentionTrimInterval,
+		},
+		Reader: ReaderConfig{
+			BackoffInitial:    constants.StreamReaderBackoffInitial,
+			BackoffMax:        constants.StreamReaderBackoffMax,
+			BackoffMultiplier: constants.StreamReaderBackoffMultiplier,
+			BackoffJitter:     constants.StreamReaderBackoffJitter,
+			MaxAttempts:       constants.StreamReaderMaxAttempts,
+			NotifyAfter:       constants.StreamReaderNotifyAfter,
+			Group:             constants.RedisConsumerGroup,
+			ClaimIdle:         constants.RedisConsumerClaimIdle,
+			ClaimInterval:     constants.RedisConsumerClaimInterval,
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:  constants.WebSocketReadBufferSize,
+			WriteBufferSize: constants.WebSocketWriteBufferSize,
+			KeepAlivePing:   constants.WebSocketKeepAlivePing,
+		},
+		Cache: CacheConfig{
+			QuerySize: constants.QueryCacheSize,
+			APQSize:   constants.APQCacheSize,
+		},
+		Auth: AuthConfig{
+			Leeway: constants.AuthLeeway,
+		},
+		Log: LogConfig{
+			Level:   constants.LogLevel,
+			Format:  constants.LogFormat,
+			Content: constants.LogContent,
+		},
+		Tracing: TracingConfig{
+			Exporter:    constants.TracingExporter,
+			Protocol:    constants.TracingProtocol,
+			ServiceName: constants.TracingServiceName,
+			SampleRatio: constants.TracingSampleRatio,
+		},
+	}
+}
+
+// Validate checks the configuration and reports every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must not be empty")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown-timeout must be positive")
+
+	check(c.Datastore == "redis" || c.Datastore == "memory", "datastore must be redis or memory, got %q", c.Datastore)
+	check(c.Redis.Mode == "single" || c.Redis.Mode == "sentinel" || c.Redis.Mode == "cluster", "redis.mode must be single, sentinel or cluster, got %q", c.Redis.Mode)
+	if c.Datastore == "redis" {
+		switch c.Redis.Mode {
+		case "single":
+			check(c.Redis.URL != "", "redis.url must not be empty with the redis datastore")
+		case "sentinel":
+			check(c.Redis.Sentinel.MasterName != "", "redis.sentinel.master-name must not be empty in sentinel mode")
+			check(len(c.Redis.Sentinel.Addrs) > 0, "redis.sentinel.addrs must not be empty in sentinel mode")
+		case "cluster":
+			check(len(c.Redis.Cluster.Addrs) > 0, "redis.cluster.addrs must not be empty in cluster mode")
+		}
+	}
+	if scheme, _, ok := strings.Cut(c.Redis.URL, "://"); ok {
+		check(scheme == "redis" || scheme == "rediss", "redis.url must use the redis:// or rediss:// scheme, got %s://", scheme)
+	}
+	check(c.Redis.DB >= 0, "redis.db must not be negative")
+	check(c.Redis.DB == 0 || c.Redis.Mode != "cluster", "redis.db is not supported in cluster mode")
+	check((c.Redis.TLS.CertFile == "") == (c.Redis.TLS.KeyFile == ""), "redis.tls.cert-file and redis.tls.key-file must be set together")
+	check(c.Redis.DialTimeout >= 0, "redis.dial-timeout must not be negative")
+	check(c.Redis.PoolSize >= 0, "redis.pool-size must not be negative")
+	check(c.Redis.MinIdleConns >= 0, "redis.min-idle-conns must not be negative")
+
+	check(c.Broker == "streams" || c.Broker == "pubsub" || c.Broker == "memory", "broker must be streams, pubsub or memory, got %q", c.Broker)
+	check(c.Broker != "pubsub" || c.Datastore == "redis", "the pubsub broker requires the redis datastore")
+	check(c.Reader.Group == "" || c.Broker == "streams", "reader.group requires the streams broker")
+	check(c.Reader.Group == "" || c.Datastore == "redis", "reader.group requires the redis datastore")
+
+	check(c.Streams.Prefix != "", "streams.prefix must not be empty")
+
+	check(c.Retention.MaxLen >= 0, "retention.max-len must not be negative")
+	check(c.Retention.MaxAge >= 0, "retention.max-age must not be negative")
+	check(c.Retention.MaxAge%time.Second == 0, "retention.max-age must be a whole number of seconds")
+	check(c.Retention.TrimInterval > 0, "retention.trim-interval must be positive")
+
+	check(c.Reader.BackoffInitial > 0, "reader.backoff-initial must be positive")
+	check(c.Reader.BackoffMax >= c.Reader.BackoffInitial, "reader.backoff-max must not be less than reader.backoff-initial")
+	check(c.Reader.BackoffMultiplier >= 1, "reader.backoff-multiplier must be at least 1")
+	check(c.Reader.BackoffJitter >= 0 && c.Reader.BackoffJitter <= 1, "reader.backoff-jitter must be between 0 and 1")
+	check(c.Reader.MaxAttempts >= 0, "reader.max-attempts must not be negative")
+	check(c.Reader.NotifyAfter >= 0, "reader.notify-after must not be negative")
+	check(c.Reader.Group == "" || c.Reader.ClaimIdle > 0, "reader.claim-idle must be positive with a consumer group")
+	check(c.Reader.Group == "" || c.Reader.ClaimInterval > 0, "reader.claim-interval must be positive with a consumer group")
+
+	check(c.WebSocket.ReadBufferSize > 0, "websocket.read-buffer-size must be positive")
+	check(c.WebSocket.WriteBufferSize > 0, "websocket.write-buffer-size must be positive")
+	check(c.WebSocket.KeepAlivePing >= 0, "websocket.keep-alive-ping must not be negative")
+
+	check(c.Cache.QuerySize > 0, "cache.query-size must be positive")
+	check(c.Cache.APQSize > 0, "cache.apq-size must be positive")
+
+	check(c.Auth.Leeway >= 0, "auth.leeway must not be negative")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json, got %q", c.Log.Format)
+
+	check(c.Tracing.Exporter == "none" || c.Tracing.Exporter == "stdout" || c.Tracing.Exporter == "otlp", "tracing.exporter must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	check(c.Tracing.Protocol == "grpc" || c.Tracing.Protocol == "http", "tracing.protocol must be grpc or http, got %q", c.Tracing.Protocol)
+	check(c.Tracing.ServiceName != "", "tracing.service-name must not be empty")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample-ratio must be between 0 and 1")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets replaced
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Redis.URL = datastore.RedactURL(r.Redis.URL)
+	if r.Redis.Password != "" {
+		r.Redis.Password = redacted
+	}
+	if r.Redis.Sentinel.Password != "" {
+		r.Redis.Sentinel.Password = redacted
+	}
+	if r.Auth.Secret != "" {
+		r.Auth.Secret = redacted
+	}
+	return &r
+}
+
+// LogValue logs the configuration the way Print prints it, keyed like the
+// config file with secrets redacted
+func (c *Config) LogValue() slog.Value {
+	data, err := yaml.Marshal(c.Redacted())
+	if !errors.Is(err, nil) {
+		return slog.StringValue(err.Error())
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); !errors.Is(err, nil) {
+		return slog.StringValue(err.Error())
+	}
+	return slog.AnyValue(values)
+}
+
+// Print writes the configuration as YAML with secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to print configuration: %w", err)
+	}
+	return enc.Close()
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variable of every setting: the flag
+// -reader.backoff-max is read from CHAT_READER_BACKOFF_MAX
+const EnvPrefix = "CHAT_"
+
+// configFlag names the flag and, with EnvPrefix, the environment variable of the config file
+const configFlag = "config"
+
+// field is a setting exposed as a flag and an environment variable
+type field struct {
+	name  string
+	usage string
+	ptr   interface{}
+}
+
+// fields lists every setting of c; names match the keys of the config file
+func fields(c *Config) []field {
+	return []field{
+		{"server.addr", "HTTP listen address", &c.Server.Addr},
+		{"server.shutdown-timeout", "how long a shutdown waits for requests and subscriptions to finish", &c.Server.ShutdownTimeout},
+		{"datastore", "datastore: redis or memory (in-process, data is lost on exit)", &c.Datastore},
+		{"redis.mode", "Redis deployment: single, sentinel or cluster (all rooms in one hash slot, no sharding)", &c.Redis.Mode},
+		{"redis.url", "Redis address as host:port or a redis:// or rediss:// (TLS) URL in single mode", &c.Redis.URL},
+		{"redis.sentinel.master-name", "name of the primary monitored by Sentinel", &c.Redis.Sentinel.MasterName},
+		{"redis.sentinel.addrs", "comma-separated host:port of the Sentinels", &c.Redis.Sentinel.Addrs},
+		{"redis.sentinel.username", "ACL user of the Sentinels", &c.Redis.Sentinel.Username},
+		{"redis.sentinel.password", "password of the Sentinels", &c.Redis.Sentinel.Password},
+		{"redis.cluster.addrs", "comma-separated host:port of some Redis Cluster nodes", &c.Redis.Cluster.Addrs},
+		{"redis.username", "Redis ACL user, overrides the one of the URL", &c.Redis.Username},
+		{"redis.password", "Redis password, overrides the one of the URL", &c.Redis.Password},
+		{"redis.db", "Redis database number, 0 keeps the one of the URL", &c.Redis.DB},
+		{"redis.tls.enabled", "connect to Redis with TLS, implied by rediss://", &c.Redis.TLS.Enabled},
+		{"redis.tls.ca-file", "PEM CA bundle verifying the Redis server, empty uses the system pool", &c.Redis.TLS.CAFile},
+		{"redis.tls.cert-file", "PEM client certificate for Redis", &c.Redis.TLS.CertFile},
+		{"redis.tls.key-file", "PEM key of the Redis client certificate", &c.Redis.TLS.KeyFile},
+		{"redis.tls.server-name", "host name checked against the Redis server certificate", &c.Redis.TLS.ServerName},
+		{"redis.tls.insecure-skip-verify", "skip verifying the Redis server certificate", &c.Redis.TLS.InsecureSkipVerify},
+		{"redis.dial-timeout", "Redis dial timeout, 0 uses the client default", &c.Redis.DialTimeout},
+		{"redis.read-timeout", "Redis read timeout, 0 uses the client default", &c.Redis.ReadTimeout},
+		{"redis.write-timeout", "Redis write timeout, 0 uses the client default", &c.Redis.WriteTimeout},
+		{"redis.pool-size", "maximum Redis connections, 0 uses the client default", &c.Redis.PoolSize},
+		{"redis.min-idle-conns", "idle Redis connections kept open", &c.Redis.MinIdleConns},
+		{"broker", "message broker: streams, pubsub (no history, edits, reactions or threads) or memory", &c.Broker},
+		{"streams.prefix", "key prefix of the room streams", &c.Streams.Prefix},
+		{"streams.hash-tag", "wrap the room IDs of the stream keys in Redis Cluster hash tags, keeping the keys of a room in its own slot; always on in cluster mode", &c.Streams.HashTag},
+		{"retention.max-len", "default maximum number of entries per room stream, edit, deletion and reaction events included, 0 for unlimited", &c.Retention.MaxLen},
+		{"retention.approx", "trim room streams approximately, which is much cheaper for Redis", &c.Retention.Approx},
+		{"retention.max-age", "default maximum message age in whole seconds, 0 for unlimited", &c.Retention.MaxAge},
+		{"retention.trim-interval", "how often room streams are trimmed and the state of trimmed messages is pruned", &c.Retention.TrimInterval},
+		{"reader.backoff-initial", "first reconnect delay of the stream reader", &c.Reader.BackoffInitial},
+		{"reader.backoff-max", "maximum reconnect delay of the stream reader", &c.Reader.BackoffMax},
+		{"reader.backoff-multiplier", "growth factor of the reconnect delay", &c.Reader.BackoffMultiplier},
+		{"reader.backoff-jitter", "fraction of each reconnect delay randomly added or removed, 0..1", &c.Reader.BackoffJitter},
+		{"reader.max-attempts", "reconnect attempts before the stream reader gives up, 0 for unlimited", &c.Reader.MaxAttempts},
+		{"reader.notify-after", "end subscriptions with an error once the reader is down this long, 0 never does", &c.Reader.NotifyAfter},
+		{"reader.group", "consumer group shared by the instances of a deployment, empty reads with plain XREAD", &c.Reader.Group},
+		{"reader.claim-idle", "claim entries left pending by another instance, such as a dead one, for this long", &c.Reader.ClaimIdle},
+		{"reader.claim-interval", "how often pending entries are claimed and missed announcements made up for", &c.Reader.ClaimInterval},
+		{"websocket.read-buffer-size", "WebSocket read buffer size in bytes", &c.WebSocket.ReadBufferSize},
+		{"websocket.write-buffer-size", "WebSocket write buffer size in bytes", &c.WebSocket.WriteBufferSize},
+		{"websocket.keep-alive-ping", "WebSocket keep-alive ping interval, 0 disables it", &c.WebSocket.KeepAlivePing},
+		{"cache.query-size", "number of parsed queries cached", &c.Cache.QuerySize},
+		{"cache.apq-size", "number of automatic persisted queries cached", &c.Cache.APQSize},
+		{"auth.secret", "HS256 secret of the bearer tokens, setting it or auth.jwks-file requires authentication", &c.Auth.Secret},
+		{"auth.jwks-file", "JSON Web Key Set file with the RS256 public keys of the bearer tokens", &c.Auth.JWKSFile},
+		{"auth.issuer", "required iss claim of the bearer tokens, empty accepts any", &c.Auth.Issuer},
+		{"auth.audience", "required aud claim of the bearer tokens, empty accepts any", &c.Auth.Audience},
+		{"auth.leeway", "clock skew tolerated when checking token expiry", &c.Auth.Leeway},
+		{"log.level", "log level: debug, info, warn or error", &c.Log.Level},
+		{"log.format", "log format: text or json", &c.Log.Format},
+		{"log.content", "log message bodies, which are user data", &c.Log.Content},
+		{"tracing.exporter", "trace exporter: none, stdout (local debugging) or otlp", &c.Tracing.Exporter},
+		{"tracing.protocol", "OTLP transport: grpc or http", &c.Tracing.Protocol},
+		{"tracing.endpoint", "OTLP collector host:port, empty uses OTEL_EXPORTER_OTLP_ENDPOINT or the exporter default", &c.Tracing.Endpoint},
+		{"tracing.insecure", "send traces to the OTLP collector without TLS", &c.Tracing.Insecure},
+		{"tracing.service-name", "service name reported in traces", &c.Tracing.ServiceName},
+		{"tracing.sample-ratio", "fraction of new traces recorded, 0..1", &c.Tracing.SampleRatio},
+	}
+}
+
+// stringList is a flag.Value of comma-separated strings
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// EnvName returns the environment variable of a setting
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the config file given by -config or CHAT_CONFIG, the environment and
+// the command-line flags, and validates it. The settings are registered on fs
+// along with -config, so the caller can add flags of its own; a -help request
+// returns flag.ErrHelp.
+func Load(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	path := configPath(args, getenv)
+	if path != "" {
+		if err := c.loadFile(path); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	// Flags are registered with the values loaded so far, so -help shows them
+	fs.String(configFlag, path, fmt.Sprintf("YAML or TOML config file (env %s)", EnvName(configFlag)))
+	for _, f := range fields(c) {
+		usage := fmt.Sprintf("%s (env %s)", f.usage, EnvName(f.name))
+		switch p := f.ptr.(type) {
+		case *string:
+			fs.StringVar(p, f.name, *p, usage)
+		case *bool:
+			fs.BoolVar(p, f.name, *p, usage)
+		case *int:
+			fs.IntVar(p, f.name, *p, usage)
+		case *int64:
+			fs.Int64Var(p, f.name, *p, usage)
+		case *float64:
+			fs.Float64Var(p, f.name, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, f.name, *p, usage)
+		case *[]string:
+			fs.Var((*stringList)(p), f.name, usage)
+		default:
+			panic(fmt.Sprintf("config: unsupported type %T of %s", f.ptr, f.name))
+		}
+	}
+
+	for _, f := range fields(c) {
+		value := getenv(EnvName(f.name))
+		if value == "" {
+			continue
+		}
+		if err := fs.Lookup(f.name).Value.Set(value); !errors.Is(err, nil) {
+			return nil, fmt.Errorf("invalid value %q for %s: %w", value, EnvName(f.name), err)
+		}
+	}
+
+	if err := fs.Parse(args); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := c.Validate(); !errors.Is(err, nil) {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configPath finds the config file in the arguments or the environment before
+// the flags are parsed, since the file provides their defaults
+func configPath(args []string, getenv func(string) string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if value, ok := strings.CutPrefix(name, configFlag+"="); ok {
+			return value
+		}
+		if name == configFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return getenv(EnvName(configFlag))
+}
+
+// loadFile overrides the configuration with a YAML or TOML file, chosen by its
+// extension. Unknown keys are rejected so typos do not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		// An empty file decodes to io.EOF and keeps the defaults
+		if err := dec.Decode(c); !errors.Is(err, nil) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("failed to parse config file %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q, use .yaml, .yml or .toml", ext)
+	}
+
+	return nil
+}
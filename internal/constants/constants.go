@@ -3,13 +3,94 @@ package constants
 import "time"
 
 const (
+	// Datastore: "redis" or "memory" (in-process, data is lost on exit)
+	Datastore = "redis"
+	RedisMode = "single"         // single, sentinel or cluster
+	RedisURL  = "localhost:6379" // host:port or a redis:// or rediss:// URL of a single node
+
+	// Message broker: "streams" (Redis Streams), "pubsub" (Redis Pub/Sub, no history) or "memory" (in-process)
+	MessageBroker      = "streams"
+	PubSubPendingLimit = 1000 // messages buffered per room between two reads of the Pub/Sub broker
+
 	// Redis Stream configuration
-	RedisStreamRoom   = "room"
-	RedisStreamMaxLen = 1
-	RedisStreamCount  = 1
+	RedisStreamRoomPrefix = "room:"
+	RedisStreamCount      = 100         // maximum entries per stream returned by one XREAD of the stream reader
+	RedisStreamBlock      = time.Second // how long the stream reader blocks before refreshing its room list
+
+	// Default stream retention, rooms can override it
+	RedisStreamMaxLen       = 10000 // 0 keeps any number of messages
+	RedisStreamMaxLenApprox = true  // trim with "~", which is much cheaper for Redis
+	RedisStreamMaxAge       = 0     // 0 keeps messages of any age
+	RetentionTrimInterval   = time.Minute
+
+	// Stream reader recovery
+	StreamReaderBackoffInitial    = 500 * time.Millisecond
+	StreamReaderBackoffMax        = 30 * time.Second
+	StreamReaderBackoffMultiplier = 2.0
+	StreamReaderBackoffJitter     = 0.2              // up to 20% of each delay is randomly added or removed
+	StreamReaderMaxAttempts       = 0                // 0 keeps reconnecting forever
+	StreamReaderNotifyAfter       = 30 * time.Second // end subscriptions with an error once the reader is down this long, 0 never does
+
+	// Consumer group mode of the stream reader
+	RedisConsumerGroup         = ""               // consumer group shared by the instances of a deployment, empty reads with plain XREAD
+	RedisConsumerClaimIdle     = 30 * time.Second // entries left pending this long by another instance are claimed
+	RedisConsumerClaimInterval = 15 * time.Second // how often pending entries are checked
+
+	// Message content
+	MessageMetadataMaxSize = 4096 // bytes of JSON metadata accepted per message
+
+	// Messages query, which returns the oldest messages of a room
+	MessagesQueryLimit = 100
+
+	// Message pagination
+	MessagesPageDefaultSize = 50
+	MessagesPageMaxSize     = 100
+
+	// Room configuration
+	DefaultRoomID       = "general"
+	DefaultRoomName     = "General"
+	RedisRoomIndexKey   = "rooms" // set of all room IDs
+	RedisRoomMetaSuffix = ":meta" // appended to the room stream key for the room metadata hash
+
+	// Message revisions, the latest revision of each edited or deleted message is kept in a hash per room
+	RedisRoomRevisionsSuffix = ":revisions" // appended to the room stream key for the revisions hash
+
+	// Threads, each reply is also copied to a stream per parent and counted in a hash per room
+	RedisRoomThreadSuffix  = ":thread:" // appended to the room stream key, followed by the parent ID, for the replies stream
+	RedisRoomThreadsSuffix = ":threads" // appended to the room stream key for the hash of reply counts and last reply times
+
+	// Reactions, counted by emoji in a hash per room
+	RedisRoomReactionsSuffix = ":reactions" // appended to the room stream key for the reactions hash
+	MessageReactionsMax      = 20           // different emojis a message can collect, the reactions hash keeps one slot per emoji
+	ReactionEmojiMaxSize     = 32           // bytes of an emoji, which may also be a :shortcode:
+
+	// Members, the users who ever subscribed to a room are kept in a set per room
+	RedisRoomMembersSuffix = ":members" // appended to the room stream key for the members set
+
+	// Field indexes, the fields of the revisions, threads and reactions hashes are also kept in a sorted set per
+	// hash, scored by the time of their message, so retention finds the fields of trimmed messages without reading the hash
+	RedisFieldIndexSuffix = ":index" // appended to a revisions, threads or reactions hash key for its field index
 
 	// Server configuration
-	ServerPort = ":8080"
+	ServerPort      = ":8080"
+	ShutdownTimeout = 15 * time.Second // how long a shutdown waits for requests and subscriptions to finish
+
+	// Authentication, enabled by setting a secret or a JWKS file
+	AuthLeeway = 30 * time.Second // clock skew tolerated when checking token expiry
+
+	// Logging
+	LogLevel   = "info" // debug, info, warn or error
+	LogFormat  = "text" // text or json
+	LogContent = false  // log message bodies, which are user data
+
+	// Tracing
+	TracingExporter    = "none" // none, stdout or otlp
+	TracingProtocol    = "grpc" // OTLP transport: grpc or http
+	TracingServiceName = "gqlgen-graphql-subscriptions"
+	TracingSampleRatio = 1.0 // fraction of new traces recorded, requests inherit the decision of their caller
+
+	// Health checks
+	ReadinessTimeout = 2 * time.Second // how long /readyz waits for the Redis PING
 
 	// WebSocket configuration
 	WebSocketReadBufferSize    = 1024
@@ -17,10 +98,40 @@ const (
 	WebSocketKeepAlivePing     = 10 * time.Second
 	WebSocketSubscriptionToken = 16 // hex length for subscription tokens
 
+	// Subscription replay configuration
+	SubscriptionReplayBatch  = 100 // stream entries read per XRANGE while replaying
+	SubscriptionReplayBuffer = 256 // live messages buffered while a subscription replays history
+	RoomEventsBuffer         = 64  // events buffered per roomEvents subscription, a client falling further behind misses events
+
 	// Cache configuration
 	QueryCacheSize = 1000
 	APQCacheSize   = 100
 
-	// Redis Stream message field
-	RedisMessageField = "message"
+	// Redis Stream message fields, only the message is present in entries of older versions
+	RedisMessageField     = "message"
+	RedisAuthorField      = "author"       // principal ID of the sender, absent for anonymous messages
+	RedisAuthorNameField  = "author_name"  // display name of the sender
+	RedisCreatedAtField   = "created_at"   // RFC 3339 publication time, the time of the entry ID when absent
+	RedisContentTypeField = "content_type" // plain or markdown
+	RedisMetadataField    = "metadata"     // JSON object, absent when empty
+	RedisParentField      = "parent"       // ID of the message replied to, absent for messages posted to the room itself
+
+	// Edits and deletions are stream entries too, carrying the resulting revision of their target
+	RedisEventField    = "event"     // created, updated or deleted; created when absent
+	RedisTargetField   = "target"    // ID of the message an update or deletion applies to
+	RedisEditedAtField = "edited_at" // RFC 3339 time of the update or deletion
+
+	// Reactions and joins are stream entries without a message, carrying the author fields of the user
+	RedisEmojiField = "emoji"
+	RedisCountField = "count" // reactions with the emoji once the change is applied
+
+	MessageEventCreated   = "created"
+	MessageEventUpdated   = "updated"
+	MessageEventDeleted   = "deleted"
+	MessageEventReacted   = "reacted"
+	MessageEventUnreacted = "unreacted"
+	MessageEventJoined    = "joined"
+
+	// The last entry of a deleted room, which ends its subscriptions on every instance
+	MessageEventRoomDeleted = "roomDeleted"
 )
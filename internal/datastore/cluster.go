@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FailoverOptions configures the connection of NewFailoverClient
+type FailoverOptions struct {
+	MasterName    string   // name of the monitored primary
+	SentinelAddrs []string // host:port of the Sentinels
+	// SentinelUsername and SentinelPassword authenticate against the Sentinels,
+	// which may use different credentials than the data nodes
+	SentinelUsername string
+	SentinelPassword string
+	DB               int
+	ConnOptions
+}
+
+// FailoverClientOptions turns the options into go-redis options
+func (o FailoverOptions) FailoverClientOptions() (*redis.FailoverOptions, error) {
+	if o.MasterName == "" {
+		return nil, fmt.Errorf("redis Sentinel master name cannot be empty")
+	}
+	if len(o.SentinelAddrs) == 0 {
+		return nil, fmt.Errorf("redis Sentinel addresses cannot be empty")
+	}
+
+	opts := &redis.FailoverOptions{
+		MasterName:       o.MasterName,
+		SentinelAddrs:    o.SentinelAddrs,
+		SentinelUsername: o.SentinelUsername,
+		SentinelPassword: o.SentinelPassword,
+		DB:               o.DB,
+	}
+	o.override(&opts.Username, &opts.Password, &opts.DialTimeout, &opts.ReadTimeout, &opts.WriteTimeout, &opts.PoolSize, &opts.MinIdleConns)
+
+	tlsConfig, err := o.tlsConfig(nil)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	opts.TLSConfig = tlsConfig
+
+	return opts, nil
+}
+
+// NewFailoverClient connects to the primary monitored by Redis Sentinel. The
+// client asks the Sentinels for the new primary after a failover, so the
+// server keeps working without a restart.
+func NewFailoverClient(ctx context.Context, opts FailoverOptions) (RedisClient, error) {
+	clientOpts, err := opts.FailoverClientOptions()
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	client := redis.NewFailoverClient(clientOpts)
+
+	if err := client.Ping(ctx).Err(); !errors.Is(err, nil) {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis primary %s: %w", opts.MasterName, err)
+	}
+
+	return client, nil
+}
+
+// ClusterOptions configures the connection of NewClusterClient
+type ClusterOptions struct {
+	Addrs []string // host:port of some cluster nodes, the others are discovered
+	ConnOptions
+}
+
+// ClusterClientOptions turns the options into go-redis options
+func (o ClusterOptions) ClusterClientOptions() (*redis.ClusterOptions, error) {
+	if len(o.Addrs) == 0 {
+		return nil, fmt.Errorf("redis Cluster addresses cannot be empty")
+	}
+
+	opts := &redis.ClusterOptions{Addrs: o.Addrs}
+	o.override(&opts.Username, &opts.Password, &opts.DialTimeout, &opts.ReadTimeout, &opts.WriteTimeout, &opts.PoolSize, &opts.MinIdleConns)
+
+	tlsConfig, err := o.tlsConfig(nil)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	opts.TLSConfig = tlsConfig
+
+	return opts, nil
+}
+
+// NewClusterClient connects to a Redis Cluster. Scripts and commands spanning
+// the keys of a room need them in one hash slot, so the room IDs must be
+// hash-tagged, see broker.SetHashTag.
+func NewClusterClient(ctx context.Context, opts ClusterOptions) (RedisClient, error) {
+	clientOpts, err := opts.ClusterClientOptions()
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	client := redis.NewClusterClient(clientOpts)
+
+	if err := client.Ping(ctx).Err(); !errors.Is(err, nil) {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis Cluster: %w", err)
+	}
+
+	return client, nil
+}
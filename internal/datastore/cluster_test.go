@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailoverOptions_FailoverClientOptions(t *testing.T) {
+	o, err := FailoverOptions{
+		MasterName:       "mymaster",
+		SentinelAddrs:    []string{"sentinel-1:26379", "sentinel-2:26379"},
+		SentinelPassword: "sentinel-secret",
+		DB:               2,
+		ConnOptions:      ConnOptions{Username: "app", Password: "secret", ReadTimeout: time.Second, TLS: TLSOptions{Enabled: true}},
+	}.FailoverClientOptions()
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if o.MasterName != "mymaster" || len(o.SentinelAddrs) != 2 || o.SentinelPassword != "sentinel-secret" || o.DB != 2 {
+		t.Errorf("unexpected Sentinel options %+v", o)
+	}
+	if o.Username != "app" || o.Password != "secret" || o.ReadTimeout != time.Second || o.TLSConfig == nil {
+		t.Errorf("unexpected connection options %+v", o)
+	}
+
+	if _, err := (FailoverOptions{SentinelAddrs: []string{"sentinel-1:26379"}}).FailoverClientOptions(); err == nil || !strings.Contains(err.Error(), "master name cannot be empty") {
+		t.Errorf("expected an error for a missing master name, got %v", err)
+	}
+	if _, err := (FailoverOptions{MasterName: "mymaster"}).FailoverClientOptions(); err == nil || !strings.Contains(err.Error(), "addresses cannot be empty") {
+		t.Errorf("expected an error for missing Sentinels, got %v", err)
+	}
+}
+
+func TestClusterOptions_ClusterClientOptions(t *testing.T) {
+	o, err := ClusterOptions{
+		Addrs:       []string{"node-1:6379", "node-2:6379"},
+		ConnOptions: ConnOptions{Password: "secret", PoolSize: 5},
+	}.ClusterClientOptions()
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(o.Addrs) != 2 || o.Password != "secret" || o.PoolSize != 5 || o.TLSConfig != nil {
+		t.Errorf("unexpected cluster options %+v", o)
+	}
+
+	if _, err := (ClusterOptions{}).ClusterClientOptions(); err == nil {
+		t.Error("expected an error for missing cluster addresses")
+	}
+	if _, err := NewClusterClient(context.Background(), ClusterOptions{}); err == nil {
+		t.Error("expected NewClusterClient to fail without addresses")
+	}
+}
@@ -0,0 +1,1237 @@
+package datastore
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// memoryEntry is a stream entry with its parsed ID
+type memoryEntry struct {
+	id  streamID
+	msg redis.XMessage
+}
+
+// pendingEntry is an entry delivered to a consumer but not acknowledged yet
+type pendingEntry struct {
+	consumer    string
+	deliveredAt time.Time
+	deliveries  int64
+}
+
+// memoryGroup is a consumer group of a stream
+type memoryGroup struct {
+	lastDelivered streamID
+	pending       map[streamID]*pendingEntry
+}
+
+// memoryStream is a stream with its consumer groups
+type memoryStream struct {
+	entries []memoryEntry // ordered by ID
+	lastID  streamID
+	groups  map[string]*memoryGroup
+}
+
+// MemoryClient is an in-process RedisClient. It implements the streams, consumer
+// groups, hashes, sets, sorted sets and scripts used by this application with the semantics
+// of Redis, including blocking reads, so the server runs without a Redis and
+// tests can exercise real behavior. Data is lost when the process exits.
+type MemoryClient struct {
+	*memoryData
+	scripted bool // set on the view a script runs its commands through, which already holds the mutex
+}
+
+// memoryData is the state of a MemoryClient, shared with the views scripts run against
+type memoryData struct {
+	mutex   sync.Mutex
+	streams map[string]*memoryStream
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]struct{}
+	zsets   map[string]map[string]float64 // key -> member -> score
+	notify  chan struct{}                 // closed and replaced whenever an entry is added
+	closed  bool
+	now     func() time.Time
+}
+
+// NewMemoryClient creates an empty in-memory datastore
+func NewMemoryClient() *MemoryClient {
+	return &MemoryClient{memoryData: &memoryData{
+		streams: map[string]*memoryStream{},
+		hashes:  map[string]map[string]string{},
+		sets:    map[string]map[string]struct{}{},
+		zsets:   map[string]map[string]float64{},
+		notify:  make(chan struct{}),
+		now:     time.Now,
+	}}
+}
+
+// lock takes the mutex, unless a script running the command holds it already,
+// and returns the matching unlock
+func (c *MemoryClient) lock() func() {
+	if c.scripted {
+		return func() {}
+	}
+	c.mutex.Lock()
+	return c.mutex.Unlock
+}
+
+// streamID is a parsed stream entry ID
+type streamID struct {
+	ms, seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) compare(other streamID) int {
+	if c := cmp.Compare(id.ms, other.ms); c != 0 {
+		return c
+	}
+	return cmp.Compare(id.seq, other.seq)
+}
+
+var errInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+// parseStreamID parses a complete or incomplete ("<ms>") stream ID; an
+// incomplete ID gets the given default sequence
+func parseStreamID(s string, defaultSeq uint64) (streamID, error) {
+	msPart, seqPart, complete := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if !errors.Is(err, nil) {
+		return streamID{}, errInvalidStreamID
+	}
+	if !complete {
+		return streamID{ms: ms, seq: defaultSeq}, nil
+	}
+
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if !errors.Is(err, nil) {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms: ms, seq: seq}, nil
+}
+
+// parseRangeBound parses an XRANGE bound into an inclusive ID
+func parseRangeBound(bound string, start bool) (streamID, error) {
+	switch bound {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return streamID{ms: math.MaxUint64, seq: math.MaxUint64}, nil
+	}
+
+	defaultSeq := uint64(0)
+	if !start {
+		defaultSeq = math.MaxUint64
+	}
+
+	exclusive, ok := strings.CutPrefix(bound, "(")
+	if !ok {
+		return parseStreamID(bound, defaultSeq)
+	}
+
+	id, err := parseStreamID(exclusive, defaultSeq)
+	if !errors.Is(err, nil) {
+		return streamID{}, err
+	}
+
+	// Turn the exclusive bound into the next or previous possible ID
+	if start {
+		if id.seq == math.MaxUint64 {
+			return streamID{ms: id.ms + 1}, nil
+		}
+		return streamID{ms: id.ms, seq: id.seq + 1}, nil
+	}
+	if id.seq == 0 {
+		if id.ms == 0 {
+			return streamID{}, errInvalidStreamID
+		}
+		return streamID{ms: id.ms - 1, seq: math.MaxUint64}, nil
+	}
+	return streamID{ms: id.ms, seq: id.seq - 1}, nil
+}
+
+// fieldValues flattens the values of XADD and HSET into field/value pairs
+func fieldValues(values interface{}) ([]string, error) {
+	var pairs []string
+
+	switch v := values.(type) {
+	case map[string]interface{}:
+		for field, value := range v {
+			pairs = append(pairs, field, fmt.Sprint(value))
+		}
+	case map[string]string:
+		for field, value := range v {
+			pairs = append(pairs, field, value)
+		}
+	case []string:
+		pairs = append(pairs, v...)
+	case []interface{}:
+		for _, value := range v {
+			pairs = append(pairs, fmt.Sprint(value))
+		}
+	default:
+		return nil, fmt.Errorf("ERR unsupported values of type %T", values)
+	}
+
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("ERR wrong number of arguments")
+	}
+	return pairs, nil
+}
+
+// hashArgs turns the variadic arguments of HSET into field/value pairs
+func hashArgs(values []interface{}) ([]string, error) {
+	if len(values) == 1 {
+		return fieldValues(values[0])
+	}
+	return fieldValues(values)
+}
+
+// checkClosed returns redis.ErrClosed once Close was called; the caller holds the mutex
+func (c *MemoryClient) checkClosed() error {
+	if c.closed {
+		return redis.ErrClosed
+	}
+	return nil
+}
+
+// stream returns a stream, creating it when create is set; the caller holds the mutex
+func (c *MemoryClient) stream(key string, create bool) *memoryStream {
+	s, ok := c.streams[key]
+	if !ok && create {
+		s = &memoryStream{groups: map[string]*memoryGroup{}}
+		c.streams[key] = s
+	}
+	return s
+}
+
+// wake releases blocked readers; the caller holds the mutex
+func (c *MemoryClient) wake() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// XAdd appends an entry, generating its ID for "*", and trims the stream
+func (c *MemoryClient) XAdd(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
+	cmd := redis.NewStringCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	pairs, err := fieldValues(args.Values)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	s := c.stream(args.Stream, false)
+	if s == nil && args.NoMkStream {
+		cmd.SetErr(redis.Nil)
+		return cmd
+	}
+	if s == nil {
+		s = c.stream(args.Stream, true)
+	}
+
+	var id streamID
+	switch {
+	case args.ID == "" || args.ID == "*":
+		ms := uint64(c.now().UnixMilli())
+		if ms > s.lastID.ms {
+			id = streamID{ms: ms}
+		} else {
+			id = streamID{ms: s.lastID.ms, seq: s.lastID.seq + 1}
+		}
+	default:
+		if id, err = parseStreamID(args.ID, 0); !errors.Is(err, nil) {
+			cmd.SetErr(err)
+			return cmd
+		}
+		if id.compare(s.lastID) <= 0 {
+			cmd.SetErr(errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item"))
+			return cmd
+		}
+	}
+
+	values := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+
+	s.entries = append(s.entries, memoryEntry{id: id, msg: redis.XMessage{ID: id.String(), Values: values}})
+	s.lastID = id
+
+	switch {
+	case args.MaxLen > 0:
+		s.trimMaxLen(args.MaxLen)
+	case args.MinID != "":
+		if minID, err := parseStreamID(args.MinID, 0); errors.Is(err, nil) {
+			s.trimMinID(minID)
+		}
+	}
+
+	c.wake()
+
+	cmd.SetVal(id.String())
+	return cmd
+}
+
+func (s *memoryStream) trimMaxLen(maxLen int64) int64 {
+	excess := int64(len(s.entries)) - maxLen
+	if excess <= 0 {
+		return 0
+	}
+	s.entries = slices.Clone(s.entries[excess:])
+	return excess
+}
+
+func (s *memoryStream) trimMinID(minID streamID) int64 {
+	n, _ := sort.Find(len(s.entries), func(i int) int {
+		return minID.compare(s.entries[i].id)
+	})
+	if n == 0 {
+		return 0
+	}
+	s.entries = slices.Clone(s.entries[n:])
+	return int64(n)
+}
+
+// after returns up to count entries with IDs greater than id
+func (s *memoryStream) after(id streamID, count int64) []redis.XMessage {
+	i, _ := sort.Find(len(s.entries), func(i int) int {
+		return id.compare(s.entries[i].id) + 1 // first entry strictly greater than id
+	})
+
+	var messages []redis.XMessage
+	for ; i < len(s.entries); i++ {
+		if count > 0 && int64(len(messages)) == count {
+			break
+		}
+		messages = append(messages, s.entries[i].msg)
+	}
+	return messages
+}
+
+// find returns the entry with the given ID
+func (s *memoryStream) find(id streamID) (redis.XMessage, bool) {
+	i, found := sort.Find(len(s.entries), func(i int) int {
+		return id.compare(s.entries[i].id)
+	})
+	if !found {
+		return redis.XMessage{}, false
+	}
+	return s.entries[i].msg, true
+}
+
+// block waits until an entry is added, the timeout expires or the context is
+// cancelled. It reports whether the caller should look for entries again.
+func (c *MemoryClient) block(ctx context.Context, notify <-chan struct{}, timeout <-chan time.Time) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timeout:
+		return false, nil
+	case <-notify:
+		return true, nil
+	}
+}
+
+// timeoutFor returns the timeout channel of a BLOCK argument: nil blocks forever
+func timeoutFor(block time.Duration) (<-chan time.Time, func()) {
+	if block == 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(block)
+	return timer.C, func() { timer.Stop() }
+}
+
+// XRead reads entries after the given IDs of one or more streams, blocking
+// when args.Block is not negative
+func (c *MemoryClient) XRead(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
+	cmd := redis.NewXStreamSliceCmd(ctx)
+
+	if len(args.Streams) == 0 || len(args.Streams)%2 != 0 {
+		cmd.SetErr(errors.New("ERR Unbalanced 'xread' list of streams"))
+		return cmd
+	}
+	n := len(args.Streams) / 2
+	keys := args.Streams[:n]
+
+	// Resolve "$" once, so blocking reads return entries added after the call
+	c.mutex.Lock()
+	ids := make([]streamID, n)
+	for i, raw := range args.Streams[n:] {
+		if raw == "$" {
+			if s := c.stream(keys[i], false); s != nil {
+				ids[i] = s.lastID
+			}
+			continue
+		}
+		id, err := parseStreamID(raw, 0)
+		if !errors.Is(err, nil) {
+			c.mutex.Unlock()
+			cmd.SetErr(err)
+			return cmd
+		}
+		ids[i] = id
+	}
+	c.mutex.Unlock()
+
+	timeout, stop := timeoutFor(args.Block)
+	defer stop()
+
+	for {
+		c.mutex.Lock()
+		if err := c.checkClosed(); !errors.Is(err, nil) {
+			c.mutex.Unlock()
+			cmd.SetErr(err)
+			return cmd
+		}
+
+		var streams []redis.XStream
+		for i, key := range keys {
+			if s := c.stream(key, false); s != nil {
+				if messages := s.after(ids[i], args.Count); len(messages) > 0 {
+					streams = append(streams, redis.XStream{Stream: key, Messages: messages})
+				}
+			}
+		}
+		notify := c.notify
+		c.mutex.Unlock()
+
+		if len(streams) > 0 {
+			cmd.SetVal(streams)
+			return cmd
+		}
+
+		if args.Block < 0 {
+			cmd.SetErr(redis.Nil)
+			return cmd
+		}
+
+		again, err := c.block(ctx, notify, timeout)
+		if !errors.Is(err, nil) {
+			cmd.SetErr(err)
+			return cmd
+		}
+		if !again {
+			cmd.SetErr(redis.Nil)
+			return cmd
+		}
+	}
+}
+
+// XRangeN returns up to count entries between start and stop
+func (c *MemoryClient) XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return c.xRange(ctx, stream, start, stop, count, false)
+}
+
+// XRevRangeN returns up to count entries between start and stop, newest first
+func (c *MemoryClient) XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return c.xRange(ctx, stream, stop, start, count, true)
+}
+
+func (c *MemoryClient) xRange(ctx context.Context, stream, start, stop string, count int64, reverse bool) *redis.XMessageSliceCmd {
+	cmd := redis.NewXMessageSliceCmd(ctx)
+
+	from, err := parseRangeBound(start, true)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+	to, err := parseRangeBound(stop, false)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	messages := []redis.XMessage{}
+	if s := c.stream(stream, false); s != nil {
+		for i := range s.entries {
+			entry := s.entries[i]
+			if reverse {
+				entry = s.entries[len(s.entries)-1-i]
+			}
+			if count > 0 && int64(len(messages)) == count {
+				break
+			}
+			if entry.id.compare(from) >= 0 && entry.id.compare(to) <= 0 {
+				messages = append(messages, entry.msg)
+			}
+		}
+	}
+
+	cmd.SetVal(messages)
+	return cmd
+}
+
+// XTrimMaxLen trims a stream to maxLen entries
+func (c *MemoryClient) XTrimMaxLen(ctx context.Context, key string, maxLen int64) *redis.IntCmd {
+	return c.xTrim(ctx, key, func(s *memoryStream) int64 { return s.trimMaxLen(maxLen) })
+}
+
+// XTrimMaxLenApprox trims a stream to maxLen entries; trimming is exact
+func (c *MemoryClient) XTrimMaxLenApprox(ctx context.Context, key string, maxLen, limit int64) *redis.IntCmd {
+	return c.XTrimMaxLen(ctx, key, maxLen)
+}
+
+// XTrimMinID drops the entries older than minID
+func (c *MemoryClient) XTrimMinID(ctx context.Context, key string, minID string) *redis.IntCmd {
+	id, err := parseStreamID(minID, 0)
+	if !errors.Is(err, nil) {
+		cmd := redis.NewIntCmd(ctx)
+		cmd.SetErr(err)
+		return cmd
+	}
+	return c.xTrim(ctx, key, func(s *memoryStream) int64 { return s.trimMinID(id) })
+}
+
+// XTrimMinIDApprox drops the entries older than minID; trimming is exact
+func (c *MemoryClient) XTrimMinIDApprox(ctx context.Context, key string, minID string, limit int64) *redis.IntCmd {
+	return c.XTrimMinID(ctx, key, minID)
+}
+
+func (c *MemoryClient) xTrim(ctx context.Context, key string, trim func(*memoryStream) int64) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	if s := c.stream(key, false); s != nil {
+		cmd.SetVal(trim(s))
+	}
+	return cmd
+}
+
+// XGroupCreateMkStream creates a consumer group starting after start ("$" for
+// the end of the stream), creating the stream if needed
+func (c *MemoryClient) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	cmd := redis.NewStatusCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	s := c.stream(stream, true)
+	if _, ok := s.groups[group]; ok {
+		cmd.SetErr(replyError("BUSYGROUP Consumer Group name already exists"))
+		return cmd
+	}
+
+	lastDelivered := s.lastID
+	if start != "$" {
+		id, err := parseStreamID(start, 0)
+		if !errors.Is(err, nil) {
+			cmd.SetErr(err)
+			return cmd
+		}
+		lastDelivered = id
+	}
+
+	s.groups[group] = &memoryGroup{lastDelivered: lastDelivered, pending: map[streamID]*pendingEntry{}}
+	cmd.SetVal("OK")
+	return cmd
+}
+
+// XReadGroup reads new entries (">") for a consumer, adding them to the pending
+// list, or re-reads the consumer's own pending entries after an explicit ID
+func (c *MemoryClient) XReadGroup(ctx context.Context, args *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	cmd := redis.NewXStreamSliceCmd(ctx)
+
+	if len(args.Streams) == 0 || len(args.Streams)%2 != 0 {
+		cmd.SetErr(errors.New("ERR Unbalanced 'xreadgroup' list of streams"))
+		return cmd
+	}
+	n := len(args.Streams) / 2
+	keys, raw := args.Streams[:n], args.Streams[n:]
+
+	timeout, stop := timeoutFor(args.Block)
+	defer stop()
+
+	for {
+		c.mutex.Lock()
+		if err := c.checkClosed(); !errors.Is(err, nil) {
+			c.mutex.Unlock()
+			cmd.SetErr(err)
+			return cmd
+		}
+
+		var streams []redis.XStream
+		newOnly := true
+		for i, key := range keys {
+			s := c.stream(key, false)
+			var g *memoryGroup
+			if s != nil {
+				g = s.groups[args.Group]
+			}
+			if g == nil {
+				c.mutex.Unlock()
+				cmd.SetErr(replyError(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, args.Group)))
+				return cmd
+			}
+
+			var messages []redis.XMessage
+			if raw[i] == ">" {
+				messages = s.after(g.lastDelivered, args.Count)
+				now := c.now()
+				for _, msg := range messages {
+					id, _ := parseStreamID(msg.ID, 0)
+					g.lastDelivered = id
+					if !args.NoAck {
+						g.pending[id] = &pendingEntry{consumer: args.Consumer, deliveredAt: now, deliveries: 1}
+					}
+				}
+			} else {
+				newOnly = false
+				after, err := parseStreamID(raw[i], 0)
+				if !errors.Is(err, nil) {
+					c.mutex.Unlock()
+					cmd.SetErr(err)
+					return cmd
+				}
+				messages = g.consumerPending(s, args.Consumer, after, args.Count)
+			}
+
+			if len(messages) > 0 || !newOnly {
+				streams = append(streams, redis.XStream{Stream: key, Messages: messages})
+			}
+		}
+		notify := c.notify
+		c.mutex.Unlock()
+
+		// Reading history never blocks
+		if len(streams) > 0 || !newOnly {
+			cmd.SetVal(streams)
+			return cmd
+		}
+
+		if args.Block < 0 {
+			cmd.SetErr(redis.Nil)
+			return cmd
+		}
+
+		again, err := c.block(ctx, notify, timeout)
+		if !errors.Is(err, nil) {
+			cmd.SetErr(err)
+			return cmd
+		}
+		if !again {
+			cmd.SetErr(redis.Nil)
+			return cmd
+		}
+	}
+}
+
+// pendingIDs returns the IDs of the pending list in order
+func (g *memoryGroup) pendingIDs() []streamID {
+	ids := make([]streamID, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, streamID.compare)
+	return ids
+}
+
+// consumerPending returns the entries pending for consumer after the given ID
+func (g *memoryGroup) consumerPending(s *memoryStream, consumer string, after streamID, count int64) []redis.XMessage {
+	messages := []redis.XMessage{}
+	for _, id := range g.pendingIDs() {
+		if count > 0 && int64(len(messages)) == count {
+			break
+		}
+		if g.pending[id].consumer != consumer || id.compare(after) <= 0 {
+			continue
+		}
+		// Entries deleted from the stream are reported without values
+		msg, ok := s.find(id)
+		if !ok {
+			msg = redis.XMessage{ID: id.String()}
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// XAck removes entries from the pending list of a group
+func (c *MemoryClient) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	s := c.stream(stream, false)
+	if s == nil || s.groups[group] == nil {
+		return cmd
+	}
+	g := s.groups[group]
+
+	var acked int64
+	for _, raw := range ids {
+		id, err := parseStreamID(raw, 0)
+		if !errors.Is(err, nil) {
+			cmd.SetErr(err)
+			return cmd
+		}
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked++
+		}
+	}
+
+	cmd.SetVal(acked)
+	return cmd
+}
+
+// XGroupDelConsumer removes a consumer from a group, returning the number of
+// its pending entries dropped along with it
+func (c *MemoryClient) XGroupDelConsumer(ctx context.Context, stream, group, consumer string) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	s := c.stream(stream, false)
+	if s == nil || s.groups[group] == nil {
+		cmd.SetErr(replyError(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", stream, group)))
+		return cmd
+	}
+	g := s.groups[group]
+
+	var dropped int64
+	for id, p := range g.pending {
+		if p.consumer == consumer {
+			delete(g.pending, id)
+			dropped++
+		}
+	}
+
+	cmd.SetVal(dropped)
+	return cmd
+}
+
+// XAutoClaim transfers pending entries idle for at least MinIdle to a consumer.
+// Entries no longer in the stream are dropped from the pending list.
+func (c *MemoryClient) XAutoClaim(ctx context.Context, args *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+	cmd := redis.NewXAutoClaimCmd(ctx)
+
+	start, err := parseStreamID(args.Start, 0)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	count := args.Count
+	if count <= 0 {
+		count = 100
+	}
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	s := c.stream(args.Stream, false)
+	if s == nil || s.groups[args.Group] == nil {
+		cmd.SetErr(replyError(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", args.Stream, args.Group)))
+		return cmd
+	}
+	g := s.groups[args.Group]
+
+	now := c.now()
+	messages := []redis.XMessage{}
+	next := "0-0"
+	var scanned int64
+
+	for _, id := range g.pendingIDs() {
+		if id.compare(start) < 0 {
+			continue
+		}
+		if scanned == count {
+			next = id.String()
+			break
+		}
+		scanned++
+
+		p := g.pending[id]
+		if now.Sub(p.deliveredAt) < args.MinIdle {
+			continue
+		}
+
+		msg, ok := s.find(id)
+		if !ok {
+			delete(g.pending, id)
+			continue
+		}
+
+		p.consumer = args.Consumer
+		p.deliveredAt = now
+		p.deliveries++
+		messages = append(messages, msg)
+	}
+
+	cmd.SetVal(messages, next)
+	return cmd
+}
+
+// HSet sets hash fields, returning the number of fields added
+func (c *MemoryClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	pairs, err := hashArgs(values)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	if c.hashes[key] == nil {
+		c.hashes[key] = map[string]string{}
+	}
+
+	var added int64
+	for i := 0; i < len(pairs); i += 2 {
+		if _, ok := c.hashes[key][pairs[i]]; !ok {
+			added++
+		}
+		c.hashes[key][pairs[i]] = pairs[i+1]
+	}
+
+	cmd.SetVal(added)
+	return cmd
+}
+
+// HSetNX sets a hash field unless it exists
+func (c *MemoryClient) HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	if _, ok := c.hashes[key][field]; ok {
+		cmd.SetVal(false)
+		return cmd
+	}
+
+	if c.hashes[key] == nil {
+		c.hashes[key] = map[string]string{}
+	}
+	c.hashes[key][field] = fmt.Sprint(value)
+
+	cmd.SetVal(true)
+	return cmd
+}
+
+// HDel removes hash fields, returning the number removed
+func (c *MemoryClient) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	var removed int64
+	for _, field := range fields {
+		if _, ok := c.hashes[key][field]; ok {
+			delete(c.hashes[key], field)
+			removed++
+		}
+	}
+	if len(c.hashes[key]) == 0 {
+		delete(c.hashes, key)
+	}
+
+	cmd.SetVal(removed)
+	return cmd
+}
+
+// HIncrBy adds incr to the integer value of a hash field, returning the new value
+func (c *MemoryClient) HIncrBy(ctx context.Context, key, field string, incr int64) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	var value int64
+	if current, ok := c.hashes[key][field]; ok {
+		parsed, err := strconv.ParseInt(current, 10, 64)
+		if !errors.Is(err, nil) {
+			cmd.SetErr(errors.New("ERR hash value is not an integer"))
+			return cmd
+		}
+		value = parsed
+	}
+	value += incr
+
+	if c.hashes[key] == nil {
+		c.hashes[key] = map[string]string{}
+	}
+	c.hashes[key][field] = strconv.FormatInt(value, 10)
+
+	cmd.SetVal(value)
+	return cmd
+}
+
+// HGetAll returns all fields of a hash
+func (c *MemoryClient) HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd {
+	cmd := redis.NewMapStringStringCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	fields := make(map[string]string, len(c.hashes[key]))
+	for field, value := range c.hashes[key] {
+		fields[field] = value
+	}
+
+	cmd.SetVal(fields)
+	return cmd
+}
+
+// HMGet returns the values of hash fields, nil for missing fields
+func (c *MemoryClient) HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd {
+	cmd := redis.NewSliceCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if value, ok := c.hashes[key][field]; ok {
+			values[i] = value
+		}
+	}
+
+	cmd.SetVal(values)
+	return cmd
+}
+
+// SAdd adds set members, returning the number added
+func (c *MemoryClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	if c.sets[key] == nil {
+		c.sets[key] = map[string]struct{}{}
+	}
+
+	var added int64
+	for _, member := range members {
+		m := fmt.Sprint(member)
+		if _, ok := c.sets[key][m]; !ok {
+			c.sets[key][m] = struct{}{}
+			added++
+		}
+	}
+
+	cmd.SetVal(added)
+	return cmd
+}
+
+// SRem removes set members, returning the number removed
+func (c *MemoryClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	var removed int64
+	for _, member := range members {
+		m := fmt.Sprint(member)
+		if _, ok := c.sets[key][m]; ok {
+			delete(c.sets[key], m)
+			removed++
+		}
+	}
+	if len(c.sets[key]) == 0 {
+		delete(c.sets, key)
+	}
+
+	cmd.SetVal(removed)
+	return cmd
+}
+
+// SMembers returns the members of a set
+func (c *MemoryClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	cmd := redis.NewStringSliceCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	members := make([]string, 0, len(c.sets[key]))
+	for member := range c.sets[key] {
+		members = append(members, member)
+	}
+
+	cmd.SetVal(members)
+	return cmd
+}
+
+// ZAdd adds sorted set members or updates their score, returning the number added
+func (c *MemoryClient) ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	if c.zsets[key] == nil {
+		c.zsets[key] = map[string]float64{}
+	}
+
+	var added int64
+	for _, member := range members {
+		m := fmt.Sprint(member.Member)
+		if _, ok := c.zsets[key][m]; !ok {
+			added++
+		}
+		c.zsets[key][m] = member.Score
+	}
+
+	cmd.SetVal(added)
+	return cmd
+}
+
+// parseScoreBound parses a bound of ZRANGEBYSCORE: a score, exclusive when
+// prefixed with "(", or "-inf" and "+inf"
+func parseScoreBound(bound string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(bound, "(")
+	score, err := strconv.ParseFloat(strings.TrimPrefix(bound, "("), 64)
+	if !errors.Is(err, nil) {
+		return 0, false, errors.New("ERR min or max is not a float")
+	}
+	return score, exclusive, nil
+}
+
+// ZRangeByScore returns the members of a sorted set with a score between
+// opt.Min and opt.Max, ordered by score then member, paged by opt.Offset and
+// opt.Count
+func (c *MemoryClient) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	cmd := redis.NewStringSliceCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	minScore, minExclusive, err := parseScoreBound(opt.Min)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+	maxScore, maxExclusive, err := parseScoreBound(opt.Max)
+	if !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	members := make([]string, 0, len(c.zsets[key]))
+	for member, score := range c.zsets[key] {
+		if score < minScore || minExclusive && score == minScore || score > maxScore || maxExclusive && score == maxScore {
+			continue
+		}
+		members = append(members, member)
+	}
+	scores := c.zsets[key]
+	slices.SortFunc(members, func(a, b string) int {
+		return cmp.Or(cmp.Compare(scores[a], scores[b]), strings.Compare(a, b))
+	})
+
+	if opt.Offset > 0 {
+		members = members[min(int(opt.Offset), len(members)):]
+	}
+	if opt.Count > 0 && int(opt.Count) < len(members) {
+		members = members[:opt.Count]
+	}
+
+	cmd.SetVal(members)
+	return cmd
+}
+
+// ZRem removes sorted set members, returning the number removed
+func (c *MemoryClient) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	var removed int64
+	for _, member := range members {
+		m := fmt.Sprint(member)
+		if _, ok := c.zsets[key][m]; ok {
+			delete(c.zsets[key], m)
+			removed++
+		}
+	}
+	if len(c.zsets[key]) == 0 {
+		delete(c.zsets, key)
+	}
+
+	cmd.SetVal(removed)
+	return cmd
+}
+
+// Del removes keys of any type, returning the number removed
+func (c *MemoryClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	cmd := redis.NewIntCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	var removed int64
+	for _, key := range keys {
+		_, isStream := c.streams[key]
+		_, isHash := c.hashes[key]
+		_, isSet := c.sets[key]
+		_, isZSet := c.zsets[key]
+		if isStream || isHash || isSet || isZSet {
+			removed++
+		}
+		delete(c.streams, key)
+		delete(c.hashes, key)
+		delete(c.sets, key)
+		delete(c.zsets, key)
+	}
+
+	cmd.SetVal(removed)
+	return cmd
+}
+
+// Eval runs a script registered with NewScript, see EvalSha
+func (c *MemoryClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	return c.EvalSha(ctx, scriptHash(script), keys, args...)
+}
+
+// EvalSha runs the Go implementation of a script registered with NewScript,
+// holding the mutex throughout so the script is atomic like in Redis. Scripts
+// cannot call blocking commands.
+func (c *MemoryClient) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd := redis.NewCmd(ctx, "evalsha", sha1)
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	return EvalEmulated(ctx, &MemoryClient{memoryData: c.memoryData, scripted: true}, sha1, keys, args)
+}
+
+// Ping answers PONG until the client is closed
+func (c *MemoryClient) Ping(ctx context.Context) *redis.StatusCmd {
+	cmd := redis.NewStatusCmd(ctx)
+
+	defer c.lock()()
+
+	if err := c.checkClosed(); !errors.Is(err, nil) {
+		cmd.SetErr(err)
+		return cmd
+	}
+
+	cmd.SetVal("PONG")
+	return cmd
+}
+
+// Close makes every further command fail and wakes up blocked readers
+func (c *MemoryClient) Close() error {
+	defer c.lock()()
+
+	if c.closed {
+		return redis.ErrClosed
+	}
+	c.closed = true
+	c.wake()
+	return nil
+}
@@ -0,0 +1,374 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestMemoryClient returns a MemoryClient whose clock is frozen at 1ms
+func newTestMemoryClient() *MemoryClient {
+	c := NewMemoryClient()
+	c.now = func() time.Time { return time.UnixMilli(1) }
+	return c
+}
+
+// messageIDs returns the IDs of messages
+func messageIDs(messages []redis.XMessage) string {
+	out := make([]string, len(messages))
+	for i, msg := range messages {
+		out[i] = msg.ID
+	}
+	return fmt.Sprint(out)
+}
+
+func addN(t *testing.T, c *MemoryClient, stream string, n int) {
+	t.Helper()
+	for i := range n {
+		if err := c.XAdd(context.Background(), &redis.XAddArgs{Stream: stream, Values: map[string]interface{}{"message": i}}).Err(); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestMemoryClient_XAdd(t *testing.T) {
+	ctx := context.Background()
+	c := newTestMemoryClient()
+	addN(t, c, "s", 2)
+
+	// Explicit IDs must grow
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: "s", ID: "1-1", Values: []string{"message", "x"}}).Err(); err == nil {
+		t.Error("expected an error for an ID not greater than the top item")
+	}
+	id, err := c.XAdd(ctx, &redis.XAddArgs{Stream: "s", ID: "5-0", Values: []string{"message", "x"}}).Result()
+	if !errors.Is(err, nil) || id != "5-0" {
+		t.Fatalf("expected ID 5-0, got %q (%v)", id, err)
+	}
+
+	// Values are stored as strings, like Redis returns them
+	messages, _ := c.XRangeN(ctx, "s", "-", "+", 0).Result()
+	if got := messageIDs(messages); got != "[1-0 1-1 5-0]" {
+		t.Fatalf("unexpected entries %s", got)
+	}
+	if messages[1].Values["message"] != "1" {
+		t.Errorf("expected string value \"1\", got %#v", messages[1].Values["message"])
+	}
+
+	// MAXLEN trims on append
+	if err := c.XAdd(ctx, &redis.XAddArgs{Stream: "s", MaxLen: 2, Values: []string{"message", "y"}}).Err(); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	messages, _ = c.XRangeN(ctx, "s", "-", "+", 0).Result()
+	if got := messageIDs(messages); got != "[5-0 5-1]" {
+		t.Errorf("expected the 2 newest entries, got %s", got)
+	}
+}
+
+func TestMemoryClient_XRange(t *testing.T) {
+	ctx := context.Background()
+	c := newTestMemoryClient()
+	addN(t, c, "s", 4)
+
+	tests := []struct {
+		name        string
+		reverse     bool
+		start, stop string
+		count       int64
+		want        string
+	}{
+		{name: "all", start: "-", stop: "+", want: "[1-0 1-1 1-2 1-3]"},
+		{name: "count", start: "-", stop: "+", count: 2, want: "[1-0 1-1]"},
+		{name: "inclusive", start: "1-1", stop: "1-2", want: "[1-1 1-2]"},
+		{name: "exclusive", start: "(1-1", stop: "(1-3", want: "[1-2]"},
+		{name: "incomplete", start: "1", stop: "1", want: "[1-0 1-1 1-2 1-3]"},
+		{name: "reverse", reverse: true, start: "+", stop: "-", count: 3, want: "[1-3 1-2 1-1]"},
+		{name: "reverse exclusive", reverse: true, start: "(1-3", stop: "(1-0", want: "[1-2 1-1]"},
+		{name: "missing stream", start: "-", stop: "+", want: "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := "s"
+			if tt.name == "missing stream" {
+				stream = "missing"
+			}
+
+			var messages []redis.XMessage
+			var err error
+			if tt.reverse {
+				messages, err = c.XRevRangeN(ctx, stream, tt.start, tt.stop, tt.count).Result()
+			} else {
+				messages, err = c.XRangeN(ctx, stream, tt.start, tt.stop, tt.count).Result()
+			}
+			if !errors.Is(err, nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := messageIDs(messages); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMemoryClient_XReadBlocks(t *testing.T) {
+	ctx := context.Background()
+	c := newTestMemoryClient()
+	addN(t, c, "a", 1)
+
+	// Entries after the ID are returned right away
+	streams, err := c.XRead(ctx, &redis.XReadArgs{Streams: []string{"a", "b", "0-0", "0-0"}, Block: time.Second}).Result()
+	if !errors.Is(err, nil) || len(streams) != 1 || streams[0].Stream != "a" {
+		t.Fatalf("expected one stream, got %+v (%v)", streams, err)
+	}
+
+	// Without BLOCK, nothing new is redis.Nil
+	if err := c.XRead(ctx, &redis.XReadArgs{Streams: []string{"a", "1-0"}, Block: -1}).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("expected redis.Nil, got %v", err)
+	}
+
+	// A timed out BLOCK is redis.Nil too
+	if err := c.XRead(ctx, &redis.XReadArgs{Streams: []string{"a", "$"}, Block: 10 * time.Millisecond}).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("expected redis.Nil, got %v", err)
+	}
+
+	// An append wakes up a blocked reader, "$" only sees entries added after the call
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		addN(t, c, "b", 1)
+	}()
+
+	streams, err = c.XRead(ctx, &redis.XReadArgs{Streams: []string{"a", "b", "$", "$"}, Block: time.Second}).Result()
+	if !errors.Is(err, nil) || len(streams) != 1 || streams[0].Stream != "b" || messageIDs(streams[0].Messages) != "[1-0]" {
+		t.Fatalf("expected the new entry of b, got %+v (%v)", streams, err)
+	}
+
+	// Cancelling the context ends the wait
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.XRead(cancelled, &redis.XReadArgs{Streams: []string{"a", "$"}, Block: 0}).Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMemoryClient_XTrim(t *testing.T) {
+	ctx := context.Background()
+	c := newTestMemoryClient()
+	addN(t, c, "s", 5)
+
+	if n, _ := c.XTrimMaxLenApprox(ctx, "s", 3, 0).Result(); n != 2 {
+		t.Errorf("expected 2 trimmed entries, got %d", n)
+	}
+	if n, _ := c.XTrimMinID(ctx, "s", "1-4").Result(); n != 2 {
+		t.Errorf("expected 2 trimmed entries, got %d", n)
+	}
+
+	messages, _ := c.XRangeN(ctx, "s", "-", "+", 0).Result()
+	if got := messageIDs(messages); got != "[1-4]" {
+		t.Errorf("expected entries from 1-4 on, got %s", got)
+	}
+}
+
+func TestMemoryClient_ConsumerGroup(t *testing.T) {
+	ctx := context.Background()
+	c := newTestMemoryClient()
+	addN(t, c, "s", 1)
+
+	if err := c.XGroupCreateMkStream(ctx, "s", "g", "$").Err(); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.XGroupCreateMkStream(ctx, "s", "g", "$").Err(); !redis.HasErrorPrefix(err, "BUSYGROUP") {
+		t.Errorf("expected BUSYGROUP, got %v", err)
+	}
+	if err := c.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "missing", Consumer: "c", Streams: []string{"s", ">"}, Block: -1}).Err(); !redis.HasErrorPrefix(err, "NOGROUP") {
+		t.Errorf("expected NOGROUP, got %v", err)
+	}
+
+	// The group starts after the entry existing at creation
+	addN(t, c, "s", 2)
+	streams, err := c.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "g", Consumer: "c1", Streams: []string{"s", ">"}, Block: -1}).Result()
+	if !errors.Is(err, nil) || len(streams) != 1 || messageIDs(streams[0].Messages) != "[1-1 1-2]" {
+		t.Fatalf("expected the new entries, got %+v (%v)", streams, err)
+	}
+	if err := c.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "g", Consumer: "c1", Streams: []string{"s", ">"}, Block: -1}).Err(); !errors.Is(err, redis.Nil) {
+		t.Errorf("expected redis.Nil once delivered, got %v", err)
+	}
+
+	if n, _ := c.XAck(ctx, "s", "g", "1-1").Result(); n != 1 {
+		t.Errorf("expected 1 acknowledged entry, got %d", n)
+	}
+
+	// The unacknowledged entry stays pending for c1 and can be claimed by c2
+	streams, _ = c.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "g", Consumer: "c1", Streams: []string{"s", "0"}}).Result()
+	if len(streams) != 1 || messageIDs(streams[0].Messages) != "[1-2]" {
+		t.Fatalf("expected 1-2 pending, got %+v", streams)
+	}
+
+	c.now = func() time.Time { return time.UnixMilli(1).Add(time.Minute) }
+	claimed, next, err := c.XAutoClaim(ctx, &redis.XAutoClaimArgs{Stream: "s", Group: "g", Consumer: "c2", MinIdle: 30 * time.Second, Start: "0-0"}).Result()
+	if !errors.Is(err, nil) || messageIDs(claimed) != "[1-2]" || next != "0-0" {
+		t.Fatalf("expected 1-2 claimed, got %s next %s (%v)", messageIDs(claimed), next, err)
+	}
+
+	streams, _ = c.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "g", Consumer: "c2", Streams: []string{"s", "0"}}).Result()
+	if len(streams) != 1 || messageIDs(streams[0].Messages) != "[1-2]" {
+		t.Errorf("expected 1-2 pending for c2, got %+v", streams)
+	}
+
+	// Removing a consumer drops its pending entries
+	if n, err := c.XGroupDelConsumer(ctx, "s", "g", "c2").Result(); !errors.Is(err, nil) || n != 1 {
+		t.Errorf("expected 1 dropped entry, got %d (%v)", n, err)
+	}
+	if claimed, _, _ := c.XAutoClaim(ctx, &redis.XAutoClaimArgs{Stream: "s", Group: "g", Consumer: "c3", Start: "0-0"}).Result(); len(claimed) != 0 {
+		t.Errorf("expected nothing left to claim, got %s", messageIDs(claimed))
+	}
+}
+
+func TestMemoryClient_HashesAndSets(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryClient()
+
+	if n, _ := c.HSet(ctx, "h", "a", 1, "b", "2").Result(); n != 2 {
+		t.Errorf("expected 2 added fields, got %d", n)
+	}
+	if n, _ := c.HSet(ctx, "h", map[string]interface{}{"a": "3"}).Result(); n != 0 {
+		t.Errorf("expected no added field, got %d", n)
+	}
+	if ok, _ := c.HSetNX(ctx, "h", "a", "4").Result(); ok {
+		t.Error("expected HSETNX to keep the existing field")
+	}
+	if n, _ := c.HDel(ctx, "h", "b", "c").Result(); n != 1 {
+		t.Errorf("expected 1 removed field, got %d", n)
+	}
+	if fields, _ := c.HGetAll(ctx, "h").Result(); len(fields) != 1 || fields["a"] != "3" {
+		t.Errorf("unexpected hash %v", fields)
+	}
+	if values, _ := c.HMGet(ctx, "h", "a", "missing").Result(); len(values) != 2 || values[0] != "3" || values[1] != nil {
+		t.Errorf("unexpected values %v", values)
+	}
+	if n, _ := c.HIncrBy(ctx, "h", "a", 2).Result(); n != 5 {
+		t.Errorf("expected 5 after incrementing, got %d", n)
+	}
+	if n, _ := c.HIncrBy(ctx, "counters", "new", -1).Result(); n != -1 {
+		t.Errorf("expected -1 for a new field, got %d", n)
+	}
+
+	if n, _ := c.SAdd(ctx, "set", "x", "y", "x").Result(); n != 2 {
+		t.Errorf("expected 2 added members, got %d", n)
+	}
+	if n, _ := c.SRem(ctx, "set", "y").Result(); n != 1 {
+		t.Errorf("expected 1 removed member, got %d", n)
+	}
+	if members, _ := c.SMembers(ctx, "set").Result(); len(members) != 1 || members[0] != "x" {
+		t.Errorf("unexpected members %v", members)
+	}
+
+	addN(t, c, "s", 1)
+	if n, _ := c.Del(ctx, "h", "set", "s", "missing").Result(); n != 3 {
+		t.Errorf("expected 3 deleted keys, got %d", n)
+	}
+	if fields, _ := c.HGetAll(ctx, "h").Result(); len(fields) != 0 {
+		t.Errorf("expected an empty hash after delete, got %v", fields)
+	}
+}
+
+func TestMemoryClient_SortedSets(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryClient()
+
+	if n, _ := c.ZAdd(ctx, "z", redis.Z{Score: 2, Member: "b"}, redis.Z{Score: 1, Member: "c"}, redis.Z{Score: 2, Member: "a"}).Result(); n != 3 {
+		t.Errorf("expected 3 added members, got %d", n)
+	}
+	if n, _ := c.ZAdd(ctx, "z", redis.Z{Score: 3, Member: "c"}).Result(); n != 0 {
+		t.Errorf("expected the score to be updated, got %d added", n)
+	}
+
+	tests := []struct {
+		opt  redis.ZRangeBy
+		want string
+	}{
+		{opt: redis.ZRangeBy{Min: "-inf", Max: "+inf"}, want: "[a b c]"},
+		{opt: redis.ZRangeBy{Min: "-inf", Max: "(3"}, want: "[a b]"},
+		{opt: redis.ZRangeBy{Min: "(2", Max: "3"}, want: "[c]"},
+		{opt: redis.ZRangeBy{Min: "-inf", Max: "+inf", Offset: 1, Count: 1}, want: "[b]"},
+	}
+	for _, tt := range tests {
+		members, err := c.ZRangeByScore(ctx, "z", &tt.opt).Result()
+		if !errors.Is(err, nil) || fmt.Sprint(members) != tt.want {
+			t.Errorf("%+v: expected %s, got %v (%v)", tt.opt, tt.want, members, err)
+		}
+	}
+	if err := c.ZRangeByScore(ctx, "z", &redis.ZRangeBy{Min: "low", Max: "+inf"}).Err(); err == nil {
+		t.Error("expected an error for an invalid bound")
+	}
+
+	if n, _ := c.ZRem(ctx, "z", "a", "missing").Result(); n != 1 {
+		t.Errorf("expected 1 removed member, got %d", n)
+	}
+	if n, _ := c.Del(ctx, "z").Result(); n != 1 {
+		t.Errorf("expected the sorted set to be deleted, got %d", n)
+	}
+}
+
+// incrScript increments KEYS[1] by ARGV[1] and returns the new value
+var incrScript = NewScript(`return redis.call('HINCRBY', KEYS[1], 'n', ARGV[1])`, func(ctx context.Context, c RedisClient, keys []string, args []interface{}) (interface{}, error) {
+	return c.HIncrBy(ctx, keys[0], "n", args[0].(int64)).Result()
+})
+
+func TestMemoryClient_Scripts(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryClient()
+
+	// Scripts hold the mutex, concurrent runs must neither deadlock nor lose updates
+	done := make(chan struct{})
+	for range 10 {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if err := incrScript.Run(ctx, c, []string{"h"}, int64(2)).Err(); !errors.Is(err, nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	for range 10 {
+		<-done
+	}
+
+	if values, _ := c.HMGet(ctx, "h", "n").Result(); values[0] != "20" {
+		t.Errorf("expected 20 after the scripts ran, got %v", values[0])
+	}
+
+	if err := c.EvalSha(ctx, "unknown", nil).Err(); !redis.HasErrorPrefix(err, "NOSCRIPT") {
+		t.Errorf("expected NOSCRIPT for an unregistered script, got %v", err)
+	}
+}
+
+func TestMemoryClient_Close(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryClient()
+
+	done := make(chan error)
+	go func() {
+		done <- c.XRead(ctx, &redis.XReadArgs{Streams: []string{"s", "$"}, Block: 0}).Err()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := c.Close(); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, redis.ErrClosed) {
+			t.Errorf("expected redis.ErrClosed for the blocked read, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the blocked read to end")
+	}
+
+	if err := c.Ping(ctx).Err(); !errors.Is(err, redis.ErrClosed) {
+		t.Errorf("expected redis.ErrClosed, got %v", err)
+	}
+}
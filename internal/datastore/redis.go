@@ -2,25 +2,184 @@ package datastore
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-func NewRedisClient(ctx context.Context, url string) (RedisClient, error) {
-	if url == "" {
+// ConnOptions are the connection settings shared by every kind of Redis client
+type ConnOptions struct {
+	Username string // ACL user, empty for the default user
+	Password string // empty when no password is set
+	TLS      TLSOptions
+
+	DialTimeout  time.Duration // 0 uses the go-redis default
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolSize     int // maximum connections per node, 0 uses the go-redis default
+	MinIdleConns int
+}
+
+// RedisOptions configures the connection of NewRedisClient. Settings given
+// explicitly override the ones taken from the URL.
+type RedisOptions struct {
+	// URL is either host:port or redis://[user[:password]@]host[:port][/db];
+	// the rediss:// scheme enables TLS
+	URL string
+	DB  int // database number, 0 keeps the one of the URL
+	ConnOptions
+}
+
+// TLSOptions configures TLS for the Redis connection
+type TLSOptions struct {
+	Enabled            bool   // implied by a rediss:// URL
+	CAFile             string // PEM CA bundle verifying the server, empty uses the system pool
+	CertFile           string // PEM client certificate, requires KeyFile
+	KeyFile            string
+	ServerName         string // overrides the host name checked against the server certificate
+	InsecureSkipVerify bool
+}
+
+// ClientOptions turns the options into go-redis options
+func (o RedisOptions) ClientOptions() (*redis.Options, error) {
+	if o.URL == "" {
 		return nil, fmt.Errorf("redis URL cannot be empty")
 	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr:     url,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
+	var opts *redis.Options
+	if strings.Contains(o.URL, "://") {
+		parsed, err := redis.ParseURL(o.URL)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("invalid redis URL: %w", err)
+		}
+		opts = parsed
+	} else {
+		opts = &redis.Options{Addr: o.URL}
+	}
+
+	if o.DB != 0 {
+		opts.DB = o.DB
+	}
+
+	o.override(&opts.Username, &opts.Password, &opts.DialTimeout, &opts.ReadTimeout, &opts.WriteTimeout, &opts.PoolSize, &opts.MinIdleConns)
+
+	tlsConfig, err := o.tlsConfig(opts.TLSConfig)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	opts.TLSConfig = tlsConfig
+
+	return opts, nil
+}
+
+// override replaces the given go-redis settings with the ones set explicitly
+func (o ConnOptions) override(username, password *string, dial, read, write *time.Duration, poolSize, minIdle *int) {
+	if o.Username != "" {
+		*username = o.Username
+	}
+	if o.Password != "" {
+		*password = o.Password
+	}
+	if o.DialTimeout != 0 {
+		*dial = o.DialTimeout
+	}
+	if o.ReadTimeout != 0 {
+		*read = o.ReadTimeout
+	}
+	if o.WriteTimeout != 0 {
+		*write = o.WriteTimeout
+	}
+	if o.PoolSize != 0 {
+		*poolSize = o.PoolSize
+	}
+	if o.MinIdleConns != 0 {
+		*minIdle = o.MinIdleConns
+	}
+}
+
+// tlsConfig returns the TLS configuration, nil when TLS is neither enabled nor
+// derived from a URL
+func (o ConnOptions) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	if !o.TLS.Enabled && base == nil {
+		return nil, nil
+	}
+	return o.TLS.config(base)
+}
+
+// config builds the TLS configuration on top of the one derived from the URL
+func (t TLSOptions) config(base *tls.Config) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		config = base.Clone()
+		if config.MinVersion == 0 {
+			config.MinVersion = tls.VersionTLS12
+		}
+	}
+
+	if t.ServerName != "" {
+		config.ServerName = t.ServerName
+	}
+	config.InsecureSkipVerify = config.InsecureSkipVerify || t.InsecureSkipVerify
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in Redis CA file %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("a Redis client certificate needs both a certificate and a key file")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// RedactURL hides the password of a redis:// URL so it can be logged
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if !errors.Is(err, nil) || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	} else {
+		// go-redis reads redis://secret@host as a password
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}
+
+func NewRedisClient(ctx context.Context, opts RedisOptions) (RedisClient, error) {
+	clientOpts, err := opts.ClientOptions()
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	client := redis.NewClient(clientOpts)
 
-	_, err := client.Ping(ctx).Result()
+	_, err = client.Ping(ctx).Result()
 	if !errors.Is(err, nil) {
+		_ = client.Close()
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ScriptFunc is the Go equivalent of a Lua script. It runs the commands of the
+// script against c and returns what the script returns: nil, an int64, a
+// string or a []interface{} of those, the way go-redis decodes Lua replies.
+type ScriptFunc func(ctx context.Context, c RedisClient, keys []string, args []interface{}) (interface{}, error)
+
+// Script is a Lua script that Redis runs atomically. The in-memory datastore
+// cannot run Lua, so every script also carries a Go implementation, which
+// MemoryClient runs while no other command can. All keys of a script must
+// share a hash slot in Redis Cluster.
+type Script struct {
+	src  string
+	hash string
+}
+
+var (
+	scriptsMutex sync.RWMutex
+	scripts      = map[string]ScriptFunc{} // SHA1 of the Lua source -> Go implementation
+)
+
+// NewScript registers a Lua script along with its Go implementation
+func NewScript(src string, fn ScriptFunc) *Script {
+	s := &Script{src: src, hash: scriptHash(src)}
+
+	scriptsMutex.Lock()
+	scripts[s.hash] = fn
+	scriptsMutex.Unlock()
+
+	return s
+}
+
+// Run runs the script with EVALSHA, falling back to EVAL when Redis does not
+// know it yet
+func (s *Script) Run(ctx context.Context, c RedisClient, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := c.EvalSha(ctx, s.hash, keys, args...)
+	if redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+		return c.Eval(ctx, s.src, keys, args...)
+	}
+	return cmd
+}
+
+// EvalEmulated runs the Go implementation of the script with the given SHA1
+// against c, for clients that cannot run Lua. c must not let other commands
+// run in between.
+func EvalEmulated(ctx context.Context, c RedisClient, sha string, keys []string, args []interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx, "evalsha", sha)
+
+	scriptsMutex.RLock()
+	fn, ok := scripts[sha]
+	scriptsMutex.RUnlock()
+	if !ok {
+		cmd.SetErr(replyError("NOSCRIPT No matching script. Please use EVAL."))
+		return cmd
+	}
+
+	val, err := fn(ctx, c, keys, args)
+	switch {
+	case err != nil:
+		cmd.SetErr(err)
+	case val == nil:
+		// Lua returns false or nil as a nil reply
+		cmd.SetErr(redis.Nil)
+	default:
+		cmd.SetVal(val)
+	}
+	return cmd
+}
+
+// replyError is an error reply of Redis, which go-redis tells apart from
+// other errors by its RedisError method
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+func (replyError) RedisError() {}
+
+// scriptHash returns the SHA1 EVALSHA knows a script source by
+func scriptHash(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
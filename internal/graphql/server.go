@@ -2,10 +2,15 @@ package graphql
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/generated"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/metrics"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
 	"github.com/vektah/gqlparser/v2/ast"
 
 	"github.com/99designs/gqlgen/graphql/handler/extension"
@@ -16,17 +21,50 @@ import (
 	"github.com/99designs/gqlgen/graphql/handler"
 )
 
-func NewGraphQLServer(resolver *graph.Resolver) *handler.Server {
-	srv := handler.New(generated.NewExecutableSchema(generated.Config{Resolvers: resolver}))
+// Options configures the transports and caches of the GraphQL server
+type Options struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+	KeepAlivePing   time.Duration
+	QueryCacheSize  int
+	APQCacheSize    int
+
+	// Authenticator authenticates WebSocket connections and enables the
+	// @auth and @hasRole directives, nil accepts anyone
+	Authenticator *auth.Authenticator
+}
+
+// DefaultOptions returns the options configured in constants
+func DefaultOptions() Options {
+	return Options{
+		ReadBufferSize:  constants.WebSocketReadBufferSize,
+		WriteBufferSize: constants.WebSocketWriteBufferSize,
+		KeepAlivePing:   constants.WebSocketKeepAlivePing,
+		QueryCacheSize:  constants.QueryCacheSize,
+		APQCacheSize:    constants.APQCacheSize,
+	}
+}
+
+func NewGraphQLServer(resolver *graph.Resolver, opts Options) *handler.Server {
+	srv := handler.New(generated.NewExecutableSchema(generated.Config{
+		Resolvers:  resolver,
+		Directives: graph.Directives(opts.Authenticator != nil),
+	}))
+
+	var initFunc transport.WebsocketInitFunc
+	if opts.Authenticator != nil {
+		initFunc = auth.InitFunc(opts.Authenticator)
+	}
 	srv.AddTransport(&transport.Websocket{
 		Upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
-			ReadBufferSize:  constants.WebSocketReadBufferSize,
-			WriteBufferSize: constants.WebSocketWriteBufferSize,
+			ReadBufferSize:  opts.ReadBufferSize,
+			WriteBufferSize: opts.WriteBufferSize,
 		},
-		KeepAlivePingInterval: constants.WebSocketKeepAlivePing,
+		KeepAlivePingInterval: opts.KeepAlivePing,
+		InitFunc:              initFunc,
 	})
 
 	srv.AddTransport(transport.Options{})
@@ -34,11 +72,16 @@ func NewGraphQLServer(resolver *graph.Resolver) *handler.Server {
 	srv.AddTransport(transport.POST{})
 	srv.AddTransport(transport.MultipartForm{})
 
-	srv.SetQueryCache(lru.New[*ast.QueryDocument](constants.QueryCacheSize))
+	srv.AroundOperations(graph.SubscriptionErrors)
+	srv.Use(metrics.GraphQL{})
+	srv.Use(tracing.GraphQL{})
+	srv.Use(logging.GraphQL{})
+
+	srv.SetQueryCache(lru.New[*ast.QueryDocument](opts.QueryCacheSize))
 
 	srv.Use(extension.Introspection{})
 	srv.Use(extension.AutomaticPersistedQuery{
-		Cache: lru.New[string](constants.APQCacheSize),
+		Cache: lru.New[string](opts.APQCacheSize),
 	})
 
 	return srv
@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// GraphQL is a gqlgen handler extension attaching the operation name to the
+// log records of the resolvers
+type GraphQL struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationInterceptor
+} = GraphQL{}
+
+func (GraphQL) ExtensionName() string {
+	return "Logging"
+}
+
+func (GraphQL) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (GraphQL) InterceptOperation(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	opCtx := graphql.GetOperationContext(ctx)
+
+	name := opCtx.OperationName
+	if opCtx.Operation != nil && opCtx.Operation.Name != "" {
+		name = opCtx.Operation.Name
+	}
+	if name == "" {
+		name = "anonymous"
+	}
+
+	return next(With(ctx, slog.String(OperationKey, name)))
+}
@@ -0,0 +1,128 @@
+// Package logging configures the structured logger of the server. Attributes
+// attached to a context with With, such as the request ID, the GraphQL
+// operation, the subscription token and the room, are added to every record
+// logged with that context, along with the current trace and span IDs.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys shared by the log records of the server
+const (
+	RequestIDKey = "request_id"
+	OperationKey = "operation"
+	TokenKey     = "token"
+	UserKey      = "user"
+	RoomKey      = "room"
+	MessageIDKey = "message_id"
+	ContentKey   = "content"
+	ErrorKey     = "error"
+)
+
+// Options configures the logger created by New
+type Options struct {
+	Level   string    // debug, info, warn or error
+	Format  string    // json or text
+	Content bool      // log message bodies, off by default as they are user data
+	Writer  io.Writer // os.Stderr when nil
+}
+
+// logContent is set by Setup, see Content
+var logContent bool
+
+// New creates a logger writing records at opts.Level and above
+func New(opts Options) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); !errors.Is(err, nil) {
+		return nil, fmt.Errorf("invalid log level %q: %w", opts.Level, err)
+	}
+
+	w := opts.Writer
+	if w == nil {
+		w = os.Stderr
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch opts.Format {
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	case "", "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+// Setup makes the logger of New the default one, used by slog and the log
+// package alike. It must be called at startup, before anything is logged.
+func Setup(opts Options) (*slog.Logger, error) {
+	logger, err := New(opts)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	logContent = opts.Content
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// Content returns the attribute logging a message body, or an empty attribute,
+// which handlers drop, unless content logging was enabled
+func Content(text string) slog.Attr {
+	if !logContent {
+		return slog.Attr{}
+	}
+	return slog.String(ContentKey, text)
+}
+
+// Err returns the attribute logging an error
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
+
+type contextKey struct{}
+
+// With returns a context whose log records carry attrs in addition to the ones
+// already attached to ctx
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	parent, _ := ctx.Value(contextKey{}).([]slog.Attr)
+
+	merged := make([]slog.Attr, 0, len(parent)+len(attrs))
+	merged = append(merged, parent...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, contextKey{}, merged)
+}
+
+// contextHandler adds the attributes attached to the context of a record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(contextKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
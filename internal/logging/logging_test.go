@@ -0,0 +1,127 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// decode returns the records written by a JSON logger
+func decode(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid JSON record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "text", opts: Options{Level: "info", Format: "text"}},
+		{name: "json", opts: Options{Level: "debug", Format: "json"}},
+		{name: "level offset", opts: Options{Level: "warn+2", Format: "json"}},
+		{name: "unknown level", opts: Options{Level: "verbose", Format: "json"}, wantErr: true},
+		{name: "unknown format", opts: Options{Level: "info", Format: "logfmt"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWith(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(Options{Level: "info", Format: "json", Writer: &out})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+
+	ctx = With(ctx, slog.String(RequestIDKey, "req-1"))
+	ctx = With(ctx, slog.String(TokenKey, "abc"), slog.String(RoomKey, "general"))
+	logger.InfoContext(ctx, "Subscription: message created")
+	logger.DebugContext(ctx, "below the level")
+	logger.With("component", "resolver").InfoContext(context.Background(), "no context attributes")
+
+	records := decode(t, &out)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	want := map[string]string{
+		RequestIDKey: "req-1",
+		TokenKey:     "abc",
+		RoomKey:      "general",
+		"trace_id":   traceID.String(),
+		"span_id":    spanID.String(),
+	}
+	for key, value := range want {
+		if records[0][key] != value {
+			t.Errorf("expected %s=%q, got %v", key, value, records[0][key])
+		}
+	}
+	if _, ok := records[1][RequestIDKey]; ok || records[1]["component"] != "resolver" {
+		t.Errorf("unexpected attributes %v", records[1])
+	}
+}
+
+func TestContent(t *testing.T) {
+	defer func(previous bool) { logContent = previous }(logContent)
+
+	logContent = false
+	if attr := Content("secret"); !attr.Equal(slog.Attr{}) {
+		t.Errorf("expected no content attribute by default, got %v", attr)
+	}
+
+	logContent = true
+	if attr := Content("secret"); attr.Key != ContentKey || attr.Value.String() != "secret" {
+		t.Errorf("expected the content once enabled, got %v", attr)
+	}
+}
+
+func TestGraphQL_InterceptOperation(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := New(Options{Level: "info", Format: "json", Writer: &out})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx := graphql.WithOperationContext(context.Background(), &graphql.OperationContext{
+		Operation: &ast.OperationDefinition{Name: "OnMessage", Operation: ast.Subscription},
+	})
+	GraphQL{}.InterceptOperation(ctx, func(ctx context.Context) graphql.ResponseHandler {
+		logger.InfoContext(ctx, "resolving")
+		return nil
+	})
+
+	records := decode(t, &out)
+	if len(records) != 1 || records[0][OperationKey] != "OnMessage" {
+		t.Errorf("expected the operation name in the record, got %v", records)
+	}
+}
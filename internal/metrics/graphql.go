@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// anonymousOperation labels operations sent without a name
+const anonymousOperation = "anonymous"
+
+// GraphQL is a gqlgen handler extension recording Operations, OperationErrors
+// and OperationDuration
+type GraphQL struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationInterceptor
+	graphql.ResponseInterceptor
+} = GraphQL{}
+
+func (GraphQL) ExtensionName() string {
+	return "Metrics"
+}
+
+func (GraphQL) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// InterceptOperation counts every operation once, a subscription when it starts
+func (GraphQL) InterceptOperation(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	name, kind := operationLabels(graphql.GetOperationContext(ctx))
+	Operations.WithLabelValues(name, kind).Inc()
+
+	return next(ctx)
+}
+
+// InterceptResponse counts the responses with errors and times queries and
+// mutations; a subscription responds once per event, so it is not timed
+func (GraphQL) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	resp := next(ctx)
+	if resp == nil {
+		return nil
+	}
+
+	opCtx := graphql.GetOperationContext(ctx)
+	name, kind := operationLabels(opCtx)
+	if len(resp.Errors) > 0 {
+		OperationErrors.WithLabelValues(name, kind).Inc()
+	}
+	if kind != string(ast.Subscription) {
+		OperationDuration.WithLabelValues(name, kind).Observe(time.Since(opCtx.Stats.OperationStart).Seconds())
+	}
+
+	return resp
+}
+
+// operationLabels returns the name and type of the operation
+func operationLabels(opCtx *graphql.OperationContext) (string, string) {
+	name := opCtx.OperationName
+	if opCtx.Operation != nil && opCtx.Operation.Name != "" {
+		name = opCtx.Operation.Name
+	}
+	if name == "" {
+		name = anonymousOperation
+	}
+
+	kind := "unknown"
+	if opCtx.Operation != nil {
+		kind = string(opCtx.Operation.Operation)
+	}
+	return name, kind
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes the name of every metric of the server
+const namespace = "chat"
+
+// Registry holds the metrics served by Handler, along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Operations counts the GraphQL operations executed, by operation name and type
+	Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "graphql",
+		Name:      "operations_total",
+		Help:      "GraphQL operations executed, by operation name and type.",
+	}, []string{"operation", "type"})
+
+	// OperationErrors counts the GraphQL responses carrying errors, subscription events included
+	OperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "graphql",
+		Name:      "operation_errors_total",
+		Help:      "GraphQL responses with errors, by operation name and type.",
+	}, []string{"operation", "type"})
+
+	// OperationDuration observes how long queries and mutations take to respond
+	OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "graphql",
+		Name:      "operation_duration_seconds",
+		Help:      "Time to respond to GraphQL queries and mutations, by operation name and type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "type"})
+
+	// MessagesPublished counts the messages stored by createMessage
+	MessagesPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_published_total",
+		Help:      "Messages published to room streams.",
+	})
+
+	// MessagesDelivered counts the messages handed to subscribers by the stream reader
+	MessagesDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_delivered_total",
+		Help:      "Messages delivered to subscriptions.",
+	})
+
+	// MessagesDropped counts the deliveries skipped because the subscriber channel was full
+	MessagesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dropped_total",
+		Help:      "Message deliveries dropped because the subscription channel was full.",
+	})
+
+	// RedisCommandDuration observes the latency of Redis commands, by command and status
+	RedisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Latency of Redis commands, by command and status; blocking reads include the time blocked.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"command", "status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Operations,
+		OperationErrors,
+		OperationDuration,
+		MessagesPublished,
+		MessagesDelivered,
+		MessagesDropped,
+		RedisCommandDuration,
+	)
+}
+
+// Handler serves the metrics of Registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+func operationContext(name string, kind ast.Operation) context.Context {
+	opCtx := &graphql.OperationContext{
+		Operation: &ast.OperationDefinition{Name: name, Operation: kind},
+		Stats:     graphql.Stats{OperationStart: time.Now()},
+	}
+	return graphql.WithOperationContext(context.Background(), opCtx)
+}
+
+// samples returns the number of observations of the histogram series with the given label values
+func samples(t *testing.T, histogram *prometheus.HistogramVec, labels map[string]string) uint64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(histogram)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var count uint64
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			matched := 0
+			for _, label := range m.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				count += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return count
+}
+
+func TestGraphQL_Query(t *testing.T) {
+	ctx := operationContext("GetMessages", ast.Query)
+	before := testutil.ToFloat64(Operations.WithLabelValues("GetMessages", "query"))
+	observed := samples(t, OperationDuration, map[string]string{"operation": "GetMessages"})
+
+	ext := GraphQL{}
+	handler := ext.InterceptOperation(ctx, func(ctx context.Context) graphql.ResponseHandler {
+		return func(ctx context.Context) *graphql.Response {
+			return ext.InterceptResponse(ctx, func(ctx context.Context) *graphql.Response {
+				return &graphql.Response{}
+			})
+		}
+	})
+	handler(ctx)
+
+	if got := testutil.ToFloat64(Operations.WithLabelValues("GetMessages", "query")); got != before+1 {
+		t.Errorf("expected the operation counted once, got %v", got-before)
+	}
+	if got := samples(t, OperationDuration, map[string]string{"operation": "GetMessages"}); got != observed+1 {
+		t.Errorf("expected the duration observed once, got %d", got-observed)
+	}
+}
+
+func TestGraphQL_SubscriptionErrors(t *testing.T) {
+	ctx := operationContext("", ast.Subscription)
+	errorsBefore := testutil.ToFloat64(OperationErrors.WithLabelValues(anonymousOperation, "subscription"))
+
+	ext := GraphQL{}
+	responses := []*graphql.Response{
+		{},
+		{Errors: gqlerror.List{gqlerror.Errorf("stream unavailable")}},
+		nil,
+	}
+	for _, resp := range responses {
+		ext.InterceptResponse(ctx, func(ctx context.Context) *graphql.Response { return resp })
+	}
+
+	if got := testutil.ToFloat64(OperationErrors.WithLabelValues(anonymousOperation, "subscription")); got != errorsBefore+1 {
+		t.Errorf("expected 1 error counted, got %v", got-errorsBefore)
+	}
+	if got := samples(t, OperationDuration, map[string]string{"operation": anonymousOperation}); got != 0 {
+		t.Errorf("subscriptions must not be timed, got %d samples", got)
+	}
+}
+
+func TestRedisHook(t *testing.T) {
+	tests := []struct {
+		err    error
+		status string
+	}{
+		{nil, "ok"},
+		{redis.Nil, "nil"},
+		{errors.New("connection refused"), "error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			cmd := redis.NewStringCmd(context.Background(), "xadd", "room:general", "*")
+			labels := map[string]string{"command": "xadd", "status": tt.status}
+			before := samples(t, RedisCommandDuration, labels)
+
+			process := RedisHook{}.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error {
+				return tt.err
+			})
+			if err := process(context.Background(), cmd); !errors.Is(err, tt.err) {
+				t.Errorf("expected the error passed through, got %v", err)
+			}
+
+			if got := commandStatus(tt.err); got != tt.status {
+				t.Errorf("expected status %q, got %q", tt.status, got)
+			}
+			if got := samples(t, RedisCommandDuration, labels); got != before+1 {
+				t.Errorf("expected the latency observed once, got %d", got-before)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	MessagesDropped.Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	for _, name := range []string{"chat_messages_dropped_total", "chat_messages_published_total", "go_goroutines"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("expected %s in the metrics", name)
+		}
+	}
+}
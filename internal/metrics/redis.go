@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisHook is a go-redis hook recording RedisCommandDuration; a pipeline is
+// recorded as a whole under the "pipeline" command
+type RedisHook struct{}
+
+var _ redis.Hook = RedisHook{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisCommandDuration.WithLabelValues(cmd.Name(), commandStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisCommandDuration.WithLabelValues("pipeline", commandStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// commandStatus labels the outcome of a command; an empty reply is not a failure
+func commandStatus(err error) string {
+	switch {
+	case errors.Is(err, nil):
+		return "ok"
+	case errors.Is(err, redis.Nil):
+		return "nil"
+	default:
+		return "error"
+	}
+}
+
+// Instrument adds RedisHook to client when it is a go-redis client, so the
+// in-memory datastore is left alone
+func Instrument(client interface{}) {
+	if c, ok := client.(interface{ AddHook(redis.Hook) }); ok {
+		c.AddHook(RedisHook{})
+	}
+}
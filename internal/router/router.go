@@ -1,21 +1,109 @@
 package router
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
+	"slices"
 
 	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/playground"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/metrics"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
 	"github.com/labstack/echo/v5"
 	"github.com/labstack/echo/v5/middleware"
 )
 
-func NewRouter(e *echo.Echo, srv *handler.Server) *echo.Echo {
-	e.Use(middleware.RequestLogger())
+// ReadinessChecker reports whether the server can serve requests, implemented by graph.Resolver
+type ReadinessChecker interface {
+	Readiness(ctx context.Context) graph.Readiness
+}
+
+// healthResponse is the JSON body of /healthz and /readyz
+type healthResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	*graph.Readiness
+}
+
+// probePaths are polled by orchestrators and scrapers, they are neither traced nor logged
+var probePaths = []string{"/healthz", "/readyz", "/metrics"}
+
+// requestLogger logs every request once it has been served, with the attributes
+// of its context such as the request ID
+func requestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		Skipper: func(c *echo.Context) bool {
+			return slices.Contains(probePaths, c.Request().URL.Path)
+		},
+		LogLatency:  true,
+		LogRemoteIP: true,
+		LogMethod:   true,
+		LogURI:      true,
+		LogStatus:   true,
+		HandleError: true,
+		LogValuesFunc: func(c *echo.Context, v middleware.RequestLoggerValues) error {
+			level := slog.LevelInfo
+			if v.Status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			attrs := []slog.Attr{
+				slog.String("method", v.Method),
+				slog.String("uri", v.URI),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("remote_ip", v.RemoteIP),
+			}
+			if v.Error != nil {
+				attrs = append(attrs, logging.Err(v.Error))
+			}
+			slog.LogAttrs(c.Request().Context(), level, "Request", attrs...)
+			return nil
+		},
+	})
+}
+
+// NewRouter registers the routes of the server. The GraphQL endpoints require
+// a bearer token when authenticator is not nil.
+func NewRouter(e *echo.Echo, srv *handler.Server, authenticator *auth.Authenticator, health ReadinessChecker, version string) *echo.Echo {
+	e.Use(tracing.Middleware(probePaths...))
+	e.Use(middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		// Log records of the request carry its ID, which is echoed in X-Request-ID
+		RequestIDHandler: func(c *echo.Context, requestID string) {
+			c.SetRequest(c.Request().WithContext(logging.With(c.Request().Context(), slog.String(logging.RequestIDKey, requestID))))
+		},
+	}))
+	e.Use(requestLogger())
 	e.Use(middleware.Recover())
 	e.GET("/", func(c *echo.Context) error {
 		return c.String(http.StatusOK, "Welcome!")
 	})
 
+	// Liveness: the process is up and serving HTTP
+	e.GET("/healthz", func(c *echo.Context) error {
+		return c.JSON(http.StatusOK, healthResponse{Status: "ok", Version: version})
+	})
+
+	// Prometheus metrics
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	// Readiness: Redis answers and the stream reader is running
+	e.GET("/readyz", func(c *echo.Context) error {
+		report := health.Readiness(c.Request().Context())
+		if !report.Ready {
+			return c.JSON(http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Version: version, Readiness: &report})
+		}
+		return c.JSON(http.StatusOK, healthResponse{Status: "ok", Version: version, Readiness: &report})
+	})
+
+	var authenticate []echo.MiddlewareFunc
+	if authenticator != nil {
+		authenticate = append(authenticate, auth.Middleware(authenticator))
+	}
+
 	{
 		// For CORS
 		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -26,13 +114,13 @@ func NewRouter(e *echo.Echo, srv *handler.Server) *echo.Echo {
 		e.POST("/query", func(c *echo.Context) error {
 			srv.ServeHTTP(c.Response(), c.Request())
 			return nil
-		})
+		}, authenticate...)
 
 		// For Subscriptions
 		e.GET("/subscriptions", func(c *echo.Context) error {
 			srv.ServeHTTP(c.Response(), c.Request())
 			return nil
-		})
+		}, authenticate...)
 
 		e.GET("/playground", func(c *echo.Context) error {
 			playground.Handler("GraphQL", "/query").ServeHTTP(c.Response(), c.Request())
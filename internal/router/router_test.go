@@ -0,0 +1,95 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph"
+	"github.com/labstack/echo/v5"
+)
+
+type mockReadinessChecker struct {
+	report graph.Readiness
+}
+
+func (m *mockReadinessChecker) Readiness(ctx context.Context) graph.Readiness {
+	return m.report
+}
+
+func get(t *testing.T, e *echo.Echo, path string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	checker := &mockReadinessChecker{}
+	e := NewRouter(echo.New(), &handler.Server{}, nil, checker, "v1.2.3")
+
+	code, body := get(t, e, "/healthz")
+	if code != http.StatusOK || body["status"] != "ok" || body["version"] != "v1.2.3" {
+		t.Errorf("unexpected response %d %v", code, body)
+	}
+	if _, ok := body["redis"]; ok {
+		t.Errorf("liveness must not report dependencies, got %v", body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		report graph.Readiness
+		code   int
+		status string
+	}{
+		{
+			name: "ready",
+			report: graph.Readiness{
+				Ready:         true,
+				Redis:         graph.Check{Status: graph.CheckOK},
+				StreamReader:  graph.ReaderCheck{Status: graph.CheckOK, State: "running"},
+				Subscriptions: graph.SubscriptionCounts{Total: 3, Rooms: map[string]int{"general": 3}},
+			},
+			code:   http.StatusOK,
+			status: "ok",
+		},
+		{
+			name: "redis down",
+			report: graph.Readiness{
+				Redis:        graph.Check{Status: graph.CheckUnavailable, Error: "connection refused"},
+				StreamReader: graph.ReaderCheck{Status: graph.CheckUnavailable, State: "reconnecting"},
+			},
+			code:   http.StatusServiceUnavailable,
+			status: "unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewRouter(echo.New(), &handler.Server{}, nil, &mockReadinessChecker{report: tt.report}, "v1.2.3")
+
+			code, body := get(t, e, "/readyz")
+			if code != tt.code || body["status"] != tt.status || body["version"] != "v1.2.3" {
+				t.Errorf("unexpected response %d %v", code, body)
+			}
+			redis, _ := body["redis"].(map[string]interface{})
+			if redis["status"] != tt.report.Redis.Status {
+				t.Errorf("expected redis status %q, got %v", tt.report.Redis.Status, body["redis"])
+			}
+			subscriptions, _ := body["subscriptions"].(map[string]interface{})
+			if subscriptions["total"] != float64(tt.report.Subscriptions.Total) {
+				t.Errorf("expected %d subscriptions, got %v", tt.report.Subscriptions.Total, body["subscriptions"])
+			}
+		})
+	}
+}
@@ -0,0 +1,518 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/redis/go-redis/v9"
+)
+
+// GroupConfig configures a GroupReader
+type GroupConfig struct {
+	// Group is the consumer group shared by every instance of a deployment. It
+	// is created on every followed room stream and also names the Pub/Sub
+	// channels the instances announce entries on.
+	Group string
+	// Consumer identifies this instance within the group, see InstanceID
+	Consumer string
+	// ClaimIdle is how long an entry stays pending before another consumer claims it
+	ClaimIdle time.Duration
+	// ClaimInterval is how often pending entries are checked
+	ClaimInterval time.Duration
+}
+
+// InstanceID returns a consumer name unique to this process
+func InstanceID() string {
+	host, err := os.Hostname()
+	if !errors.Is(err, nil) || host == "" {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// GroupReader follows the streams of a changing set of rooms as one consumer
+// of a group shared by every instance. The group splits the entries between
+// the instances: each entry is read by one consumer, which announces it to all
+// instances over Pub/Sub and then acknowledges it with XACK, so XPENDING and
+// XINFO CONSUMERS show which instance processed what. Entries left pending by
+// a dead instance are claimed with XAUTOCLAIM after ClaimIdle and announced
+// by the claiming instance.
+//
+// Announcements only carry the entry ID. On each one, an instance reads its
+// room stream from the last entry it delivered up to the announced one and
+// hands those entries to its subscribers, so every instance delivers every
+// entry of its rooms exactly once and in stream order, however the
+// announcements of different instances interleave. Announcements missed
+// while the subscription was down are made up for every ClaimInterval, when
+// each followed room catches up with the end of its stream. A room only
+// delivers the entries added after it was followed. It reads Redis directly, so it only
+// works with the Redis Streams broker.
+type GroupReader struct {
+	redis  datastore.RedisClient
+	rooms  func() []string
+	config GroupConfig
+
+	// publish announces an entry ID on a channel
+	publish func(ctx context.Context, channel string, id string) error
+	// subscribe starts receiving the announcements on the channels of the group
+	subscribe func(ctx context.Context, pattern string) (<-chan *redis.Message, io.Closer, error)
+
+	mutex     sync.Mutex
+	offsets   map[string]string   // room ID -> ID of the last entry delivered
+	groups    map[string]struct{} // rooms whose stream has the group
+	lastClaim time.Time
+	now       func() time.Time
+
+	reads     atomic.Uint64
+	delivered atomic.Uint64
+	invalid   atomic.Uint64
+	acked     atomic.Uint64
+	claimed   atomic.Uint64
+}
+
+// NewGroupReader creates a GroupReader following the rooms returned by rooms.
+// Entries are announced over the Pub/Sub of client, which must be a
+// broker.PubSubClient.
+func NewGroupReader(client datastore.RedisClient, rooms func() []string, config GroupConfig) *GroupReader {
+	g := &GroupReader{
+		redis:   client,
+		rooms:   rooms,
+		config:  config,
+		offsets: map[string]string{},
+		groups:  map[string]struct{}{},
+		now:     time.Now,
+	}
+
+	pubsub, ok := client.(broker.PubSubClient)
+	if !ok {
+		errNoPubSub := errors.New("redis client does not support Pub/Sub")
+		g.publish = func(context.Context, string, string) error {
+			return errNoPubSub
+		}
+		g.subscribe = func(context.Context, string) (<-chan *redis.Message, io.Closer, error) {
+			return nil, nil, errNoPubSub
+		}
+		return g
+	}
+	g.publish = func(ctx context.Context, channel, id string) error {
+		return pubsub.Publish(ctx, channel, id).Err()
+	}
+	g.subscribe = func(ctx context.Context, pattern string) (<-chan *redis.Message, io.Closer, error) {
+		sub := pubsub.PSubscribe(ctx, pattern)
+		return sub.Channel(), sub, nil
+	}
+	return g
+}
+
+// Stats returns a snapshot of the reader counters
+func (g *GroupReader) Stats() ReaderStats {
+	return ReaderStats{
+		Reads:     g.reads.Load(),
+		Delivered: g.delivered.Load(),
+		Invalid:   g.invalid.Load(),
+		Acked:     g.acked.Load(),
+		Claimed:   g.claimed.Load(),
+	}
+}
+
+// channel returns the Pub/Sub channel the entries of a room are announced on
+func (g *GroupReader) channel(roomID string) string {
+	return g.config.Group + ":" + RoomStreamKey(roomID)
+}
+
+// Consume reads new entries with XREADGROUP, announces and acknowledges them,
+// and hands the entries announced by any instance to handle. Pending entries
+// of dead consumers are claimed every ClaimInterval. Once ctx is cancelled
+// the consumer of this instance is removed from the group.
+func (g *GroupReader) Consume(ctx context.Context, handle func(model.RoomEvent)) error {
+	slog.InfoContext(ctx, "Reading room streams through a consumer group", slog.String("consumer", g.config.Consumer), slog.String("group", g.config.Group))
+
+	announcements, receiver, err := g.subscribe(ctx, g.config.Group+":*")
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to subscribe to consumer group %s: %w", g.config.Group, err)
+	}
+	defer func() {
+		if err := receiver.Close(); !errors.Is(err, nil) {
+			slog.WarnContext(ctx, "Error closing consumer group subscription", logging.Err(err))
+		}
+	}()
+
+	readCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	delivered := make(chan error, 1)
+	go func() {
+		err := g.deliver(readCtx, announcements, handle)
+		stop()
+		delivered <- err
+	}()
+
+	err = g.read(readCtx)
+	stop()
+	if deliverErr := <-delivered; !errors.Is(deliverErr, nil) && !errors.Is(deliverErr, context.Canceled) {
+		err = deliverErr
+	}
+
+	if !errors.Is(ctx.Err(), nil) {
+		g.removeConsumer(context.WithoutCancel(ctx))
+		return ctx.Err()
+	}
+	return err
+}
+
+// read runs XREADGROUP on the followed rooms, one hash slot at a time, until
+// ctx is done or a read fails
+func (g *GroupReader) read(ctx context.Context) error {
+	return readLanes(ctx, broker.Slot, g.follow, g.readGroup)
+}
+
+// follow syncs the followed rooms and claims their pending entries once every
+// ClaimInterval. It returns the followed rooms.
+func (g *GroupReader) follow(ctx context.Context) ([]string, error) {
+	roomIDs, err := g.syncGroups(ctx)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	g.mutex.Lock()
+	due := g.now().Sub(g.lastClaim) >= g.config.ClaimInterval
+	if due {
+		g.lastClaim = g.now()
+	}
+	g.mutex.Unlock()
+	if due {
+		if err := g.claimPending(ctx, roomIDs); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	return roomIDs, nil
+}
+
+// readGroup waits for new entries of rooms of one slot with XREADGROUP, and
+// announces and acknowledges them
+func (g *GroupReader) readGroup(ctx context.Context, roomIDs []string) error {
+	keys := make([]string, 0, len(roomIDs)*2)
+	for _, roomID := range roomIDs {
+		keys = append(keys, RoomStreamKey(roomID))
+	}
+	for range roomIDs {
+		keys = append(keys, ">")
+	}
+
+	g.reads.Add(1)
+	start := time.Now()
+	streams, err := g.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    g.config.Group,
+		Consumer: g.config.Consumer,
+		Streams:  keys,
+		Count:    constants.RedisStreamCount,
+		Block:    constants.RedisStreamBlock,
+	}).Result()
+	entries := 0
+	for _, stream := range streams {
+		entries += len(stream.Messages)
+	}
+	traceRead(ctx, "XREADGROUP", start, len(roomIDs), entries, err)
+
+	if !errors.Is(err, nil) {
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		// Block timed out without new entries
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		// A room stream was deleted along with its group, recreate the groups
+		if redis.HasErrorPrefix(err, "NOGROUP") {
+			g.mutex.Lock()
+			for _, roomID := range roomIDs {
+				delete(g.groups, roomID)
+			}
+			g.mutex.Unlock()
+			for _, roomID := range roomIDs {
+				if err := g.Follow(ctx, roomID); !errors.Is(err, nil) {
+					return err
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("failed to read consumer group %s: %w", g.config.Group, err)
+	}
+
+	for _, stream := range streams {
+		if err := g.announce(ctx, stream.Stream, stream.Messages); !errors.Is(err, nil) {
+			return err
+		}
+	}
+	return nil
+}
+
+// announce publishes the last of the entries this consumer took from a stream,
+// which stands for all of them, and acknowledges them
+func (g *GroupReader) announce(ctx context.Context, key string, entries []redis.XMessage) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	roomID := broker.RoomIDFromStreamKey(key)
+	last := entries[len(entries)-1].ID
+	if err := g.publish(ctx, g.channel(roomID), last); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to announce entries of stream %s: %w", key, err)
+	}
+
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+	acked, err := g.redis.XAck(ctx, key, g.config.Group, ids...).Result()
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to acknowledge entries in stream %s: %w", key, err)
+	}
+	g.acked.Add(uint64(acked))
+
+	return nil
+}
+
+// deliver hands the entries of the followed rooms up to each announced entry
+// to handle, in stream order, until ctx is done or a read fails. Every
+// ClaimInterval it catches up with the end of every followed room.
+func (g *GroupReader) deliver(ctx context.Context, announcements <-chan *redis.Message, handle func(model.RoomEvent)) error {
+	ticker := time.NewTicker(g.config.ClaimInterval)
+	defer ticker.Stop()
+
+	prefix := g.config.Group + ":"
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := g.catchUpAll(ctx, handle); !errors.Is(err, nil) {
+				return err
+			}
+		case msg, ok := <-announcements:
+			if !ok {
+				return fmt.Errorf("consumer group %s subscription closed", g.config.Group)
+			}
+			roomID := broker.RoomIDFromStreamKey(strings.TrimPrefix(msg.Channel, prefix))
+			if err := g.catchUp(ctx, roomID, msg.Payload, handle); !errors.Is(err, nil) {
+				return err
+			}
+		}
+	}
+}
+
+// catchUp hands the entries of a followed room after the last one delivered,
+// up to and including until, to handle
+func (g *GroupReader) catchUp(ctx context.Context, roomID, until string, handle func(model.RoomEvent)) error {
+	key := RoomStreamKey(roomID)
+	for {
+		g.mutex.Lock()
+		after, followed := g.offsets[roomID]
+		g.mutex.Unlock()
+		if !followed || CompareStreamIDs(until, after) <= 0 {
+			return nil
+		}
+
+		entries, err := g.redis.XRangeN(ctx, key, "("+after, until, constants.RedisStreamCount).Result()
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("failed to read announced entries of stream %s: %w", key, err)
+		}
+		if len(entries) == 0 {
+			// The entries were trimmed or the stream deleted meanwhile
+			g.advance(roomID, until)
+			return nil
+		}
+
+		for _, entry := range entries {
+			event, err := decodeEvent(roomID, broker.Entry{ID: entry.ID, Values: entry.Values})
+			if !errors.Is(err, nil) {
+				// Skip the entry rather than stall the room on it forever
+				g.invalid.Add(1)
+				slog.WarnContext(ctx, "Skipping invalid entry", slog.String(logging.RoomKey, roomID), slog.String(logging.MessageIDKey, entry.ID), logging.Err(err))
+			} else {
+				handle(event)
+				g.delivered.Add(1)
+			}
+			g.advance(roomID, entry.ID)
+		}
+	}
+}
+
+// catchUpAll hands the entries of every followed room up to the end of its
+// stream to handle
+func (g *GroupReader) catchUpAll(ctx context.Context, handle func(model.RoomEvent)) error {
+	g.mutex.Lock()
+	roomIDs := make([]string, 0, len(g.offsets))
+	for roomID := range g.offsets {
+		roomIDs = append(roomIDs, roomID)
+	}
+	g.mutex.Unlock()
+
+	for _, roomID := range roomIDs {
+		last, err := g.redis.XRevRangeN(ctx, RoomStreamKey(roomID), "+", "-", 1).Result()
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("failed to read end of stream for room %s: %w", roomID, err)
+		}
+		if len(last) == 0 {
+			continue
+		}
+		if err := g.catchUp(ctx, roomID, last[0].ID, handle); !errors.Is(err, nil) {
+			return err
+		}
+	}
+	return nil
+}
+
+// advance records id as the last entry delivered of a room still followed
+func (g *GroupReader) advance(roomID, id string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.offsets[roomID]; ok {
+		g.offsets[roomID] = id
+	}
+}
+
+// claimPending takes over the entries that stayed pending for longer than
+// ClaimIdle, left by any consumer of the group, and announces them
+func (g *GroupReader) claimPending(ctx context.Context, roomIDs []string) error {
+	for _, roomID := range roomIDs {
+		key := RoomStreamKey(roomID)
+		start := "0-0"
+
+		for {
+			entries, next, err := g.redis.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   key,
+				Group:    g.config.Group,
+				Consumer: g.config.Consumer,
+				MinIdle:  g.config.ClaimIdle,
+				Start:    start,
+				Count:    constants.RedisStreamCount,
+			}).Result()
+			if !errors.Is(err, nil) {
+				return fmt.Errorf("failed to claim pending entries in stream %s: %w", key, err)
+			}
+
+			if len(entries) > 0 {
+				slog.InfoContext(ctx, "Claimed pending entries", slog.String(logging.RoomKey, roomID), slog.Int("entries", len(entries)))
+				g.claimed.Add(uint64(len(entries)))
+			}
+			if err := g.announce(ctx, key, entries); !errors.Is(err, nil) {
+				return err
+			}
+
+			// XAUTOCLAIM returns 0-0 once the whole pending list was scanned
+			if next == "0-0" {
+				break
+			}
+			start = next
+		}
+	}
+
+	return nil
+}
+
+// removeConsumer deletes the consumer of this instance from the group on
+// every followed room stream. Entries still pending for it are dropped from
+// the group; they were never announced, but the next announcement of their
+// room covers them.
+func (g *GroupReader) removeConsumer(ctx context.Context) {
+	g.mutex.Lock()
+	keys := make([]string, 0, len(g.groups))
+	for roomID := range g.groups {
+		keys = append(keys, RoomStreamKey(roomID))
+	}
+	g.mutex.Unlock()
+
+	for _, key := range keys {
+		dropped, err := g.redis.XGroupDelConsumer(ctx, key, g.config.Group, g.config.Consumer).Result()
+		if !errors.Is(err, nil) && !redis.HasErrorPrefix(err, "NOGROUP") {
+			slog.WarnContext(ctx, "Error removing consumer", slog.String("stream", key), logging.Err(err))
+			continue
+		}
+		if dropped > 0 {
+			slog.InfoContext(ctx, "Dropped pending entries of removed consumer", slog.String("stream", key), slog.Int64("entries", dropped))
+		}
+	}
+}
+
+// syncGroups forgets rooms that are no longer followed and creates the
+// consumer group on newly followed room streams. It returns the followed rooms.
+func (g *GroupReader) syncGroups(ctx context.Context) ([]string, error) {
+	// The room list is taken under the mutex, so a room followed after the
+	// list was taken keeps the offset Follow recorded
+	g.mutex.Lock()
+	roomIDs := g.rooms()
+	followed := make(map[string]struct{}, len(roomIDs))
+	for _, roomID := range roomIDs {
+		followed[roomID] = struct{}{}
+	}
+	for roomID := range g.offsets {
+		if _, ok := followed[roomID]; !ok {
+			delete(g.offsets, roomID)
+		}
+	}
+	g.mutex.Unlock()
+
+	for _, roomID := range roomIDs {
+		if err := g.Follow(ctx, roomID); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	return roomIDs, nil
+}
+
+// Follow starts a room at the current end of its stream unless the room is
+// followed already, and creates the group on the stream unless it has it. A
+// new group starts at that entry; an existing one keeps its position, and
+// the backlog it holds is announced like new entries, which instances
+// following the room have delivered already.
+func (g *GroupReader) Follow(ctx context.Context, roomID string) error {
+	g.mutex.Lock()
+	_, followed := g.offsets[roomID]
+	_, grouped := g.groups[roomID]
+	g.mutex.Unlock()
+	if followed && grouped {
+		return nil
+	}
+
+	key := RoomStreamKey(roomID)
+	last, err := g.redis.XRevRangeN(ctx, key, "+", "-", 1).Result()
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to read end of stream for room %s: %w", roomID, err)
+	}
+	start := "0-0"
+	if len(last) > 0 {
+		start = last[0].ID
+	}
+
+	if !grouped {
+		err = g.redis.XGroupCreateMkStream(ctx, key, g.config.Group, start).Err()
+		if !errors.Is(err, nil) && !redis.HasErrorPrefix(err, "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group for room %s: %w", roomID, err)
+		}
+	}
+
+	g.mutex.Lock()
+	g.groups[roomID] = struct{}{}
+	if _, ok := g.offsets[roomID]; !ok {
+		g.offsets[roomID] = start
+	}
+	g.mutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+// groupReplyError is an error reply of Redis, as go-redis reports them
+type groupReplyError string
+
+func (e groupReplyError) Error() string { return string(e) }
+
+func (groupReplyError) RedisError() {}
+
+// announcementHub is an in-process Pub/Sub carrying the announcements of
+// group readers
+type announcementHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan *redis.Message]string // channel -> channel name prefix
+}
+
+// attach makes g announce over the hub
+func (h *announcementHub) attach(g *GroupReader) {
+	g.publish = func(ctx context.Context, channel, id string) error {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		for sub, prefix := range h.subscribers {
+			if strings.HasPrefix(channel, prefix) {
+				sub <- &redis.Message{Channel: channel, Payload: id}
+			}
+		}
+		return nil
+	}
+	g.subscribe = func(ctx context.Context, pattern string) (<-chan *redis.Message, io.Closer, error) {
+		sub := make(chan *redis.Message, 100)
+		h.mutex.Lock()
+		if h.subscribers == nil {
+			h.subscribers = map[chan *redis.Message]string{}
+		}
+		h.subscribers[sub] = strings.TrimSuffix(pattern, "*")
+		h.mutex.Unlock()
+		return sub, closerFunc(func() error {
+			h.mutex.Lock()
+			delete(h.subscribers, sub)
+			h.mutex.Unlock()
+			return nil
+		}), nil
+	}
+}
+
+// wait waits until n readers subscribed
+func (h *announcementHub) wait(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mutex.Lock()
+		subscribed := len(h.subscribers)
+		h.mutex.Unlock()
+		if subscribed >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d subscribers", n)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// newTestGroupReader creates a reader following room "a" as consumer of the
+// "chat" group, announcing over hub
+func newTestGroupReader(client datastore.RedisClient, hub *announcementHub, consumer string) *GroupReader {
+	g := NewGroupReader(client, func() []string { return []string{"a"} }, GroupConfig{Group: "chat", Consumer: consumer, ClaimIdle: time.Minute, ClaimInterval: time.Hour})
+	hub.attach(g)
+	return g
+}
+
+// consumeMessages runs g until ctx is done and sends the text of every message it delivers
+func consumeMessages(ctx context.Context, g *GroupReader) (<-chan string, <-chan error) {
+	messages := make(chan string, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Consume(ctx, func(event model.RoomEvent) {
+			messages <- event.(*model.MessageCreated).Message.Message
+		})
+	}()
+	return messages, done
+}
+
+// addMessages appends messages to the stream of room "a"
+func addMessages(t *testing.T, client datastore.RedisClient, messages ...string) {
+	t.Helper()
+	for _, message := range messages {
+		err := client.XAdd(context.Background(), &redis.XAddArgs{Stream: RoomStreamKey("a"), Values: map[string]interface{}{constants.RedisMessageField: message}}).Err()
+		if !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+// receive waits for n messages
+func receive(t *testing.T, messages <-chan string, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case message := <-messages:
+			got = append(got, message)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for messages, got %v", got)
+		}
+	}
+	return got
+}
+
+func TestGroupReader_SharesEntriesBetweenInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	hub := &announcementHub{}
+	first := newTestGroupReader(client, hub, "c1")
+	second := newTestGroupReader(client, hub, "c2")
+	for _, g := range []*GroupReader{first, second} {
+		if err := g.Follow(ctx, "a"); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	firstMessages, _ := consumeMessages(ctx, first)
+	secondMessages, _ := consumeMessages(ctx, second)
+	hub.wait(t, 2)
+
+	addMessages(t, client, "m1", "m2", "m3", "m4", "m5")
+
+	// Whichever instance read an entry, both deliver every entry in order
+	for _, messages := range []<-chan string{firstMessages, secondMessages} {
+		if got := receive(t, messages, 5); fmt.Sprint(got) != "[m1 m2 m3 m4 m5]" {
+			t.Errorf("unexpected deliveries: %v", got)
+		}
+	}
+
+	// Each entry was read and acknowledged once across the group
+	deadline := time.Now().Add(2 * time.Second)
+	for first.Stats().Acked+second.Stats().Acked < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if acked := first.Stats().Acked + second.Stats().Acked; acked != 5 {
+		t.Errorf("expected 5 acknowledged entries, got %d", acked)
+	}
+}
+
+func TestGroupReader_ClaimsEntriesOfDeadConsumers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	hub := &announcementHub{}
+	g := newTestGroupReader(client, hub, "c1")
+	g.config.ClaimIdle = time.Millisecond
+	if err := g.Follow(ctx, "a"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A consumer read two entries and died before announcing them
+	addMessages(t, client, "lost", "lost too")
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "chat", Consumer: "dead", Streams: []string{RoomStreamKey("a"), ">"}, Block: -1}).Err(); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	messages, _ := consumeMessages(ctx, g)
+	if got := receive(t, messages, 2); fmt.Sprint(got) != "[lost lost too]" {
+		t.Errorf("unexpected deliveries: %v", got)
+	}
+	if stats := g.Stats(); stats.Claimed != 2 || stats.Acked != 2 {
+		t.Errorf("expected 2 claimed and acknowledged entries, got %+v", stats)
+	}
+}
+
+func TestGroupReader_SkipsEntriesOlderThanTheFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The group existed before and kept a backlog
+	client := datastore.NewMemoryClient()
+	if err := client.XGroupCreateMkStream(ctx, RoomStreamKey("a"), "chat", "0-0").Err(); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addMessages(t, client, "backlog", "old")
+
+	hub := &announcementHub{}
+	g := newTestGroupReader(client, hub, "c1")
+	if err := g.Follow(ctx, "a"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	messages, _ := consumeMessages(ctx, g)
+	hub.wait(t, 1)
+	addMessages(t, client, "new")
+
+	if got := receive(t, messages, 1); fmt.Sprint(got) != "[new]" {
+		t.Errorf("expected only the entry added after the follow, got %v", got)
+	}
+	select {
+	case message := <-messages:
+		t.Errorf("unexpected delivery %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGroupReader_RemovesConsumerOnStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock := &mockRedisClient{
+		xReadGroupFunc: func(ctx context.Context, args *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+			cancel()
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			cmd.SetErr(context.Canceled)
+			return cmd
+		},
+	}
+	g := newTestGroupReader(mock, &announcementHub{}, "c1")
+	if err := g.Consume(ctx, func(model.RoomEvent) {}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if fmt.Sprint(mock.removed) != "[room:a chat c1]" {
+		t.Errorf("expected the consumer to be removed, got %v", mock.removed)
+	}
+}
+
+func TestGroupReader_RecreatesDeletedGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reads := 0
+	mock := &mockRedisClient{
+		xReadGroupFunc: func(ctx context.Context, args *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+			reads++
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			if reads == 1 {
+				cmd.SetErr(groupReplyError("NOGROUP No such key 'room:a' or consumer group 'chat'"))
+				return cmd
+			}
+			cancel()
+			cmd.SetErr(context.Canceled)
+			return cmd
+		},
+	}
+
+	g := newTestGroupReader(mock, &announcementHub{}, "c1")
+	if err := g.Consume(ctx, func(model.RoomEvent) {}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if len(mock.groupsCreated) != 2 {
+		t.Errorf("expected the group to be created again after NOGROUP, got %v", mock.groupsCreated)
+	}
+}
+
+func TestGroupReader_CatchesUpMissedAnnouncements(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := datastore.NewMemoryClient()
+	g := newTestGroupReader(client, &announcementHub{}, "c1")
+	g.config.ClaimInterval = 10 * time.Millisecond
+	if err := g.Follow(ctx, "a"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Another instance read the entry and its announcement got lost
+	g.publish = func(context.Context, string, string) error { return nil }
+	messages, _ := consumeMessages(ctx, g)
+	addMessages(t, client, "late")
+
+	if got := receive(t, messages, 1); fmt.Sprint(got) != "[late]" {
+		t.Errorf("unexpected deliveries: %v", got)
+	}
+}
+
+func TestGroupReader_RequiresPubSub(t *testing.T) {
+	g := NewGroupReader(&mockRedisClient{}, func() []string { return nil }, GroupConfig{Group: "chat", Consumer: "c1"})
+	if err := g.Consume(context.Background(), func(model.RoomEvent) {}); err == nil {
+		t.Error("expected an error without Pub/Sub")
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
+	"github.com/redis/go-redis/v9"
+)
+
+// RoomMembersKey returns the Redis set key holding the IDs of the users who
+// joined a room
+func RoomMembersKey(roomID string) string {
+	return RoomStreamKey(roomID) + constants.RedisRoomMembersSuffix
+}
+
+// joinScript adds a user to the members of a room. KEYS are the room stream
+// and the members set. ARGV are "*" to also append the joined event to the
+// room stream or "" not to, the trim arguments, the user ID, then the fields
+// of the event. It returns nil when the user was a member already, and
+// otherwise the ID of the event appended, if any.
+var joinScript = datastore.NewScript(luaXAdd+`
+if redis.call('SADD', KEYS[2], ARGV[5]) == 0 then
+  return false
+end
+if ARGV[1] ~= '*' then
+  return ''
+end
+return xadd(KEYS[1], '*', ARGV[2], ARGV[3], ARGV[4], {unpack(ARGV, 6)})
+`, func(ctx context.Context, c datastore.RedisClient, keys []string, args []interface{}) (interface{}, error) {
+	added, err := c.SAdd(ctx, keys[1], args[4]).Result()
+	if !errors.Is(err, nil) || added == 0 {
+		return nil, err
+	}
+	if fmt.Sprint(args[0]) != "*" {
+		return "", nil
+	}
+	return xAdd(ctx, c, keys[0], "*", args[1:4], args[5:])
+})
+
+// JoinRoom adds user to the members of a room and appends a joined event to
+// the room stream, unless the user joined before. It reports whether the user
+// was added. With the Streams broker the script appends the event itself.
+// Other brokers publish it once the user was added, and withdraw the
+// membership should that fail.
+func (s *MessageService) JoinRoom(ctx context.Context, roomID string, user *model.User, retention RetentionPolicy) (bool, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return false, err
+	}
+
+	now := s.now().UTC()
+	trim := retention.Trim(now)
+	values := map[string]interface{}{
+		constants.RedisEventField:      constants.MessageEventJoined,
+		constants.RedisAuthorField:     user.ID,
+		constants.RedisAuthorNameField: user.Name,
+		constants.RedisCreatedAtField:  now.Format(time.RFC3339Nano),
+	}
+
+	keys := []string{RoomStreamKey(roomID), RoomMembersKey(roomID)}
+	run := func(ctx context.Context, id string) (string, bool, error) {
+		args := append([]interface{}{id}, trimArgs(trim)...)
+		args = append(args, user.ID)
+		args = append(args, fieldArgs(values)...)
+
+		eventID, err := joinScript.Run(ctx, s.redis, keys, args...).Text()
+		if errors.Is(err, redis.Nil) {
+			return "", false, nil
+		}
+		if !errors.Is(err, nil) {
+			return "", false, fmt.Errorf("failed to join room: %w", err)
+		}
+		return eventID, true, nil
+	}
+
+	if s.scriptsPublish() {
+		var joined bool
+		_, _, err := s.traced(ctx, roomID, values, func(ctx context.Context) (string, error) {
+			id, added, err := run(ctx, "*")
+			joined = added
+			return id, err
+		})
+		return joined && errors.Is(err, nil), err
+	}
+
+	_, joined, err := run(ctx, "")
+	if !errors.Is(err, nil) || !joined {
+		return false, err
+	}
+	if _, _, err := s.publish(ctx, roomID, values, trim); !errors.Is(err, nil) {
+		if rollbackErr := s.redis.SRem(ctx, RoomMembersKey(roomID), user.ID).Err(); !errors.Is(rollbackErr, nil) {
+			return false, fmt.Errorf("failed to publish %s event: %w (membership not withdrawn: %v)", constants.MessageEventJoined, err, rollbackErr)
+		}
+		return false, fmt.Errorf("failed to publish %s event: %w", constants.MessageEventJoined, err)
+	}
+	return true, nil
+}
+
+// decodeJoin converts a joined stream entry into a room event
+func decodeJoin(roomID string, entry broker.Entry) (model.RoomEvent, error) {
+	id, _ := entry.Values[constants.RedisAuthorField].(string)
+	if id == "" {
+		return nil, fmt.Errorf("entry %s has no %q field", entry.ID, constants.RedisAuthorField)
+	}
+	name, _ := entry.Values[constants.RedisAuthorNameField].(string)
+
+	return &model.MemberJoined{ID: entry.ID, RoomID: roomID, User: &model.User{ID: id, Name: name}, Trace: tracing.Extract(entry.Values)}, nil
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+)
+
+func TestJoinRoom(t *testing.T) {
+	ctx := context.Background()
+	alice := &model.User{ID: "u-1", Name: "Alice"}
+
+	for name, newBroker := range map[string]func(*mockRedisClient) broker.Broker{
+		"streams": func(mock *mockRedisClient) broker.Broker { return broker.NewStreams(mock) },
+		"memory":  func(*mockRedisClient) broker.Broker { return broker.NewMemory() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			mock := newAppendingMock()
+			b := newBroker(mock)
+			svc := NewMessageService(mock, b)
+
+			// Joining again leaves the room unchanged
+			for i, want := range []bool{true, false} {
+				joined, err := svc.JoinRoom(ctx, "general", alice, RetentionPolicy{})
+				if !errors.Is(err, nil) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if joined != want {
+					t.Errorf("join %d: expected joined %v, got %v", i+1, want, joined)
+				}
+			}
+			if _, ok := mock.sets[RoomMembersKey("general")][alice.ID]; !ok {
+				t.Errorf("expected %s to be a member", alice.ID)
+			}
+
+			entries, err := b.Range(ctx, "general", "-", "+", 10)
+			if !errors.Is(err, nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("expected one joined event, got %d entries", len(entries))
+			}
+			event, err := decodeEvent("general", entries[0])
+			if !errors.Is(err, nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if joined, ok := event.(*model.MemberJoined); !ok || joined.User.ID != alice.ID || joined.User.Name != alice.Name {
+				t.Errorf("expected Alice to have joined, got %+v", event)
+			}
+
+			// Reads skip joins
+			messages, err := svc.ReadMessages(ctx, "general")
+			if !errors.Is(err, nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(messages) != 0 {
+				t.Errorf("expected no messages, got %d", len(messages))
+			}
+		})
+	}
+}
@@ -2,143 +2,763 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
-	"github.com/redis/go-redis/v9"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// MessageService handles message publishing and retrieval via Redis
+// ErrInvalidRoomID is returned when a room ID is empty or contains unsupported characters
+var ErrInvalidRoomID = errors.New("invalid room ID")
+
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidateRoomID checks that a room ID can be safely used as part of a Redis key
+func ValidateRoomID(roomID string) error {
+	if !roomIDPattern.MatchString(roomID) {
+		return fmt.Errorf("%w: %q", ErrInvalidRoomID, roomID)
+	}
+	return nil
+}
+
+// RoomStreamKey returns the Redis stream key holding the messages of a room
+func RoomStreamKey(roomID string) string {
+	return broker.StreamKey(roomID)
+}
+
+// RoomRevisionsKey returns the Redis hash key holding the latest revisions of
+// the edited and deleted messages of a room
+func RoomRevisionsKey(roomID string) string {
+	return RoomStreamKey(roomID) + constants.RedisRoomRevisionsSuffix
+}
+
+// RoomThreadKey returns the Redis stream key holding the replies to a message of a room
+func RoomThreadKey(roomID, parentID string) string {
+	return broker.StreamKey(threadRoomID(roomID, parentID))
+}
+
+// threadRoomID returns the ID the broker knows the thread of a message by, so
+// its stream key is RoomThreadKey
+func threadRoomID(roomID, parentID string) string {
+	return roomID + constants.RedisRoomThreadSuffix + parentID
+}
+
+// RoomThreadsKey returns the Redis hash key holding the reply counts and last
+// reply times of the messages of a room
+func RoomThreadsKey(roomID string) string {
+	return RoomStreamKey(roomID) + constants.RedisRoomThreadsSuffix
+}
+
+// Fields of the threads hash, each one prefixed by the ID of the parent message
+const (
+	threadCountField = ":count" // replies that were not deleted
+	threadLastField  = ":last"  // RFC 3339 time of the last reply
+)
+
+var (
+	// ErrInvalidMessage is returned when a message to publish is empty or malformed
+	ErrInvalidMessage = errors.New("invalid message")
+	// ErrMessageNotFound is returned when a message does not exist or was deleted
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// Content types as stored in stream entries
+var contentTypes = map[model.ContentType]string{
+	model.ContentTypePlain:    "plain",
+	model.ContentTypeMarkdown: "markdown",
+}
+
+// decodeEvent converts a stream entry into the room event it records
+func decodeEvent(roomID string, entry broker.Entry) (model.RoomEvent, error) {
+	msg, event, err := decodeMessage(roomID, entry)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	switch event {
+	case constants.MessageEventReacted, constants.MessageEventUnreacted:
+		return decodeReaction(roomID, entry, event)
+	case constants.MessageEventJoined:
+		return decodeJoin(roomID, entry)
+	case constants.MessageEventRoomDeleted:
+		return &model.RoomDeleted{ID: entry.ID, RoomID: roomID}, nil
+	case constants.MessageEventUpdated:
+		return &model.MessageUpdated{ID: entry.ID, RoomID: roomID, Message: msg}, nil
+	case constants.MessageEventDeleted:
+		return &model.MessageDeleted{ID: entry.ID, RoomID: roomID, Message: msg}, nil
+	default:
+		return &model.MessageCreated{ID: entry.ID, RoomID: roomID, Message: msg}, nil
+	}
+}
+
+// decodeMessage converts a stream entry into a message, along with the
+// constants.MessageEvent value of the entry. Only the message field is
+// required: entries written before authors, timestamps, content types and
+// metadata were stored are anonymous plain text messages created at the time
+// of their ID. Update and deletion entries decode to the revision they
+// produced, identified by the ID of their target message. Reaction, join and
+// room deletion entries carry no message and decode to nil.
+func decodeMessage(roomID string, entry broker.Entry) (*model.Message, string, error) {
+	event := constants.MessageEventCreated
+	if value, ok := entry.Values[constants.RedisEventField].(string); ok {
+		event = value
+	}
+	switch event {
+	case constants.MessageEventCreated, constants.MessageEventUpdated, constants.MessageEventDeleted:
+	case constants.MessageEventReacted, constants.MessageEventUnreacted, constants.MessageEventJoined, constants.MessageEventRoomDeleted:
+		return nil, event, nil
+	default:
+		return nil, "", fmt.Errorf("entry %s has an unknown event %q", entry.ID, event)
+	}
+
+	msgValue, ok := entry.Values[constants.RedisMessageField].(string)
+	if !ok {
+		return nil, "", fmt.Errorf("entry %s has no %q field", entry.ID, constants.RedisMessageField)
+	}
+
+	m := &model.Message{
+		ID:          entry.ID,
+		RoomID:      roomID,
+		Message:     msgValue,
+		ContentType: model.ContentTypePlain,
+		Trace:       tracing.Extract(entry.Values),
+	}
+
+	if event != constants.MessageEventCreated {
+		target, _ := entry.Values[constants.RedisTargetField].(string)
+		if !errors.Is(ValidateStreamID(target), nil) {
+			return nil, "", fmt.Errorf("entry %s has an invalid %q field", entry.ID, constants.RedisTargetField)
+		}
+		editedAt, err := time.Parse(time.RFC3339Nano, fmt.Sprint(entry.Values[constants.RedisEditedAtField]))
+		if !errors.Is(err, nil) {
+			return nil, "", fmt.Errorf("entry %s has an invalid %q field: %w", entry.ID, constants.RedisEditedAtField, err)
+		}
+		m.ID = target
+		m.EditedAt = &editedAt
+		m.Deleted = event == constants.MessageEventDeleted
+	}
+	if id, ok := entry.Values[constants.RedisAuthorField].(string); ok && id != "" {
+		name, _ := entry.Values[constants.RedisAuthorNameField].(string)
+		m.Author = &model.User{ID: id, Name: name}
+	}
+
+	if value, ok := entry.Values[constants.RedisCreatedAtField].(string); ok {
+		createdAt, err := time.Parse(time.RFC3339Nano, value)
+		if !errors.Is(err, nil) {
+			return nil, "", fmt.Errorf("entry %s has an invalid %q field: %w", entry.ID, constants.RedisCreatedAtField, err)
+		}
+		m.CreatedAt = createdAt
+	} else if ms, _, err := broker.ParseID(m.ID); errors.Is(err, nil) {
+		m.CreatedAt = time.UnixMilli(int64(ms)).UTC()
+	}
+
+	if value, ok := entry.Values[constants.RedisContentTypeField].(string); ok {
+		for contentType, stored := range contentTypes {
+			if value == stored {
+				m.ContentType = contentType
+			}
+		}
+	}
+
+	if value, ok := entry.Values[constants.RedisMetadataField].(string); ok && value != "" {
+		if err := json.Unmarshal([]byte(value), &m.Metadata); !errors.Is(err, nil) {
+			return nil, "", fmt.Errorf("entry %s has an invalid %q field: %w", entry.ID, constants.RedisMetadataField, err)
+		}
+	}
+
+	if value, ok := entry.Values[constants.RedisParentField].(string); ok && value != "" {
+		m.ParentID = &value
+	}
+	return m, event, nil
+}
+
+// MessageInput is a message to publish
+type MessageInput struct {
+	Message     string
+	ContentType model.ContentType // plain when empty
+	Metadata    map[string]interface{}
+	Author      *model.User // nil for an anonymous message
+	ParentID    string      // message replied to, empty for a message posted to the room itself
+}
+
+// revision is the latest state of an edited or deleted message, as kept in
+// the revisions hash of its room
+type revision struct {
+	Message  string                 `json:"message"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	EditedAt time.Time              `json:"editedAt"`
+	Deleted  bool                   `json:"deleted,omitempty"`
+}
+
+// MessageService handles message publishing and retrieval through a broker,
+// keeping the latest revisions of edited messages, the threads of replies and
+// the reactions in Redis
 type MessageService struct {
-	redis datastore.RedisClient
+	redis  datastore.RedisClient
+	broker broker.Broker
+	now    func() time.Time
 }
 
 // NewMessageService creates a new MessageService
-func NewMessageService(redis datastore.RedisClient) *MessageService {
+func NewMessageService(redis datastore.RedisClient, b broker.Broker) *MessageService {
 	return &MessageService{
-		redis: redis,
+		redis:  redis,
+		broker: b,
+		now:    time.Now,
 	}
 }
 
-// PublishMessage publishes a message to Redis stream
-func (s *MessageService) PublishMessage(ctx context.Context, message string) (*model.Message, error) {
-	if message == "" {
-		return nil, fmt.Errorf("message cannot be empty")
+// PublishMessage publishes a message to a room, trimming the room history
+// according to the room retention policy. A reply is published to the room
+// stream like any message, then added to the thread of its parent.
+func (s *MessageService) PublishMessage(ctx context.Context, roomID string, input MessageInput, retention RetentionPolicy) (*model.Message, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
 	}
 
+	if input.Message == "" {
+		return nil, fmt.Errorf("%w: message cannot be empty", ErrInvalidMessage)
+	}
+
+	contentType := input.ContentType
+	if contentType == "" {
+		contentType = model.ContentTypePlain
+	}
+	storedContentType, ok := contentTypes[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown content type %q", ErrInvalidMessage, contentType)
+	}
+
+	var metadata []byte
+	if len(input.Metadata) > 0 {
+		var err error
+		metadata, err = json.Marshal(input.Metadata)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("%w: metadata is not JSON: %w", ErrInvalidMessage, err)
+		}
+		if len(metadata) > constants.MessageMetadataMaxSize {
+			return nil, fmt.Errorf("%w: metadata exceeds %d bytes", ErrInvalidMessage, constants.MessageMetadataMaxSize)
+		}
+	}
+
+	if input.ParentID != "" {
+		parent, err := s.GetMessage(ctx, roomID, input.ParentID)
+		if !errors.Is(err, nil) {
+			return nil, err
+		}
+		if parent.Deleted {
+			return nil, fmt.Errorf("%w: %s was deleted", ErrMessageNotFound, parent.ID)
+		}
+	}
+
+	now := s.now().UTC()
 	m := &model.Message{
-		Message: message,
+		RoomID:      roomID,
+		Message:     input.Message,
+		Author:      input.Author,
+		CreatedAt:   now,
+		ContentType: contentType,
+		Metadata:    input.Metadata,
 	}
 
-	err := s.redis.XAdd(ctx, &redis.XAddArgs{
-		Stream: constants.RedisStreamRoom,
-		ID:     "*",
-		MaxLen: constants.RedisStreamMaxLen,
-		Values: map[string]interface{}{
-			constants.RedisMessageField: m.Message,
-		},
-	}).Err()
+	values := map[string]interface{}{
+		constants.RedisMessageField:     m.Message,
+		constants.RedisCreatedAtField:   now.Format(time.RFC3339Nano),
+		constants.RedisContentTypeField: storedContentType,
+	}
+	if m.Author != nil {
+		values[constants.RedisAuthorField] = m.Author.ID
+		values[constants.RedisAuthorNameField] = m.Author.Name
+	}
+	if metadata != nil {
+		values[constants.RedisMetadataField] = string(metadata)
+	}
+	if input.ParentID != "" {
+		m.ParentID = &input.ParentID
+		values[constants.RedisParentField] = input.ParentID
+	}
 
+	trim := retention.Trim(now)
+	publish := s.publish
+	if m.ParentID != nil {
+		publish = s.publishReply
+	}
+	id, spanCtx, err := publish(ctx, roomID, values, trim)
 	if !errors.Is(err, nil) {
 		return nil, fmt.Errorf("failed to publish message: %w", err)
 	}
+	m.ID = id
+	m.Trace = spanCtx
 
 	return m, nil
 }
 
-// ReadMessages reads messages from Redis stream
-func (s *MessageService) ReadMessages(ctx context.Context) ([]*model.Message, error) {
-	streams, err := s.redis.XRead(ctx, &redis.XReadArgs{
-		Streams: []string{constants.RedisStreamRoom, "0"}, // Read from beginning, not "$" (new messages only)
-		Count:   100,                                       // Limit to prevent loading too many messages
-		Block:   -1,                                        // Don't block, return immediately
-	}).Result()
+// replyScript appends a reply to the room stream, copies it to the thread of
+// its parent under the same ID and counts it on the parent, all at once.
+// KEYS are the room stream, the thread stream, the threads hash and its field
+// index. ARGV are
+// "*", or the ID the reply was already published and copied under to only
+// count it, the trim arguments, the count and last reply fields of the parent
+// and the last reply time, then the fields of the entry.
+var replyScript = datastore.NewScript(luaXAdd+luaIndex+`
+local id = ARGV[1]
+if id == '*' then
+  local fields = {unpack(ARGV, 8)}
+  id = xadd(KEYS[1], '*', ARGV[2], ARGV[3], ARGV[4], fields)
+  xadd(KEYS[2], id, ARGV[2], ARGV[3], ARGV[4], fields)
+end
+redis.call('HINCRBY', KEYS[3], ARGV[5], 1)
+redis.call('HSET', KEYS[3], ARGV[6], ARGV[7])
+index(KEYS[4], ARGV[5], {ARGV[5], ARGV[6]})
+return id
+`, func(ctx context.Context, c datastore.RedisClient, keys []string, args []interface{}) (interface{}, error) {
+	id := fmt.Sprint(args[0])
+	if id == "*" {
+		var err error
+		if id, err = xAdd(ctx, c, keys[0], "*", args[1:4], args[7:]); !errors.Is(err, nil) {
+			return nil, err
+		}
+		if _, err := xAdd(ctx, c, keys[1], id, args[1:4], args[7:]); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+	if err := c.HIncrBy(ctx, keys[2], fmt.Sprint(args[4]), 1).Err(); !errors.Is(err, nil) {
+		return nil, err
+	}
+	if err := c.HSet(ctx, keys[2], args[5], args[6]).Err(); !errors.Is(err, nil) {
+		return nil, err
+	}
+	if err := indexFields(ctx, c, keys[3], fmt.Sprint(args[4]), fmt.Sprint(args[4]), fmt.Sprint(args[5])); !errors.Is(err, nil) {
+		return nil, err
+	}
+	return id, nil
+})
+
+// publishReply publishes a reply to the room stream and the thread of its
+// parent, which is trimmed like the room stream so it keeps at least every
+// reply the room stream still holds, then counts it on the parent. With the
+// Streams broker all of it is one script. Other brokers publish the reply and
+// copy it to the thread first, so a failure may leave it uncounted.
+func (s *MessageService) publishReply(ctx context.Context, roomID string, values map[string]interface{}, trim broker.Trim) (string, trace.SpanContext, error) {
+	parentID := fmt.Sprint(values[constants.RedisParentField])
+	keys := []string{RoomStreamKey(roomID), RoomThreadKey(roomID, parentID), RoomThreadsKey(roomID), fieldIndexKey(RoomThreadsKey(roomID))}
+	// run reads values once add is called, after the trace context was injected
+	run := func(ctx context.Context, id string) (string, error) {
+		args := append([]interface{}{id}, trimArgs(trim)...)
+		args = append(args, parentID+threadCountField, parentID+threadLastField, values[constants.RedisCreatedAtField])
+		args = append(args, fieldArgs(values)...)
+		return replyScript.Run(ctx, s.redis, keys, args...).Text()
+	}
+
+	if s.scriptsPublish() {
+		return s.traced(ctx, roomID, values, func(ctx context.Context) (string, error) {
+			return run(ctx, "*")
+		})
+	}
+
+	id, spanCtx, err := s.publish(ctx, roomID, values, trim)
+	if !errors.Is(err, nil) {
+		return "", spanCtx, err
+	}
+	if err := s.broker.Append(ctx, threadRoomID(roomID, parentID), id, values, trim); !errors.Is(err, nil) {
+		return "", spanCtx, fmt.Errorf("failed to add reply %s to its thread: %w", id, err)
+	}
+	if _, err := run(ctx, id); !errors.Is(err, nil) {
+		return "", spanCtx, fmt.Errorf("failed to count reply %s: %w", id, err)
+	}
+	return id, spanCtx, nil
+}
+
+// publish appends an entry to the room stream within an XADD span, which the
+// entry carries so deliveries can link back to it
+func (s *MessageService) publish(ctx context.Context, roomID string, values map[string]interface{}, trim broker.Trim) (string, trace.SpanContext, error) {
+	return s.traced(ctx, roomID, values, func(ctx context.Context) (string, error) {
+		return s.broker.Publish(ctx, roomID, values, trim)
+	})
+}
+
+// traced runs add, which appends values to the room stream and returns the
+// ID of the entry, within the XADD span of publish
+func (s *MessageService) traced(ctx context.Context, roomID string, values map[string]interface{}, add func(ctx context.Context) (string, error)) (string, trace.SpanContext, error) {
+	key := RoomStreamKey(roomID)
+	ctx, span := tracing.Tracer().Start(ctx, "XADD "+key, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		semconv.DBSystemNameRedis,
+		semconv.DBOperationName("XADD"),
+		semconv.MessagingDestinationName(key),
+	))
+	defer span.End()
+
+	tracing.Inject(ctx, values)
+
+	id, err := add(ctx)
+	if !errors.Is(err, nil) {
+		tracing.RecordError(span, err)
+		return "", span.SpanContext(), err
+	}
+	// add may have appended nothing, such as for a reaction that changed nothing
+	if id != "" {
+		span.SetAttributes(semconv.MessagingMessageID(id))
+	}
+
+	return id, span.SpanContext(), nil
+}
+
+// GetMessage returns the latest revision of a message. Deleted messages are
+// returned as tombstones.
+func (s *MessageService) GetMessage(ctx context.Context, roomID, id string) (*model.Message, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := ValidateStreamID(id); !errors.Is(err, nil) {
+		return nil, err
+	}
 
+	entries, err := s.broker.Range(ctx, roomID, id, id, 1)
 	if !errors.Is(err, nil) {
-		// If no messages exist yet, return empty array
-		if err == redis.Nil {
-			return []*model.Message{}, nil
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+	}
+
+	msg, event, err := decodeMessage(roomID, entries[0])
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	// The ID of an update or deletion names no message of its own
+	if event != constants.MessageEventCreated {
+		return nil, fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+	}
+
+	if err := s.applyState(ctx, roomID, []*model.Message{msg}); !errors.Is(err, nil) {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// UpdateMessage replaces the text of msg, as returned by GetMessage, and
+// records the update on the room stream
+func (s *MessageService) UpdateMessage(ctx context.Context, msg *model.Message, text string, retention RetentionPolicy) (*model.Message, error) {
+	if msg.Deleted {
+		return nil, fmt.Errorf("%w: %s was deleted", ErrMessageNotFound, msg.ID)
+	}
+
+	if text == "" {
+		return nil, fmt.Errorf("%w: message cannot be empty", ErrInvalidMessage)
+	}
+
+	updated := *msg
+	updated.Message = text
+	return s.revise(ctx, constants.MessageEventUpdated, &updated, retention)
+}
+
+// DeleteMessage replaces msg, as returned by GetMessage, with a tombstone
+// that keeps its author and creation time, and records the deletion on the
+// room stream. A deleted reply no longer counts on its parent, while the
+// replies to a deleted message stay in its thread.
+func (s *MessageService) DeleteMessage(ctx context.Context, msg *model.Message, retention RetentionPolicy) (*model.Message, error) {
+	if msg.Deleted {
+		return nil, fmt.Errorf("%w: %s was deleted", ErrMessageNotFound, msg.ID)
+	}
+
+	deleted := *msg
+	deleted.Message = ""
+	deleted.Metadata = nil
+	deleted.Deleted = true
+	return s.revise(ctx, constants.MessageEventDeleted, &deleted, retention)
+}
+
+// reviseScript stores the latest revision of a message and appends the update
+// or deletion event to the room stream, all at once. A deleted reply is also
+// uncounted on its parent. KEYS are the room stream, the revisions hash, the
+// threads hash and the field indexes of both hashes. ARGV are "*" to also append the event or "" not to, the
+// trim arguments, the message ID, the revision, the count field of the parent
+// to decrement or "", then the fields of the event. It returns the ID of the
+// event appended, if any.
+var reviseScript = datastore.NewScript(luaXAdd+luaIndex+`
+redis.call('HSET', KEYS[2], ARGV[5], ARGV[6])
+index(KEYS[4], ARGV[5], {ARGV[5]})
+if ARGV[7] ~= '' then
+  redis.call('HINCRBY', KEYS[3], ARGV[7], -1)
+  index(KEYS[5], ARGV[7], {ARGV[7]})
+end
+if ARGV[1] ~= '*' then
+  return ''
+end
+return xadd(KEYS[1], '*', ARGV[2], ARGV[3], ARGV[4], {unpack(ARGV, 8)})
+`, func(ctx context.Context, c datastore.RedisClient, keys []string, args []interface{}) (interface{}, error) {
+	msgID := fmt.Sprint(args[4])
+	if err := c.HSet(ctx, keys[1], msgID, args[5]).Err(); !errors.Is(err, nil) {
+		return nil, err
+	}
+	if err := indexFields(ctx, c, keys[3], msgID, msgID); !errors.Is(err, nil) {
+		return nil, err
+	}
+	if field := fmt.Sprint(args[6]); field != "" {
+		if err := c.HIncrBy(ctx, keys[2], field, -1).Err(); !errors.Is(err, nil) {
+			return nil, err
 		}
-		return nil, fmt.Errorf("failed to read messages: %w", err)
+		if err := indexFields(ctx, c, keys[4], field, field); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+	if fmt.Sprint(args[0]) != "*" {
+		return "", nil
 	}
+	return xAdd(ctx, c, keys[0], "*", args[1:4], args[7:])
+})
 
-	if len(streams) == 0 {
-		return []*model.Message{}, nil
+// revise stores msg as the latest revision of its message and appends the
+// update or deletion event carrying the whole revision to the room stream.
+// With the Streams broker both are one script. Other brokers publish the
+// event once the revision is stored, since reads rely on the revisions hash:
+// should the event fail, readers see the revision but subscribers miss it.
+func (s *MessageService) revise(ctx context.Context, event string, msg *model.Message, retention RetentionPolicy) (*model.Message, error) {
+	now := s.now().UTC()
+	msg.EditedAt = &now
+
+	data, err := json.Marshal(revision{
+		Message:  msg.Message,
+		Metadata: msg.Metadata,
+		EditedAt: now,
+		Deleted:  msg.Deleted,
+	})
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to encode revision: %w", err)
+	}
+	// A deleted reply no longer counts on its parent
+	countField := ""
+	if msg.Deleted && msg.ParentID != nil {
+		countField = *msg.ParentID + threadCountField
 	}
 
-	stream := streams[0]
-	messages := make([]*model.Message, len(stream.Messages))
+	values := map[string]interface{}{
+		constants.RedisEventField:       event,
+		constants.RedisTargetField:      msg.ID,
+		constants.RedisMessageField:     msg.Message,
+		constants.RedisCreatedAtField:   msg.CreatedAt.Format(time.RFC3339Nano),
+		constants.RedisContentTypeField: contentTypes[msg.ContentType],
+		constants.RedisEditedAtField:    now.Format(time.RFC3339Nano),
+	}
+	if msg.Author != nil {
+		values[constants.RedisAuthorField] = msg.Author.ID
+		values[constants.RedisAuthorNameField] = msg.Author.Name
+	}
+	if msg.ParentID != nil {
+		values[constants.RedisParentField] = *msg.ParentID
+	}
+	if len(msg.Metadata) > 0 {
+		metadata, err := json.Marshal(msg.Metadata)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to encode metadata: %w", err)
+		}
+		values[constants.RedisMetadataField] = string(metadata)
+	}
 
-	for i, v := range stream.Messages {
-		msgValue, ok := v.Values[constants.RedisMessageField].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid message format at index %d", i)
+	trim := retention.Trim(now)
+	revisionsKey, threadsKey := RoomRevisionsKey(msg.RoomID), RoomThreadsKey(msg.RoomID)
+	keys := []string{RoomStreamKey(msg.RoomID), revisionsKey, threadsKey, fieldIndexKey(revisionsKey), fieldIndexKey(threadsKey)}
+	// run reads values once add is called, after the trace context was injected
+	run := func(ctx context.Context, id string) (string, error) {
+		args := append([]interface{}{id}, trimArgs(trim)...)
+		args = append(args, msg.ID, string(data), countField)
+		args = append(args, fieldArgs(values)...)
+		return reviseScript.Run(ctx, s.redis, keys, args...).Text()
+	}
+
+	if s.scriptsPublish() {
+		_, spanCtx, err := s.traced(ctx, msg.RoomID, values, func(ctx context.Context) (string, error) {
+			return run(ctx, "*")
+		})
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to publish %s event: %w", event, err)
 		}
+		msg.Trace = spanCtx
+		return msg, nil
+	}
+
+	if _, err := run(ctx, ""); !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to store revision: %w", err)
+	}
+	_, spanCtx, err := s.publish(ctx, msg.RoomID, values, trim)
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to publish %s event: %w", event, err)
+	}
+	msg.Trace = spanCtx
+
+	return msg, nil
+}
+
+// applyState completes messages read from a stream with their latest
+// revision, the summary of their thread and their reactions
+func (s *MessageService) applyState(ctx context.Context, roomID string, messages []*model.Message) error {
+	if err := s.applyRevisions(ctx, roomID, messages); !errors.Is(err, nil) {
+		return err
+	}
+	if err := s.applyThreads(ctx, roomID, messages); !errors.Is(err, nil) {
+		return err
+	}
+	return s.applyReactions(ctx, roomID, messages)
+}
+
+// applyThreads fills in the reply count and last reply time of messages,
+// looking all of them up with a single HMGET
+func (s *MessageService) applyThreads(ctx context.Context, roomID string, messages []*model.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
 
-		messages[i] = &model.Message{
-			ID:      v.ID,
-			Message: msgValue,
+	fields := make([]string, 0, 2*len(messages))
+	for _, msg := range messages {
+		fields = append(fields, msg.ID+threadCountField, msg.ID+threadLastField)
+	}
+
+	values, err := s.redis.HMGet(ctx, RoomThreadsKey(roomID), fields...).Result()
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to read threads: %w", err)
+	}
+
+	for i := 0; i+1 < len(values) && i/2 < len(messages); i += 2 {
+		msg := messages[i/2]
+		if count, ok := values[i].(string); ok {
+			n, err := strconv.Atoi(count)
+			if !errors.Is(err, nil) {
+				return fmt.Errorf("invalid reply count of message %s: %w", msg.ID, err)
+			}
+			msg.ReplyCount = n
+		}
+		if last, ok := values[i+1].(string); ok {
+			lastReplyAt, err := time.Parse(time.RFC3339Nano, last)
+			if !errors.Is(err, nil) {
+				return fmt.Errorf("invalid last reply time of message %s: %w", msg.ID, err)
+			}
+			msg.LastReplyAt = &lastReplyAt
 		}
 	}
+	return nil
+}
 
-	return messages, nil
+// applyRevisions replaces messages by their latest revision, looking all of
+// them up with a single HMGET
+func (s *MessageService) applyRevisions(ctx context.Context, roomID string, messages []*model.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+
+	values, err := s.redis.HMGet(ctx, RoomRevisionsKey(roomID), ids...).Result()
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to read revisions: %w", err)
+	}
+
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok || i >= len(messages) {
+			continue
+		}
+
+		var rev revision
+		if err := json.Unmarshal([]byte(data), &rev); !errors.Is(err, nil) {
+			return fmt.Errorf("invalid revision of message %s: %w", ids[i], err)
+		}
+		messages[i].Message = rev.Message
+		messages[i].Metadata = rev.Metadata
+		messages[i].EditedAt = &rev.EditedAt
+		messages[i].Deleted = rev.Deleted
+	}
+	return nil
 }
 
-// StreamMessages continuously reads messages from Redis stream and sends them to the channel
-func (s *MessageService) StreamMessages(ctx context.Context) (<-chan *model.Message, <-chan error) {
-	msgChan := make(chan *model.Message)
-	errChan := make(chan error, 1)
-
-	go func() {
-		defer close(msgChan)
-		defer close(errChan)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				streams, err := s.redis.XRead(ctx, &redis.XReadArgs{
-					Streams: []string{constants.RedisStreamRoom, "$"},
-					Count:   constants.RedisStreamCount,
-					Block:   0,
-				}).Result()
-
-				if !errors.Is(err, nil) {
-					if errors.Is(err, context.Canceled) {
-						return
-					}
-					errChan <- fmt.Errorf("failed to stream messages: %w", err)
-					return
-				}
-
-				if len(streams) > 0 {
-					stream := streams[0]
-					if len(stream.Messages) > 0 {
-						msgValue, ok := stream.Messages[0].Values[constants.RedisMessageField].(string)
-						if !ok {
-							errChan <- fmt.Errorf("invalid message format in stream")
-							return
-						}
-
-						msg := &model.Message{
-							ID:      stream.Messages[0].ID,
-							Message: msgValue,
-						}
-
-						select {
-						case msgChan <- msg:
-						case <-ctx.Done():
-							return
-						}
-					}
-				}
+// rangeMessages reads up to count messages between start and stop, newest
+// first when reverse is set, skipping the replies and the update and deletion
+// events stored in between. Messages are returned as created, without their
+// revisions.
+func (s *MessageService) rangeMessages(ctx context.Context, roomID, start, stop string, count int64, reverse bool) ([]*model.Message, error) {
+	var messages []*model.Message
+
+	for remaining := count; remaining > 0; remaining = count - int64(len(messages)) {
+		var entries []broker.Entry
+		var err error
+		if reverse {
+			entries, err = s.broker.RevRange(ctx, roomID, start, stop, remaining)
+		} else {
+			entries, err = s.broker.Range(ctx, roomID, start, stop, remaining)
+		}
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to read messages: %w", err)
+		}
+
+		for _, entry := range entries {
+			msg, event, err := decodeMessage(roomID, entry)
+			if !errors.Is(err, nil) {
+				return nil, fmt.Errorf("invalid message format: %w", err)
 			}
+			if event == constants.MessageEventCreated && msg.ParentID == nil {
+				messages = append(messages, msg)
+			}
+		}
+
+		if int64(len(entries)) < remaining {
+			break
 		}
-	}()
+		start = exclusive(entries[len(entries)-1].ID, "")
+	}
+
+	return messages, nil
+}
 
-	return msgChan, errChan
+// ReadMessages reads the latest revisions of the oldest messages of a room
+func (s *MessageService) ReadMessages(ctx context.Context, roomID string) ([]*model.Message, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	// Limit to prevent loading too many messages
+	messages, err := s.rangeMessages(ctx, roomID, "-", "+", constants.MessagesQueryLimit, false)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := s.applyState(ctx, roomID, messages); !errors.Is(err, nil) {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// ReadMessagesAfter reads the latest revisions of up to count messages of a
+// room stored after the given stream ID, oldest first. stop bounds the range
+// exclusively when set.
+func (s *MessageService) ReadMessagesAfter(ctx context.Context, roomID, afterID, stop string, count int64) ([]*model.Message, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := ValidateStreamID(afterID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	messages, err := s.rangeMessages(ctx, roomID, exclusive(afterID, "-"), exclusive(stop, "+"), count, false)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := s.applyState(ctx, roomID, messages); !errors.Is(err, nil) {
+		return nil, err
+	}
+	return messages, nil
 }
@@ -3,15 +3,41 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
 	"github.com/redis/go-redis/v9"
 )
 
 type mockRedisClient struct {
 	xAddFunc  func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd
 	xReadFunc func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd
+	pingFunc  func(ctx context.Context) *redis.StatusCmd
+
+	// consumer group commands
+	xReadGroupFunc func(ctx context.Context, args *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	xAutoClaimFunc func(ctx context.Context, args *redis.XAutoClaimArgs) *redis.XAutoClaimCmd
+	groupsCreated  []string // "stream group start" of every XGROUP CREATE
+	acks           []string // "stream id" of every acknowledged entry
+	removed        []string // "stream group consumer" of every XGROUP DELCONSUMER
+
+	// entries backs the range commands, keyed by stream
+	entries map[string][]redis.XMessage
+
+	// trims records every XTRIM call as "key strategy threshold"
+	trims []string
+
+	// hashes and sets back the hash and set commands, zsets records the
+	// sorted set members with their score
+	hashes map[string]map[string]string
+	sets   map[string]map[string]struct{}
+	zsets  map[string]map[string]float64
 }
 
 func (m *mockRedisClient) XAdd(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
@@ -28,7 +54,267 @@ func (m *mockRedisClient) XRead(ctx context.Context, args *redis.XReadArgs) *red
 	return redis.NewXStreamSliceCmd(ctx)
 }
 
+func (m *mockRedisClient) XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return m.xRange(ctx, stream, start, stop, count, false)
+}
+
+func (m *mockRedisClient) XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	return m.xRange(ctx, stream, stop, start, count, true)
+}
+
+// xRange serves range reads from entries, which must be sorted by ID
+func (m *mockRedisClient) xRange(ctx context.Context, stream, start, stop string, count int64, reverse bool) *redis.XMessageSliceCmd {
+	inRange := func(id string) bool {
+		switch {
+		case start == "-":
+		case strings.HasPrefix(start, "("):
+			if CompareStreamIDs(id, start[1:]) <= 0 {
+				return false
+			}
+		case CompareStreamIDs(id, start) < 0:
+			return false
+		}
+
+		switch {
+		case stop == "+":
+		case strings.HasPrefix(stop, "("):
+			if CompareStreamIDs(id, stop[1:]) >= 0 {
+				return false
+			}
+		case CompareStreamIDs(id, stop) > 0:
+			return false
+		}
+		return true
+	}
+
+	entries := m.entries[stream]
+	result := []redis.XMessage{}
+	for i := range entries {
+		entry := entries[i]
+		if reverse {
+			entry = entries[len(entries)-1-i]
+		}
+		if inRange(entry.ID) {
+			result = append(result, entry)
+		}
+		if int64(len(result)) == count {
+			break
+		}
+	}
+
+	cmd := redis.NewXMessageSliceCmd(ctx)
+	cmd.SetVal(result)
+	return cmd
+}
+
+func (m *mockRedisClient) XTrimMaxLen(ctx context.Context, key string, maxLen int64) *redis.IntCmd {
+	m.trims = append(m.trims, fmt.Sprintf("%s MAXLEN %d", key, maxLen))
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMaxLenApprox(ctx context.Context, key string, maxLen, limit int64) *redis.IntCmd {
+	m.trims = append(m.trims, fmt.Sprintf("%s MAXLEN ~ %d", key, maxLen))
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMinID(ctx context.Context, key string, minID string) *redis.IntCmd {
+	m.trims = append(m.trims, fmt.Sprintf("%s MINID %s", key, minID))
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XTrimMinIDApprox(ctx context.Context, key string, minID string, limit int64) *redis.IntCmd {
+	m.trims = append(m.trims, fmt.Sprintf("%s MINID ~ %s", key, minID))
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	m.groupsCreated = append(m.groupsCreated, fmt.Sprintf("%s %s %s", stream, group, start))
+	return redis.NewStatusCmd(ctx)
+}
+
+func (m *mockRedisClient) XReadGroup(ctx context.Context, args *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	if m.xReadGroupFunc != nil {
+		return m.xReadGroupFunc(ctx, args)
+	}
+	return redis.NewXStreamSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	for _, id := range ids {
+		m.acks = append(m.acks, fmt.Sprintf("%s %s", stream, id))
+	}
+	cmd := redis.NewIntCmd(ctx)
+	cmd.SetVal(int64(len(ids)))
+	return cmd
+}
+
+func (m *mockRedisClient) XAutoClaim(ctx context.Context, args *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+	if m.xAutoClaimFunc != nil {
+		return m.xAutoClaimFunc(ctx, args)
+	}
+	cmd := redis.NewXAutoClaimCmd(ctx)
+	cmd.SetVal(nil, "0-0")
+	return cmd
+}
+
+func (m *mockRedisClient) XGroupDelConsumer(ctx context.Context, stream, group, consumer string) *redis.IntCmd {
+	m.removed = append(m.removed, fmt.Sprintf("%s %s %s", stream, group, consumer))
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	if m.hashes == nil {
+		m.hashes = map[string]map[string]string{}
+	}
+	if m.hashes[key] == nil {
+		m.hashes[key] = map[string]string{}
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		m.hashes[key][fmt.Sprint(values[i])] = fmt.Sprint(values[i+1])
+	}
+	cmd := redis.NewIntCmd(ctx)
+	cmd.SetVal(int64(len(values) / 2))
+	return cmd
+}
+
+func (m *mockRedisClient) HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd {
+	cmd := redis.NewBoolCmd(ctx)
+	if _, ok := m.hashes[key][field]; ok {
+		return cmd
+	}
+	m.HSet(ctx, key, field, value)
+	cmd.SetVal(true)
+	return cmd
+}
+
+func (m *mockRedisClient) HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd {
+	var removed int64
+	for _, field := range fields {
+		if _, ok := m.hashes[key][field]; ok {
+			delete(m.hashes[key], field)
+			removed++
+		}
+	}
+	cmd := redis.NewIntCmd(ctx)
+	cmd.SetVal(removed)
+	return cmd
+}
+
+func (m *mockRedisClient) HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd {
+	cmd := redis.NewMapStringStringCmd(ctx)
+	fields := map[string]string{}
+	for k, v := range m.hashes[key] {
+		fields[k] = v
+	}
+	cmd.SetVal(fields)
+	return cmd
+}
+
+func (m *mockRedisClient) HIncrBy(ctx context.Context, key, field string, incr int64) *redis.IntCmd {
+	var value int64
+	fmt.Sscan(m.hashes[key][field], &value)
+	value += incr
+	m.HSet(ctx, key, field, value)
+	cmd := redis.NewIntCmd(ctx)
+	cmd.SetVal(value)
+	return cmd
+}
+
+func (m *mockRedisClient) HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd {
+	cmd := redis.NewSliceCmd(ctx)
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if value, ok := m.hashes[key][field]; ok {
+			values[i] = value
+		}
+	}
+	cmd.SetVal(values)
+	return cmd
+}
+
+func (m *mockRedisClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	if m.sets == nil {
+		m.sets = map[string]map[string]struct{}{}
+	}
+	if m.sets[key] == nil {
+		m.sets[key] = map[string]struct{}{}
+	}
+	cmd := redis.NewIntCmd(ctx)
+	for _, member := range members {
+		if _, ok := m.sets[key][fmt.Sprint(member)]; !ok {
+			m.sets[key][fmt.Sprint(member)] = struct{}{}
+			cmd.SetVal(cmd.Val() + 1)
+		}
+	}
+	return cmd
+}
+
+func (m *mockRedisClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	for _, member := range members {
+		delete(m.sets[key], fmt.Sprint(member))
+	}
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	cmd := redis.NewStringSliceCmd(ctx)
+	members := []string{}
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	cmd.SetVal(members)
+	return cmd
+}
+
+func (m *mockRedisClient) ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	if m.zsets == nil {
+		m.zsets = map[string]map[string]float64{}
+	}
+	if m.zsets[key] == nil {
+		m.zsets[key] = map[string]float64{}
+	}
+	for _, member := range members {
+		m.zsets[key][fmt.Sprint(member.Member)] = member.Score
+	}
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	return redis.NewStringSliceCmd(ctx)
+}
+
+func (m *mockRedisClient) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	for _, member := range members {
+		delete(m.zsets[key], fmt.Sprint(member))
+	}
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	for _, key := range keys {
+		delete(m.hashes, key)
+		delete(m.sets, key)
+		delete(m.zsets, key)
+		delete(m.entries, key)
+	}
+	return redis.NewIntCmd(ctx)
+}
+
+func (m *mockRedisClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx)
+	cmd.SetErr(errors.New("ERR scripts run through EvalSha"))
+	return cmd
+}
+
+// EvalSha runs the Go implementation of a script against the mock
+func (m *mockRedisClient) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	return datastore.EvalEmulated(ctx, m, sha1, keys, args)
+}
+
 func (m *mockRedisClient) Ping(ctx context.Context) *redis.StatusCmd {
+	if m.pingFunc != nil {
+		return m.pingFunc(ctx)
+	}
 	return redis.NewStatusCmd(ctx)
 }
 
@@ -37,15 +323,15 @@ func (m *mockRedisClient) Close() error {
 }
 
 func TestNewMessageService(t *testing.T) {
-	mock := &mockRedisClient{}
-	svc := NewMessageService(mock)
+	b := broker.NewStreams(&mockRedisClient{})
+	svc := NewMessageService(&mockRedisClient{}, b)
 
 	if svc == nil {
 		t.Fatal("expected service to be created, got nil")
 	}
 
-	if svc.redis != mock {
-		t.Error("expected redis client to be set correctly")
+	if svc.broker != b {
+		t.Error("expected broker to be set correctly")
 	}
 }
 
@@ -53,11 +339,11 @@ func TestPublishMessage_Success(t *testing.T) {
 	ctx := context.Background()
 	mock := &mockRedisClient{
 		xAddFunc: func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
-			if args.Stream != constants.RedisStreamRoom {
-				t.Errorf("expected stream %s, got %s", constants.RedisStreamRoom, args.Stream)
+			if args.Stream != RoomStreamKey("general") {
+				t.Errorf("expected stream %s, got %s", RoomStreamKey("general"), args.Stream)
 			}
-			if args.MaxLen != constants.RedisStreamMaxLen {
-				t.Errorf("expected maxlen %d, got %d", constants.RedisStreamMaxLen, args.MaxLen)
+			if args.MaxLen != 500 || !args.Approx {
+				t.Errorf("expected maxlen ~500, got %d (approx %t)", args.MaxLen, args.Approx)
 			}
 			cmd := redis.NewStringCmd(ctx)
 			cmd.SetVal("OK")
@@ -65,8 +351,8 @@ func TestPublishMessage_Success(t *testing.T) {
 		},
 	}
 
-	svc := NewMessageService(mock)
-	msg, err := svc.PublishMessage(ctx, "hello")
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	msg, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "hello"}, RetentionPolicy{MaxLen: 500, Approx: true})
 
 	if !errors.Is(err, nil) {
 		t.Fatalf("unexpected error: %v", err)
@@ -81,12 +367,358 @@ func TestPublishMessage_Success(t *testing.T) {
 	}
 }
 
+// newAppendingMock returns a mock whose XADD appends entries with IDs "1-0", "1-1"... to the range commands
+func newAppendingMock() *mockRedisClient {
+	mock := &mockRedisClient{entries: map[string][]redis.XMessage{}}
+	mock.xAddFunc = func(ctx context.Context, args *redis.XAddArgs) *redis.StringCmd {
+		id := fmt.Sprintf("1-%d", len(mock.entries[args.Stream]))
+		if args.ID != "" && args.ID != "*" {
+			id = args.ID
+		}
+		mock.entries[args.Stream] = append(mock.entries[args.Stream], redis.XMessage{ID: id, Values: args.Values.(map[string]interface{})})
+		cmd := redis.NewStringCmd(ctx)
+		cmd.SetVal(id)
+		return cmd
+	}
+	return mock
+}
+
+func TestPublishMessage_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	mock := newAppendingMock()
+
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	now := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	svc.now = func() time.Time { return now }
+
+	author := &model.User{ID: "u-1", Name: "Alice"}
+	published, err := svc.PublishMessage(ctx, "general", MessageInput{
+		Message:     "**hello**",
+		ContentType: model.ContentTypeMarkdown,
+		Metadata:    map[string]interface{}{"client": "web", "mentions": []interface{}{"bob"}},
+		Author:      author,
+	}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "anonymous"}, RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages, err := svc.ReadMessages(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+
+	rich := messages[0]
+	if got := rich.Author; got == nil || *got != *author {
+		t.Errorf("expected author %+v, got %+v", author, got)
+	}
+	if !rich.CreatedAt.Equal(now) || !published.CreatedAt.Equal(now) {
+		t.Errorf("expected createdAt %v, got %v", now, rich.CreatedAt)
+	}
+	if rich.ContentType != model.ContentTypeMarkdown {
+		t.Errorf("expected markdown, got %s", rich.ContentType)
+	}
+	if rich.Metadata["client"] != "web" || fmt.Sprint(rich.Metadata["mentions"]) != "[bob]" {
+		t.Errorf("unexpected metadata %v", rich.Metadata)
+	}
+
+	plain := messages[1]
+	if plain.Author != nil || plain.ContentType != model.ContentTypePlain || plain.Metadata != nil {
+		t.Errorf("expected an anonymous plain message without metadata, got %+v", plain)
+	}
+}
+
+func TestPublishMessage_InvalidInput(t *testing.T) {
+	ctx := context.Background()
+	svc := NewMessageService(&mockRedisClient{}, broker.NewStreams(&mockRedisClient{}))
+
+	tests := []struct {
+		name  string
+		input MessageInput
+	}{
+		{name: "empty message", input: MessageInput{}},
+		{name: "unknown content type", input: MessageInput{Message: "hello", ContentType: "HTML"}},
+		{name: "metadata too large", input: MessageInput{Message: "hello", Metadata: map[string]interface{}{"blob": strings.Repeat("x", constants.MessageMetadataMaxSize)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.PublishMessage(ctx, "general", tt.input, RetentionPolicy{}); !errors.Is(err, ErrInvalidMessage) {
+				t.Errorf("expected ErrInvalidMessage, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeMessage_LegacyEntry(t *testing.T) {
+	// Entries written before the rich message format only have the message field
+	msg, event, err := decodeMessage("general", broker.Entry{
+		ID:     "1714564800000-0",
+		Values: map[string]interface{}{constants.RedisMessageField: "hello"},
+	})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if event != constants.MessageEventCreated || msg.Message != "hello" || msg.Author != nil || msg.Metadata != nil {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if want := time.UnixMilli(1714564800000).UTC(); !msg.CreatedAt.Equal(want) {
+		t.Errorf("expected createdAt from the stream ID %v, got %v", want, msg.CreatedAt)
+	}
+	if msg.ContentType != model.ContentTypePlain {
+		t.Errorf("expected plain text, got %s", msg.ContentType)
+	}
+}
+
+func TestDecodeMessage_InvalidFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		value string
+	}{
+		{name: "created at", field: constants.RedisCreatedAtField, value: "yesterday"},
+		{name: "metadata", field: constants.RedisMetadataField, value: "{not json"},
+		{name: "event", field: constants.RedisEventField, value: "moved"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeMessage("general", broker.Entry{
+				ID:     "1-0",
+				Values: map[string]interface{}{constants.RedisMessageField: "hello", tt.field: tt.value},
+			})
+			if err == nil {
+				t.Errorf("expected an error for an invalid %s field", tt.field)
+			}
+		})
+	}
+}
+
+func TestReplies(t *testing.T) {
+	ctx := context.Background()
+	mock := newAppendingMock()
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return now }
+
+	parent, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "lunch?"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var replies []*model.Message
+	for _, text := range []string{"yes", "no", "later"} {
+		now = now.Add(time.Minute)
+		reply, err := svc.PublishMessage(ctx, "general", MessageInput{Message: text, ParentID: parent.ID}, RetentionPolicy{})
+		if !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reply.ParentID == nil || *reply.ParentID != parent.ID {
+			t.Errorf("expected a reply to %s, got %+v", parent.ID, reply)
+		}
+		replies = append(replies, reply)
+	}
+
+	// Replies are copied to the thread under their room stream ID
+	thread := mock.entries[RoomThreadKey("general", parent.ID)]
+	if len(thread) != 3 || thread[0].ID != replies[0].ID {
+		t.Fatalf("unexpected thread %v", thread)
+	}
+
+	// Room reads only return the parent, along with its thread summary
+	messages, err := svc.ReadMessages(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != parent.ID {
+		t.Fatalf("expected only the parent, got %+v", messages)
+	}
+	if messages[0].ReplyCount != 3 || messages[0].LastReplyAt == nil || !messages[0].LastReplyAt.Equal(now) {
+		t.Errorf("unexpected thread summary %d %v", messages[0].ReplyCount, messages[0].LastReplyAt)
+	}
+
+	first := 2
+	page, err := svc.ReadReplies(ctx, "general", parent.ID, PageArgs{First: &first})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Edges) != 2 || page.Edges[0].Node.Message != "yes" || !page.PageInfo.HasNextPage || page.PageInfo.HasPreviousPage {
+		t.Errorf("unexpected first page %+v %+v", page.Edges, page.PageInfo)
+	}
+
+	// A deleted reply stays in the thread as a tombstone but no longer counts
+	current, err := svc.GetMessage(ctx, "general", replies[2].ID)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.DeleteMessage(ctx, current, RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	page, err = svc.ReadReplies(ctx, "general", parent.ID, PageArgs{First: &first, After: page.PageInfo.EndCursor})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Edges) != 1 || !page.Edges[0].Node.Deleted || page.PageInfo.HasNextPage || !page.PageInfo.HasPreviousPage {
+		t.Errorf("unexpected last page %+v %+v", page.Edges, page.PageInfo)
+	}
+
+	current, err = svc.GetMessage(ctx, "general", parent.ID)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if current.ReplyCount != 2 {
+		t.Errorf("expected 2 replies after the deletion, got %d", current.ReplyCount)
+	}
+
+	if _, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "orphan", ParentID: "9-0"}, RetentionPolicy{}); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound replying to a missing message, got %v", err)
+	}
+	if _, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "too late", ParentID: replies[2].ID}, RetentionPolicy{}); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound replying to a deleted message, got %v", err)
+	}
+	last := 1
+	if _, err := svc.ReadReplies(ctx, "general", parent.ID, PageArgs{Last: &last}); !errors.Is(err, ErrInvalidPagination) {
+		t.Errorf("expected ErrInvalidPagination paging replies backwards, got %v", err)
+	}
+}
+
+func TestReplies_MemoryBroker(t *testing.T) {
+	ctx := context.Background()
+	mock := &mockRedisClient{}
+	svc := NewMessageService(mock, broker.NewMemory())
+
+	parent, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "lunch?"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reply, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "yes", ParentID: parent.ID}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The thread is kept by the broker, only the counters are in the datastore
+	page, err := svc.ReadReplies(ctx, "general", parent.ID, PageArgs{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Edges) != 1 || page.Edges[0].Node.ID != reply.ID {
+		t.Errorf("expected the reply in the thread, got %+v", page.Edges)
+	}
+	if count := mock.hashes[RoomThreadsKey("general")][parent.ID+threadCountField]; count != "1" {
+		t.Errorf("expected the reply to be counted, got %q", count)
+	}
+
+	// Deleting the reply stores its revision, uncounts it and publishes the event
+	if _, err := svc.DeleteMessage(ctx, page.Edges[0].Node, RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := mock.hashes[RoomRevisionsKey("general")][reply.ID]; !ok {
+		t.Error("expected the revision of the deleted reply")
+	}
+	if count := mock.hashes[RoomThreadsKey("general")][parent.ID+threadCountField]; count != "0" {
+		t.Errorf("expected the reply to be uncounted, got %q", count)
+	}
+	messages, err := svc.ReadMessages(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 1 || messages[0].ReplyCount != 0 {
+		t.Errorf("expected the parent without replies, got %+v", messages)
+	}
+}
+
+func TestUpdateAndDeleteMessage(t *testing.T) {
+	ctx := context.Background()
+	mock := newAppendingMock()
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	edited := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+
+	author := &model.User{ID: "u-1", Name: "Alice"}
+	first, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "helo", Author: author, Metadata: map[string]interface{}{"client": "web"}}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "bye"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.now = func() time.Time { return edited }
+	current, err := svc.GetMessage(ctx, "general", first.ID)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := svc.UpdateMessage(ctx, current, "hello", RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.ID != first.ID || updated.Message != "hello" || updated.EditedAt == nil || !updated.EditedAt.Equal(edited) {
+		t.Errorf("unexpected update %+v", updated)
+	}
+
+	current, err = svc.GetMessage(ctx, "general", second.ID)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.DeleteMessage(ctx, current, RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The edit and the deletion are stream events carrying the new revision
+	events := mock.entries[RoomStreamKey("general")][2:]
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	event, err := decodeEvent("general", broker.Entry{ID: events[0].ID, Values: events[0].Values})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if update, ok := event.(*model.MessageUpdated); !ok || update.ID != events[0].ID || update.Message.ID != first.ID || update.Message.Message != "hello" || update.Message.Author == nil || update.Message.Metadata["client"] != "web" {
+		t.Errorf("unexpected update event %+v", event)
+	}
+	event, err = decodeEvent("general", broker.Entry{ID: events[1].ID, Values: events[1].Values})
+	if deletion, ok := event.(*model.MessageDeleted); !errors.Is(err, nil) || !ok || deletion.Message.ID != second.ID || !deletion.Message.Deleted {
+		t.Errorf("unexpected deletion event %+v (%v)", event, err)
+	}
+
+	// Reads skip the events and return the latest revisions
+	messages, err := svc.ReadMessages(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if m := messages[0]; m.Message != "hello" || m.Deleted || m.EditedAt == nil || m.Metadata["client"] != "web" || !m.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("expected the edited revision, got %+v", m)
+	}
+	if m := messages[1]; m.Message != "" || !m.Deleted || m.EditedAt == nil {
+		t.Errorf("expected a tombstone, got %+v", m)
+	}
+
+	if _, err := svc.GetMessage(ctx, "general", events[0].ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound for an event ID, got %v", err)
+	}
+	if _, err := svc.UpdateMessage(ctx, messages[1], "again", RetentionPolicy{}); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("expected ErrMessageNotFound when editing a deleted message, got %v", err)
+	}
+	if _, err := svc.UpdateMessage(ctx, messages[0], "", RetentionPolicy{}); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("expected ErrInvalidMessage for an empty edit, got %v", err)
+	}
+}
+
 func TestPublishMessage_EmptyMessage(t *testing.T) {
 	ctx := context.Background()
 	mock := &mockRedisClient{}
-	svc := NewMessageService(mock)
+	svc := NewMessageService(mock, broker.NewStreams(mock))
 
-	_, err := svc.PublishMessage(ctx, "")
+	_, err := svc.PublishMessage(ctx, "general", MessageInput{Message: ""}, RetentionPolicy{})
 
 	if err == nil {
 		t.Fatal("expected error for empty message, got nil")
@@ -104,8 +736,8 @@ func TestPublishMessage_RedisError(t *testing.T) {
 		},
 	}
 
-	svc := NewMessageService(mock)
-	_, err := svc.PublishMessage(ctx, "hello")
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	_, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "hello"}, RetentionPolicy{})
 
 	if err == nil {
 		t.Fatal("expected error, got nil")
@@ -119,29 +751,22 @@ func TestPublishMessage_RedisError(t *testing.T) {
 func TestReadMessages_Success(t *testing.T) {
 	ctx := context.Background()
 	mock := &mockRedisClient{
-		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
-			cmd := redis.NewXStreamSliceCmd(ctx)
-			cmd.SetVal([]redis.XStream{
+		entries: map[string][]redis.XMessage{
+			RoomStreamKey("general"): {
 				{
-					Stream: constants.RedisStreamRoom,
-					Messages: []redis.XMessage{
-						{
-							ID:     "1-0",
-							Values: map[string]interface{}{constants.RedisMessageField: "message1"},
-						},
-						{
-							ID:     "2-0",
-							Values: map[string]interface{}{constants.RedisMessageField: "message2"},
-						},
-					},
+					ID:     "1-0",
+					Values: map[string]interface{}{constants.RedisMessageField: "message1"},
 				},
-			})
-			return cmd
+				{
+					ID:     "2-0",
+					Values: map[string]interface{}{constants.RedisMessageField: "message2"},
+				},
+			},
 		},
 	}
 
-	svc := NewMessageService(mock)
-	messages, err := svc.ReadMessages(ctx)
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	messages, err := svc.ReadMessages(ctx, "general")
 
 	if !errors.Is(err, nil) {
 		t.Fatalf("unexpected error: %v", err)
@@ -151,7 +776,7 @@ func TestReadMessages_Success(t *testing.T) {
 		t.Fatalf("expected 2 messages, got %d", len(messages))
 	}
 
-	if messages[0].ID != "1-0" || messages[0].Message != "message1" {
+	if messages[0].ID != "1-0" || messages[0].RoomID != "general" || messages[0].Message != "message1" {
 		t.Errorf("unexpected first message: %+v", messages[0])
 	}
 
@@ -162,16 +787,10 @@ func TestReadMessages_Success(t *testing.T) {
 
 func TestReadMessages_EmptyStream(t *testing.T) {
 	ctx := context.Background()
-	mock := &mockRedisClient{
-		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
-			cmd := redis.NewXStreamSliceCmd(ctx)
-			cmd.SetVal([]redis.XStream{})
-			return cmd
-		},
-	}
+	mock := &mockRedisClient{}
 
-	svc := NewMessageService(mock)
-	messages, err := svc.ReadMessages(ctx)
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	messages, err := svc.ReadMessages(ctx, "general")
 
 	if !errors.Is(err, nil) {
 		t.Fatalf("unexpected error: %v", err)
@@ -185,27 +804,32 @@ func TestReadMessages_EmptyStream(t *testing.T) {
 func TestReadMessages_InvalidFormat(t *testing.T) {
 	ctx := context.Background()
 	mock := &mockRedisClient{
-		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
-			cmd := redis.NewXStreamSliceCmd(ctx)
-			cmd.SetVal([]redis.XStream{
+		entries: map[string][]redis.XMessage{
+			RoomStreamKey("general"): {
 				{
-					Stream: constants.RedisStreamRoom,
-					Messages: []redis.XMessage{
-						{
-							ID:     "1-0",
-							Values: map[string]interface{}{constants.RedisMessageField: 12345}, // Invalid type
-						},
-					},
+					ID:     "1-0",
+					Values: map[string]interface{}{constants.RedisMessageField: 12345}, // Invalid type
 				},
-			})
-			return cmd
+			},
 		},
 	}
 
-	svc := NewMessageService(mock)
-	_, err := svc.ReadMessages(ctx)
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	_, err := svc.ReadMessages(ctx, "general")
 
 	if err == nil {
 		t.Fatal("expected error for invalid message format, got nil")
 	}
 }
+
+func TestPublishMessage_InvalidRoom(t *testing.T) {
+	ctx := context.Background()
+	svc := NewMessageService(&mockRedisClient{}, broker.NewStreams(&mockRedisClient{}))
+
+	for _, roomID := range []string{"", "room with spaces", "room:nested"} {
+		_, err := svc.PublishMessage(ctx, roomID, MessageInput{Message: "hello"}, RetentionPolicy{})
+		if !errors.Is(err, ErrInvalidRoomID) {
+			t.Errorf("expected ErrInvalidRoomID for %q, got %v", roomID, err)
+		}
+	}
+}
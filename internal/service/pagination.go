@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+)
+
+// ErrInvalidPagination is returned for unusable connection arguments
+var ErrInvalidPagination = errors.New("invalid pagination arguments")
+
+// PageArgs holds the Relay connection arguments of a paginated query
+type PageArgs struct {
+	First  *int
+	After  *string
+	Last   *int
+	Before *string
+}
+
+// EncodeCursor turns a stream ID into an opaque Relay cursor
+func EncodeCursor(streamID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(streamID))
+}
+
+// DecodeCursor turns a Relay cursor back into the stream ID it points at
+func DecodeCursor(cursor string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if !errors.Is(err, nil) || !errors.Is(ValidateStreamID(string(decoded)), nil) {
+		return "", fmt.Errorf("%w: malformed cursor %q", ErrInvalidPagination, cursor)
+	}
+	return string(decoded), nil
+}
+
+// exclusive turns a stream ID into an exclusive XRANGE bound, or returns
+// the open bound when no ID is given
+func exclusive(id, open string) string {
+	if id == "" {
+		return open
+	}
+	return "(" + id
+}
+
+// pageSize validates a first/last argument
+func pageSize(name string, n *int) (int64, error) {
+	if *n < 0 || *n > constants.MessagesPageMaxSize {
+		return 0, fmt.Errorf("%w: %s must be between 0 and %d", ErrInvalidPagination, name, constants.MessagesPageMaxSize)
+	}
+	return int64(*n), nil
+}
+
+// ReadMessagesPage reads a page of room messages as a Relay connection. Cursors
+// map onto stream IDs: first/after page forwards with Range and last/before
+// pages backwards with RevRange, fetching one extra message to detect more pages.
+// Messages are returned in their latest revision.
+func (s *MessageService) ReadMessagesPage(ctx context.Context, roomID string, args PageArgs) (*model.MessageConnection, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if args.First != nil && args.Last != nil {
+		return nil, fmt.Errorf("%w: first and last cannot be combined", ErrInvalidPagination)
+	}
+
+	var after, before string
+	var err error
+	if args.After != nil {
+		if after, err = DecodeCursor(*args.After); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+	if args.Before != nil {
+		if before, err = DecodeCursor(*args.Before); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	pageInfo := &model.PageInfo{}
+	var messages []*model.Message
+
+	if args.Last != nil {
+		last, err := pageSize("last", args.Last)
+		if !errors.Is(err, nil) {
+			return nil, err
+		}
+
+		messages, err = s.rangeMessages(ctx, roomID, exclusive(before, "+"), exclusive(after, "-"), last+1, true)
+		if !errors.Is(err, nil) {
+			return nil, err
+		}
+
+		if int64(len(messages)) > last {
+			pageInfo.HasPreviousPage = true
+			messages = messages[:last]
+		}
+
+		// XREVRANGE returns newest first, connections are always oldest first
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+
+		if len(messages) > 0 {
+			if pageInfo.HasNextPage, err = s.hasMessages(ctx, roomID, exclusive(messages[len(messages)-1].ID, "-"), "+", false); !errors.Is(err, nil) {
+				return nil, err
+			}
+		} else {
+			pageInfo.HasNextPage = before != ""
+		}
+	} else {
+		first := int64(constants.MessagesPageDefaultSize)
+		if args.First != nil {
+			if first, err = pageSize("first", args.First); !errors.Is(err, nil) {
+				return nil, err
+			}
+		}
+
+		messages, err = s.rangeMessages(ctx, roomID, exclusive(after, "-"), exclusive(before, "+"), first+1, false)
+		if !errors.Is(err, nil) {
+			return nil, err
+		}
+
+		if int64(len(messages)) > first {
+			pageInfo.HasNextPage = true
+			messages = messages[:first]
+		}
+
+		if len(messages) > 0 {
+			if pageInfo.HasPreviousPage, err = s.hasMessages(ctx, roomID, exclusive(messages[0].ID, "+"), "-", true); !errors.Is(err, nil) {
+				return nil, err
+			}
+		} else {
+			pageInfo.HasPreviousPage = after != ""
+		}
+	}
+
+	if err := s.applyState(ctx, roomID, messages); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	edges := make([]*model.MessageEdge, len(messages))
+	for i, msg := range messages {
+		edges[i] = &model.MessageEdge{
+			Cursor: EncodeCursor(msg.ID),
+			Node:   msg,
+		}
+	}
+
+	if len(edges) > 0 {
+		pageInfo.StartCursor = &edges[0].Cursor
+		pageInfo.EndCursor = &edges[len(edges)-1].Cursor
+	}
+
+	return &model.MessageConnection{
+		Edges:    edges,
+		PageInfo: pageInfo,
+	}, nil
+}
+
+// hasMessages reports whether the room has at least one message in the given range
+func (s *MessageService) hasMessages(ctx context.Context, roomID, start, stop string, reverse bool) (bool, error) {
+	messages, err := s.rangeMessages(ctx, roomID, start, stop, 1, reverse)
+	if !errors.Is(err, nil) {
+		return false, err
+	}
+	return len(messages) > 0, nil
+}
+
+// ReadReplies reads a page of the replies to a message as a Relay connection,
+// oldest first, from the thread stream of the message. Threads only page
+// forwards: last and before are rejected. Replies are returned in their latest
+// revision.
+func (s *MessageService) ReadReplies(ctx context.Context, roomID, parentID string, args PageArgs) (*model.MessageConnection, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := ValidateStreamID(parentID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if args.Last != nil || args.Before != nil {
+		return nil, fmt.Errorf("%w: replies only page forwards with first and after", ErrInvalidPagination)
+	}
+
+	var after string
+	var err error
+	if args.After != nil {
+		if after, err = DecodeCursor(*args.After); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	first := int64(constants.MessagesPageDefaultSize)
+	if args.First != nil {
+		if first, err = pageSize("first", args.First); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	entries, err := s.broker.Range(ctx, threadRoomID(roomID, parentID), exclusive(after, "-"), "+", first+1)
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to read replies: %w", err)
+	}
+
+	// A cursor always points at a reply, so a page after it has one before it
+	pageInfo := &model.PageInfo{HasPreviousPage: after != ""}
+	if int64(len(entries)) > first {
+		pageInfo.HasNextPage = true
+		entries = entries[:first]
+	}
+
+	messages := make([]*model.Message, len(entries))
+	for i, entry := range entries {
+		msg, _, err := decodeMessage(roomID, entry)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("invalid message format: %w", err)
+		}
+		messages[i] = msg
+	}
+
+	if err := s.applyState(ctx, roomID, messages); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	edges := make([]*model.MessageEdge, len(messages))
+	for i, msg := range messages {
+		edges[i] = &model.MessageEdge{
+			Cursor: EncodeCursor(msg.ID),
+			Node:   msg,
+		}
+	}
+
+	if len(edges) > 0 {
+		pageInfo.StartCursor = &edges[0].Cursor
+		pageInfo.EndCursor = &edges[len(edges)-1].Cursor
+	}
+
+	return &model.MessageConnection{
+		Edges:    edges,
+		PageInfo: pageInfo,
+	}, nil
+}
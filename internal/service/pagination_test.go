@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/redis/go-redis/v9"
+)
+
+// newPagedMock returns a mock holding n messages "m1".."mn" with IDs "1-0".."n-0" in room general
+func newPagedMock(n int) *mockRedisClient {
+	entries := make([]redis.XMessage, n)
+	for i := range entries {
+		entries[i] = redis.XMessage{
+			ID:     fmt.Sprintf("%d-0", i+1),
+			Values: map[string]interface{}{constants.RedisMessageField: fmt.Sprintf("m%d", i+1)},
+		}
+	}
+	return &mockRedisClient{entries: map[string][]redis.XMessage{RoomStreamKey("general"): entries}}
+}
+
+func pageMessages(conn *model.MessageConnection) string {
+	messages := make([]string, len(conn.Edges))
+	for i, edge := range conn.Edges {
+		messages[i] = edge.Node.Message
+	}
+	return fmt.Sprint(messages)
+}
+
+func intPtr(n int) *int { return &n }
+
+func strPtr(s string) *string { return &s }
+
+func TestCursorRoundTrip(t *testing.T) {
+	id, err := DecodeCursor(EncodeCursor("1700000000000-3"))
+	if !errors.Is(err, nil) || id != "1700000000000-3" {
+		t.Errorf("expected round trip to return the stream ID, got %q (%v)", id, err)
+	}
+
+	if _, err := DecodeCursor("not a cursor"); !errors.Is(err, ErrInvalidPagination) {
+		t.Errorf("expected ErrInvalidPagination, got %v", err)
+	}
+}
+
+func TestReadMessagesPage(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        PageArgs
+		want        string
+		hasNext     bool
+		hasPrevious bool
+	}{
+		{name: "first page", args: PageArgs{First: intPtr(2)}, want: "[m1 m2]", hasNext: true},
+		{name: "after cursor", args: PageArgs{First: intPtr(2), After: strPtr(EncodeCursor("2-0"))}, want: "[m3 m4]", hasNext: true, hasPrevious: true},
+		{name: "last page forwards", args: PageArgs{First: intPtr(2), After: strPtr(EncodeCursor("3-0"))}, want: "[m4 m5]", hasPrevious: true},
+		{name: "last", args: PageArgs{Last: intPtr(2)}, want: "[m4 m5]", hasPrevious: true},
+		{name: "before cursor", args: PageArgs{Last: intPtr(2), Before: strPtr(EncodeCursor("4-0"))}, want: "[m2 m3]", hasNext: true, hasPrevious: true},
+		{name: "first page backwards", args: PageArgs{Last: intPtr(2), Before: strPtr(EncodeCursor("3-0"))}, want: "[m1 m2]", hasNext: true},
+		{name: "between cursors", args: PageArgs{After: strPtr(EncodeCursor("1-0")), Before: strPtr(EncodeCursor("4-0"))}, want: "[m2 m3]", hasNext: false, hasPrevious: true},
+		{name: "past the end", args: PageArgs{First: intPtr(2), After: strPtr(EncodeCursor("5-0"))}, want: "[]", hasPrevious: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newPagedMock(5)
+			svc := NewMessageService(mock, broker.NewStreams(mock))
+
+			conn, err := svc.ReadMessagesPage(context.Background(), "general", tt.args)
+			if !errors.Is(err, nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := pageMessages(conn); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+
+			if conn.PageInfo.HasNextPage != tt.hasNext || conn.PageInfo.HasPreviousPage != tt.hasPrevious {
+				t.Errorf("expected hasNext %t hasPrevious %t, got %+v", tt.hasNext, tt.hasPrevious, conn.PageInfo)
+			}
+
+			if len(conn.Edges) > 0 {
+				if *conn.PageInfo.StartCursor != conn.Edges[0].Cursor || *conn.PageInfo.EndCursor != conn.Edges[len(conn.Edges)-1].Cursor {
+					t.Errorf("page cursors do not match edges: %+v", conn.PageInfo)
+				}
+			}
+		})
+	}
+}
+
+func TestReadMessagesPage_SkipsEvents(t *testing.T) {
+	mock := newPagedMock(3)
+	key := RoomStreamKey("general")
+	// Edits of m1 between every message
+	for _, id := range []string{"1-1", "2-1", "3-1"} {
+		mock.entries[key] = append(mock.entries[key], redis.XMessage{ID: id, Values: map[string]interface{}{
+			constants.RedisEventField:    constants.MessageEventUpdated,
+			constants.RedisTargetField:   "1-0",
+			constants.RedisMessageField:  "m1 edited",
+			constants.RedisEditedAtField: "2024-05-01T12:00:00Z",
+		}})
+	}
+	sort.Slice(mock.entries[key], func(i, j int) bool {
+		return CompareStreamIDs(mock.entries[key][i].ID, mock.entries[key][j].ID) < 0
+	})
+	mock.HSet(context.Background(), RoomRevisionsKey("general"), "1-0", `{"message":"m1 edited","editedAt":"2024-05-01T12:00:00Z"}`)
+
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+	conn, err := svc.ReadMessagesPage(context.Background(), "general", PageArgs{First: intPtr(2)})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := pageMessages(conn); got != "[m1 edited m2]" || !conn.PageInfo.HasNextPage || conn.Edges[0].Node.EditedAt == nil {
+		t.Errorf("expected [m1 edited m2] with a next page, got %s %+v", got, conn.PageInfo)
+	}
+
+	conn, err = svc.ReadMessagesPage(context.Background(), "general", PageArgs{Last: intPtr(1)})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := pageMessages(conn); got != "[m3]" || !conn.PageInfo.HasPreviousPage || conn.PageInfo.HasNextPage {
+		t.Errorf("expected [m3] with only a previous page, got %s %+v", got, conn.PageInfo)
+	}
+}
+
+func TestReadMessagesPage_InvalidArgs(t *testing.T) {
+	mock := newPagedMock(1)
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+
+	invalid := []PageArgs{
+		{First: intPtr(1), Last: intPtr(1)},
+		{First: intPtr(-1)},
+		{Last: intPtr(constants.MessagesPageMaxSize + 1)},
+		{After: strPtr("bogus")},
+	}
+
+	for _, args := range invalid {
+		if _, err := svc.ReadMessagesPage(context.Background(), "general", args); !errors.Is(err, ErrInvalidPagination) {
+			t.Errorf("expected ErrInvalidPagination for %+v, got %v", args, err)
+		}
+	}
+}
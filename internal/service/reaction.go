@@ -0,0 +1,447 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrInvalidReaction is returned for an unusable emoji, or when a message has
+// no room for another one
+var ErrInvalidReaction = errors.New("invalid reaction")
+
+// RoomReactionsKey returns the Redis hash key holding the reactions to the
+// messages of a room
+func RoomReactionsKey(roomID string) string {
+	return RoomStreamKey(roomID) + constants.RedisRoomReactionsSuffix
+}
+
+// Each emoji of a message takes the first free slot of the reactions hash and
+// keeps it for good, so a page of messages reads with one HMGET. Every change
+// runs reactScript, which finds the slot, sets or clears the marker of the
+// user, counts the change and appends it to the room stream in one go.
+
+// reactionEmojiField holds the emoji of a slot
+func reactionEmojiField(msgID string, slot int) string {
+	return msgID + ":e" + strconv.Itoa(slot)
+}
+
+// reactionCountField holds the number of reactions with the emoji of a slot
+func reactionCountField(msgID string, slot int) string {
+	return msgID + ":c" + strconv.Itoa(slot)
+}
+
+// reactionUserField marks that a user reacted with the emoji of a slot
+func reactionUserField(msgID string, slot int, userID string) string {
+	return msgID + ":u" + strconv.Itoa(slot) + ":" + userID
+}
+
+// reactionMaskField holds the slots a user reacted with as a bit mask
+func reactionMaskField(msgID, userID string) string {
+	return msgID + ":by:" + userID
+}
+
+// ValidateEmoji checks that an emoji is a short string without whitespace
+func ValidateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > constants.ReactionEmojiMaxSize || !utf8.ValidString(emoji) || strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("%w: emoji must be 1 to %d bytes without whitespace", ErrInvalidReaction, constants.ReactionEmojiMaxSize)
+	}
+	return nil
+}
+
+// reactorID returns the ID reactions of user are recorded under. Without
+// authentication every caller shares the empty ID, so each emoji counts once.
+func reactorID(user *model.User) string {
+	if user == nil {
+		return ""
+	}
+	return user.ID
+}
+
+// viewerID returns the ID of the caller reading messages, the anonymous
+// reactor without authentication
+func viewerID(ctx context.Context) string {
+	if p := auth.FromContext(ctx); p != nil {
+		return p.ID
+	}
+	return ""
+}
+
+// AddReaction records a reaction of user, nil for an anonymous caller, to
+// msg as returned by GetMessage and appends it to the room stream. Reacting
+// twice with the same emoji leaves the reactions unchanged.
+func (s *MessageService) AddReaction(ctx context.Context, msg *model.Message, emoji string, user *model.User, retention RetentionPolicy) (*model.Message, error) {
+	if msg.Deleted {
+		return nil, fmt.Errorf("%w: %s was deleted", ErrMessageNotFound, msg.ID)
+	}
+
+	if err := ValidateEmoji(emoji); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := s.react(ctx, constants.MessageEventReacted, msg, emoji, user, retention); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	return s.withReactions(ctx, msg)
+}
+
+// RemoveReaction withdraws a reaction of user, nil for an anonymous caller,
+// to msg as returned by GetMessage and appends the removal to the room
+// stream. Removing a missing reaction leaves the reactions unchanged.
+func (s *MessageService) RemoveReaction(ctx context.Context, msg *model.Message, emoji string, user *model.User, retention RetentionPolicy) (*model.Message, error) {
+	if msg.Deleted {
+		return nil, fmt.Errorf("%w: %s was deleted", ErrMessageNotFound, msg.ID)
+	}
+
+	if err := ValidateEmoji(emoji); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if err := s.react(ctx, constants.MessageEventUnreacted, msg, emoji, user, retention); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	return s.withReactions(ctx, msg)
+}
+
+// reactScript adds or removes the reaction of a user to a message. It finds
+// the slot of the emoji, claiming the first free one for an addition, sets or
+// clears the marker of the user, counts the change and updates the field
+// index. KEYS are the room stream, the reactions hash and its field
+// index. ARGV are "*" to also append the change to
+// the room stream or "" not to, the trim arguments, the message ID, the emoji,
+// the reactor ID, 1 or -1, the number of slots and the name of the count
+// field, then the fields of the event. It returns nil when nothing changed, -1
+// when no slot is left, and otherwise the ID of the event appended, if any,
+// along with the new count. Field names follow the reaction*Field functions.
+var reactScript = datastore.NewScript(luaXAdd+luaIndex+`
+local msg, emoji, user = ARGV[5], ARGV[6], ARGV[7]
+local incr, slots = tonumber(ARGV[8]), tonumber(ARGV[9])
+
+local slot, free = -1, -1
+for i = 0, slots - 1 do
+  local value = redis.call('HGET', KEYS[2], msg .. ':e' .. i)
+  if value == emoji then
+    slot = i
+    break
+  end
+  if not value and free < 0 then
+    free = i
+  end
+end
+if slot < 0 then
+  if incr < 0 then
+    return false
+  end
+  if free < 0 then
+    return -1
+  end
+  slot = free
+  redis.call('HSET', KEYS[2], msg .. ':e' .. slot, emoji)
+end
+
+local marker = msg .. ':u' .. slot .. ':' .. user
+if incr > 0 then
+  if redis.call('HSETNX', KEYS[2], marker, 1) == 0 then
+    return false
+  end
+elseif redis.call('HDEL', KEYS[2], marker) == 0 then
+  return false
+else
+  redis.call('ZREM', KEYS[3], marker)
+end
+
+local count = redis.call('HINCRBY', KEYS[2], msg .. ':c' .. slot, incr)
+redis.call('HINCRBY', KEYS[2], msg .. ':by:' .. user, incr * 2 ^ slot)
+if incr > 0 then
+  index(KEYS[3], msg, {msg .. ':e' .. slot, marker, msg .. ':c' .. slot, msg .. ':by:' .. user})
+end
+
+local id = ''
+if ARGV[1] == '*' then
+  local fields = {unpack(ARGV, 11)}
+  fields[#fields + 1] = ARGV[10]
+  fields[#fields + 1] = count
+  id = xadd(KEYS[1], '*', ARGV[2], ARGV[3], ARGV[4], fields)
+end
+return {id, count}
+`, func(ctx context.Context, c datastore.RedisClient, keys []string, args []interface{}) (interface{}, error) {
+	msgID, emoji, user := fmt.Sprint(args[4]), fmt.Sprint(args[5]), fmt.Sprint(args[6])
+	incr, err := strconv.ParseInt(fmt.Sprint(args[7]), 10, 64)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	slots, err := strconv.Atoi(fmt.Sprint(args[8]))
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	fields := make([]string, slots)
+	for i := range fields {
+		fields[i] = reactionEmojiField(msgID, i)
+	}
+	values, err := c.HMGet(ctx, keys[1], fields...).Result()
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	slot, free := -1, -1
+	for i, value := range values {
+		if value == emoji {
+			slot = i
+			break
+		}
+		if value == nil && free < 0 {
+			free = i
+		}
+	}
+	if slot < 0 {
+		switch {
+		case incr < 0:
+			return nil, nil
+		case free < 0:
+			return int64(-1), nil
+		}
+		slot = free
+		if err := c.HSet(ctx, keys[1], fields[slot], emoji).Err(); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	marker := reactionUserField(msgID, slot, user)
+	if incr > 0 {
+		added, err := c.HSetNX(ctx, keys[1], marker, 1).Result()
+		if !errors.Is(err, nil) || !added {
+			return nil, err
+		}
+	} else {
+		removed, err := c.HDel(ctx, keys[1], marker).Result()
+		if !errors.Is(err, nil) || removed == 0 {
+			return nil, err
+		}
+		if err := c.ZRem(ctx, keys[2], marker).Err(); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	count, err := c.HIncrBy(ctx, keys[1], reactionCountField(msgID, slot), incr).Result()
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	if err := c.HIncrBy(ctx, keys[1], reactionMaskField(msgID, user), incr<<slot).Err(); !errors.Is(err, nil) {
+		return nil, err
+	}
+	if incr > 0 {
+		if err := indexFields(ctx, c, keys[2], msgID, fields[slot], marker, reactionCountField(msgID, slot), reactionMaskField(msgID, user)); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	id := ""
+	if fmt.Sprint(args[0]) == "*" {
+		event := append(append([]interface{}{}, args[10:]...), args[9], count)
+		if id, err = xAdd(ctx, c, keys[0], "*", args[1:4], event); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+	return []interface{}{id, count}, nil
+})
+
+// react adds or removes the reaction of user to msg with reactScript and
+// appends the change to the room stream, unless the user had already reacted
+// with the emoji or had not. With the Streams broker the script appends the
+// event itself. Other brokers publish it once the script counted the change,
+// so a failure may leave the change unpublished.
+func (s *MessageService) react(ctx context.Context, event string, msg *model.Message, emoji string, user *model.User, retention RetentionPolicy) error {
+	incr := 1
+	if event == constants.MessageEventUnreacted {
+		incr = -1
+	}
+
+	now := s.now().UTC()
+	trim := retention.Trim(now)
+	values := map[string]interface{}{
+		constants.RedisEventField:     event,
+		constants.RedisTargetField:    msg.ID,
+		constants.RedisEmojiField:     emoji,
+		constants.RedisCreatedAtField: now.Format(time.RFC3339Nano),
+	}
+	if user != nil {
+		values[constants.RedisAuthorField] = user.ID
+		values[constants.RedisAuthorNameField] = user.Name
+	}
+
+	// run applies the change, appending the event when id is "*", and reports
+	// the ID of the event, the new count and whether anything changed
+	keys := []string{RoomStreamKey(msg.RoomID), RoomReactionsKey(msg.RoomID), fieldIndexKey(RoomReactionsKey(msg.RoomID))}
+	run := func(ctx context.Context, id string) (string, int64, bool, error) {
+		args := append([]interface{}{id}, trimArgs(trim)...)
+		args = append(args, msg.ID, emoji, reactorID(user), incr, constants.MessageReactionsMax, constants.RedisCountField)
+		args = append(args, fieldArgs(values)...)
+
+		result, err := reactScript.Run(ctx, s.redis, keys, args...).Result()
+		if errors.Is(err, redis.Nil) {
+			return "", 0, false, nil
+		}
+		if !errors.Is(err, nil) {
+			return "", 0, false, fmt.Errorf("failed to store reaction: %w", err)
+		}
+		if full, ok := result.(int64); ok && full < 0 {
+			return "", 0, false, fmt.Errorf("%w: message %s already has %d different reactions", ErrInvalidReaction, msg.ID, constants.MessageReactionsMax)
+		}
+		changed, ok := result.([]interface{})
+		if !ok || len(changed) != 2 {
+			return "", 0, false, fmt.Errorf("failed to store reaction: unexpected reply %v", result)
+		}
+		count, _ := changed[1].(int64)
+		return fmt.Sprint(changed[0]), count, true, nil
+	}
+
+	if s.scriptsPublish() {
+		_, _, err := s.traced(ctx, msg.RoomID, values, func(ctx context.Context) (string, error) {
+			id, _, _, err := run(ctx, "*")
+			return id, err
+		})
+		return err
+	}
+
+	_, count, changed, err := run(ctx, "")
+	if !errors.Is(err, nil) || !changed {
+		return err
+	}
+	values[constants.RedisCountField] = count
+	if _, _, err := s.publish(ctx, msg.RoomID, values, trim); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to publish %s event: %w", event, err)
+	}
+	return nil
+}
+
+// withReactions returns a copy of msg carrying its current reactions
+func (s *MessageService) withReactions(ctx context.Context, msg *model.Message) (*model.Message, error) {
+	m := *msg
+	m.Reactions = nil
+	if err := s.applyReactions(ctx, m.RoomID, []*model.Message{&m}); !errors.Is(err, nil) {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Reactions returns the reactions to msg as seen by the caller, reading them
+// unless msg was read along with them
+func (s *MessageService) Reactions(ctx context.Context, msg *model.Message) ([]*model.Reaction, error) {
+	if msg.Reactions != nil {
+		return msg.Reactions, nil
+	}
+
+	m, err := s.withReactions(ctx, msg)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	return m.Reactions, nil
+}
+
+// applyReactions fills in the reactions to messages as seen by the caller,
+// looking all of them up with a single HMGET
+func (s *MessageService) applyReactions(ctx context.Context, roomID string, messages []*model.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	// Per message: the emoji of each slot, the count of each slot and the mask of the viewer
+	stride := 2*constants.MessageReactionsMax + 1
+	viewer := viewerID(ctx)
+	fields := make([]string, 0, stride*len(messages))
+	for _, msg := range messages {
+		for i := 0; i < constants.MessageReactionsMax; i++ {
+			fields = append(fields, reactionEmojiField(msg.ID, i))
+		}
+		for i := 0; i < constants.MessageReactionsMax; i++ {
+			fields = append(fields, reactionCountField(msg.ID, i))
+		}
+		fields = append(fields, reactionMaskField(msg.ID, viewer))
+	}
+
+	values, err := s.redis.HMGet(ctx, RoomReactionsKey(roomID), fields...).Result()
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to read reactions: %w", err)
+	}
+	if len(values) != len(fields) {
+		return fmt.Errorf("failed to read reactions: expected %d values, got %d", len(fields), len(values))
+	}
+
+	for m, msg := range messages {
+		record := values[m*stride : (m+1)*stride]
+
+		var mask int64
+		if value, ok := record[stride-1].(string); ok {
+			if mask, err = strconv.ParseInt(value, 10, 64); !errors.Is(err, nil) {
+				return fmt.Errorf("invalid reactions of message %s: %w", msg.ID, err)
+			}
+		}
+
+		msg.Reactions = []*model.Reaction{}
+		for i := 0; i < constants.MessageReactionsMax; i++ {
+			emoji, ok := record[i].(string)
+			if !ok {
+				continue
+			}
+			count := 0
+			if value, ok := record[constants.MessageReactionsMax+i].(string); ok {
+				if count, err = strconv.Atoi(value); !errors.Is(err, nil) {
+					return fmt.Errorf("invalid reactions of message %s: %w", msg.ID, err)
+				}
+			}
+			// A slot keeps its emoji once every reaction with it was withdrawn
+			if count <= 0 {
+				continue
+			}
+			msg.Reactions = append(msg.Reactions, &model.Reaction{
+				Emoji:            emoji,
+				Count:            count,
+				ViewerHasReacted: mask&(1<<i) != 0,
+			})
+		}
+	}
+	return nil
+}
+
+// decodeReaction converts a reaction entry into the room event it records
+func decodeReaction(roomID string, entry broker.Entry, event string) (model.RoomEvent, error) {
+	target, _ := entry.Values[constants.RedisTargetField].(string)
+	if !errors.Is(ValidateStreamID(target), nil) {
+		return nil, fmt.Errorf("entry %s has an invalid %q field", entry.ID, constants.RedisTargetField)
+	}
+	emoji, _ := entry.Values[constants.RedisEmojiField].(string)
+	if emoji == "" {
+		return nil, fmt.Errorf("entry %s has no %q field", entry.ID, constants.RedisEmojiField)
+	}
+	count, err := strconv.Atoi(fmt.Sprint(entry.Values[constants.RedisCountField]))
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("entry %s has an invalid %q field: %w", entry.ID, constants.RedisCountField, err)
+	}
+
+	var user *model.User
+	if id, ok := entry.Values[constants.RedisAuthorField].(string); ok && id != "" {
+		name, _ := entry.Values[constants.RedisAuthorNameField].(string)
+		user = &model.User{ID: id, Name: name}
+	}
+
+	if event == constants.MessageEventUnreacted {
+		return &model.ReactionRemoved{ID: entry.ID, RoomID: roomID, MessageID: target, Emoji: emoji, User: user, Count: count, Trace: tracing.Extract(entry.Values)}, nil
+	}
+	return &model.ReactionAdded{ID: entry.ID, RoomID: roomID, MessageID: target, Emoji: emoji, User: user, Count: count, Trace: tracing.Extract(entry.Values)}, nil
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+)
+
+// formatReactions renders reactions as "emoji count viewerHasReacted" items
+func formatReactions(reactions []*model.Reaction) string {
+	items := make([]string, len(reactions))
+	for i, r := range reactions {
+		items[i] = fmt.Sprintf("%s %d %t", r.Emoji, r.Count, r.ViewerHasReacted)
+	}
+	return strings.Join(items, ", ")
+}
+
+func TestReactions(t *testing.T) {
+	ctx := context.Background()
+	mock := newAppendingMock()
+	svc := NewMessageService(mock, broker.NewStreams(mock))
+
+	alice := &model.User{ID: "u-1", Name: "Alice"}
+	bob := &model.User{ID: "u-2", Name: "Bob"}
+	aliceCtx := auth.WithPrincipal(ctx, &auth.Principal{ID: alice.ID})
+
+	first, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "ship it?"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "shipped"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	react := func(msg *model.Message, emoji string, user *model.User) {
+		t.Helper()
+		if _, err := svc.AddReaction(aliceCtx, msg, emoji, user, RetentionPolicy{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	react(first, "👍", alice)
+	react(first, "👍", bob)
+	react(first, "👍", alice) // a second identical reaction is ignored
+	react(first, "🎉", bob)
+	react(second, "🚀", alice)
+
+	m, err := svc.RemoveReaction(aliceCtx, first, "👍", bob, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := formatReactions(m.Reactions), "👍 1 true, 🎉 1 false"; got != want {
+		t.Errorf("expected %q after removing, got %q", want, got)
+	}
+	if _, err := svc.RemoveReaction(aliceCtx, first, "👀", bob, RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Errorf("expected removing a missing reaction to succeed, got %v", err)
+	}
+
+	// Reads resolve the reactions of the whole page along with the messages, as seen by the caller
+	messages, err := svc.ReadMessages(aliceCtx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if got, want := formatReactions(messages[0].Reactions), "👍 1 true, 🎉 1 false"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := formatReactions(messages[1].Reactions), "🚀 1 true"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	messages, err = svc.ReadMessages(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := formatReactions(messages[0].Reactions), "👍 1 false, 🎉 1 false"; got != want {
+		t.Errorf("expected %q for an anonymous viewer, got %q", want, got)
+	}
+
+	// Each effective change is a stream event, which reads skip
+	var events []string
+	for _, entry := range mock.entries[RoomStreamKey("general")][2:] {
+		event, err := decodeEvent("general", broker.Entry{ID: entry.ID, Values: entry.Values})
+		if !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		switch e := event.(type) {
+		case *model.ReactionAdded:
+			events = append(events, fmt.Sprintf("+%s %s %d", e.Emoji, e.User.Name, e.Count))
+		case *model.ReactionRemoved:
+			events = append(events, fmt.Sprintf("-%s %s %d", e.Emoji, e.User.Name, e.Count))
+		default:
+			t.Errorf("unexpected event %T", event)
+		}
+	}
+	if got, want := fmt.Sprint(events), "[+👍 Alice 1 +👍 Bob 2 +🎉 Bob 1 +🚀 Alice 1 -👍 Bob 1]"; got != want {
+		t.Errorf("expected events %s, got %s", want, got)
+	}
+
+	if _, err := svc.AddReaction(ctx, first, "thumbs up", alice, RetentionPolicy{}); !errors.Is(err, ErrInvalidReaction) {
+		t.Errorf("expected ErrInvalidReaction for whitespace, got %v", err)
+	}
+	// The second message already has one emoji
+	for i := 1; i < constants.MessageReactionsMax; i++ {
+		if _, err := svc.AddReaction(ctx, second, fmt.Sprintf(":e%d:", i), alice, RetentionPolicy{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := svc.AddReaction(ctx, second, ":more:", alice, RetentionPolicy{}); !errors.Is(err, ErrInvalidReaction) {
+		t.Errorf("expected ErrInvalidReaction past %d emojis, got %v", constants.MessageReactionsMax, err)
+	}
+}
+
+func TestReactions_MemoryBroker(t *testing.T) {
+	ctx := context.Background()
+	mock := &mockRedisClient{}
+	b := broker.NewMemory()
+	svc := NewMessageService(mock, b)
+
+	alice := &model.User{ID: "u-1", Name: "Alice"}
+	msg, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "ship it?"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := svc.AddReaction(ctx, msg, "👍", alice, RetentionPolicy{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The broker gets the event with the count the script returned, once
+	entries, err := b.Range(ctx, "general", "-", "+", 10)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the message and one event, got %d entries", len(entries))
+	}
+	event, err := decodeEvent("general", entries[1])
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if added, ok := event.(*model.ReactionAdded); !ok || added.Emoji != "👍" || added.Count != 1 {
+		t.Errorf("expected a 👍 event counting 1, got %+v", event)
+	}
+	if count := mock.hashes[RoomReactionsKey("general")][reactionCountField(msg.ID, 0)]; count != "1" {
+		t.Errorf("expected the reaction to be counted, got %q", count)
+	}
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+)
+
+// ErrInvalidRetention is returned when a retention policy has negative limits
+var ErrInvalidRetention = errors.New("invalid retention policy")
+
+// RetentionPolicy describes how much history a room stream keeps. MaxLen counts
+// every entry of the stream: messages and replies, but also the edit, deletion
+// and reaction events, so busy rooms keep fewer messages. The revisions,
+// threads and reactions of trimmed messages are pruned by the Trimmer.
+// The zero value keeps messages forever.
+type RetentionPolicy struct {
+	MaxLen int64         `json:"maxLen,omitempty"` // maximum number of entries, 0 for unlimited
+	Approx bool          `json:"approx,omitempty"` // trim with "~", letting Redis keep a few extra entries for speed
+	MaxAge time.Duration `json:"maxAge,omitempty"` // maximum entry age, 0 for unlimited
+}
+
+// Validate checks that the policy limits are usable
+func (p RetentionPolicy) Validate() error {
+	if p.MaxLen < 0 {
+		return fmt.Errorf("%w: maxLen must not be negative", ErrInvalidRetention)
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("%w: maxAge must not be negative", ErrInvalidRetention)
+	}
+	// Rooms expose the policy in whole seconds, a finer age would not survive the round trip
+	if p.MaxAge%time.Second != 0 {
+		return fmt.Errorf("%w: maxAge must be a whole number of seconds", ErrInvalidRetention)
+	}
+	return nil
+}
+
+// KeepForever reports whether the policy never trims the stream
+func (p RetentionPolicy) KeepForever() bool {
+	return p.MaxLen == 0 && p.MaxAge == 0
+}
+
+// Trim converts the policy into broker trim limits as of now. Publishing applies
+// a single limit, so when both are set the length is enforced on write and the
+// age is left to the Trimmer.
+func (p RetentionPolicy) Trim(now time.Time) broker.Trim {
+	trim := broker.Trim{MaxLen: p.MaxLen, Approx: p.Approx}
+	if p.MaxAge > 0 {
+		trim.MinID = minIDForAge(now, p.MaxAge)
+	}
+	return trim
+}
+
+// Model converts the policy into its GraphQL representation
+func (p RetentionPolicy) Model() *model.RetentionPolicy {
+	m := &model.RetentionPolicy{
+		Approximate: p.Approx,
+		KeepForever: p.KeepForever(),
+	}
+	if p.MaxLen > 0 {
+		maxLen := int(p.MaxLen)
+		m.MaxLen = &maxLen
+	}
+	if p.MaxAge > 0 {
+		maxAge := int(p.MaxAge / time.Second)
+		m.MaxAgeSeconds = &maxAge
+	}
+	return m
+}
+
+// RetentionFromModel converts the GraphQL representation of a policy back into a RetentionPolicy
+func RetentionFromModel(m *model.RetentionPolicy) RetentionPolicy {
+	var p RetentionPolicy
+	if m == nil {
+		return p
+	}
+
+	p.Approx = m.Approximate
+	if m.MaxLen != nil {
+		p.MaxLen = int64(*m.MaxLen)
+	}
+	if m.MaxAgeSeconds != nil {
+		p.MaxAge = time.Duration(*m.MaxAgeSeconds) * time.Second
+	}
+	return p
+}
+
+// RetentionPolicyFromInput converts a GraphQL retention input into a validated policy
+func RetentionPolicyFromInput(input *model.RetentionPolicyInput) (RetentionPolicy, error) {
+	var p RetentionPolicy
+	if input == nil {
+		return p, nil
+	}
+
+	if input.MaxLen != nil {
+		p.MaxLen = int64(*input.MaxLen)
+	}
+	if input.MaxAgeSeconds != nil {
+		p.MaxAge = time.Duration(*input.MaxAgeSeconds) * time.Second
+	}
+	if input.Approximate != nil {
+		p.Approx = *input.Approximate
+	}
+
+	return p, p.Validate()
+}
+
+// minIDForAge returns the smallest stream ID that is younger than maxAge
+func minIDForAge(now time.Time, maxAge time.Duration) string {
+	return fmt.Sprintf("%d-0", now.Add(-maxAge).UnixMilli())
+}
+
+// Trimmer periodically applies room retention policies, so age limits hold
+// even on streams that receive no new messages
+type Trimmer struct {
+	broker   broker.Broker
+	rooms    *RoomService
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewTrimmer creates a new Trimmer running every interval
+func NewTrimmer(b broker.Broker, rooms *RoomService, interval time.Duration) *Trimmer {
+	return &Trimmer{
+		broker:   b,
+		rooms:    rooms,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Run trims all room streams every interval until the context is cancelled
+func (t *Trimmer) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.TrimAll(ctx); !errors.Is(err, nil) && !errors.Is(err, context.Canceled) {
+				slog.ErrorContext(ctx, "Error trimming room streams", logging.Err(err))
+			}
+		}
+	}
+}
+
+// TrimAll applies the effective retention policy of every room to its stream
+func (t *Trimmer) TrimAll(ctx context.Context) error {
+	rooms, err := t.rooms.ListRooms(ctx, true)
+	if !errors.Is(err, nil) {
+		return err
+	}
+
+	var errs []error
+	for _, room := range rooms {
+		if err := t.Trim(ctx, room.ID, RetentionFromModel(room.Retention)); !errors.Is(err, nil) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Trim applies a retention policy to the stream of a room, then prunes what the
+// room keeps next to it about the messages trimmed, on this call or on publish
+func (t *Trimmer) Trim(ctx context.Context, roomID string, policy RetentionPolicy) error {
+	if policy.KeepForever() {
+		return nil
+	}
+
+	trim := policy.Trim(t.now())
+	if err := t.broker.Trim(ctx, roomID, trim); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to trim room %s: %w", roomID, err)
+	}
+
+	// Everything older than the first entry left was trimmed, or older than the
+	// age limit once the stream is empty
+	first, err := t.broker.Range(ctx, roomID, "-", "+", 1)
+	if errors.Is(err, broker.ErrNoHistory) {
+		return nil
+	}
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to trim room %s: %w", roomID, err)
+	}
+	before := trim.MinID
+	if len(first) > 0 {
+		before = first[0].ID
+	}
+	if before == "" {
+		return nil
+	}
+
+	if err := t.rooms.PruneRoom(ctx, roomID, before); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to prune room %s: %w", roomID, err)
+	}
+	return nil
+}
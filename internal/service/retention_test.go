@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRetentionPolicy_Trim(t *testing.T) {
+	now := time.UnixMilli(10_000)
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   broker.Trim
+	}{
+		{name: "keep forever", policy: RetentionPolicy{}},
+		{name: "exact length", policy: RetentionPolicy{MaxLen: 10}, want: broker.Trim{MaxLen: 10}},
+		{name: "approximate length", policy: RetentionPolicy{MaxLen: 10, Approx: true}, want: broker.Trim{MaxLen: 10, Approx: true}},
+		{name: "age", policy: RetentionPolicy{MaxAge: 4 * time.Second}, want: broker.Trim{MinID: "6000-0"}},
+		{name: "length and age", policy: RetentionPolicy{MaxLen: 10, MaxAge: time.Second}, want: broker.Trim{MaxLen: 10, MinID: "9000-0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Trim(now); got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyFromInput(t *testing.T) {
+	maxLen, maxAge, approx := 100, 3600, true
+
+	p, err := RetentionPolicyFromInput(&model.RetentionPolicyInput{
+		MaxLen:        &maxLen,
+		MaxAgeSeconds: &maxAge,
+		Approximate:   &approx,
+	})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if p.MaxLen != 100 || p.MaxAge != time.Hour || !p.Approx {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+
+	if got := RetentionFromModel(p.Model()); got != p {
+		t.Errorf("expected model round trip to return %+v, got %+v", p, got)
+	}
+
+	negative := -1
+	_, err = RetentionPolicyFromInput(&model.RetentionPolicyInput{MaxLen: &negative})
+	if !errors.Is(err, ErrInvalidRetention) {
+		t.Errorf("expected ErrInvalidRetention, got %v", err)
+	}
+
+	// A sub-second age would read back as keep forever
+	if err := (RetentionPolicy{MaxAge: 500 * time.Millisecond}).Validate(); !errors.Is(err, ErrInvalidRetention) {
+		t.Errorf("expected ErrInvalidRetention for a sub-second maxAge, got %v", err)
+	}
+}
+
+func TestRoomRetention_OverrideAndReset(t *testing.T) {
+	ctx := context.Background()
+	defaultPolicy := RetentionPolicy{MaxLen: 1000, Approx: true}
+	svc := newTestRoomService(&mockRedisClient{}, defaultPolicy)
+
+	room, err := svc.CreateRoom(ctx, "general", "General")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := RetentionFromModel(room.Retention); got != defaultPolicy {
+		t.Errorf("expected default retention %+v, got %+v", defaultPolicy, got)
+	}
+
+	if _, err := svc.SetRetention(ctx, "general", &RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	room, err = svc.GetRoom(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !room.Retention.KeepForever {
+		t.Errorf("expected room override to keep messages forever, got %+v", room.Retention)
+	}
+
+	if _, err := svc.SetRetention(ctx, "general", nil); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	room, err = svc.GetRoom(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := RetentionFromModel(room.Retention); got != defaultPolicy {
+		t.Errorf("expected reset to default retention %+v, got %+v", defaultPolicy, got)
+	}
+}
+
+func TestTrimmer_TrimAll(t *testing.T) {
+	ctx := context.Background()
+	mock := &mockRedisClient{}
+	rooms := newTestRoomService(mock, RetentionPolicy{MaxLen: 50})
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := rooms.CreateRoom(ctx, id, id); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := rooms.SetRetention(ctx, "b", &RetentionPolicy{MaxAge: time.Second, Approx: true}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	trimmer := NewTrimmer(broker.NewStreams(mock), rooms, time.Minute)
+	trimmer.now = func() time.Time { return time.UnixMilli(5_000) }
+
+	if err := trimmer.TrimAll(ctx); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]bool{
+		RoomStreamKey("a") + " MAXLEN 50":      true,
+		RoomStreamKey("b") + " MINID ~ 4000-0": true,
+	}
+
+	if len(mock.trims) != len(want) {
+		t.Fatalf("expected %d trims, got %v", len(want), mock.trims)
+	}
+
+	for _, trim := range mock.trims {
+		if !want[trim] {
+			t.Errorf("unexpected trim %q", trim)
+		}
+	}
+}
+
+func TestTrimmer_PrunesTrimmedMessages(t *testing.T) {
+	ctx := context.Background()
+	client := datastore.NewMemoryClient()
+	b := broker.NewStreams(client)
+	svc := NewMessageService(client, b)
+
+	// An old message with a reply, an edit and a reaction, then a newer one
+	var parents []*model.Message
+	for _, text := range []string{"old", "new"} {
+		parent, err := svc.PublishMessage(ctx, "general", MessageInput{Message: text}, RetentionPolicy{})
+		if !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := svc.PublishMessage(ctx, "general", MessageInput{Message: "re: " + text, ParentID: parent.ID}, RetentionPolicy{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if parent, err = svc.UpdateMessage(ctx, parent, text+"!", RetentionPolicy{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := svc.AddReaction(ctx, parent, "👍", nil, RetentionPolicy{}); !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		parents = append(parents, parent)
+	}
+
+	// Events count against the length limit, so the 4 entries of the new message are all that is left
+	trimmer := NewTrimmer(b, NewRoomService(client, b, RetentionPolicy{}), time.Minute)
+	if err := trimmer.Trim(ctx, "general", RetentionPolicy{MaxLen: 4}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{RoomRevisionsKey("general"), RoomThreadsKey("general"), RoomReactionsKey("general")} {
+		values, err := client.HGetAll(ctx, key).Result()
+		if !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(values) == 0 {
+			t.Errorf("expected %s to keep the fields of the new message", key)
+		}
+		for field := range values {
+			if field == parents[0].ID || strings.HasPrefix(field, parents[0].ID+":") {
+				t.Errorf("expected %s to drop %s", key, field)
+			}
+		}
+
+		// The index lists exactly the fields left
+		indexed, err := client.ZRangeByScore(ctx, fieldIndexKey(key), &redis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result()
+		if !errors.Is(err, nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(indexed) != len(values) {
+			t.Errorf("expected the index of %s to list %d fields, got %v", key, len(values), indexed)
+		}
+		for _, field := range indexed {
+			if _, ok := values[field]; !ok {
+				t.Errorf("expected the index of %s to drop %s", key, field)
+			}
+		}
+	}
+
+	for i, want := range []int{0, 1} {
+		replies, err := client.XRangeN(ctx, RoomThreadKey("general", parents[i].ID), "-", "+", 10).Result()
+		if !errors.Is(err, nil) || len(replies) != want {
+			t.Errorf("expected %d replies in thread %d, got %v (%v)", want, i, replies, err)
+		}
+	}
+
+	current, err := svc.GetMessage(ctx, "general", parents[1].ID)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if current.Message != "new!" || current.ReplyCount != 1 || len(current.Reactions) != 1 {
+		t.Errorf("expected the new message to keep its revision, thread and reaction, got %+v", current)
+	}
+}
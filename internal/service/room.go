@@ -0,0 +1,454 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrRoomNotFound is returned when a room does not exist
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrRoomExists is returned when creating a room whose ID is already taken
+	ErrRoomExists = errors.New("room already exists")
+	// ErrRoomArchived is returned when writing to an archived room
+	ErrRoomArchived = errors.New("room is archived")
+)
+
+// Room hash fields
+const (
+	roomFieldID        = "id"
+	roomFieldName      = "name"
+	roomFieldArchived  = "archived"
+	roomFieldCreatedAt = "createdAt"
+	roomFieldUpdatedAt = "updatedAt"
+	roomFieldRetention = "retention" // JSON encoded RetentionPolicy overriding the server default
+)
+
+// RoomMetaKey returns the Redis hash key holding the metadata of a room
+func RoomMetaKey(roomID string) string {
+	return RoomStreamKey(roomID) + constants.RedisRoomMetaSuffix
+}
+
+// RoomService manages room metadata stored in Redis next to the room streams
+type RoomService struct {
+	redis            datastore.RedisClient
+	broker           broker.Broker
+	defaultRetention RetentionPolicy
+	now              func() time.Time
+}
+
+// NewRoomService creates a new RoomService whose messages are kept in b. Rooms
+// without a retention policy of their own use defaultRetention.
+func NewRoomService(redis datastore.RedisClient, b broker.Broker, defaultRetention RetentionPolicy) *RoomService {
+	return &RoomService{
+		redis:            redis,
+		broker:           b,
+		defaultRetention: defaultRetention,
+		now:              time.Now,
+	}
+}
+
+// createRoomScript writes every field of a room hash, given as KEYS[1], unless
+// the hash exists, and adds the room to the room index given as KEYS[2], if
+// any. ARGV holds the field/value pairs, the ID first. It returns 1 when the
+// room was created, so a concurrent create or GetRoom never sees a
+// half-written room, nor ListRooms a room missing from the index.
+var createRoomScript = datastore.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return false
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 3))
+if KEYS[2] then
+	redis.call('SADD', KEYS[2], ARGV[2])
+end
+return 1
+`, func(ctx context.Context, c datastore.RedisClient, keys []string, args []interface{}) (interface{}, error) {
+	created, err := c.HSetNX(ctx, keys[0], fmt.Sprint(args[0]), args[1]).Result()
+	if !errors.Is(err, nil) || !created {
+		return nil, err
+	}
+	if err := c.HSet(ctx, keys[0], args[2:]...).Err(); !errors.Is(err, nil) {
+		return nil, err
+	}
+	if len(keys) > 1 {
+		if err := c.SAdd(ctx, keys[1], args[1]).Err(); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+	return int64(1), nil
+})
+
+// CreateRoom creates a room with the given ID and display name
+func (s *RoomService) CreateRoom(ctx context.Context, roomID, name string) (*model.Room, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("room name cannot be empty")
+	}
+
+	now := s.now().UTC()
+	room := &model.Room{
+		ID:        roomID,
+		Name:      name,
+		Retention: s.defaultRetention.Model(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	keys := []string{RoomMetaKey(roomID)}
+	if broker.HashTags() {
+		// The index lives in another cluster slot than the room, which a
+		// script cannot span. Indexing first never leaves a room unlisted,
+		// and ListRooms skips the entry should the create fail.
+		if err := s.redis.SAdd(ctx, constants.RedisRoomIndexKey, roomID).Err(); !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to index room: %w", err)
+		}
+	} else {
+		keys = append(keys, constants.RedisRoomIndexKey)
+	}
+
+	created, err := createRoomScript.Run(ctx, s.redis, keys,
+		roomFieldID, room.ID,
+		roomFieldName, room.Name,
+		roomFieldArchived, formatBool(room.Archived),
+		roomFieldCreatedAt, room.CreatedAt.Format(time.RFC3339Nano),
+		roomFieldUpdatedAt, room.UpdatedAt.Format(time.RFC3339Nano),
+	).Bool()
+	if !errors.Is(err, nil) && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to create room: %w", err)
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: %s", ErrRoomExists, roomID)
+	}
+
+	return room, nil
+}
+
+// EnsureRoom creates a room unless it already exists
+func (s *RoomService) EnsureRoom(ctx context.Context, roomID, name string) (*model.Room, error) {
+	room, err := s.CreateRoom(ctx, roomID, name)
+	if errors.Is(err, ErrRoomExists) {
+		return s.GetRoom(ctx, roomID)
+	}
+	return room, err
+}
+
+// GetRoom returns a room by ID
+func (s *RoomService) GetRoom(ctx context.Context, roomID string) (*model.Room, error) {
+	if err := ValidateRoomID(roomID); !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	fields, err := s.redis.HGetAll(ctx, RoomMetaKey(roomID)).Result()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to read room: %w", err)
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRoomNotFound, roomID)
+	}
+
+	return s.decodeRoom(fields)
+}
+
+// ListRooms returns all rooms ordered by creation time, optionally including archived ones
+func (s *RoomService) ListRooms(ctx context.Context, includeArchived bool) ([]*model.Room, error) {
+	ids, err := s.redis.SMembers(ctx, constants.RedisRoomIndexKey).Result()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+
+	rooms := make([]*model.Room, 0, len(ids))
+	for _, id := range ids {
+		room, err := s.GetRoom(ctx, id)
+		if errors.Is(err, ErrRoomNotFound) {
+			// Index entry left behind by an interrupted delete
+			continue
+		}
+		if !errors.Is(err, nil) {
+			return nil, err
+		}
+
+		if room.Archived && !includeArchived {
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].CreatedAt.Equal(rooms[j].CreatedAt) {
+			return rooms[i].ID < rooms[j].ID
+		}
+		return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+	})
+
+	return rooms, nil
+}
+
+// RenameRoom changes the display name of a room
+func (s *RoomService) RenameRoom(ctx context.Context, roomID, name string) (*model.Room, error) {
+	if name == "" {
+		return nil, fmt.Errorf("room name cannot be empty")
+	}
+
+	room, err := s.GetRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	room.Name = name
+	room.UpdatedAt = s.now().UTC()
+
+	err = s.redis.HSet(ctx, RoomMetaKey(roomID),
+		roomFieldName, room.Name,
+		roomFieldUpdatedAt, room.UpdatedAt.Format(time.RFC3339Nano),
+	).Err()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to rename room: %w", err)
+	}
+
+	return room, nil
+}
+
+// ArchiveRoom marks a room as archived so it no longer accepts new messages
+func (s *RoomService) ArchiveRoom(ctx context.Context, roomID string) (*model.Room, error) {
+	room, err := s.GetRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if room.Archived {
+		return room, nil
+	}
+
+	room.Archived = true
+	room.UpdatedAt = s.now().UTC()
+
+	err = s.redis.HSet(ctx, RoomMetaKey(roomID),
+		roomFieldArchived, formatBool(room.Archived),
+		roomFieldUpdatedAt, room.UpdatedAt.Format(time.RFC3339Nano),
+	).Err()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to archive room: %w", err)
+	}
+
+	return room, nil
+}
+
+// DeleteRoom removes a room together with its messages, threads, reactions
+// and members. Rather than deleted, the room stream is trimmed down to a
+// roomDeleted entry appended first, which the readers of every instance
+// deliver and then end the subscriptions of the room. A room created again
+// under the same ID starts after that entry.
+func (s *RoomService) DeleteRoom(ctx context.Context, roomID string) error {
+	if _, err := s.GetRoom(ctx, roomID); !errors.Is(err, nil) {
+		return err
+	}
+
+	values := map[string]interface{}{
+		constants.RedisEventField:     constants.MessageEventRoomDeleted,
+		constants.RedisCreatedAtField: s.now().UTC().Format(time.RFC3339Nano),
+	}
+	if _, err := s.broker.Publish(ctx, roomID, values, broker.Trim{MaxLen: 1}); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to delete room messages: %w", err)
+	}
+
+	// Every thread counts its parent in the threads hash
+	threads, err := s.redis.HGetAll(ctx, RoomThreadsKey(roomID)).Result()
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to read room threads: %w", err)
+	}
+	for field := range threads {
+		if parentID, ok := strings.CutSuffix(field, threadCountField); ok {
+			if err := s.broker.Delete(ctx, threadRoomID(roomID, parentID)); !errors.Is(err, nil) {
+				return fmt.Errorf("failed to delete room threads: %w", err)
+			}
+		}
+	}
+
+	keys := []string{RoomMetaKey(roomID), RoomMembersKey(roomID)}
+	for _, key := range []string{RoomRevisionsKey(roomID), RoomThreadsKey(roomID), RoomReactionsKey(roomID)} {
+		keys = append(keys, key, fieldIndexKey(key))
+	}
+	if err := s.redis.Del(ctx, keys...).Err(); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to delete room: %w", err)
+	}
+
+	if err := s.redis.SRem(ctx, constants.RedisRoomIndexKey, roomID).Err(); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to unindex room: %w", err)
+	}
+
+	return nil
+}
+
+// PruneRoom drops the revisions, threads and reactions of the messages of a
+// room older than before, the oldest entry retention left in the room stream.
+// The fields to drop are taken from the field index of each hash, a page at a
+// time. Replies are newer than their parent, so a thread goes as a whole once
+// its parent was trimmed.
+func (s *RoomService) PruneRoom(ctx context.Context, roomID, before string) error {
+	ms, _, _ := strings.Cut(before, "-")
+	threadsKey := RoomThreadsKey(roomID)
+	var threads []string
+	for _, key := range []string{RoomRevisionsKey(roomID), threadsKey, RoomReactionsKey(roomID)} {
+		// Every field of a message older than the millisecond of before goes,
+		// then those of that millisecond whose message is older than before
+		for _, bounds := range [][2]string{{"-inf", "(" + ms}, {ms, ms}} {
+			for {
+				indexed, err := s.redis.ZRangeByScore(ctx, fieldIndexKey(key), &redis.ZRangeBy{Min: bounds[0], Max: bounds[1], Count: constants.RedisStreamCount}).Result()
+				if !errors.Is(err, nil) {
+					return fmt.Errorf("failed to read index of %s: %w", key, err)
+				}
+
+				var fields []string
+				for _, field := range indexed {
+					msgID, _, _ := strings.Cut(field, ":")
+					if CompareStreamIDs(msgID, before) >= 0 {
+						continue
+					}
+					fields = append(fields, field)
+					if parentID, ok := strings.CutSuffix(field, threadCountField); ok && key == threadsKey {
+						threads = append(threads, threadRoomID(roomID, parentID))
+					}
+				}
+				if len(fields) > 0 {
+					if err := s.prune(ctx, key, fields); !errors.Is(err, nil) {
+						return err
+					}
+				}
+				// A page of fields to keep, or the last page, ends the range
+				if len(fields) < len(indexed) || int64(len(indexed)) < constants.RedisStreamCount {
+					break
+				}
+			}
+		}
+	}
+
+	for _, thread := range threads {
+		if err := s.broker.Delete(ctx, thread); !errors.Is(err, nil) {
+			return fmt.Errorf("failed to delete room threads: %w", err)
+		}
+	}
+	return nil
+}
+
+// prune drops fields of a hash along with their index entries
+func (s *RoomService) prune(ctx context.Context, key string, fields []string) error {
+	if err := s.redis.HDel(ctx, key, fields...).Err(); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to prune %s: %w", key, err)
+	}
+
+	members := make([]interface{}, len(fields))
+	for i, field := range fields {
+		members[i] = field
+	}
+	if err := s.redis.ZRem(ctx, fieldIndexKey(key), members...).Err(); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to prune index of %s: %w", key, err)
+	}
+	return nil
+}
+
+// SetRetention overrides the retention policy of a room; a nil policy restores the server default
+func (s *RoomService) SetRetention(ctx context.Context, roomID string, policy *RetentionPolicy) (*model.Room, error) {
+	if policy != nil {
+		if err := policy.Validate(); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	room, err := s.GetRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	room.UpdatedAt = s.now().UTC()
+
+	if policy == nil {
+		room.Retention = s.defaultRetention.Model()
+		err = s.redis.HDel(ctx, RoomMetaKey(roomID), roomFieldRetention).Err()
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to update room retention: %w", err)
+		}
+	} else {
+		encoded, err := json.Marshal(policy)
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to encode retention policy: %w", err)
+		}
+
+		room.Retention = policy.Model()
+		err = s.redis.HSet(ctx, RoomMetaKey(roomID), roomFieldRetention, string(encoded)).Err()
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to update room retention: %w", err)
+		}
+	}
+
+	err = s.redis.HSet(ctx, RoomMetaKey(roomID), roomFieldUpdatedAt, room.UpdatedAt.Format(time.RFC3339Nano)).Err()
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to update room retention: %w", err)
+	}
+
+	return room, nil
+}
+
+// WritableRoom returns the room unless it does not exist or is archived
+func (s *RoomService) WritableRoom(ctx context.Context, roomID string) (*model.Room, error) {
+	room, err := s.GetRoom(ctx, roomID)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+
+	if room.Archived {
+		return nil, fmt.Errorf("%w: %s", ErrRoomArchived, roomID)
+	}
+
+	return room, nil
+}
+
+func (s *RoomService) decodeRoom(fields map[string]string) (*model.Room, error) {
+	createdAt, err := time.Parse(time.RFC3339Nano, fields[roomFieldCreatedAt])
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("invalid room %s: bad %s: %w", fields[roomFieldID], roomFieldCreatedAt, err)
+	}
+
+	updatedAt, err := time.Parse(time.RFC3339Nano, fields[roomFieldUpdatedAt])
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("invalid room %s: bad %s: %w", fields[roomFieldID], roomFieldUpdatedAt, err)
+	}
+
+	retention := s.defaultRetention
+	if encoded, ok := fields[roomFieldRetention]; ok {
+		retention = RetentionPolicy{}
+		if err := json.Unmarshal([]byte(encoded), &retention); !errors.Is(err, nil) {
+			return nil, fmt.Errorf("invalid room %s: bad %s: %w", fields[roomFieldID], roomFieldRetention, err)
+		}
+	}
+
+	return &model.Room{
+		ID:        fields[roomFieldID],
+		Name:      fields[roomFieldName],
+		Archived:  fields[roomFieldArchived] == "1",
+		Retention: retention.Model(),
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+	}, nil
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+)
+
+// newTestRoomService creates a RoomService keeping messages in the mocked Redis streams
+func newTestRoomService(mock *mockRedisClient, defaultRetention RetentionPolicy) *RoomService {
+	return NewRoomService(mock, broker.NewStreams(mock), defaultRetention)
+}
+
+func TestCreateRoom_Success(t *testing.T) {
+	ctx := context.Background()
+	mock := &mockRedisClient{}
+	svc := newTestRoomService(mock, RetentionPolicy{})
+
+	room, err := svc.CreateRoom(ctx, "general", "General")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if room.ID != "general" || room.Name != "General" || room.Archived {
+		t.Errorf("unexpected room: %+v", room)
+	}
+
+	if _, ok := mock.sets[constants.RedisRoomIndexKey]["general"]; !ok {
+		t.Error("expected room to be added to the index")
+	}
+
+	stored, err := svc.GetRoom(ctx, "general")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if stored.Name != room.Name || !stored.CreatedAt.Equal(room.CreatedAt) {
+		t.Errorf("stored room %+v does not match created room %+v", stored, room)
+	}
+}
+
+func TestCreateRoom_HashTags(t *testing.T) {
+	broker.SetHashTag(true)
+	defer broker.SetHashTag(false)
+
+	ctx := context.Background()
+	mock := &mockRedisClient{}
+	svc := newTestRoomService(mock, RetentionPolicy{})
+
+	// The index is written apart from the script, which only names the room slot
+	if _, err := svc.CreateRoom(ctx, "general", "General"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := mock.sets[constants.RedisRoomIndexKey]["general"]; !ok {
+		t.Error("expected room to be added to the index")
+	}
+	if _, ok := mock.hashes[RoomMetaKey("general")]; !ok {
+		t.Errorf("expected the room under %s, got %v", RoomMetaKey("general"), mock.hashes)
+	}
+}
+
+func TestCreateRoom_Duplicate(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestRoomService(&mockRedisClient{}, RetentionPolicy{})
+
+	if _, err := svc.CreateRoom(ctx, "general", "General"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := svc.CreateRoom(ctx, "general", "Other")
+	if !errors.Is(err, ErrRoomExists) {
+		t.Errorf("expected ErrRoomExists, got %v", err)
+	}
+
+	room, err := svc.EnsureRoom(ctx, "general", "Other")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if room.Name != "General" {
+		t.Errorf("expected EnsureRoom to keep the existing name, got %s", room.Name)
+	}
+}
+
+func TestGetRoom_NotFound(t *testing.T) {
+	svc := newTestRoomService(&mockRedisClient{}, RetentionPolicy{})
+
+	_, err := svc.GetRoom(context.Background(), "missing")
+	if !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+}
+
+func TestRenameAndArchiveRoom(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestRoomService(&mockRedisClient{}, RetentionPolicy{})
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return created }
+
+	if _, err := svc.CreateRoom(ctx, "general", "General"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	svc.now = func() time.Time { return created.Add(time.Hour) }
+
+	room, err := svc.RenameRoom(ctx, "general", "Lobby")
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if room.Name != "Lobby" || !room.UpdatedAt.After(room.CreatedAt) {
+		t.Errorf("unexpected renamed room: %+v", room)
+	}
+
+	if _, err := svc.WritableRoom(ctx, "general"); !errors.Is(err, nil) {
+		t.Errorf("expected active room to be writable, got %v", err)
+	}
+
+	if _, err := svc.ArchiveRoom(ctx, "general"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := svc.WritableRoom(ctx, "general"); !errors.Is(err, ErrRoomArchived) {
+		t.Errorf("expected ErrRoomArchived, got %v", err)
+	}
+
+	active, err := svc.ListRooms(ctx, false)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(active) != 0 {
+		t.Errorf("expected archived room to be hidden, got %d rooms", len(active))
+	}
+
+	all, err := svc.ListRooms(ctx, true)
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(all) != 1 || !all[0].Archived {
+		t.Errorf("expected one archived room, got %+v", all)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	ctx := context.Background()
+	client := datastore.NewMemoryClient()
+	b := broker.NewStreams(client)
+	svc := NewRoomService(client, b, RetentionPolicy{})
+	messages := NewMessageService(client, b)
+
+	if _, err := svc.CreateRoom(ctx, "general", "General"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parent, err := messages.PublishMessage(ctx, "general", MessageInput{Message: "lunch?"}, RetentionPolicy{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := messages.PublishMessage(ctx, "general", MessageInput{Message: "yes", ParentID: parent.ID}, RetentionPolicy{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := svc.DeleteRoom(ctx, "general"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The room stream only holds the roomDeleted entry for the readers
+	entries, err := client.XRangeN(ctx, RoomStreamKey("general"), "-", "+", 10).Result()
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the roomDeleted entry, got %v", entries)
+	}
+	event, err := decodeEvent("general", broker.Entry{ID: entries[0].ID, Values: entries[0].Values})
+	if _, ok := event.(*model.RoomDeleted); !errors.Is(err, nil) || !ok {
+		t.Errorf("expected a RoomDeleted event, got %+v (%v)", event, err)
+	}
+
+	if thread, _ := client.XRangeN(ctx, RoomThreadKey("general", parent.ID), "-", "+", 10).Result(); len(thread) != 0 {
+		t.Errorf("expected the thread to be removed, got %v", thread)
+	}
+	if threads, _ := client.HGetAll(ctx, RoomThreadsKey("general")).Result(); len(threads) != 0 {
+		t.Errorf("expected the thread counts to be removed, got %v", threads)
+	}
+
+	if _, err := svc.GetRoom(ctx, "general"); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound after delete, got %v", err)
+	}
+
+	if rooms, _ := client.SMembers(ctx, constants.RedisRoomIndexKey).Result(); len(rooms) != 0 {
+		t.Errorf("expected room to be removed from the index, got %v", rooms)
+	}
+
+	if err := svc.DeleteRoom(ctx, "general"); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound deleting twice, got %v", err)
+	}
+
+	// A room created again starts after the roomDeleted entry
+	if _, err := svc.CreateRoom(ctx, "general", "General"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if history, err := messages.ReadMessages(ctx, "general"); !errors.Is(err, nil) || len(history) != 0 {
+		t.Errorf("expected an empty room, got %v (%v)", history, err)
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/redis/go-redis/v9"
+)
+
+// luaXAdd defines the xadd function scripts append stream entries with. The
+// trim limit comes as three arguments, see trimArgs.
+const luaXAdd = `
+local function xadd(key, id, strategy, approx, threshold, fields)
+  if strategy == '' then
+    return redis.call('XADD', key, id, unpack(fields))
+  end
+  return redis.call('XADD', key, strategy, approx, threshold, id, unpack(fields))
+end
+`
+
+// luaIndex defines the index function scripts record the hash fields of a
+// message in a field index with, see fieldIndexKey. The score is taken from
+// id, the message ID or a field starting with it.
+const luaIndex = `
+local function index(key, id, fields)
+  local score = tonumber(string.match(id, '^%d+'))
+  for _, field in ipairs(fields) do
+    redis.call('ZADD', key, score, field)
+  end
+end
+`
+
+// fieldIndexKey returns the key of the sorted set indexing the fields of a
+// revisions, threads or reactions hash. Every field starts with the ID of its
+// message and is scored by the milliseconds of that ID, so the fields of the
+// messages older than a stream ID are found without reading the hash.
+func fieldIndexKey(hashKey string) string {
+	return hashKey + constants.RedisFieldIndexSuffix
+}
+
+// indexFields is the Go implementation of the index function of scripts
+func indexFields(ctx context.Context, c datastore.RedisClient, key, id string, fields ...string) error {
+	ms, _, _ := strings.Cut(id, "-")
+	score, err := strconv.ParseFloat(ms, 64)
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("invalid message ID %q: %w", id, err)
+	}
+
+	members := make([]redis.Z, len(fields))
+	for i, field := range fields {
+		members[i] = redis.Z{Score: score, Member: field}
+	}
+	return c.ZAdd(ctx, key, members...).Err()
+}
+
+// trimArgs passes the limit the Streams broker would apply on publish to a
+// script: the XADD strategy ("MAXLEN", "MINID" or "" for none), "~" or "="
+// and the threshold
+func trimArgs(trim broker.Trim) []interface{} {
+	approx := "="
+	if trim.Approx {
+		approx = "~"
+	}
+	switch {
+	case trim.MaxLen > 0:
+		return []interface{}{"MAXLEN", approx, trim.MaxLen}
+	case trim.MinID != "":
+		return []interface{}{"MINID", approx, trim.MinID}
+	}
+	return []interface{}{"", approx, ""}
+}
+
+// xAdd is the Go implementation of the xadd function of scripts, trim being
+// the three arguments of trimArgs
+func xAdd(ctx context.Context, c datastore.RedisClient, key, id string, trim, fields []interface{}) (string, error) {
+	values := make(map[string]interface{}, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		values[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+
+	args := &redis.XAddArgs{Stream: key, ID: id, Values: values, Approx: fmt.Sprint(trim[1]) == "~"}
+	switch fmt.Sprint(trim[0]) {
+	case "MAXLEN":
+		maxLen, err := strconv.ParseInt(fmt.Sprint(trim[2]), 10, 64)
+		if !errors.Is(err, nil) {
+			return "", fmt.Errorf("invalid MAXLEN %v: %w", trim[2], err)
+		}
+		args.MaxLen = maxLen
+	case "MINID":
+		args.MinID = fmt.Sprint(trim[2])
+	}
+	return c.XAdd(ctx, args).Result()
+}
+
+// fieldArgs flattens the values of a stream entry into field and value
+// arguments of a script, ordered by field
+func fieldArgs(values map[string]interface{}) []interface{} {
+	fields := make([]string, 0, len(values))
+	for field := range values {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	args := make([]interface{}, 0, 2*len(fields))
+	for _, field := range fields {
+		args = append(args, field, values[field])
+	}
+	return args
+}
+
+// scriptsPublish reports whether the room streams are Redis streams of the
+// datastore, so that a script can append to them along with its other writes.
+// Other brokers keep rooms elsewhere and are published to separately.
+func (s *MessageService) scriptsPublish() bool {
+	_, ok := s.broker.(*broker.Streams)
+	return ok
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+)
+
+// ErrInvalidStreamID is returned for strings that are not Redis stream entry IDs
+var ErrInvalidStreamID = broker.ErrInvalidID
+
+// ParseStreamID splits a Redis stream entry ID "<ms>-<seq>" into its parts
+func ParseStreamID(id string) (ms, seq uint64, err error) {
+	return broker.ParseID(id)
+}
+
+// ValidateStreamID checks that id is a complete Redis stream entry ID
+func ValidateStreamID(id string) error {
+	_, _, err := broker.ParseID(id)
+	return err
+}
+
+// CompareStreamIDs orders two valid stream IDs the way Redis does, returning
+// -1, 0 or +1. Invalid IDs sort before valid ones.
+func CompareStreamIDs(a, b string) int {
+	return broker.CompareIDs(a, b)
+}
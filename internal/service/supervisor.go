@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+)
+
+// ErrStreamUnavailable is reported to subscribers when the stream reader is down
+var ErrStreamUnavailable = errors.New("message stream unavailable")
+
+// ReaderState is the lifecycle state of the supervised stream reader
+type ReaderState string
+
+const (
+	ReaderStarting     ReaderState = "starting"
+	ReaderRunning      ReaderState = "running"
+	ReaderReconnecting ReaderState = "reconnecting"
+	ReaderFailed       ReaderState = "failed"
+	ReaderStopped      ReaderState = "stopped"
+)
+
+// ReaderStatus describes the current state of the supervised stream reader
+type ReaderStatus struct {
+	State     ReaderState
+	Since     time.Time // when the reader entered State
+	Attempts  int       // reconnect attempts made since the reader last ran
+	LastError error
+}
+
+// Backoff configures the delay between reconnect attempts
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64 // fraction of the delay randomly added or removed, 0..1
+	MaxAttempts int     // give up after this many failed attempts, 0 retries forever
+}
+
+// DefaultBackoff returns the reconnect backoff configured in constants
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial:     constants.StreamReaderBackoffInitial,
+		Max:         constants.StreamReaderBackoffMax,
+		Multiplier:  constants.StreamReaderBackoffMultiplier,
+		Jitter:      constants.StreamReaderBackoffJitter,
+		MaxAttempts: constants.StreamReaderMaxAttempts,
+	}
+}
+
+// Delay returns how long to wait before the given reconnect attempt, starting at 1
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt-1))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// StreamSupervisor keeps a StreamReader running. When the reader fails it waits
+// with exponential backoff until Redis answers again and restarts the reader,
+// which resumes from the last stream IDs it processed.
+type StreamSupervisor struct {
+	reader  StreamReader
+	redis   datastore.RedisClient
+	backoff Backoff
+
+	// OnStateChange, when set before Run, is called after every state transition
+	OnStateChange func(ReaderStatus)
+
+	mutex  sync.Mutex
+	status ReaderStatus
+}
+
+// NewStreamSupervisor creates a StreamSupervisor for a reader
+func NewStreamSupervisor(redis datastore.RedisClient, reader StreamReader, backoff Backoff) *StreamSupervisor {
+	return &StreamSupervisor{
+		reader:  reader,
+		redis:   redis,
+		backoff: backoff,
+		status:  ReaderStatus{State: ReaderStarting, Since: time.Now()},
+	}
+}
+
+// Status returns the current state of the reader
+func (s *StreamSupervisor) Status() ReaderStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+func (s *StreamSupervisor) setState(state ReaderState, attempts int, err error) {
+	s.mutex.Lock()
+	if s.status.State != state {
+		s.status.Since = time.Now()
+	}
+	s.status.State = state
+	s.status.Attempts = attempts
+	s.status.LastError = err
+	status := s.status
+	s.mutex.Unlock()
+
+	if s.OnStateChange != nil {
+		s.OnStateChange(status)
+	}
+}
+
+// Run delivers room events to handle until the context is cancelled or the
+// reconnect attempts are exhausted
+func (s *StreamSupervisor) Run(ctx context.Context, handle func(model.RoomEvent)) {
+	for {
+		s.setState(ReaderRunning, 0, nil)
+		err := s.reader.Consume(ctx, handle)
+		if !errors.Is(ctx.Err(), nil) {
+			s.setState(ReaderStopped, 0, nil)
+			return
+		}
+
+		slog.WarnContext(ctx, "Stream reader stopped", logging.Err(err))
+
+		for attempt := 1; ; attempt++ {
+			if s.backoff.MaxAttempts > 0 && attempt > s.backoff.MaxAttempts {
+				slog.ErrorContext(ctx, "Stream reader failed, giving up", slog.Int("attempts", s.backoff.MaxAttempts), logging.Err(err))
+				s.setState(ReaderFailed, attempt-1, err)
+				return
+			}
+
+			s.setState(ReaderReconnecting, attempt, err)
+			delay := s.backoff.Delay(attempt)
+			slog.InfoContext(ctx, "Stream reader reconnecting", slog.Duration("delay", delay), slog.Int("attempt", attempt))
+
+			select {
+			case <-ctx.Done():
+				s.setState(ReaderStopped, 0, nil)
+				return
+			case <-time.After(delay):
+			}
+
+			if err = s.redis.Ping(ctx).Err(); errors.Is(err, nil) {
+				slog.InfoContext(ctx, "Stream reader reconnected, resuming", slog.Int("attempts", attempt))
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/redis/go-redis/v9"
+)
+
+// fastBackoff keeps reconnect delays short in tests
+var fastBackoff = Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond, Multiplier: 2}
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := b.Delay(i + 1); got != w {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, w, got)
+		}
+	}
+
+	b.Jitter = 0.5
+	for range 100 {
+		if got := b.Delay(2); got < 100*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("jittered delay %s outside of 100ms..300ms", got)
+		}
+	}
+}
+
+func TestStreamSupervisor_ResumesAfterError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	var reads [][]string
+
+	mock := &mockRedisClient{
+		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
+			mutex.Lock()
+			reads = append(reads, args.Streams)
+			n := len(reads)
+			mutex.Unlock()
+
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			switch n {
+			case 1:
+				cmd.SetVal([]redis.XStream{{Stream: RoomStreamKey("a"), Messages: []redis.XMessage{entry("1-0", "before")}}})
+			case 2:
+				cmd.SetErr(errors.New("connection reset"))
+			case 3:
+				cmd.SetVal([]redis.XStream{{Stream: RoomStreamKey("a"), Messages: []redis.XMessage{entry("2-0", "after")}}})
+			default:
+				<-ctx.Done()
+				cmd.SetErr(ctx.Err())
+			}
+			return cmd
+		},
+	}
+
+	supervisor := NewStreamSupervisor(mock, NewStreamTailer(broker.NewStreams(mock), func() []string { return []string{"a"} }), fastBackoff)
+
+	var states []ReaderState
+	supervisor.OnStateChange = func(status ReaderStatus) {
+		mutex.Lock()
+		states = append(states, status.State)
+		mutex.Unlock()
+	}
+
+	received := make(chan *model.Message, 2)
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(ctx, func(event model.RoomEvent) { received <- event.(*model.MessageCreated).Message })
+		close(done)
+	}()
+
+	for _, want := range []string{"before", "after"} {
+		select {
+		case msg := <-received:
+			if msg.Message != want {
+				t.Errorf("expected %q, got %q", want, msg.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	mutex.Lock()
+	resumed := reads[2]
+	mutex.Unlock()
+	if resumed[1] != "1-0" {
+		t.Errorf("expected the reader to resume after 1-0, got %v", resumed)
+	}
+
+	cancel()
+	<-done
+
+	if got := supervisor.Status().State; got != ReaderStopped {
+		t.Errorf("expected state %s after cancel, got %s", ReaderStopped, got)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []ReaderState{ReaderRunning, ReaderReconnecting, ReaderRunning, ReaderStopped}
+	if len(states) != len(want) {
+		t.Fatalf("expected states %v, got %v", want, states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("expected states %v, got %v", want, states)
+		}
+	}
+}
+
+func TestStreamSupervisor_FailsAfterMaxAttempts(t *testing.T) {
+	redisErr := errors.New("connection refused")
+	pings := 0
+
+	mock := &mockRedisClient{
+		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			cmd.SetErr(redisErr)
+			return cmd
+		},
+		pingFunc: func(ctx context.Context) *redis.StatusCmd {
+			pings++
+			cmd := redis.NewStatusCmd(ctx)
+			cmd.SetErr(redisErr)
+			return cmd
+		},
+	}
+
+	backoff := fastBackoff
+	backoff.MaxAttempts = 3
+	supervisor := NewStreamSupervisor(mock, NewStreamTailer(broker.NewStreams(mock), func() []string { return []string{"a"} }), backoff)
+
+	done := make(chan struct{})
+	go func() {
+		supervisor.Run(context.Background(), func(model.RoomEvent) {})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the supervisor to give up")
+	}
+
+	status := supervisor.Status()
+	if status.State != ReaderFailed || !errors.Is(status.LastError, redisErr) {
+		t.Errorf("expected failed state with the ping error, got %+v", status)
+	}
+	if pings != 3 {
+		t.Errorf("expected 3 reconnect attempts, got %d", pings)
+	}
+}
@@ -0,0 +1,357 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph/model"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ReaderStats counts the work done by a StreamReader
+type ReaderStats struct {
+	Reads     uint64 // XREAD or XREADGROUP calls issued
+	Delivered uint64 // entries handed to subscribers
+	Invalid   uint64 // entries skipped because they could not be decoded
+	Acked     uint64 // entries acknowledged to the consumer group
+	Claimed   uint64 // pending entries claimed from other consumers
+}
+
+// StreamReader follows the streams of the subscribed rooms
+type StreamReader interface {
+	// Consume hands every new entry to handle until the context is cancelled or a read fails
+	Consume(ctx context.Context, handle func(model.RoomEvent)) error
+	// Follow starts a room at the current end of its stream unless it is followed
+	// already. Subscribing calls it once the subscriber is registered, so entries
+	// published right after are delivered although the reader only adds the room
+	// to its reads once the current blocking read returns.
+	Follow(ctx context.Context, roomID string) error
+	Stats() ReaderStats
+}
+
+// StreamTailer follows the streams of a changing set of rooms and delivers
+// every entry exactly once, in stream order. It remembers the last entry
+// delivered per room, so a stopped tailer resumes where it left off.
+type StreamTailer struct {
+	broker broker.Broker
+	rooms  func() []string
+
+	mutex   sync.Mutex
+	offsets map[string]string // room ID -> ID of the last entry delivered
+
+	reads     atomic.Uint64
+	delivered atomic.Uint64
+	invalid   atomic.Uint64
+}
+
+// NewStreamTailer creates a StreamTailer following the rooms returned by rooms
+func NewStreamTailer(b broker.Broker, rooms func() []string) *StreamTailer {
+	return &StreamTailer{
+		broker:  b,
+		rooms:   rooms,
+		offsets: map[string]string{},
+	}
+}
+
+// Stats returns a snapshot of the tailer counters
+func (t *StreamTailer) Stats() ReaderStats {
+	return ReaderStats{
+		Reads:     t.reads.Load(),
+		Delivered: t.delivered.Load(),
+		Invalid:   t.invalid.Load(),
+	}
+}
+
+// Offsets returns a copy of the last delivered entry ID per room
+func (t *StreamTailer) Offsets() map[string]string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	offsets := make(map[string]string, len(t.offsets))
+	for roomID, id := range t.offsets {
+		offsets[roomID] = id
+	}
+	return offsets
+}
+
+// Stream continuously reads new entries from the room streams and sends them to
+// the event channel. The room list is refreshed every time a blocking read
+// returns, so newly subscribed rooms are read within constants.RedisStreamBlock,
+// starting from the offset Follow recorded when they were subscribed. Rooms of
+// different Redis Cluster hash slots are read concurrently, see readLanes.
+// Both channels are closed when the context is cancelled or a read fails.
+func (t *StreamTailer) Stream(ctx context.Context) (<-chan model.RoomEvent, <-chan error) {
+	eventChan := make(chan model.RoomEvent)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(eventChan)
+		defer close(errChan)
+
+		if err := t.run(ctx, eventChan); !errors.Is(err, nil) && !errors.Is(err, context.Canceled) {
+			errChan <- err
+		}
+	}()
+
+	return eventChan, errChan
+}
+
+// Consume runs Stream, handing every event to handle, and returns the error that stopped it
+func (t *StreamTailer) Consume(ctx context.Context, handle func(model.RoomEvent)) error {
+	eventChan, errChan := t.Stream(ctx)
+
+	for event := range eventChan {
+		handle(event)
+	}
+
+	// Stream reports its error before closing the event channel
+	if err, ok := <-errChan; ok {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (t *StreamTailer) run(ctx context.Context, eventChan chan<- model.RoomEvent) error {
+	// Pub/Sub drops the pending messages of rooms a read does not name, so
+	// only streams are read per slot
+	slot := func(string) int { return 0 }
+	if _, ok := t.broker.(*broker.Streams); ok {
+		slot = broker.Slot
+	}
+
+	return readLanes(ctx, slot, t.syncOffsets, func(ctx context.Context, roomIDs []string) error {
+		return t.read(ctx, roomIDs, eventChan)
+	})
+}
+
+// read waits for new entries of rooms and sends them to the event channel
+func (t *StreamTailer) read(ctx context.Context, roomIDs []string, eventChan chan<- model.RoomEvent) error {
+	offsets := make([]broker.Offset, len(roomIDs))
+	t.mutex.Lock()
+	for i, roomID := range roomIDs {
+		offsets[i] = broker.Offset{RoomID: roomID, After: t.offsets[roomID]}
+	}
+	t.mutex.Unlock()
+
+	t.reads.Add(1)
+	start := time.Now()
+	batches, err := t.broker.Read(ctx, offsets, constants.RedisStreamCount, constants.RedisStreamBlock)
+	entries := 0
+	for _, batch := range batches {
+		entries += len(batch.Entries)
+	}
+	traceRead(ctx, "XREAD", start, len(roomIDs), entries, err)
+	if !errors.Is(err, nil) {
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		return fmt.Errorf("failed to stream messages: %w", err)
+	}
+
+	for _, batch := range batches {
+		for _, entry := range batch.Entries {
+			event, err := decodeEvent(batch.RoomID, entry)
+			if !errors.Is(err, nil) {
+				// Skip the entry rather than stall the room on it forever
+				t.invalid.Add(1)
+				slog.WarnContext(ctx, "Skipping invalid entry", slog.String(logging.RoomKey, batch.RoomID), slog.String(logging.MessageIDKey, entry.ID), logging.Err(err))
+			} else {
+				select {
+				case eventChan <- event:
+					t.delivered.Add(1)
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			t.mutex.Lock()
+			t.offsets[batch.RoomID] = entry.ID
+			t.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// syncOffsets forgets rooms that are no longer followed and starts tracking
+// newly followed rooms at the current end of their stream. It returns the
+// followed rooms.
+func (t *StreamTailer) syncOffsets(ctx context.Context) ([]string, error) {
+	// The room list is taken under the mutex, so a room followed after the
+	// list was taken keeps the offset Follow recorded
+	t.mutex.Lock()
+	roomIDs := t.rooms()
+	followed := make(map[string]struct{}, len(roomIDs))
+	for _, roomID := range roomIDs {
+		followed[roomID] = struct{}{}
+	}
+	for roomID := range t.offsets {
+		if _, ok := followed[roomID]; !ok {
+			delete(t.offsets, roomID)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, roomID := range roomIDs {
+		if err := t.Follow(ctx, roomID); !errors.Is(err, nil) {
+			return nil, err
+		}
+	}
+
+	return roomIDs, nil
+}
+
+// Follow starts tracking a room at the current end of its stream unless it is tracked already
+func (t *StreamTailer) Follow(ctx context.Context, roomID string) error {
+	t.mutex.Lock()
+	_, ok := t.offsets[roomID]
+	t.mutex.Unlock()
+	if ok {
+		return nil
+	}
+
+	offset, err := streamEnd(ctx, t.broker, roomID)
+	if !errors.Is(err, nil) {
+		return err
+	}
+
+	t.mutex.Lock()
+	if _, ok := t.offsets[roomID]; !ok {
+		t.offsets[roomID] = offset
+	}
+	t.mutex.Unlock()
+
+	return nil
+}
+
+// readLanes reads the followed rooms in one lane per hash slot, so that no
+// read names keys of several slots of a Redis Cluster. Each lane is a
+// goroutine calling read with the followed rooms of its slot over and over,
+// and stops once its slot has no followed room left. follow returns the
+// followed rooms; the lanes call it before every read, and lanes for new
+// slots are started every constants.RedisStreamBlock. It returns once ctx is
+// done or a call fails, after every lane stopped.
+func readLanes(ctx context.Context, slot func(roomID string) int, follow func(context.Context) ([]string, error), read func(ctx context.Context, roomIDs []string) error) error {
+	laneCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		lanes  = map[int]struct{}{} // slots with a running lane
+		failed = make(chan error, 1)
+	)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+		cancel()
+	}
+
+	lane := func(s int) {
+		defer wg.Done()
+		for {
+			roomIDs, err := follow(laneCtx)
+			if !errors.Is(err, nil) {
+				fail(err)
+				return
+			}
+			var own []string
+			for _, roomID := range roomIDs {
+				if slot(roomID) == s {
+					own = append(own, roomID)
+				}
+			}
+			if len(own) == 0 {
+				mutex.Lock()
+				delete(lanes, s)
+				mutex.Unlock()
+				return
+			}
+			if err := read(laneCtx, own); !errors.Is(err, nil) {
+				fail(err)
+				return
+			}
+		}
+	}
+
+	for {
+		roomIDs, err := follow(laneCtx)
+		if !errors.Is(err, nil) {
+			fail(err)
+		}
+
+		mutex.Lock()
+		for _, roomID := range roomIDs {
+			s := slot(roomID)
+			if _, ok := lanes[s]; ok {
+				continue
+			}
+			lanes[s] = struct{}{}
+			wg.Add(1)
+			go lane(s)
+		}
+		mutex.Unlock()
+
+		select {
+		case <-laneCtx.Done():
+			wg.Wait()
+			if err := ctx.Err(); !errors.Is(err, nil) {
+				return err
+			}
+			return <-failed
+		case <-time.After(constants.RedisStreamBlock):
+		}
+	}
+}
+
+// streamEnd returns the ID of the last entry of a room, "0-0" for an empty
+// stream so it is tailed from the very beginning, or for a broker keeping no
+// history, which ignores offsets anyway
+func streamEnd(ctx context.Context, b broker.Broker, roomID string) (string, error) {
+	last, err := b.RevRange(ctx, roomID, "+", "-", 1)
+	if errors.Is(err, broker.ErrNoHistory) {
+		return "0-0", nil
+	}
+	if !errors.Is(err, nil) {
+		return "", fmt.Errorf("failed to read end of stream for room %s: %w", roomID, err)
+	}
+	if len(last) == 0 {
+		return "0-0", nil
+	}
+	return last[0].ID, nil
+}
+
+// traceRead records a read of the room streams as a span that ends now. Reads
+// that returned nothing are not traced, an idle reader would otherwise emit a
+// span per blocking read.
+func traceRead(ctx context.Context, command string, start time.Time, rooms, entries int, err error) {
+	if entries == 0 && (errors.Is(err, nil) || errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled)) {
+		return
+	}
+
+	_, span := tracing.Tracer().Start(ctx, command,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			semconv.DBSystemNameRedis,
+			semconv.DBOperationName(command),
+			attribute.Int("chat.stream.rooms", rooms),
+			attribute.Int("chat.stream.entries", entries),
+		),
+	)
+	tracing.RecordError(span, err)
+	span.End()
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/redis/go-redis/v9"
+)
+
+func entry(id, message string) redis.XMessage {
+	return redis.XMessage{ID: id, Values: map[string]interface{}{constants.RedisMessageField: message}}
+}
+
+func TestStreamTailer_DeliversEveryEntry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mutex sync.Mutex
+	var reads [][]string
+
+	mock := &mockRedisClient{
+		// Room b already has history, the tailer must start after it
+		entries: map[string][]redis.XMessage{RoomStreamKey("b"): {entry("5-0", "old")}},
+		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
+			mutex.Lock()
+			reads = append(reads, args.Streams)
+			n := len(reads)
+			mutex.Unlock()
+
+			if args.Count != constants.RedisStreamCount {
+				t.Errorf("expected count %d, got %d", constants.RedisStreamCount, args.Count)
+			}
+
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			if n > 1 {
+				<-ctx.Done()
+				cmd.SetErr(ctx.Err())
+				return cmd
+			}
+
+			cmd.SetVal([]redis.XStream{
+				{Stream: RoomStreamKey("a"), Messages: []redis.XMessage{entry("1-0", "a1"), entry("2-0", "a2")}},
+				{Stream: RoomStreamKey("b"), Messages: []redis.XMessage{entry("6-0", "b1"), {ID: "7-0"}, entry("8-0", "b2")}},
+			})
+			return cmd
+		},
+	}
+
+	tailer := NewStreamTailer(broker.NewStreams(mock), func() []string { return []string{"a", "b"} })
+	eventChan, errChan := tailer.Stream(ctx)
+
+	var got []string
+	for len(got) < 4 {
+		select {
+		case event := <-eventChan:
+			got = append(got, fmt.Sprintf("%s/%s", event.GetRoomID(), event.GetID()))
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for messages, got %v", got)
+		}
+	}
+
+	if fmt.Sprint(got) != "[a/1-0 a/2-0 b/6-0 b/8-0]" {
+		t.Errorf("unexpected delivery order: %v", got)
+	}
+
+	// Wait for the second read, which must continue from the delivered entries
+	deadline := time.After(time.Second)
+	for {
+		mutex.Lock()
+		n := len(reads)
+		mutex.Unlock()
+		if n >= 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for the second read")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	mutex.Lock()
+	first, second := fmt.Sprint(reads[0]), fmt.Sprint(reads[1])
+	mutex.Unlock()
+
+	if first != "[room:a room:b 0-0 5-0]" {
+		t.Errorf("unexpected first read: %s", first)
+	}
+	if second != "[room:a room:b 2-0 8-0]" {
+		t.Errorf("unexpected second read: %s", second)
+	}
+
+	stats := tailer.Stats()
+	if stats.Delivered != 4 || stats.Invalid != 1 || stats.Reads != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	cancel()
+	for err := range errChan {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamTailer_ReadError(t *testing.T) {
+	redisErr := errors.New("connection reset")
+	mock := &mockRedisClient{
+		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			cmd.SetErr(redisErr)
+			return cmd
+		},
+	}
+
+	tailer := NewStreamTailer(broker.NewStreams(mock), func() []string { return []string{"a"} })
+	_, errChan := tailer.Stream(context.Background())
+
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, redisErr) {
+			t.Errorf("expected error to wrap redis error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+}
+
+func TestStreamTailer_ForgetsUnfollowedRooms(t *testing.T) {
+	ctx := context.Background()
+	rooms := []string{"a", "b"}
+	tailer := NewStreamTailer(broker.NewStreams(&mockRedisClient{}), func() []string { return rooms })
+
+	if _, err := tailer.syncOffsets(ctx); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rooms = []string{"b"}
+	if _, err := tailer.syncOffsets(ctx); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	offsets := tailer.Offsets()
+	if _, ok := offsets["a"]; ok || len(offsets) != 1 {
+		t.Errorf("expected only room b to be tracked, got %v", offsets)
+	}
+}
+
+func TestStreamTailer_DeliversEntriesPublishedRightAfterFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := broker.NewMemory()
+	if _, err := b.Publish(ctx, "a", map[string]interface{}{constants.RedisMessageField: "old"}, broker.Trim{}); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var rooms []string
+	tailer := NewStreamTailer(b, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return rooms
+	})
+	eventChan, _ := tailer.Stream(ctx)
+
+	// Let the tailer start waiting while no room is followed
+	time.Sleep(10 * time.Millisecond)
+
+	mutex.Lock()
+	rooms = []string{"a"}
+	mutex.Unlock()
+	if err := tailer.Follow(ctx, "a"); !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id, err := b.Publish(ctx, "a", map[string]interface{}{constants.RedisMessageField: "new"}, broker.Trim{})
+	if !errors.Is(err, nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case event := <-eventChan:
+		if event.GetID() != id {
+			t.Errorf("expected the entry published after Follow, got %s", event.GetID())
+		}
+	case <-time.After(3 * constants.RedisStreamBlock):
+		t.Fatal("timeout waiting for the entry published after Follow")
+	}
+}
+
+func TestStreamTailer_ReadsOneSlotAtATime(t *testing.T) {
+	broker.SetHashTag(true)
+	defer broker.SetHashTag(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reads := make(chan []string, 10)
+	mock := &mockRedisClient{
+		xReadFunc: func(ctx context.Context, args *redis.XReadArgs) *redis.XStreamSliceCmd {
+			reads <- args.Streams
+			<-ctx.Done()
+			cmd := redis.NewXStreamSliceCmd(ctx)
+			cmd.SetErr(ctx.Err())
+			return cmd
+		},
+	}
+
+	// Rooms foo and bar hash to different slots, foo and its thread to the same
+	tailer := NewStreamTailer(broker.NewStreams(mock), func() []string { return []string{"foo", "bar", "foo:thread:1-0"} })
+	_, errChan := tailer.Stream(ctx)
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case streams := <-reads:
+			got[fmt.Sprint(streams)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for reads, got %v", got)
+		}
+	}
+	if !got["[room:{foo} room:{foo}:thread:1-0 0-0 0-0]"] || !got["[room:{bar} 0-0]"] {
+		t.Errorf("expected one read per slot, got %v", got)
+	}
+
+	cancel()
+	for err := range errChan {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
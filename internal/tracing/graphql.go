@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// GraphQL is a gqlgen handler extension starting a span per operation and a
+// child span per resolver call; fields read from structs are not traced
+type GraphQL struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationInterceptor
+	graphql.FieldInterceptor
+} = GraphQL{}
+
+func (GraphQL) ExtensionName() string {
+	return "Tracing"
+}
+
+func (GraphQL) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// InterceptOperation spans a query or mutation until its response is ready.
+// A subscription span covers its setup only, each event being traced where it
+// is delivered.
+func (GraphQL) InterceptOperation(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	opCtx := graphql.GetOperationContext(ctx)
+
+	kind, name := "unknown", opCtx.OperationName
+	if opCtx.Operation != nil {
+		kind = string(opCtx.Operation.Operation)
+		if opCtx.Operation.Name != "" {
+			name = opCtx.Operation.Name
+		}
+	}
+	if name == "" {
+		name = "anonymous"
+	}
+
+	ctx, span := Tracer().Start(ctx, kind+" "+name, trace.WithAttributes(
+		semconv.GraphQLOperationName(name),
+		semconv.GraphQLOperationTypeKey.String(kind),
+	))
+
+	respond := next(ctx)
+	if kind == string(ast.Subscription) {
+		span.End()
+		return respond
+	}
+
+	return func(ctx context.Context) *graphql.Response {
+		resp := respond(ctx)
+		if resp != nil && len(resp.Errors) > 0 {
+			span.SetStatus(codes.Error, resp.Errors.Error())
+		}
+		span.End()
+		return resp
+	}
+}
+
+// InterceptField spans the call of a resolver
+func (GraphQL) InterceptField(ctx context.Context, next graphql.Resolver) (interface{}, error) {
+	fc := graphql.GetFieldContext(ctx)
+	if fc == nil || !fc.IsResolver {
+		return next(ctx)
+	}
+
+	ctx, span := Tracer().Start(ctx, fc.Object+"."+fc.Field.Name, trace.WithAttributes(
+		attribute.String("graphql.field.path", fc.Path().String()),
+		attribute.String("graphql.field.type", fc.Field.Definition.Type.String()),
+	))
+	defer span.End()
+
+	res, err := next(ctx)
+	RecordError(span, err)
+	return res, err
+}
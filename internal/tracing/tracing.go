@@ -0,0 +1,153 @@
+// Package tracing sets up OpenTelemetry tracing and instruments the HTTP
+// router, the GraphQL server and the room streams. The trace context of a
+// message travels with its stream entry, so the delivery to subscribers can be
+// linked back to the request that published it.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans created by this server
+const instrumentationName = "github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions"
+
+// Options configures the trace exporter of Setup
+type Options struct {
+	Exporter       string // none, stdout or otlp
+	Protocol       string // OTLP transport: grpc or http
+	Endpoint       string // OTLP collector host:port, empty uses OTEL_EXPORTER_OTLP_ENDPOINT
+	Insecure       bool   // send to the collector without TLS
+	ServiceName    string
+	ServiceVersion string
+	SampleRatio    float64   // fraction of new traces recorded
+	Writer         io.Writer // output of the stdout exporter, os.Stdout when nil
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. It returns a function flushing the spans not exported yet,
+// to be called on shutdown. With the none exporter spans are not recorded,
+// but incoming trace context is still passed on.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newExporter(ctx, opts)
+	if !errors.Is(err, nil) {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(opts.ServiceName), semconv.ServiceVersion(opts.ServiceVersion)),
+	)
+	if !errors.Is(err, nil) {
+		return nil, fmt.Errorf("failed to describe the trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// newExporter creates the configured exporter, nil for none
+func newExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, error) {
+	switch opts.Exporter {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		w := opts.Writer
+		if w == nil {
+			w = os.Stdout
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(w), stdouttrace.WithPrettyPrint())
+	case "otlp":
+		switch opts.Protocol {
+		case "", "grpc":
+			var grpcOpts []otlptracegrpc.Option
+			if opts.Endpoint != "" {
+				grpcOpts = append(grpcOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+			}
+			if opts.Insecure {
+				grpcOpts = append(grpcOpts, otlptracegrpc.WithInsecure())
+			}
+			return otlptracegrpc.New(ctx, grpcOpts...)
+		case "http":
+			var httpOpts []otlptracehttp.Option
+			if opts.Endpoint != "" {
+				httpOpts = append(httpOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+			}
+			if opts.Insecure {
+				httpOpts = append(httpOpts, otlptracehttp.WithInsecure())
+			}
+			return otlptracehttp.New(ctx, httpOpts...)
+		default:
+			return nil, fmt.Errorf("unknown OTLP protocol %q", opts.Protocol)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", opts.Exporter)
+	}
+}
+
+// Tracer returns the tracer of the server, backed by the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Inject adds the trace context of ctx to the values of a stream entry
+func Inject(ctx context.Context, values map[string]interface{}) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for key, value := range carrier {
+		values[key] = value
+	}
+}
+
+// Extract returns the trace context stored in the values of a stream entry by
+// Inject, an invalid span context when there is none
+func Extract(values map[string]interface{}) trace.SpanContext {
+	propagator := otel.GetTextMapPropagator()
+
+	carrier := propagation.MapCarrier{}
+	for _, key := range propagator.Fields() {
+		if value, ok := values[key].(string); ok {
+			carrier[key] = value
+		}
+	}
+	if len(carrier) == 0 {
+		return trace.SpanContext{}
+	}
+
+	return trace.SpanContextFromContext(propagator.Extract(context.Background(), carrier))
+}
+
+// RecordError marks span as failed when err is not nil
+func RecordError(span trace.Span, err error) {
+	if errors.Is(err, nil) {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
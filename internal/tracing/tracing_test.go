@@ -0,0 +1,162 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/labstack/echo/v5"
+	"github.com/vektah/gqlparser/v2/ast"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider recording every span for the duration of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func TestInjectExtract(t *testing.T) {
+	recordSpans(t)
+
+	ctx, span := Tracer().Start(context.Background(), "createMessage")
+	defer span.End()
+
+	values := map[string]interface{}{"message": "hello"}
+	Inject(ctx, values)
+	if _, ok := values["traceparent"].(string); !ok {
+		t.Fatalf("expected a traceparent field, got %v", values)
+	}
+
+	got := Extract(values)
+	if !got.IsValid() || !got.IsRemote() || got.TraceID() != span.SpanContext().TraceID() || got.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("expected the span context of createMessage, got %+v", got)
+	}
+
+	if sc := Extract(map[string]interface{}{"message": "hello"}); sc.IsValid() {
+		t.Errorf("expected no span context for an entry without trace fields, got %+v", sc)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), Options{Exporter: "stdout", ServiceName: "chat", SampleRatio: 1, Writer: &out})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, span := Tracer().Start(context.Background(), "exported")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), `"Name": "exported"`) {
+		t.Errorf("expected the span written to stdout, got %s", out.String())
+	}
+
+	if _, err := Setup(context.Background(), Options{Exporter: "jaeger"}); err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+	if _, err := Setup(context.Background(), Options{Exporter: "otlp", Protocol: "udp"}); err == nil {
+		t.Error("expected an error for an unknown OTLP protocol")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+
+	e := echo.New()
+	e.Use(Middleware("/healthz"))
+	e.GET("/rooms/:id", func(c *echo.Context) error {
+		if !trace.SpanContextFromContext(c.Request().Context()).IsValid() {
+			t.Error("expected the request context to carry the span")
+		}
+		return c.String(http.StatusInternalServerError, "boom")
+	})
+	e.GET("/healthz", func(c *echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/rooms/general", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, the probe being skipped, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /rooms/:id" || span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("unexpected span %s of kind %s", span.Name(), span.SpanKind())
+	}
+	if span.Parent().TraceID().String() != traceID {
+		t.Errorf("expected the trace of the caller, got %s", span.Parent().TraceID())
+	}
+	if span.Status().Code != codes.Error {
+		t.Errorf("expected an error status for a 500, got %v", span.Status())
+	}
+}
+
+func TestGraphQL_InterceptField(t *testing.T) {
+	recorder := recordSpans(t)
+
+	field := func(isResolver bool) context.Context {
+		return graphql.WithFieldContext(context.Background(), &graphql.FieldContext{
+			Object:     "Mutation",
+			IsResolver: isResolver,
+			Field: graphql.CollectedField{Field: &ast.Field{
+				Name:       "createMessage",
+				Alias:      "createMessage",
+				Definition: &ast.FieldDefinition{Type: ast.NonNullNamedType("Message", nil)},
+			}},
+		})
+	}
+
+	failure := errors.New("room archived")
+	_, err := GraphQL{}.InterceptField(field(true), func(ctx context.Context) (interface{}, error) {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			t.Error("expected the resolver to run in the field span")
+		}
+		return nil, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("expected the resolver error, got %v", err)
+	}
+
+	// Struct fields are not traced
+	_, _ = GraphQL{}.InterceptField(field(false), func(ctx context.Context) (interface{}, error) {
+		return "hello", nil
+	})
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "Mutation.createMessage" {
+		t.Fatalf("expected a single Mutation.createMessage span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error || len(spans[0].Events()) == 0 {
+		t.Errorf("expected the error recorded, got %v", spans[0].Status())
+	}
+}
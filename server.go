@@ -3,54 +3,328 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/labstack/echo/v5"
 
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/graph"
-	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/constants"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/auth"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/broker"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/config"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/datastore"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/graphql"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/logging"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/metrics"
 	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/router"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/service"
+	"github.com/AndriyKalashnykov/gqlgen-graphql-subscriptions/internal/tracing"
 )
 
 // Version is a constant variable containing the version
 const Version = "v0.0.1"
 
-const redisURL = "localhost:6379"
-
 func run() error {
-	ctx := context.Background()
+	// ctx is cancelled by the first SIGINT or SIGTERM; a second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	cfg, err := config.Load(fs, os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if !errors.Is(err, nil) {
+		return err
+	}
+	if *printConfig {
+		return cfg.Print(os.Stdout)
+	}
+
+	logger, err := logging.Setup(logging.Options{
+		Level:   cfg.Log.Level,
+		Format:  cfg.Log.Format,
+		Content: cfg.Log.Content,
+	})
+	if !errors.Is(err, nil) {
+		return err
+	}
+	slog.Info("Effective configuration", slog.Any("config", cfg.Redacted()))
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Options{
+		Exporter:       cfg.Tracing.Exporter,
+		Protocol:       cfg.Tracing.Protocol,
+		Endpoint:       cfg.Tracing.Endpoint,
+		Insecure:       cfg.Tracing.Insecure,
+		ServiceName:    cfg.Tracing.ServiceName,
+		ServiceVersion: Version,
+		SampleRatio:    cfg.Tracing.SampleRatio,
+	})
+	if !errors.Is(err, nil) {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		// Flush the remaining spans, the signal context is already cancelled
+		flushCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); !errors.Is(err, nil) {
+			slog.Error("Error flushing traces", logging.Err(err))
+		}
+	}()
+
+	broker.SetStreamPrefix(cfg.Streams.Prefix)
+	broker.SetHashTag(cfg.Streams.HashTag || (cfg.Datastore == "redis" && cfg.Redis.Mode == "cluster"))
 
-	client, err := datastore.NewRedisClient(ctx, redisURL)
+	client, err := newDatastore(ctx, cfg)
 	if !errors.Is(err, nil) {
-		return fmt.Errorf("failed to connect to Redis at %s: %w", redisURL, err)
+		return err
 	}
 	defer func() {
 		if err := client.Close(); err != nil {
-			log.Printf("Error closing Redis client: %v", err)
+			slog.Error("Error closing datastore", logging.Err(err))
 		}
 	}()
 
-	r := graph.NewResolver(client)
-	r.SubscribeRedis(ctx)
-	srv := graphql.NewGraphQLServer(r)
+	metrics.Instrument(client)
 
-	e := router.NewRouter(echo.New(), srv)
+	b, err := newBroker(cfg.Broker, client)
+	if !errors.Is(err, nil) {
+		return err
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			slog.Error("Error closing message broker", logging.Err(err))
+		}
+	}()
+
+	r := graph.NewResolver(client, b, service.RetentionPolicy{
+		MaxLen: cfg.Retention.MaxLen,
+		Approx: cfg.Retention.Approx,
+		MaxAge: cfg.Retention.MaxAge,
+	})
+	if err := r.EnsureDefaultRoom(ctx); !errors.Is(err, nil) {
+		return fmt.Errorf("failed to create default room: %w", err)
+	}
+	metrics.Registry.MustRegister(r.MetricsCollector())
+
+	streamOptions := graph.StreamOptions{
+		Backoff: service.Backoff{
+			Initial:     cfg.Reader.BackoffInitial,
+			Max:         cfg.Reader.BackoffMax,
+			Multiplier:  cfg.Reader.BackoffMultiplier,
+			Jitter:      cfg.Reader.BackoffJitter,
+			MaxAttempts: cfg.Reader.MaxAttempts,
+		},
+		NotifyAfter: cfg.Reader.NotifyAfter,
+	}
+	if group := cfg.Reader.Group; group != "" {
+		streamOptions.Group = &service.GroupConfig{
+			Group:         group,
+			Consumer:      service.InstanceID(),
+			ClaimIdle:     cfg.Reader.ClaimIdle,
+			ClaimInterval: cfg.Reader.ClaimInterval,
+		}
+	}
+	// Background work outlives ctx, it is stopped once the subscriptions are drained
+	appCtx, cancelApp := context.WithCancel(context.Background())
+	defer cancelApp()
 
-	log.Printf("Starting server on %s", constants.ServerPort)
-	if err := e.Start(constants.ServerPort); err != nil {
-		return fmt.Errorf("server failed to start: %w", err)
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled() {
+		authenticator, err = auth.New(auth.Options{
+			Secret:   cfg.Auth.Secret,
+			JWKSFile: cfg.Auth.JWKSFile,
+			Issuer:   cfg.Auth.Issuer,
+			Audience: cfg.Auth.Audience,
+			Leeway:   cfg.Auth.Leeway,
+		})
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("failed to set up authentication: %w", err)
+		}
+	} else {
+		slog.Warn("Authentication is disabled, set auth.secret or auth.jwks-file to require bearer tokens")
 	}
 
+	r.SubscribeRedis(appCtx, streamOptions)
+	r.StartRetentionTrimmer(appCtx, cfg.Retention.TrimInterval)
+	srv := graphql.NewGraphQLServer(r, graphql.Options{
+		ReadBufferSize:  cfg.WebSocket.ReadBufferSize,
+		WriteBufferSize: cfg.WebSocket.WriteBufferSize,
+		KeepAlivePing:   cfg.WebSocket.KeepAlivePing,
+		QueryCacheSize:  cfg.Cache.QuerySize,
+		APQCacheSize:    cfg.Cache.APQSize,
+		Authenticator:   authenticator,
+	})
+
+	e := echo.New()
+	e.Logger = logger
+	e = router.NewRouter(e, srv, authenticator, r, Version)
+
+	return serve(ctx, e, r, cfg.Server)
+}
+
+// serve runs the HTTP server until ctx is cancelled and then shuts down
+// gracefully: it stops accepting connections, completes the active
+// subscriptions, stops the stream reader and closes the remaining WebSocket
+// connections, giving up after the shutdown timeout.
+func serve(ctx context.Context, e *echo.Echo, r *graph.Resolver, cfg config.ServerConfig) error {
+	// Requests, WebSocket connections included, live until connCtx is cancelled
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+
+	serverCtx, stopServer := context.WithCancel(context.Background())
+	defer stopServer()
+
+	// A WebSocket request is served until its connection closes
+	var requests sync.WaitGroup
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		defer requests.Done()
+		e.ServeHTTP(w, req)
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Starting server", slog.String("addr", cfg.Addr), slog.String("version", Version))
+		serverErr <- echo.StartConfig{
+			Address:         cfg.Addr,
+			HideBanner:      true,
+			GracefulTimeout: cfg.ShutdownTimeout,
+			BeforeServeFunc: func(s *http.Server) error {
+				s.BaseContext = func(net.Listener) context.Context { return connCtx }
+				return nil
+			},
+		}.Start(serverCtx, handler)
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, nil) {
+			return fmt.Errorf("server failed to start: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", slog.Duration("timeout", cfg.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Close the listener; requests in flight finish within the timeout
+	stopServer()
+
+	if err := r.Shutdown(shutdownCtx); !errors.Is(err, nil) {
+		slog.Error("Error shutting down resolver", logging.Err(err))
+	}
+
+	// WebSocket connections are hijacked, so the HTTP server does not wait for
+	// them; cancelling their context sends a close frame
+	closeConns()
+
+	done := make(chan struct{})
+	go func() {
+		requests.Wait()
+		if err := <-serverErr; !errors.Is(err, nil) {
+			slog.Error("Error shutting down server", logging.Err(err))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		slog.Warn("Server not stopped within the shutdown timeout", slog.Duration("timeout", cfg.ShutdownTimeout))
+	}
+
+	slog.Info("Server stopped")
 	return nil
 }
 
+// newDatastore creates the configured datastore
+func newDatastore(ctx context.Context, cfg *config.Config) (datastore.RedisClient, error) {
+	switch cfg.Datastore {
+	case "redis":
+		return newRedisClient(ctx, cfg.Redis)
+	case "memory":
+		slog.Warn("Using the in-memory datastore, data is lost on exit")
+		return datastore.NewMemoryClient(), nil
+	default:
+		return nil, fmt.Errorf("unknown datastore %q", cfg.Datastore)
+	}
+}
+
+// newRedisClient connects to Redis in the configured mode
+func newRedisClient(ctx context.Context, cfg config.RedisConfig) (datastore.RedisClient, error) {
+	conn := datastore.ConnOptions{
+		Username: cfg.Username,
+		Password: cfg.Password,
+		TLS: datastore.TLSOptions{
+			Enabled:            cfg.TLS.Enabled,
+			CAFile:             cfg.TLS.CAFile,
+			CertFile:           cfg.TLS.CertFile,
+			KeyFile:            cfg.TLS.KeyFile,
+			ServerName:         cfg.TLS.ServerName,
+			InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+		},
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		PoolSize:     cfg.PoolSize,
+		MinIdleConns: cfg.MinIdleConns,
+	}
+
+	switch cfg.Mode {
+	case "single":
+		client, err := datastore.NewRedisClient(ctx, datastore.RedisOptions{URL: cfg.URL, DB: cfg.DB, ConnOptions: conn})
+		if !errors.Is(err, nil) {
+			return nil, fmt.Errorf("failed to connect to Redis at %s: %w", datastore.RedactURL(cfg.URL), err)
+		}
+		return client, nil
+	case "sentinel":
+		return datastore.NewFailoverClient(ctx, datastore.FailoverOptions{
+			MasterName:       cfg.Sentinel.MasterName,
+			SentinelAddrs:    cfg.Sentinel.Addrs,
+			SentinelUsername: cfg.Sentinel.Username,
+			SentinelPassword: cfg.Sentinel.Password,
+			DB:               cfg.DB,
+			ConnOptions:      conn,
+		})
+	case "cluster":
+		return datastore.NewClusterClient(ctx, datastore.ClusterOptions{Addrs: cfg.Cluster.Addrs, ConnOptions: conn})
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", cfg.Mode)
+	}
+}
+
+// newBroker creates the message broker of the given kind
+func newBroker(kind string, client datastore.RedisClient) (broker.Broker, error) {
+	switch kind {
+	case "streams":
+		return broker.NewStreams(client), nil
+	case "pubsub":
+		pubsub, ok := client.(broker.PubSubClient)
+		if !ok {
+			return nil, fmt.Errorf("redis client does not support Pub/Sub")
+		}
+		return broker.NewPubSub(pubsub), nil
+	case "memory":
+		return broker.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown message broker %q", kind)
+	}
+}
+
 func main() {
 	if err := run(); err != nil {
-		log.Println(err)
+		slog.Error("Server failed", logging.Err(err))
 		os.Exit(1)
 	}
 }